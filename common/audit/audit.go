@@ -0,0 +1,317 @@
+// Package audit keeps an append-only log of the writes a node applies, one
+// JSON entry per line. The file is rotated when it grows over a size and
+// the oldest rotated files are removed.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outcomes of audited requests.
+const (
+	OutcomeOk = "ok"
+	// OutcomeCasFailed is a cas of a key that did not hold the expected
+	// value.
+	OutcomeCasFailed = "cas-failed"
+	// OutcomeElse is a write of the else branch of a txn whose comparisons
+	// failed.
+	OutcomeElse = "else"
+	// OutcomePatchFailed is a patch that could not be applied to the
+	// document of the key.
+	OutcomePatchFailed = "patch-failed"
+	// OutcomeSuperseded is a replicated write that lost to a newer or
+	// concurrent write of the key.
+	OutcomeSuperseded      = "superseded"
+	OutcomeInvalid         = "invalid"
+	OutcomeUnauthenticated = "unauthenticated"
+	OutcomeForbidden       = "forbidden"
+)
+
+// Entry is a write applied at raft log Index or with the vector Clock of a
+// CRDT, or a write refused by the api if it has neither.
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Op        string    `json:"op"`
+	Key       string    `json:"key"`
+	Index     int       `json:"index,omitempty"`
+	Clock     []int     `json:"clock,omitempty"`
+	Outcome   string    `json:"outcome"`
+}
+
+// rotatedLayout names rotated files, so that they sort by time.
+const rotatedLayout = "20060102T150405.000000000"
+
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	// lastIndex is the highest index in the log when it was opened, the
+	// state machine applies these entries again if it replays the raft log.
+	lastIndex int
+}
+
+// Open appends to the log at path, it is rotated once it is larger than
+// maxSize bytes and at most maxFiles rotated files are kept.
+func Open(path string, maxSize int64, maxFiles int) (*Log, error) {
+	if maxSize <= 0 || maxFiles < 0 {
+		return nil, fmt.Errorf("invalid audit log size %d or file count %d", maxSize, maxFiles)
+	}
+	l := &Log{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	files, err := l.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range files {
+		err := readEntries(name, func(entry Entry) bool {
+			l.lastIndex = max(l.lastIndex, entry.Index)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	if err := os.MkdirAll(filepath.Dir(l.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	if l.size == 0 {
+		return nil
+	}
+	// end a torn last line, so that it does not swallow the next entry
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, l.size-1); err != nil {
+		file.Close()
+		return err
+	}
+	if last[0] != '\n' {
+		if _, err := file.Write([]byte{'\n'}); err != nil {
+			file.Close()
+			return err
+		}
+		l.size++
+	}
+	return nil
+}
+
+// Append writes entry and syncs the file. Entries with an index that was in
+// the log when it was opened are skipped. A nil log, as used when auditing
+// is off, drops all entries.
+func (l *Log) Append(entry Entry) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if entry.Index > 0 && entry.Index <= l.lastIndex {
+		return nil
+	}
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := l.file.Write(line); err != nil {
+		return err
+	}
+	l.size += int64(len(line))
+	return l.file.Sync()
+}
+
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path, l.rotatedName(time.Now())); err != nil {
+		return err
+	}
+	rotated, err := l.rotatedFiles()
+	if err != nil {
+		return err
+	}
+	for len(rotated) > l.maxFiles {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return l.open()
+}
+
+func (l *Log) rotatedName(t time.Time) string {
+	ext := filepath.Ext(l.path)
+	return strings.TrimSuffix(l.path, ext) + "-" + t.UTC().Format(rotatedLayout) + ext
+}
+
+// rotatedFiles are sorted from the oldest.
+func (l *Log) rotatedFiles() ([]string, error) {
+	ext := filepath.Ext(l.path)
+	files, err := filepath.Glob(strings.TrimSuffix(l.path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// files are the rotated files and the current one, from the oldest.
+func (l *Log) files() ([]string, error) {
+	files, err := l.rotatedFiles()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(l.path); err == nil {
+		files = append(files, l.path)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return files, nil
+}
+
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Query selects entries of Key, or of keys starting with Prefix, in the time
+// range [From, To). Zero values do not filter.
+type Query struct {
+	Key    string
+	Prefix string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+func (q Query) match(entry Entry) bool {
+	return (q.Key == "" || entry.Key == q.Key) &&
+		strings.HasPrefix(entry.Key, q.Prefix) &&
+		(q.From.IsZero() || !entry.Time.Before(q.From)) &&
+		(q.To.IsZero() || entry.Time.Before(q.To))
+}
+
+// Query returns the matching entries from the oldest, at most Limit of them
+// if it is positive. The files are read without blocking appends.
+func (l *Log) Query(q Query) ([]Entry, error) {
+	l.mu.Lock()
+	files, err := l.files()
+	l.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	entries := []Entry{}
+	for _, name := range files {
+		err := readEntries(name, func(entry Entry) bool {
+			if q.match(entry) {
+				entries = append(entries, entry)
+			}
+			return q.Limit <= 0 || len(entries) < q.Limit
+		})
+		if err != nil {
+			return nil, err
+		}
+		if q.Limit > 0 && len(entries) >= q.Limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// readEntries calls f with the entries of the file until it returns false. A
+// torn last line of a crashed node is skipped.
+func readEntries(name string, f func(Entry) bool) error {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		// removed by rotation in the meantime
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !f(entry) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+// Handler serves the entries selected by the key, prefix, from, to and limit
+// query parameters, times are RFC 3339.
+func (l *Log) Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		params := request.URL.Query()
+		q := Query{Key: params.Get("key"), Prefix: params.Get("prefix")}
+		var err error
+		for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+			if params.Has(name) {
+				if *t, err = time.Parse(time.RFC3339, params.Get(name)); err != nil {
+					http.Error(writer, fmt.Sprintf("Invalid %s: %s", name, err), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if params.Has("limit") {
+			if q.Limit, err = strconv.Atoi(params.Get("limit")); err != nil {
+				http.Error(writer, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+		}
+		entries, err := l.Query(q)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(entries)
+	})
+}
@@ -0,0 +1,159 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func keys(entries []Entry) []string {
+	result := make([]string, len(entries))
+	for i, entry := range entries {
+		result[i] = entry.Key
+	}
+	return result
+}
+
+func openLog(t *testing.T, path string, maxSize int64, maxFiles int) *Log {
+	t.Helper()
+	l, err := Open(path, maxSize, maxFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func TestRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// every entry is about 90 bytes, two of them fit in a file
+	l := openLog(t, path, 200, 2)
+	var written []string
+	for i := range 10 {
+		key := string(rune('a' + i))
+		if err := l.Append(Entry{Op: "set", Key: key, Index: i + 1, Outcome: OutcomeOk}); err != nil {
+			t.Fatal(err)
+		}
+		written = append(written, key)
+		// rotated files are named by time
+		time.Sleep(time.Millisecond)
+	}
+
+	rotated, err := l.rotatedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rotated) != 2 {
+		t.Fatalf("%d rotated files kept, want 2", len(rotated))
+	}
+	for _, name := range append(rotated, path) {
+		if info, err := os.Stat(name); err != nil || info.Size() > 200 {
+			t.Fatalf("%s has %v bytes, want at most 200", name, info.Size())
+		}
+	}
+	entries, err := l.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(entries); !slices.Equal(got, written[len(written)-len(got):]) || len(got) < 5 {
+		t.Fatalf("entries %v kept, want the last of %v", got, written)
+	}
+}
+
+func TestReplayIsSkipped(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := openLog(t, path, 1<<20, 1)
+	for index := 1; index <= 3; index++ {
+		l.Append(Entry{Op: "set", Key: "applied", Index: index, Outcome: OutcomeOk})
+	}
+	l.Close()
+
+	// the state machine applies the raft log again after a restart
+	l = openLog(t, path, 1<<20, 1)
+	for index := 2; index <= 4; index++ {
+		l.Append(Entry{Op: "set", Key: "replayed", Index: index, Outcome: OutcomeOk})
+	}
+	// refused requests and CRDT writes have no index and are never skipped
+	l.Append(Entry{Op: "set", Key: "refused", Outcome: OutcomeForbidden})
+	l.Append(Entry{Op: "set", Key: "replica", Clock: []int{1, 0, 2}, Outcome: OutcomeSuperseded})
+
+	entries, err := l.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []int
+	for _, entry := range entries {
+		indexes = append(indexes, entry.Index)
+	}
+	want := []string{"applied", "applied", "applied", "replayed", "refused", "replica"}
+	if got := keys(entries); !slices.Equal(got, want) || !slices.Equal(indexes, []int{1, 2, 3, 4, 0, 0}) {
+		t.Fatalf("entries %v at %v, want %v at 1..4", got, indexes, want)
+	}
+	if !slices.Equal(entries[5].Clock, []int{1, 0, 2}) {
+		t.Fatalf("clock %v read back", entries[5].Clock)
+	}
+}
+
+func TestTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte(`{"op":"set","key":"whole","index":1}`+"\n"+`{"op":"set","ke`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	l := openLog(t, path, 1<<20, 1)
+	l.Append(Entry{Op: "set", Key: "next", Index: 2})
+	entries, err := l.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keys(entries); !slices.Equal(got, []string{"whole", "next"}) {
+		t.Fatalf("entries %v after a torn line", got)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	l := openLog(t, filepath.Join(t.TempDir(), "audit.log"), 1<<20, 1)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, key := range []string{"user/1", "user/2", "doc", "user/1"} {
+		l.Append(Entry{Time: start.Add(time.Duration(i) * time.Hour), Op: "set", Key: key, Index: i + 1})
+	}
+	tests := []struct {
+		name    string
+		query   Query
+		indexes []int
+	}{
+		{"all", Query{}, []int{1, 2, 3, 4}},
+		{"key", Query{Key: "user/1"}, []int{1, 4}},
+		{"prefix", Query{Prefix: "user/"}, []int{1, 2, 4}},
+		{"from", Query{From: start.Add(2 * time.Hour)}, []int{3, 4}},
+		{"to", Query{To: start.Add(time.Hour)}, []int{1}},
+		{"limit", Query{Prefix: "user/", Limit: 2}, []int{1, 2}},
+		{"no match", Query{Key: "missing"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := l.Query(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var indexes []int
+			for _, entry := range entries {
+				indexes = append(indexes, entry.Index)
+			}
+			if !slices.Equal(indexes, test.indexes) {
+				t.Fatalf("entries at %v, want %v", indexes, test.indexes)
+			}
+		})
+	}
+}
+
+func TestNilLog(t *testing.T) {
+	var l *Log
+	if err := l.Append(Entry{Op: "set", Key: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,216 @@
+// Package auth authenticates api requests by bearer token and authorizes
+// them by the roles of the user, with read and write permissions scoped by
+// key prefix:
+//
+//	roles:
+//	  admin:
+//	    admin: true
+//	  app:
+//	    permissions:
+//	      - prefix: app/
+//	        read: true
+//	        write: true
+//	users:
+//	  - name: alice
+//	    token: secret                # or tokenSha256: <hex digest>
+//	    roles: [admin]
+//
+// Keys with a reserved prefix, given to New, are for admins only.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Roles map[string]Role `yaml:"roles" json:"roles"`
+	Users []User          `yaml:"users" json:"users"`
+}
+
+type Role struct {
+	// Admin may access every key and the admin endpoints.
+	Admin       bool         `yaml:"admin,omitempty" json:"admin,omitempty"`
+	Permissions []Permission `yaml:"permissions,omitempty" json:"permissions,omitempty"`
+}
+
+// Permission applies to keys starting with Prefix, the empty prefix matches
+// all keys.
+type Permission struct {
+	Prefix string `yaml:"prefix" json:"prefix"`
+	Read   bool   `yaml:"read,omitempty" json:"read,omitempty"`
+	Write  bool   `yaml:"write,omitempty" json:"write,omitempty"`
+}
+
+type User struct {
+	Name        string   `yaml:"name" json:"name"`
+	Token       string   `yaml:"token,omitempty" json:"token,omitempty"`
+	TokenSha256 string   `yaml:"tokenSha256,omitempty" json:"tokenSha256,omitempty"`
+	Roles       []string `yaml:"roles" json:"roles"`
+}
+
+var (
+	ErrUnauthenticated = errors.New("missing or invalid token")
+	ErrForbidden       = errors.New("permission denied")
+)
+
+// Principal is an authenticated user. A nil principal, as used when
+// authentication is off, may do anything.
+type Principal struct {
+	Name        string
+	Admin       bool
+	permissions []Permission
+	reserved    []string
+}
+
+// User is the name of the principal, empty if authentication is off.
+func (p *Principal) User() string {
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+func (p *Principal) IsAdmin() bool {
+	return p == nil || p.Admin
+}
+
+func (p *Principal) CanRead(key string) bool {
+	return p.allowed(key, func(permission Permission) bool { return permission.Read })
+}
+
+func (p *Principal) CanWrite(key string) bool {
+	return p.allowed(key, func(permission Permission) bool { return permission.Write })
+}
+
+func (p *Principal) allowed(key string, granted func(Permission) bool) bool {
+	if p == nil || p.Admin {
+		return true
+	}
+	for _, prefix := range p.reserved {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
+	}
+	for _, permission := range p.permissions {
+		if strings.HasPrefix(key, permission.Prefix) && granted(permission) {
+			return true
+		}
+	}
+	return false
+}
+
+type Authorizer struct {
+	principals map[string]*Principal // by token digest
+}
+
+func Load(path string, reserved ...string) (*Authorizer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	authorizer, err := Parse(data, reserved...)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return authorizer, nil
+}
+
+// Parse reads a configuration in YAML or JSON.
+func Parse(data []byte, reserved ...string) (*Authorizer, error) {
+	config, err := ParseConfig(data)
+	if err != nil {
+		return nil, err
+	}
+	return New(config, reserved...)
+}
+
+func ParseConfig(data []byte) (Config, error) {
+	var config Config
+	err := yaml.Unmarshal(data, &config)
+	return config, err
+}
+
+// New returns the authorizer of config. Keys starting with one of the
+// reserved prefixes are accessible to admins only, whatever the permissions.
+func New(config Config, reserved ...string) (*Authorizer, error) {
+	authorizer := &Authorizer{principals: make(map[string]*Principal)}
+	names := make(map[string]bool)
+	for _, user := range config.Hashed().Users {
+		if user.Name == "" || names[user.Name] {
+			return nil, fmt.Errorf("user names must be unique and not empty")
+		}
+		names[user.Name] = true
+		if _, err := hex.DecodeString(user.TokenSha256); err != nil || len(user.TokenSha256) != 2*sha256.Size {
+			return nil, fmt.Errorf("user %s needs a token or a tokenSha256 of 64 hex digits", user.Name)
+		}
+		digest := strings.ToLower(user.TokenSha256)
+		if authorizer.principals[digest] != nil {
+			return nil, fmt.Errorf("user %s shares its token with another user", user.Name)
+		}
+		principal := &Principal{Name: user.Name, reserved: reserved}
+		for _, name := range user.Roles {
+			role, ok := config.Roles[name]
+			if !ok {
+				return nil, fmt.Errorf("user %s has unknown role %s", user.Name, name)
+			}
+			principal.Admin = principal.Admin || role.Admin
+			principal.permissions = append(principal.permissions, role.Permissions...)
+		}
+		authorizer.principals[digest] = principal
+	}
+	return authorizer, nil
+}
+
+// Hashed replaces plain tokens with their digests, so that the configuration
+// can be stored without them.
+func (c Config) Hashed() Config {
+	hashed := Config{Roles: c.Roles}
+	for _, user := range c.Users {
+		if user.Token != "" {
+			user.TokenSha256, user.Token = digest(user.Token), ""
+		}
+		hashed.Users = append(hashed.Users, user)
+	}
+	return hashed
+}
+
+func digest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the user of the bearer token in the Authorization
+// header of request.
+func (a *Authorizer) Authenticate(request *http.Request) (*Principal, error) {
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, ErrUnauthenticated
+	}
+	principal, ok := a.principals[digest(token)]
+	if !ok {
+		return nil, ErrUnauthenticated
+	}
+	return principal, nil
+}
+
+type contextKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying principal.
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, principal)
+}
+
+// FromContext returns the user of a request, nil if authentication is off.
+func FromContext(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(contextKey{}).(*Principal)
+	return principal
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+const testConfig = `
+roles:
+  admin:
+    admin: true
+  app:
+    permissions:
+      - prefix: app/
+        read: true
+        write: true
+      - prefix: app/config/
+        read: true
+  reader:
+    permissions:
+      - prefix: ""
+        read: true
+users:
+  - name: alice
+    token: alice-token
+    roles: [admin]
+  - name: bob
+    token: bob-token
+    roles: [app]
+  - name: carol
+    tokenSha256: 4A6EC7F7C6B3AF1E41E0FB1A1B3D0C1A8C5D3B2E1F0A9B8C7D6E5F4A3B2C1D0E
+    roles: [reader]
+  - name: dave
+    token: dave-token
+    roles: [app, reader]
+`
+
+// reserved are the prefixes chaddb reserves for admins.
+var reserved = []string{"_auth/", "_cluster/"}
+
+func authenticate(t *testing.T, authorizer *Authorizer, token string) *Principal {
+	t.Helper()
+	request := httptest.NewRequest("GET", "/kv/a", nil)
+	request.Header.Set("Authorization", "Bearer "+token)
+	principal, err := authorizer.Authenticate(request)
+	if err != nil {
+		t.Fatalf("token %s: %v", token, err)
+	}
+	return principal
+}
+
+func TestPermissions(t *testing.T) {
+	authorizer, err := Parse([]byte(testConfig), reserved...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token string
+		key   string
+		read  bool
+		write bool
+	}{
+		{"alice-token", "app/a", true, true},
+		{"alice-token", "other", true, true},
+		{"alice-token", "_auth/users", true, true},
+		{"alice-token", "_cluster/id", true, true},
+
+		{"bob-token", "app/a", true, true},
+		{"bob-token", "app/", true, true},
+		{"bob-token", "app", false, false},
+		{"bob-token", "apps/a", false, false},
+		{"bob-token", "other/app/a", false, false},
+		// permissions add up, a narrower prefix does not take write away
+		{"bob-token", "app/config/a", true, true},
+		{"bob-token", "_auth/users", false, false},
+
+		{"dave-token", "other", true, false},
+		{"dave-token", "app/a", true, true},
+		// the empty prefix matches every key but the reserved ones
+		{"dave-token", "", true, false},
+		{"dave-token", "_auth/users", false, false},
+		{"dave-token", "_cluster/sessions/x", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.token+" "+test.key, func(t *testing.T) {
+			principal := authenticate(t, authorizer, test.token)
+			if read := principal.CanRead(test.key); read != test.read {
+				t.Errorf("read %v, want %v", read, test.read)
+			}
+			if write := principal.CanWrite(test.key); write != test.write {
+				t.Errorf("write %v, want %v", write, test.write)
+			}
+		})
+	}
+}
+
+func TestNoReservedPrefixes(t *testing.T) {
+	authorizer, err := Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	principal := authenticate(t, authorizer, "dave-token")
+	if !principal.CanRead("_auth/users") || principal.CanWrite("_auth/users") {
+		t.Fatal("permissions of a store without reserved prefixes not applied")
+	}
+}
+
+func TestNilPrincipal(t *testing.T) {
+	var principal *Principal
+	if !principal.IsAdmin() || !principal.CanWrite("_auth/users") || principal.User() != "" {
+		t.Fatal("a nil principal must be allowed everything")
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	authorizer, err := Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		header string
+		user   string
+	}{
+		{"token", "Bearer alice-token", "alice"},
+		{"no header", "", ""},
+		{"empty token", "Bearer ", ""},
+		{"unknown token", "Bearer nobody", ""},
+		{"basic auth", "Basic alice-token", ""},
+		{"lowercase scheme", "bearer alice-token", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest("GET", "/kv/a", nil)
+			if test.header != "" {
+				request.Header.Set("Authorization", test.header)
+			}
+			principal, err := authorizer.Authenticate(request)
+			if test.user == "" {
+				if !errors.Is(err, ErrUnauthenticated) {
+					t.Fatalf("error %v, want %v", err, ErrUnauthenticated)
+				}
+				return
+			}
+			if err != nil || principal.User() != test.user {
+				t.Fatalf("user %s, %v, want %s", principal.User(), err, test.user)
+			}
+		})
+	}
+}
+
+func TestInvalidConfigs(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+	}{
+		{"unnamed user", Config{Users: []User{{Token: "a"}}}},
+		{"same name", Config{Users: []User{{Name: "a", Token: "a"}, {Name: "a", Token: "b"}}}},
+		{"same token", Config{Users: []User{{Name: "a", Token: "a"}, {Name: "b", Token: "a"}}}},
+		{"no token", Config{Users: []User{{Name: "a"}}}},
+		{"short digest", Config{Users: []User{{Name: "a", TokenSha256: "abcd"}}}},
+		{"unknown role", Config{Users: []User{{Name: "a", Token: "a", Roles: []string{"missing"}}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := New(test.config); err == nil {
+				t.Fatal("configuration accepted")
+			}
+		})
+	}
+}
+
+func TestHashed(t *testing.T) {
+	config := Config{Users: []User{{Name: "a", Token: "secret"}}}
+	hashed := config.Hashed()
+	if hashed.Users[0].Token != "" || hashed.Users[0].TokenSha256 != digest("secret") || config.Users[0].Token != "secret" {
+		t.Fatalf("hashed %+v from %+v", hashed.Users, config.Users)
+	}
+	authorizer, err := New(hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authenticate(t, authorizer, "secret").User() != "a" {
+		t.Fatal("hashed token not accepted")
+	}
+}
@@ -0,0 +1,138 @@
+// Package certs keeps the certificate, key and CA of a node loaded from files
+// and reloads them when the files change, so that certificates are rotated
+// without a restart.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type Certs struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mutex    sync.RWMutex
+	cert     tls.Certificate
+	pool     *x509.CertPool
+	modified time.Time
+}
+
+// Load reads the key pair and, unless caFile is empty, the CA certificates
+// peers are verified with.
+func Load(certFile, keyFile, caFile string) (*Certs, error) {
+	c := &Certs{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if _, err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the files again if any of them was modified since the last
+// load and reports whether it did. The previous certificates stay in use if
+// the files are invalid, e.g. written halfway.
+func (c *Certs) Reload() (bool, error) {
+	modified, err := c.lastModified()
+	if err != nil {
+		return false, err
+	}
+	c.mutex.RLock()
+	unchanged := modified.Equal(c.modified)
+	c.mutex.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		data, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return false, err
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return false, fmt.Errorf("no certificates in %s", c.caFile)
+		}
+	}
+
+	c.mutex.Lock()
+	c.cert, c.pool, c.modified = cert, pool, modified
+	c.mutex.Unlock()
+	return true, nil
+}
+
+func (c *Certs) lastModified() (time.Time, error) {
+	var modified time.Time
+	for _, file := range []string{c.certFile, c.keyFile, c.caFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return modified, err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified, nil
+}
+
+// Certificate returns the current key pair.
+func (c *Certs) Certificate() tls.Certificate {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert
+}
+
+// ServerConfig serves the current certificate and, if clientAuth, requires
+// clients to present a certificate signed by the CA.
+func (c *Certs) ServerConfig(clientAuth bool) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mutex.RLock()
+			defer c.mutex.RUnlock()
+			config := &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{c.cert}}
+			if clientAuth {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = c.pool
+			}
+			return config, nil
+		},
+	}
+}
+
+// ClientConfig verifies servers with the CA in caFile, or the system roots
+// if it is empty, and presents the key pair if given, for command line
+// clients that are not reloaded.
+func ClientConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
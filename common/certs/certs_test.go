@@ -0,0 +1,299 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns the PEM certificate and key of name, valid for localhost
+// servers and clients.
+func (ca testCA) issue(t *testing.T, name string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// testFiles are the files of a node, written with increasing modification
+// times so that every write is seen as a change.
+type testFiles struct {
+	dir      string
+	modified time.Time
+}
+
+func (f *testFiles) path(name string) string {
+	return filepath.Join(f.dir, name)
+}
+
+func (f *testFiles) write(t *testing.T, name string, data []byte) {
+	path := f.path(name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f.modified = f.modified.Add(time.Second)
+	if err := os.Chtimes(path, f.modified, f.modified); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newTestFiles(t *testing.T, ca testCA, name string) *testFiles {
+	files := &testFiles{dir: t.TempDir(), modified: time.Now()}
+	cert, key := ca.issue(t, name)
+	files.write(t, "ca.pem", ca.pem)
+	files.write(t, "node.pem", cert)
+	files.write(t, "node-key.pem", key)
+	return files
+}
+
+func (f *testFiles) load(t *testing.T) *Certs {
+	c, err := Load(f.path("node.pem"), f.path("node-key.pem"), f.path("ca.pem"))
+	if err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+	return c
+}
+
+// serve starts an HTTPS server with the ServerConfig of c.
+func serve(t *testing.T, c *Certs, clientAuth bool) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = c.ServerConfig(clientAuth)
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// get makes a request on a new connection and returns the name of the
+// server certificate.
+func get(server *httptest.Server, config *tls.Config) (string, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+	response, err := client.Get(server.URL)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	return response.TLS.PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestReload(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	files := newTestFiles(t, ca, "node-1")
+	c := files.load(t)
+	server := serve(t, c, false)
+	client, err := ClientConfig(files.path("ca.pem"), "", "")
+	if err != nil {
+		t.Fatalf("ClientConfig: %s", err)
+	}
+	expect := func(want string) {
+		t.Helper()
+		if name, err := get(server, client); err != nil || name != want {
+			t.Fatalf("server presents %q, %v, want %s", name, err, want)
+		}
+	}
+	expect("node-1")
+
+	if reloaded, err := c.Reload(); reloaded || err != nil {
+		t.Fatalf("Reload of unchanged files = %t, %v", reloaded, err)
+	}
+
+	cert, key := ca.issue(t, "node-1-rotated")
+	files.write(t, "node.pem", cert)
+	files.write(t, "node-key.pem", key)
+	if reloaded, err := c.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload of rotated files = %t, %v", reloaded, err)
+	}
+	expect("node-1-rotated")
+
+	// a rotated CA is picked up too, the new certificate is signed by it
+	other := newTestCA(t, "other-ca")
+	cert, key = other.issue(t, "node-1-other-ca")
+	files.write(t, "node.pem", cert)
+	files.write(t, "node-key.pem", key)
+	files.write(t, "ca.pem", other.pem)
+	if reloaded, err := c.Reload(); !reloaded || err != nil {
+		t.Fatalf("Reload of a rotated CA = %t, %v", reloaded, err)
+	}
+	if client, err = ClientConfig(files.path("ca.pem"), "", ""); err != nil {
+		t.Fatalf("ClientConfig: %s", err)
+	}
+	expect("node-1-other-ca")
+}
+
+func TestReloadKeepsPreviousCerts(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	newCert, newKey := ca.issue(t, "node-1-rotated")
+	otherCert, _ := ca.issue(t, "node-1-other")
+
+	for _, test := range []struct {
+		name  string
+		files map[string][]byte
+		err   string
+	}{
+		{"cert written halfway", map[string][]byte{"node.pem": newCert[:len(newCert)/2]}, "failed to find any PEM data"},
+		{"cert without its key", map[string][]byte{"node.pem": otherCert}, "private key does not match public key"},
+		{"key without its cert", map[string][]byte{"node-key.pem": newKey}, "private key does not match public key"},
+		{"empty key", map[string][]byte{"node.pem": newCert, "node-key.pem": nil}, "failed to find any PEM data"},
+		{"ca without certificates", map[string][]byte{"ca.pem": []byte("not a certificate\n")}, "no certificates in"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			files := newTestFiles(t, ca, "node-1")
+			c := files.load(t)
+			server := serve(t, c, false)
+			client, err := ClientConfig(files.path("ca.pem"), "", "")
+			if err != nil {
+				t.Fatalf("ClientConfig: %s", err)
+			}
+
+			for name, data := range test.files {
+				files.write(t, name, data)
+			}
+			if reloaded, err := c.Reload(); reloaded || err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Reload = %t, %v, want an error containing %q", reloaded, err, test.err)
+			}
+			if name, err := get(server, client); err != nil || name != "node-1" {
+				t.Fatalf("server presents %q, %v after a bad rotation, want node-1", name, err)
+			}
+
+			// the rotation is retried until it is complete
+			files.write(t, "ca.pem", ca.pem)
+			files.write(t, "node.pem", newCert)
+			files.write(t, "node-key.pem", newKey)
+			if reloaded, err := c.Reload(); !reloaded || err != nil {
+				t.Fatalf("Reload of the completed rotation = %t, %v", reloaded, err)
+			}
+			if name, err := get(server, client); err != nil || name != "node-1-rotated" {
+				t.Fatalf("server presents %q, %v, want node-1-rotated", name, err)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		files := newTestFiles(t, ca, "node-1")
+		c := files.load(t)
+		if err := os.Remove(files.path("node-key.pem")); err != nil {
+			t.Fatal(err)
+		}
+		if reloaded, err := c.Reload(); reloaded || !os.IsNotExist(err) {
+			t.Fatalf("Reload = %t, %v, want a missing file", reloaded, err)
+		}
+		if leaf := c.Certificate().Leaf; leaf == nil || leaf.Subject.CommonName != "node-1" {
+			t.Fatalf("Certificate = %v after a bad rotation, want node-1", leaf)
+		}
+	})
+}
+
+func TestClientAuth(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	files := newTestFiles(t, ca, "node-1")
+	c := files.load(t)
+
+	clientCert, clientKey := ca.issue(t, "client")
+	files.write(t, "client.pem", clientCert)
+	files.write(t, "client-key.pem", clientKey)
+	other := newTestCA(t, "other-ca")
+	otherCert, otherKey := other.issue(t, "other-client")
+	files.write(t, "other.pem", otherCert)
+	files.write(t, "other-key.pem", otherKey)
+
+	for _, test := range []struct {
+		name       string
+		clientAuth bool
+		cert       string
+		ok         bool
+	}{
+		{"client cert", true, "client", true},
+		{"no client cert", true, "", false},
+		{"client cert of another ca", true, "other", false},
+		{"no client auth", false, "", true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			server := serve(t, c, test.clientAuth)
+			var certFile, keyFile string
+			if test.cert != "" {
+				certFile, keyFile = files.path(test.cert+".pem"), files.path(test.cert+"-key.pem")
+			}
+			client, err := ClientConfig(files.path("ca.pem"), certFile, keyFile)
+			if err != nil {
+				t.Fatalf("ClientConfig: %s", err)
+			}
+			name, err := get(server, client)
+			if test.ok && (err != nil || name != "node-1") {
+				t.Fatalf("server presents %q, %v, want node-1", name, err)
+			}
+			if !test.ok && err == nil {
+				t.Fatalf("server accepted the client")
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package certs
+
+import (
+	"time"
+
+	"ergo.services/ergo/act"
+	"ergo.services/ergo/gen"
+)
+
+// NewReloader returns the behavior of a process that reloads certs every
+// interval and updates manager when the files changed. New certificates are
+// used by connections made afterwards.
+func NewReloader(certs *Certs, manager gen.CertManager, interval time.Duration) gen.ProcessBehavior {
+	return &Reloader{certs: certs, manager: manager, interval: interval}
+}
+
+type Reloader struct {
+	act.Actor
+	certs    *Certs
+	manager  gen.CertManager
+	interval time.Duration
+}
+
+type reload struct{}
+
+func (r *Reloader) Init(args ...any) error {
+	r.SendAfter(r.PID(), reload{}, r.interval)
+	return nil
+}
+
+func (r *Reloader) HandleMessage(from gen.PID, message any) error {
+	switch message.(type) {
+	case reload:
+		reloaded, err := r.certs.Reload()
+		if err != nil {
+			r.Log().Warning("unable to reload certificates, keeping the current ones: %s", err)
+		} else if reloaded {
+			r.manager.Update(r.certs.Certificate())
+			r.Log().Info("reloaded certificates")
+		}
+		r.SendAfter(r.PID(), reload{}, r.interval)
+	default:
+		r.Log().Error("unknown message %v", message)
+	}
+	return nil
+}
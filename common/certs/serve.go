@@ -0,0 +1,24 @@
+package certs
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+)
+
+// Serve serves handler over HTTPS on address until the returned server is
+// closed, stopped is called if it stops for another reason. Unlike the web
+// server meta-process of ergo, config may verify client certificates.
+func Serve(address string, config *tls.Config, handler http.Handler, stopped func(error)) (*http.Server, error) {
+	listener, err := tls.Listen("tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: handler}
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			stopped(err)
+		}
+	}()
+	return server, nil
+}
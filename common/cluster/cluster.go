@@ -0,0 +1,194 @@
+// Package cluster describes the nodes of a cluster, either from a YAML or,
+// with a .toml extension, a TOML file or the defaults of a cluster of -node-count nodes on localhost. Only ids are
+// required, the other fields default to the ones of a local cluster on host:
+//
+//	nodes:
+//	  - id: 1
+//	    name: chaddb-node-1@host1   # ergo node name, see NamePrefix
+//	    host: host1                 # localhost by default
+//	    api: host1:5001             # host:5000+id by default
+//	    observer: host1:4001        # host:4000+id by default
+//	    network: host1:6001         # ergo acceptor, host:6000+id by default
+//	  - id: 2
+//	    host: host2
+//
+// or in TOML:
+//
+//	[[nodes]]
+//	id = 1
+//	host = "host1"
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// NamePrefix is the prefix of default ergo node names, set by each program
+// to its own, e.g. chaddb-node.
+var NamePrefix = "node"
+
+type Node struct {
+	Id       int    `yaml:"id" toml:"id"`
+	Name     string `yaml:"name" toml:"name"`
+	Host     string `yaml:"host" toml:"host"`
+	Api      string `yaml:"api" toml:"api"`
+	Observer string `yaml:"observer" toml:"observer"`
+	Network  string `yaml:"network" toml:"network"`
+}
+
+type Cluster struct {
+	Nodes []Node `yaml:"nodes" toml:"nodes"`
+}
+
+// DefaultNode is node id of a local cluster.
+func DefaultNode(id int) Node {
+	return Node{Id: id}.withDefaults()
+}
+
+// Default is the cluster of nodes 1..count on localhost.
+func Default(count int) Cluster {
+	var cluster Cluster
+	for id := 1; id <= count; id++ {
+		cluster.Nodes = append(cluster.Nodes, DefaultNode(id))
+	}
+	return cluster
+}
+
+func (n Node) withDefaults() Node {
+	if n.Host == "" {
+		n.Host = "localhost"
+	}
+	if n.Name == "" {
+		n.Name = fmt.Sprintf("%s-%d@%s", NamePrefix, n.Id, n.Host)
+	}
+	if n.Api == "" {
+		n.Api = net.JoinHostPort(n.Host, strconv.Itoa(5000+n.Id))
+	}
+	if n.Observer == "" {
+		n.Observer = net.JoinHostPort(n.Host, strconv.Itoa(4000+n.Id))
+	}
+	if n.Network == "" {
+		n.Network = net.JoinHostPort(n.Host, strconv.Itoa(6000+n.Id))
+	}
+	return n
+}
+
+func Load(path string) (Cluster, error) {
+	var cluster Cluster
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return cluster, err
+	}
+	if filepath.Ext(path) == ".toml" {
+		err = toml.Unmarshal(data, &cluster)
+	} else {
+		err = yaml.Unmarshal(data, &cluster)
+	}
+	if err != nil {
+		return cluster, fmt.Errorf("%s: %w", path, err)
+	}
+	if cluster, err = New(cluster.Nodes); err != nil {
+		return cluster, fmt.Errorf("%s: %w", path, err)
+	}
+	return cluster, nil
+}
+
+// New fills in the defaults of nodes and validates them.
+func New(nodes []Node) (Cluster, error) {
+	var cluster Cluster
+	for _, node := range nodes {
+		cluster.Nodes = append(cluster.Nodes, node.withDefaults())
+	}
+	return cluster, cluster.validate()
+}
+
+func (c Cluster) validate() error {
+	if len(c.Nodes) == 0 {
+		return fmt.Errorf("cluster has no nodes")
+	}
+	ids := make(map[int]bool)
+	names := make(map[string]bool)
+	addresses := make(map[string]bool)
+	for _, node := range c.Nodes {
+		if node.Id <= 0 {
+			return fmt.Errorf("invalid node id %d", node.Id)
+		}
+		if ids[node.Id] {
+			return fmt.Errorf("duplicate node id %d", node.Id)
+		}
+		ids[node.Id] = true
+		if names[node.Name] {
+			return fmt.Errorf("duplicate node name %s", node.Name)
+		}
+		names[node.Name] = true
+		for _, address := range []string{node.Api, node.Observer, node.Network} {
+			if _, _, err := SplitAddress(address); err != nil {
+				return fmt.Errorf("node %d: %w", node.Id, err)
+			}
+			if addresses[address] {
+				return fmt.Errorf("node %d: address %s is used twice", node.Id, address)
+			}
+			addresses[address] = true
+		}
+	}
+	return nil
+}
+
+func (c Cluster) Node(id int) (Node, bool) {
+	for _, node := range c.Nodes {
+		if node.Id == id {
+			return node, true
+		}
+	}
+	return Node{}, false
+}
+
+// NodeByName returns the node with the given ergo node name.
+func (c Cluster) NodeByName(name string) (Node, bool) {
+	for _, node := range c.Nodes {
+		if node.Name == name {
+			return node, true
+		}
+	}
+	return Node{}, false
+}
+
+// Ids returns the sorted ids of all nodes.
+func (c Cluster) Ids() []int {
+	ids := make([]int, 0, len(c.Nodes))
+	for _, node := range c.Nodes {
+		ids = append(ids, node.Id)
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+// Endpoints returns the api addresses of all nodes.
+func (c Cluster) Endpoints() []string {
+	endpoints := make([]string, 0, len(c.Nodes))
+	for _, node := range c.Nodes {
+		endpoints = append(endpoints, node.Api)
+	}
+	return endpoints
+}
+
+// SplitAddress splits a host:port address to listen on.
+func SplitAddress(address string) (string, uint16, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, err
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in address %s", address)
+	}
+	return host, uint16(n), nil
+}
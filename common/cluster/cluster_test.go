@@ -0,0 +1,171 @@
+package cluster
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	NamePrefix = "chaddb-node"
+	defer func() { NamePrefix = "node" }()
+
+	want := Cluster{Nodes: []Node{
+		{Id: 1, Name: "db1@host1", Host: "host1", Api: "host1:7001", Observer: "host1:4001", Network: "host1:6001"},
+		{Id: 2, Name: "chaddb-node-2@host2", Host: "host2", Api: "host2:5002", Observer: "host2:4002", Network: "host2:6002"},
+		{Id: 3, Name: "chaddb-node-3@localhost", Host: "localhost", Api: "localhost:5003", Observer: "localhost:4003", Network: "localhost:6003"},
+	}}
+	for _, test := range []struct {
+		name   string
+		file   string
+		config string
+	}{
+		{"yaml", "cluster.yaml", `
+nodes:
+  - id: 1
+    name: db1@host1
+    host: host1
+    api: host1:7001
+  - id: 2
+    host: host2
+  - id: 3
+`},
+		{"toml", "cluster.toml", `
+[[nodes]]
+id = 1
+name = "db1@host1"
+host = "host1"
+api = "host1:7001"
+
+[[nodes]]
+id = 2
+host = "host2"
+
+[[nodes]]
+id = 3
+`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), test.file)
+			if err := os.WriteFile(path, []byte(test.config), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cluster, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load: %s", err)
+			}
+			if !reflect.DeepEqual(cluster, want) {
+				t.Fatalf("Load = %+v, want %+v", cluster, want)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		file   string
+		config string
+		err    string
+	}{
+		{"missing file", "", "", "no such file"},
+		{"invalid yaml", "cluster.yaml", "nodes: [", "cluster.yaml: yaml"},
+		{"invalid toml", "cluster.toml", "[[nodes]\nid = 1", "cluster.toml: toml"},
+		{"yaml as toml", "cluster.toml", "nodes:\n  - id: 1\n", "cluster.toml: toml"},
+		{"invalid node", "cluster.yaml", "nodes:\n  - host: host1\n", "cluster.yaml: invalid node id 0"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "missing.yaml")
+			if test.file != "" {
+				path = filepath.Join(t.TempDir(), test.file)
+				if err := os.WriteFile(path, []byte(test.config), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := Load(path); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Load = %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		nodes []Node
+		err   string
+	}{
+		{"defaults", []Node{{Id: 1}, {Id: 2}, {Id: 3}}, ""},
+		{"other hosts", []Node{{Id: 1, Host: "host1"}, {Id: 2, Host: "host2"}}, ""},
+		{"same ports on other hosts", []Node{{Id: 1, Host: "host1", Api: "host1:80"}, {Id: 2, Host: "host2", Api: "host2:80"}}, ""},
+		{"no nodes", nil, "cluster has no nodes"},
+		{"missing id", []Node{{Host: "host1"}}, "invalid node id 0"},
+		{"negative id", []Node{{Id: -1}}, "invalid node id -1"},
+		{"duplicate id", []Node{{Id: 1, Host: "host1"}, {Id: 1, Host: "host2"}}, "duplicate node id 1"},
+		{"duplicate name", []Node{{Id: 1, Name: "db@host"}, {Id: 2, Name: "db@host"}}, "duplicate node name db@host"},
+		{"duplicate api", []Node{{Id: 1}, {Id: 2, Api: "localhost:5001"}}, "node 2: address localhost:5001 is used twice"},
+		{"api as network", []Node{{Id: 1}, {Id: 2, Network: "localhost:5001"}}, "node 2: address localhost:5001 is used twice"},
+		{"same address twice on a node", []Node{{Id: 1, Api: "localhost:9000", Observer: "localhost:9000"}}, "node 1: address localhost:9000 is used twice"},
+		{"missing port", []Node{{Id: 1, Api: "localhost"}}, "node 1: address localhost: missing port"},
+		{"invalid port", []Node{{Id: 1, Observer: "localhost:http"}}, "node 1: invalid port in address localhost:http"},
+		{"port out of range", []Node{{Id: 1, Network: "localhost:70000"}}, "node 1: invalid port in address localhost:70000"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cluster, err := New(test.nodes)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("New: %s", err)
+				}
+				if len(cluster.Nodes) != len(test.nodes) {
+					t.Fatalf("New has %d nodes, want %d", len(cluster.Nodes), len(test.nodes))
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("New = %v, want an error containing %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestDefault(t *testing.T) {
+	NamePrefix = "chadcrdt-node"
+	defer func() { NamePrefix = "node" }()
+
+	for _, test := range []struct {
+		node Node
+		want Node
+	}{
+		{Node{Id: 2}, Node{Id: 2, Name: "chadcrdt-node-2@localhost", Host: "localhost", Api: "localhost:5002", Observer: "localhost:4002", Network: "localhost:6002"}},
+		{Node{Id: 12, Host: "10.0.0.1"}, Node{Id: 12, Name: "chadcrdt-node-12@10.0.0.1", Host: "10.0.0.1", Api: "10.0.0.1:5012", Observer: "10.0.0.1:4012", Network: "10.0.0.1:6012"}},
+		{Node{Id: 3, Host: "::1"}, Node{Id: 3, Name: "chadcrdt-node-3@::1", Host: "::1", Api: "[::1]:5003", Observer: "[::1]:4003", Network: "[::1]:6003"}},
+		{Node{Id: 4, Name: "custom@host"}, Node{Id: 4, Name: "custom@host", Host: "localhost", Api: "localhost:5004", Observer: "localhost:4004", Network: "localhost:6004"}},
+	} {
+		if got := test.node.withDefaults(); got != test.want {
+			t.Errorf("withDefaults(%+v) = %+v, want %+v", test.node, got, test.want)
+		}
+	}
+
+	cluster := Default(3)
+	if ids := cluster.Ids(); !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+		t.Fatalf("Default(3) has ids %v", ids)
+	}
+	if err := cluster.validate(); err != nil {
+		t.Fatalf("Default(3) is invalid: %s", err)
+	}
+	if node := DefaultNode(2); node != cluster.Nodes[1] {
+		t.Fatalf("DefaultNode(2) = %+v, want %+v", node, cluster.Nodes[1])
+	}
+	if node, ok := cluster.NodeByName("chadcrdt-node-3@localhost"); !ok || node.Id != 3 {
+		t.Fatalf("NodeByName = %+v, %t", node, ok)
+	}
+	if _, ok := cluster.Node(4); ok {
+		t.Fatalf("Node(4) found in a cluster of 3")
+	}
+	want := []string{"localhost:5001", "localhost:5002", "localhost:5003"}
+	if endpoints := cluster.Endpoints(); !reflect.DeepEqual(endpoints, want) {
+		t.Fatalf("Endpoints = %v, want %v", endpoints, want)
+	}
+}
@@ -0,0 +1,167 @@
+// Package content maps the bodies of api requests to stored values by their
+// Content-Type and back. A JSON string is stored as its text without a
+// content type, as every value was before content types. Other JSON
+// documents are stored compacted with TypeJSON, and bytes are stored in
+// base64 with TypeBinary so that values stay text wherever they are kept or
+// replicated, e.g. in the raft log, in snapshots and in CRDT rows.
+package content
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"chadcommon/jsonpatch"
+)
+
+const (
+	TypeJSON   = "application/json"
+	TypeBinary = "application/octet-stream"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported content type")
+	ErrTooLarge        = errors.New("value is too large")
+)
+
+// Read reads the body of request as a value of at most maxSize bytes and
+// returns it with the content type to store. A body without Content-Type is
+// JSON.
+func Read(writer http.ResponseWriter, request *http.Request, maxSize int64) (string, string, error) {
+	mediaType, body, err := readBody(writer, request, maxSize, TypeJSON, TypeBinary)
+	if err != nil {
+		return "", "", err
+	}
+	if mediaType == TypeBinary {
+		return base64.StdEncoding.EncodeToString(body), TypeBinary, nil
+	}
+	var text string
+	if err := json.Unmarshal(body, &text); err == nil {
+		return text, "", nil
+	}
+	var compacted bytes.Buffer
+	if err := json.Compact(&compacted, body); err != nil {
+		return "", "", fmt.Errorf("invalid JSON value: %w", err)
+	}
+	return compacted.String(), TypeJSON, nil
+}
+
+// Expect returns the stored form of the expect parameter of a compare and
+// set whose new value has contentType, so that it equals the value stored
+// from a body with the same text: bytes in base64, JSON documents compacted
+// and JSON strings as their text. Anything else is compared as plain text.
+func Expect(expect string, contentType string) string {
+	switch contentType {
+	case TypeBinary:
+		return base64.StdEncoding.EncodeToString([]byte(expect))
+	case TypeJSON:
+		var compacted bytes.Buffer
+		if err := json.Compact(&compacted, []byte(expect)); err == nil {
+			return compacted.String()
+		}
+	default:
+		var text string
+		if err := json.Unmarshal([]byte(expect), &text); err == nil {
+			return text
+		}
+	}
+	return expect
+}
+
+// ReadPatch reads the body of request as a JSON Merge Patch or JSON Patch of
+// at most maxSize bytes and returns it with its content type.
+func ReadPatch(writer http.ResponseWriter, request *http.Request, maxSize int64) (string, string, error) {
+	mediaType, body, err := readBody(writer, request, maxSize, jsonpatch.TypeMergePatch, jsonpatch.TypeJSONPatch)
+	if err != nil {
+		return "", "", err
+	}
+	if err := jsonpatch.Validate(body, mediaType); err != nil {
+		return "", "", err
+	}
+	return string(body), mediaType, nil
+}
+
+// readBody reads the body of request if its media type is one of accepted,
+// the first one is assumed without Content-Type.
+func readBody(writer http.ResponseWriter, request *http.Request, maxSize int64, accepted ...string) (string, []byte, error) {
+	mediaType := accepted[0]
+	if header := request.Header.Get("Content-Type"); header != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(header); err != nil {
+			return "", nil, fmt.Errorf("%w: %w", ErrUnsupportedType, err)
+		}
+	}
+	if !slices.Contains(accepted, mediaType) {
+		return "", nil, fmt.Errorf("%w %q", ErrUnsupportedType, mediaType)
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(writer, request.Body, maxSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return "", nil, fmt.Errorf("%w: the limit is %d bytes", ErrTooLarge, maxSize)
+	}
+	return mediaType, body, err
+}
+
+// Check verifies a value given with its stored content type outside of a
+// request body, as in a txn, and that it has at most maxSize bytes.
+func Check(value string, contentType string, maxSize int64) error {
+	size := int64(len(value))
+	switch contentType {
+	case "":
+	case TypeJSON:
+		if !json.Valid([]byte(value)) {
+			return errors.New("invalid JSON value")
+		}
+	case TypeBinary:
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("invalid base64 value: %w", err)
+		}
+		size = int64(len(data))
+	default:
+		return fmt.Errorf("%w %q", ErrUnsupportedType, contentType)
+	}
+	if size > maxSize {
+		return fmt.Errorf("%w: the limit is %d bytes", ErrTooLarge, maxSize)
+	}
+	return nil
+}
+
+// Write responds with a stored value in its content type.
+func Write(writer http.ResponseWriter, value string, contentType string) {
+	switch contentType {
+	case "":
+		writer.Header().Set("Content-Type", TypeJSON)
+		json.NewEncoder(writer).Encode(value)
+	case TypeBinary:
+		data, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			http.Error(writer, "Stored value is not base64", http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", TypeBinary)
+		writer.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		writer.Write(data)
+	default:
+		writer.Header().Set("Content-Type", contentType)
+		writer.Write([]byte(value + "\n"))
+	}
+}
+
+// Error responds to a request whose value Read, ReadPatch or Check refused.
+func Error(writer http.ResponseWriter, err error) {
+	code := http.StatusBadRequest
+	if errors.Is(err, ErrUnsupportedType) {
+		code = http.StatusUnsupportedMediaType
+	} else if errors.Is(err, ErrTooLarge) {
+		code = http.StatusRequestEntityTooLarge
+	}
+	http.Error(writer, err.Error(), code)
+}
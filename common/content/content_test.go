@@ -0,0 +1,119 @@
+package content
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		value       string
+		stored      string
+		err         error
+	}{
+		{"string without content type", "", `"text"`, "text", "", nil},
+		{"string", TypeJSON, `"text"`, "text", "", nil},
+		{"document", "application/json; charset=utf-8", `{"a": [1, 2]}`, `{"a":[1,2]}`, TypeJSON, nil},
+		{"number", TypeJSON, `42`, `42`, TypeJSON, nil},
+		{"binary", TypeBinary, "\x00\xffbytes", "AP9ieXRlcw==", TypeBinary, nil},
+		{"invalid JSON", TypeJSON, `{"a":`, "", "", errors.New("invalid JSON value")},
+		{"unsupported type", "text/plain", "text", "", "", ErrUnsupportedType},
+		{"too large", TypeBinary, strings.Repeat("x", 17), "", "", ErrTooLarge},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/key", strings.NewReader(test.body))
+			if test.contentType != "" {
+				request.Header.Set("Content-Type", test.contentType)
+			}
+			value, contentType, err := Read(httptest.NewRecorder(), request, 16)
+			if test.err != nil {
+				if err == nil || !errors.Is(err, test.err) && !strings.Contains(err.Error(), test.err.Error()) {
+					t.Fatalf("error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil || value != test.value || contentType != test.stored {
+				t.Fatalf("read %q as %q with %v, want %q as %q", test.body, contentType, err, test.value, test.stored)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		contentType string
+		err         error
+	}{
+		{"text", "any text", "", nil},
+		{"document", `{"a":1}`, TypeJSON, nil},
+		{"invalid document", `{"a":`, TypeJSON, errors.New("invalid JSON value")},
+		{"binary", "AP9ieXRlcw==", TypeBinary, nil},
+		{"invalid base64", "not base64!", TypeBinary, errors.New("invalid base64 value")},
+		// the limit applies to the decoded bytes
+		{"binary at the limit", "eHh4eHh4eHg=", TypeBinary, nil},
+		{"too large", "eHh4eHh4eHh4", TypeBinary, ErrTooLarge},
+		{"unsupported type", "text", "text/plain", ErrUnsupportedType},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Check(test.value, test.contentType, 8)
+			if test.err == nil && err != nil || test.err != nil && (err == nil || !errors.Is(err, test.err) && !strings.Contains(err.Error(), test.err.Error())) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestWrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       string
+		contentType string
+		header      string
+		body        string
+	}{
+		{"text", "text", "", TypeJSON, "\"text\"\n"},
+		{"document", `{"a":1}`, TypeJSON, TypeJSON, "{\"a\":1}\n"},
+		{"binary", "AP9ieXRlcw==", TypeBinary, TypeBinary, "\x00\xffbytes"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			Write(recorder, test.value, test.contentType)
+			if header := recorder.Header().Get("Content-Type"); header != test.header || recorder.Body.String() != test.body {
+				t.Fatalf("wrote %q as %s, want %q as %s", recorder.Body.String(), header, test.body, test.header)
+			}
+		})
+	}
+}
+
+func TestExpect(t *testing.T) {
+	tests := []struct {
+		name        string
+		expect      string
+		contentType string
+		want        string
+	}{
+		{"plain text", "1-2", "", "1-2"},
+		{"JSON string", `"text"`, "", "text"},
+		{"document", `{"a": 1}`, TypeJSON, `{"a":1}`},
+		{"invalid document", `{"a":`, TypeJSON, `{"a":`},
+		{"binary", "\x00\xffbytes", TypeBinary, "AP9ieXRlcw=="},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := Expect(test.expect, test.contentType); got != test.want {
+				t.Fatalf("Expect(%q, %q) = %q, want %q", test.expect, test.contentType, got, test.want)
+			}
+		})
+	}
+}
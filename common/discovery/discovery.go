@@ -0,0 +1,159 @@
+// Package discovery resolves the nodes of a cluster: their ids, ergo node
+// names and network addresses. Nodes are either listed statically in the
+// cluster file or found in DNS SRV records of a domain:
+//
+//	_ergo._tcp.<domain>  ergo acceptors of the nodes, required
+//	_api._tcp.<domain>   api addresses, host:5000+id by default
+//
+// The id of a node is the number at the end of the first label of its
+// target, e.g. 2 for chaddb-2.example.com.
+package discovery
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"chadcommon/cluster"
+)
+
+type Resolver interface {
+	Resolve(ctx context.Context) (cluster.Cluster, error)
+}
+
+// Static always resolves to the same cluster, e.g. the one of a cluster file.
+type Static struct {
+	Cluster cluster.Cluster
+}
+
+func (s Static) Resolve(ctx context.Context) (cluster.Cluster, error) {
+	return s.Cluster, nil
+}
+
+// Lookup is implemented by net.Resolver and Records.
+type Lookup interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+}
+
+type SRV struct {
+	Domain string
+	Lookup Lookup
+}
+
+// NewSRV resolves nodes from the SRV records of domain, lookup defaults to
+// net.DefaultResolver.
+func NewSRV(domain string, lookup Lookup) SRV {
+	if lookup == nil {
+		lookup = net.DefaultResolver
+	}
+	return SRV{Domain: domain, Lookup: lookup}
+}
+
+func (s SRV) Resolve(ctx context.Context) (cluster.Cluster, error) {
+	_, peers, err := s.Lookup.LookupSRV(ctx, "ergo", "tcp", s.Domain)
+	if err != nil {
+		return cluster.Cluster{}, err
+	}
+	apis := make(map[string]uint16)
+	// the api records are optional
+	if _, records, err := s.Lookup.LookupSRV(ctx, "api", "tcp", s.Domain); err == nil {
+		for _, record := range records {
+			apis[record.Target] = record.Port
+		}
+	}
+	var nodes []cluster.Node
+	for _, peer := range peers {
+		host := strings.TrimSuffix(peer.Target, ".")
+		id, err := parseId(host)
+		if err != nil {
+			return cluster.Cluster{}, err
+		}
+		node := cluster.Node{Id: id, Host: host, Network: net.JoinHostPort(host, strconv.Itoa(int(peer.Port)))}
+		if port, ok := apis[peer.Target]; ok {
+			node.Api = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		nodes = append(nodes, node)
+	}
+	c, err := cluster.New(nodes)
+	if err != nil {
+		return c, fmt.Errorf("SRV records of %s: %w", s.Domain, err)
+	}
+	return c, nil
+}
+
+// parseId returns the number at the end of the first label of host.
+func parseId(host string) (int, error) {
+	label, _, _ := strings.Cut(host, ".")
+	digits := len(label)
+	for digits > 0 && label[digits-1] >= '0' && label[digits-1] <= '9' {
+		digits--
+	}
+	id, err := strconv.Atoi(label[digits:])
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("no node id at the end of %s", label)
+	}
+	return id, nil
+}
+
+// Records is a stand-in for DNS serving SRV records from memory, e.g. in
+// tests or to run a cluster locally without a DNS server.
+type Records map[string][]*net.SRV
+
+// LoadRecords reads records in the zone file format of SRV records, one per
+// line, blank lines and lines starting with ; are skipped:
+//
+//	_ergo._tcp.chaddb.local. SRV 0 0 6001 chaddb-1.localhost.
+func LoadRecords(path string) (Records, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records := make(Records)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], ";") {
+			continue
+		}
+		if len(fields) != 6 || !strings.EqualFold(fields[1], "SRV") {
+			return nil, fmt.Errorf("%s:%d: expected <name> SRV <priority> <weight> <port> <target>", path, line)
+		}
+		var numbers [3]uint16
+		for i := range numbers {
+			n, err := strconv.ParseUint(fields[2+i], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+			}
+			numbers[i] = uint16(n)
+		}
+		name := fqdn(fields[0])
+		records[name] = append(records[name], &net.SRV{
+			Target: fqdn(fields[5]), Priority: numbers[0], Weight: numbers[1], Port: numbers[2],
+		})
+	}
+	return records, scanner.Err()
+}
+
+func (r Records) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	cname := fqdn(name)
+	if service != "" || proto != "" {
+		cname = fqdn("_" + service + "._" + proto + "." + name)
+	}
+	records, ok := r[cname]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: cname, IsNotFound: true}
+	}
+	return cname, records, nil
+}
+
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
@@ -0,0 +1,100 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chadcommon/cluster"
+)
+
+func srv(port uint16, target string) *net.SRV {
+	return &net.SRV{Target: target, Port: port}
+}
+
+func TestSRVResolve(t *testing.T) {
+	records := Records{
+		"_ergo._tcp.chaddb.local.": {srv(7001, "chaddb-1.example.com."), srv(7002, "chaddb-2.example.com.")},
+		"_api._tcp.chaddb.local.":  {srv(8001, "chaddb-1.example.com.")},
+	}
+	c, err := NewSRV("chaddb.local", records).Resolve(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _ := cluster.New([]cluster.Node{
+		{Id: 1, Host: "chaddb-1.example.com", Network: "chaddb-1.example.com:7001", Api: "chaddb-1.example.com:8001"},
+		// without an api record the api is on the default port
+		{Id: 2, Host: "chaddb-2.example.com", Network: "chaddb-2.example.com:7002"},
+	})
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("resolved %+v, want %+v", c, want)
+	}
+}
+
+func TestSRVResolveErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		records Records
+		want    string
+	}{
+		{"no records", Records{}, "no such host"},
+		{"no node id", Records{"_ergo._tcp.chaddb.local.": {srv(7001, "chaddb.example.com.")}}, "no node id at the end of chaddb"},
+		{"duplicate id", Records{"_ergo._tcp.chaddb.local.": {srv(7001, "a-1.example.com."), srv(7002, "b-1.example.com.")}}, "duplicate node id 1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewSRV("chaddb.local", test.records).Resolve(context.Background())
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("error %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records")
+	data := `; nodes of a local cluster
+_ergo._tcp.chaddb.local. SRV 0 0 6001 chaddb-1.localhost.
+
+_ergo._tcp.chaddb.local SRV 1 2 6002 chaddb-2.localhost
+`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	records, err := LoadRecords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Records{"_ergo._tcp.chaddb.local.": {
+		{Target: "chaddb-1.localhost.", Port: 6001},
+		{Target: "chaddb-2.localhost.", Priority: 1, Weight: 2, Port: 6002},
+	}}
+	if !reflect.DeepEqual(records, want) {
+		t.Fatalf("loaded %v, want %v", records, want)
+	}
+	_, found, err := records.LookupSRV(context.Background(), "ergo", "tcp", "chaddb.local")
+	if err != nil || len(found) != 2 {
+		t.Fatalf("lookup found %v, %v", found, err)
+	}
+	_, _, err = records.LookupSRV(context.Background(), "api", "tcp", "chaddb.local")
+	if dnsErr := (*net.DNSError)(nil); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+		t.Fatalf("lookup of missing records returned %v", err)
+	}
+
+	for _, invalid := range []string{
+		"_ergo._tcp.chaddb.local. A 127.0.0.1",
+		"_ergo._tcp.chaddb.local. SRV 0 0 70000 chaddb-1.localhost.",
+	} {
+		if err := os.WriteFile(path, []byte(invalid), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadRecords(path); err == nil || !strings.Contains(err.Error(), path+":1") {
+			t.Fatalf("loading %q returned %v", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"chadcommon/cluster"
+
+	"ergo.services/ergo/act"
+	"ergo.services/ergo/gen"
+)
+
+// RouterConfig tells Router how to find the other nodes and connect to them.
+type RouterConfig struct {
+	// Self is the id of this node, it gets no route.
+	Self     int
+	Resolver Resolver
+	Interval time.Duration
+	Cookie   string
+	// CertManager makes the routes use TLS if it is not nil.
+	CertManager gen.CertManager
+	// Cluster returns the nodes last resolved, SetCluster replaces them after
+	// they are resolved again.
+	Cluster    func() cluster.Cluster
+	SetCluster func(cluster.Cluster)
+}
+
+// NewRouter returns the behavior of a process keeping a static network route
+// to every other node of the cluster, so that ergo connects to the address of
+// the node instead of asking the registrar on its host. Nodes are resolved
+// again every config.Interval.
+func NewRouter(config RouterConfig) gen.ProcessBehavior {
+	return &Router{config: config}
+}
+
+type Router struct {
+	act.Actor
+	config RouterConfig
+	routes *routeTable
+}
+
+type resolve struct{}
+
+func (r *Router) Init(args ...any) error {
+	r.routes = newRouteTable(r.config, r.Node().Network())
+	r.update(r.config.Cluster())
+	r.SendAfter(r.PID(), resolve{}, r.config.Interval)
+	return nil
+}
+
+func (r *Router) HandleMessage(from gen.PID, message any) error {
+	switch message.(type) {
+	case resolve:
+		if c, err := refresh(r.config); err != nil {
+			r.Log().Warning("unable to resolve nodes, keeping the previous ones: %s", err)
+		} else {
+			r.update(c)
+		}
+		r.SendAfter(r.PID(), resolve{}, r.config.Interval)
+	default:
+		r.Log().Error("unknown message %v", message)
+	}
+	return nil
+}
+
+func (r *Router) update(c cluster.Cluster) {
+	for _, result := range r.routes.update(c) {
+		if result.err != nil {
+			r.Log().Error("unable to add route to node %d: %s", result.node.Id, result.err)
+		} else {
+			r.Log().Info("node %d (%s) is at %s", result.node.Id, result.node.Name, result.node.Network)
+		}
+	}
+}
+
+// refresh resolves the nodes again and passes them to config.SetCluster, the
+// previous ones are kept if that fails.
+func refresh(config RouterConfig) (cluster.Cluster, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := config.Resolver.Resolve(ctx)
+	if err != nil {
+		return c, err
+	}
+	config.SetCluster(c)
+	return c, nil
+}
+
+// network is the part of gen.Network the router changes.
+type network interface {
+	AddRoute(match string, route gen.NetworkRoute, weight int) error
+	RemoveRoute(match string) error
+}
+
+// routeTable holds the route to every other node added to network.
+type routeTable struct {
+	config  RouterConfig
+	network network
+	// routes are the network addresses routed to by node name
+	routes map[string]string
+}
+
+func newRouteTable(config RouterConfig, network network) *routeTable {
+	return &routeTable{config: config, network: network, routes: make(map[string]string)}
+}
+
+// routeResult is a node whose route update added, or failed to add.
+type routeResult struct {
+	node cluster.Node
+	err  error
+}
+
+// update adds routes to new nodes and to nodes whose address changed. Routes
+// of nodes that disappeared are kept, they may be missing only for a while.
+func (t *routeTable) update(c cluster.Cluster) []routeResult {
+	var results []routeResult
+	for _, node := range c.Nodes {
+		if node.Id == t.config.Self || t.routes[node.Name] == node.Network {
+			continue
+		}
+		err := t.add(node)
+		if err == nil {
+			t.routes[node.Name] = node.Network
+		}
+		results = append(results, routeResult{node: node, err: err})
+	}
+	return results
+}
+
+func (t *routeTable) add(node cluster.Node) error {
+	host, port, err := cluster.SplitAddress(node.Network)
+	if err != nil {
+		return fmt.Errorf("invalid network address: %w", err)
+	}
+	match := "^" + regexp.QuoteMeta(node.Name) + "$"
+	if _, ok := t.routes[node.Name]; ok {
+		t.network.RemoveRoute(match)
+	}
+	route := gen.NetworkRoute{Route: gen.Route{Host: host, Port: port}, Cookie: t.config.Cookie}
+	if t.config.CertManager != nil {
+		route.Route.TLS = true
+		route.Cert = t.config.CertManager
+	}
+	return t.network.AddRoute(match, route, 100)
+}
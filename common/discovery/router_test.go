@@ -0,0 +1,141 @@
+package discovery
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"testing"
+
+	"chadcommon/cluster"
+
+	"ergo.services/ergo/gen"
+)
+
+// testNetwork records the routes added to it.
+type testNetwork struct {
+	routes  map[string]gen.NetworkRoute
+	removed []string
+}
+
+func (n *testNetwork) AddRoute(match string, route gen.NetworkRoute, weight int) error {
+	if _, ok := n.routes[match]; ok {
+		return errors.New("route exists")
+	}
+	n.routes[match] = route
+	return nil
+}
+
+func (n *testNetwork) RemoveRoute(match string) error {
+	n.removed = append(n.removed, match)
+	delete(n.routes, match)
+	return nil
+}
+
+func (n *testNetwork) hosts() map[string]string {
+	hosts := make(map[string]string)
+	for match, route := range n.routes {
+		hosts[match] = net.JoinHostPort(route.Route.Host, strconv.Itoa(int(route.Route.Port)))
+	}
+	return hosts
+}
+
+func TestRouteTable(t *testing.T) {
+	records := Records{"_ergo._tcp.chaddb.local.": {srv(6001, "chaddb-1.example.com."), srv(6002, "chaddb-2.example.com."), srv(6003, "chaddb-3.example.com.")}}
+	var current cluster.Cluster
+	config := RouterConfig{
+		Self:       1,
+		Resolver:   NewSRV("chaddb.local", records),
+		Cookie:     "cookie",
+		Cluster:    func() cluster.Cluster { return current },
+		SetCluster: func(c cluster.Cluster) { current = c },
+	}
+	network := &testNetwork{routes: make(map[string]gen.NetworkRoute)}
+	routes := newRouteTable(config, network)
+	refreshed := func() []routeResult {
+		t.Helper()
+		c, err := refresh(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return routes.update(c)
+	}
+
+	// no route to the node itself
+	if results := refreshed(); len(results) != 2 || results[0].err != nil || results[1].err != nil {
+		t.Fatalf("first update %+v", results)
+	}
+	want := map[string]string{
+		"^node-2@chaddb-2\\.example\\.com$": "chaddb-2.example.com:6002",
+		"^node-3@chaddb-3\\.example\\.com$": "chaddb-3.example.com:6003",
+	}
+	if got := network.hosts(); !maps.Equal(got, want) {
+		t.Fatalf("routes %v, want %v", got, want)
+	}
+	if route := network.routes["^node-2@chaddb-2\\.example\\.com$"]; route.Cookie != "cookie" || route.Route.TLS {
+		t.Fatalf("route %+v", route)
+	}
+	if results := refreshed(); len(results) != 0 {
+		t.Fatalf("unchanged nodes updated %+v", results)
+	}
+
+	// node 3 moves to another port, node 2 disappears for a while
+	records["_ergo._tcp.chaddb.local."] = []*net.SRV{srv(6001, "chaddb-1.example.com."), srv(7003, "chaddb-3.example.com.")}
+	if results := refreshed(); len(results) != 1 || results[0].node.Id != 3 || results[0].err != nil {
+		t.Fatalf("update after a move %+v", results)
+	}
+	want["^node-3@chaddb-3\\.example\\.com$"] = "chaddb-3.example.com:7003"
+	if got := network.hosts(); !maps.Equal(got, want) {
+		t.Fatalf("routes %v, want %v", got, want)
+	}
+	if !slices.Equal(network.removed, []string{"^node-3@chaddb-3\\.example\\.com$"}) {
+		t.Fatalf("removed routes %v", network.removed)
+	}
+	if ids := current.Ids(); !slices.Equal(ids, []int{1, 3}) {
+		t.Fatalf("cluster has nodes %v after refresh", ids)
+	}
+
+	// failures keep the previous nodes
+	delete(records, "_ergo._tcp.chaddb.local.")
+	if _, err := refresh(config); err == nil {
+		t.Fatal("refresh without records succeeded")
+	}
+	if ids := current.Ids(); !slices.Equal(ids, []int{1, 3}) {
+		t.Fatalf("cluster has nodes %v after a failed refresh", ids)
+	}
+}
+
+func TestRouteTableErrors(t *testing.T) {
+	network := &testNetwork{routes: make(map[string]gen.NetworkRoute)}
+	routes := newRouteTable(RouterConfig{Self: 1, CertManager: testCertManager{}}, network)
+	node := cluster.DefaultNode(2)
+	node.Network = "localhost"
+	results := routes.update(cluster.Cluster{Nodes: []cluster.Node{node}})
+	if len(results) != 1 || results[0].err == nil {
+		t.Fatalf("update with an invalid address %+v", results)
+	}
+	// the route is added once the address is fixed
+	node.Network = "localhost:6002"
+	results = routes.update(cluster.Cluster{Nodes: []cluster.Node{node}})
+	if len(results) != 1 || results[0].err != nil {
+		t.Fatalf("update with a valid address %+v", results)
+	}
+	if route := network.routes["^node-2@localhost$"]; !route.Route.TLS || route.Cert == nil {
+		t.Fatalf("route without TLS %+v", route)
+	}
+	// a failed route is tried again
+	network.routes["^node-3@localhost$"] = gen.NetworkRoute{}
+	other := cluster.DefaultNode(3)
+	if results := routes.update(cluster.Cluster{Nodes: []cluster.Node{other}}); len(results) != 1 || results[0].err == nil {
+		t.Fatalf("update with a failing network %+v", results)
+	}
+	delete(network.routes, "^node-3@localhost$")
+	if results := routes.update(cluster.Cluster{Nodes: []cluster.Node{other}}); len(results) != 1 || results[0].err != nil {
+		t.Fatalf("retry %+v", results)
+	}
+}
+
+type testCertManager struct {
+	gen.CertManager
+}
@@ -0,0 +1,9 @@
+module chadcommon
+
+go 1.23.3
+
+require (
+	ergo.services/ergo v1.999.300
+	github.com/BurntSushi/toml v1.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
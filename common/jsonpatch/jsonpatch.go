@@ -0,0 +1,369 @@
+// Package jsonpatch applies JSON Merge Patch (RFC 7396) and JSON Patch
+// (RFC 6902) documents to JSON documents. Results are encoded with sorted
+// object keys and numbers as they were written, so that every replica that
+// applies a patch to the same document gets the same bytes.
+package jsonpatch
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	TypeMergePatch = "application/merge-patch+json"
+	TypeJSONPatch  = "application/json-patch+json"
+)
+
+// ErrInvalid is a patch that can not be applied to any document.
+var ErrInvalid = errors.New("invalid patch")
+
+// ErrFailed is a patch that can not be applied to the document it was given,
+// such as a path that does not exist or a failed test.
+var ErrFailed = errors.New("patch failed")
+
+// Operation is an operation of a JSON Patch. Value is nil if it was not
+// given, as opposed to a JSON null.
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Validate checks that patch is a well-formed patch of contentType.
+func Validate(patch []byte, contentType string) error {
+	switch contentType {
+	case TypeMergePatch:
+		_, err := decode(patch)
+		return err
+	case TypeJSONPatch:
+		_, err := parseOperations(patch)
+		return err
+	}
+	return fmt.Errorf("%w: unknown patch type %q", ErrInvalid, contentType)
+}
+
+// Apply applies patch of contentType to doc, a nil doc is a missing
+// document.
+func Apply(doc []byte, patch []byte, contentType string) ([]byte, error) {
+	var target any
+	if doc != nil {
+		var err error
+		if target, err = decode(doc); err != nil {
+			return nil, fmt.Errorf("%w: the value is not a JSON document", ErrFailed)
+		}
+	}
+	switch contentType {
+	case TypeMergePatch:
+		p, err := decode(patch)
+		if err != nil {
+			return nil, err
+		}
+		return encode(mergePatch(target, p))
+	case TypeJSONPatch:
+		operations, err := parseOperations(patch)
+		if err != nil {
+			return nil, err
+		}
+		for i, operation := range operations {
+			if target, err = operation.apply(target); err != nil {
+				return nil, fmt.Errorf("operation %d (%s %s): %w", i, operation.Op, operation.Path, err)
+			}
+		}
+		return encode(target)
+	}
+	return nil, fmt.Errorf("%w: unknown patch type %q", ErrInvalid, contentType)
+}
+
+func mergePatch(target any, patch any) any {
+	fields, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	object, ok := target.(map[string]any)
+	if !ok {
+		object = make(map[string]any)
+	}
+	for name, value := range fields {
+		if value == nil {
+			delete(object, name)
+		} else {
+			object[name] = mergePatch(object[name], value)
+		}
+	}
+	return object
+}
+
+func parseOperations(patch []byte) ([]Operation, error) {
+	var operations []Operation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	for i, operation := range operations {
+		if err := operation.validate(); err != nil {
+			return nil, fmt.Errorf("%w: operation %d: %w", ErrInvalid, i, err)
+		}
+	}
+	return operations, nil
+}
+
+func (o Operation) validate() error {
+	if _, err := parsePointer(o.Path); err != nil {
+		return err
+	}
+	switch o.Op {
+	case "add", "replace", "test":
+		if o.Value == nil {
+			return fmt.Errorf("%s without value", o.Op)
+		}
+		_, err := decode(o.Value)
+		return err
+	case "remove":
+		return nil
+	case "move", "copy":
+		if _, err := parsePointer(o.From); err != nil {
+			return err
+		}
+		if o.Op == "move" && strings.HasPrefix(o.Path+"/", o.From+"/") && o.Path != o.From {
+			return errors.New("move into its own child")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown op %q", o.Op)
+}
+
+func (o Operation) apply(doc any) (any, error) {
+	path, _ := parsePointer(o.Path)
+	switch o.Op {
+	case "add":
+		value, _ := decode(o.Value)
+		return add(doc, path, value)
+	case "remove":
+		doc, _, err := remove(doc, path)
+		return doc, err
+	case "replace":
+		value, _ := decode(o.Value)
+		if len(path) == 0 {
+			return value, nil
+		}
+		doc, _, err := remove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "move":
+		from, _ := parsePointer(o.From)
+		doc, value, err := remove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, path, value)
+	case "copy":
+		from, _ := parsePointer(o.From)
+		value, err := get(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		// the copy must not share containers with the original
+		data, err := encode(value)
+		if err != nil {
+			return nil, err
+		}
+		value, _ = decode(data)
+		return add(doc, path, value)
+	case "test":
+		expected, _ := decode(o.Value)
+		actual, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equal(actual, expected) {
+			return nil, fmt.Errorf("%w: the value differs", ErrFailed)
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("%w: unknown op %q", ErrInvalid, o.Op)
+}
+
+// parsePointer splits a JSON pointer (RFC 6901) into its unescaped tokens.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("pointer %q does not start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+var errNotFound = fmt.Errorf("%w: path does not exist", ErrFailed)
+
+// index parses an array index, which may be the length of the array if end
+// is set.
+func index(token string, length int, end bool) (int, bool) {
+	if end && token == "-" {
+		return length, true
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, false
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > length || (i == length && !end) {
+		return 0, false
+	}
+	return i, true
+}
+
+func get(doc any, path []string) (any, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]any:
+			value, ok := node[token]
+			if !ok {
+				return nil, errNotFound
+			}
+			doc = value
+		case []any:
+			j, ok := index(token, len(node), false)
+			if !ok {
+				return nil, errNotFound
+			}
+			doc = node[j]
+		default:
+			return nil, errNotFound
+		}
+	}
+	return doc, nil
+}
+
+// add returns doc with value added at path, arrays may be replaced by
+// longer ones.
+func add(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	var err error
+	switch node := doc.(type) {
+	case map[string]any:
+		if len(path) == 1 {
+			node[path[0]] = value
+			return node, nil
+		}
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, errNotFound
+		}
+		node[path[0]], err = add(child, path[1:], value)
+		return node, err
+	case []any:
+		i, ok := index(path[0], len(node), len(path) == 1)
+		if !ok {
+			return nil, errNotFound
+		}
+		if len(path) == 1 {
+			return slices.Insert(node, i, value), nil
+		}
+		node[i], err = add(node[i], path[1:], value)
+		return node, err
+	}
+	return nil, errNotFound
+}
+
+// remove returns doc without the value at path and the removed value.
+func remove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("%w: the whole document can not be removed", ErrFailed)
+	}
+	var removed any
+	var err error
+	switch node := doc.(type) {
+	case map[string]any:
+		child, ok := node[path[0]]
+		if !ok {
+			return nil, nil, errNotFound
+		}
+		if len(path) == 1 {
+			delete(node, path[0])
+			return node, child, nil
+		}
+		node[path[0]], removed, err = remove(child, path[1:])
+		return node, removed, err
+	case []any:
+		i, ok := index(path[0], len(node), false)
+		if !ok {
+			return nil, nil, errNotFound
+		}
+		if len(path) == 1 {
+			removed = node[i]
+			return slices.Delete(node, i, i+1), removed, nil
+		}
+		node[i], removed, err = remove(node[i], path[1:])
+		return node, removed, err
+	}
+	return nil, nil, errNotFound
+}
+
+// equal compares JSON values, numbers by their value.
+func equal(a any, b any) bool {
+	switch x := a.(type) {
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for name, value := range x {
+			other, ok := y[name]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		y, ok := b.([]any)
+		return ok && slices.EqualFunc(x, y, equal)
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		r, okX := new(big.Rat).SetString(string(x))
+		s, okY := new(big.Rat).SetString(string(y))
+		return okX && okY && r.Cmp(s) == 0
+	}
+	return a == b
+}
+
+// decode reads a single JSON document, keeping numbers as written.
+func decode(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, fmt.Errorf("%w: data after the JSON document", ErrInvalid)
+	}
+	return doc, nil
+}
+
+func encode(doc any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(doc); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,184 @@
+package jsonpatch
+
+import (
+	"errors"
+	"testing"
+)
+
+// canonical encodes doc like Apply, so that documents compare by value.
+func canonical(t *testing.T, doc string) string {
+	t.Helper()
+	value, err := decode([]byte(doc))
+	if err != nil {
+		t.Fatalf("%s: %v", doc, err)
+	}
+	data, err := encode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// TestJSONPatch runs the examples of RFC 6902, Appendix A.
+func TestJSONPatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    string
+		patch  string
+		result string
+		err    error
+	}{
+		{"A.1 adding an object member", `{"foo": "bar"}`,
+			`[{"op": "add", "path": "/baz", "value": "qux"}]`,
+			`{"baz": "qux", "foo": "bar"}`, nil},
+		{"A.2 adding an array element", `{"foo": ["bar", "baz"]}`,
+			`[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+			`{"foo": ["bar", "qux", "baz"]}`, nil},
+		{"A.3 removing an object member", `{"baz": "qux", "foo": "bar"}`,
+			`[{"op": "remove", "path": "/baz"}]`,
+			`{"foo": "bar"}`, nil},
+		{"A.4 removing an array element", `{"foo": ["bar", "qux", "baz"]}`,
+			`[{"op": "remove", "path": "/foo/1"}]`,
+			`{"foo": ["bar", "baz"]}`, nil},
+		{"A.5 replacing a value", `{"baz": "qux", "foo": "bar"}`,
+			`[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+			`{"baz": "boo", "foo": "bar"}`, nil},
+		{"A.6 moving a value", `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+			`[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`, nil},
+		{"A.7 moving an array element", `{"foo": ["all", "grass", "cows", "eat"]}`,
+			`[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+			`{"foo": ["all", "cows", "eat", "grass"]}`, nil},
+		{"A.8 testing a value: success", `{"baz": "qux", "foo": ["a", 2, "c"]}`,
+			`[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+			`{"baz": "qux", "foo": ["a", 2, "c"]}`, nil},
+		{"A.9 testing a value: error", `{"baz": "qux"}`,
+			`[{"op": "test", "path": "/baz", "value": "bar"}]`,
+			"", ErrFailed},
+		{"A.10 adding a nested member object", `{"foo": "bar"}`,
+			`[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`,
+			`{"foo": "bar", "child": {"grandchild": {}}}`, nil},
+		{"A.11 ignoring unrecognized elements", `{"foo": "bar"}`,
+			`[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`,
+			`{"foo": "bar", "baz": "qux"}`, nil},
+		{"A.12 adding to a nonexistent target", `{"foo": "bar"}`,
+			`[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+			"", ErrFailed},
+		{"A.13 invalid JSON Patch document", `{"foo": "bar"}`,
+			`[{"op": "add", "path": "/baz", "value": "qux", "op": "remove"}]`,
+			"", ErrFailed},
+		{"A.14 ~ escape ordering", `{"/": 9, "~1": 10}`,
+			`[{"op": "test", "path": "/~01", "value": 10}]`,
+			`{"/": 9, "~1": 10}`, nil},
+		{"A.15 comparing strings and numbers", `{"/": 9, "~1": 10}`,
+			`[{"op": "test", "path": "/~01", "value": "10"}]`,
+			"", ErrFailed},
+		{"A.16 adding an array value", `{"foo": ["bar"]}`,
+			`[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+			`{"foo": ["bar", ["abc", "def"]]}`, nil},
+
+		{"numbers are compared by value", `{"n": 1.0}`,
+			`[{"op": "test", "path": "/n", "value": 1}]`,
+			`{"n": 1.0}`, nil},
+		{"copy does not share containers", `{"a": {"b": 1}}`,
+			`[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "add", "path": "/c/d", "value": 2}]`,
+			`{"a": {"b": 1}, "c": {"b": 1, "d": 2}}`, nil},
+		{"missing document", ``,
+			`[{"op": "add", "path": "", "value": {"a": 1}}]`,
+			`{"a": 1}`, nil},
+		{"unknown op", `{}`, `[{"op": "merge", "path": "/a"}]`, "", ErrInvalid},
+		{"add without value", `{}`, `[{"op": "add", "path": "/a"}]`, "", ErrInvalid},
+		{"pointer without slash", `{}`, `[{"op": "remove", "path": "a"}]`, "", ErrInvalid},
+		{"move into its own child", `{"a": {}}`, `[{"op": "move", "from": "/a", "path": "/a/b"}]`, "", ErrInvalid},
+		{"leading zero index", `{"a": [1, 2]}`, `[{"op": "remove", "path": "/a/01"}]`, "", ErrFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var doc []byte
+			if test.doc != "" {
+				doc = []byte(test.doc)
+			}
+			if err := Validate([]byte(test.patch), TypeJSONPatch); err != nil && !errors.Is(test.err, ErrInvalid) {
+				t.Fatalf("valid patch refused: %v", err)
+			}
+			result, err := Apply(doc, []byte(test.patch), TypeJSONPatch)
+			if test.err != nil {
+				if !errors.Is(err, test.err) {
+					t.Fatalf("error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := canonical(t, test.result); string(result) != want {
+				t.Fatalf("result %s, want %s", result, want)
+			}
+		})
+	}
+}
+
+// TestMergePatch runs the examples of RFC 7396, Appendix A.
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		doc    string
+		patch  string
+		result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+		// a missing document is patched as null
+		{``, `{"a":{"b":null,"c":1}}`, `{"a":{"c":1}}`},
+	}
+	for _, test := range tests {
+		t.Run(test.doc+" "+test.patch, func(t *testing.T) {
+			var doc []byte
+			if test.doc != "" {
+				doc = []byte(test.doc)
+			}
+			result, err := Apply(doc, []byte(test.patch), TypeMergePatch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := canonical(t, test.result); string(result) != want {
+				t.Fatalf("result %s, want %s", result, want)
+			}
+		})
+	}
+}
+
+func TestInvalidPatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		doc         string
+		patch       string
+		contentType string
+		err         error
+	}{
+		{"merge patch is not JSON", `{}`, `{"a":`, TypeMergePatch, ErrInvalid},
+		{"data after the merge patch", `{}`, `{} {}`, TypeMergePatch, ErrInvalid},
+		{"JSON patch is not an array", `{}`, `{"op": "remove", "path": "/a"}`, TypeJSONPatch, ErrInvalid},
+		{"unknown patch type", `{}`, `{}`, "application/json", ErrInvalid},
+		{"document is not JSON", `not json`, `{}`, TypeMergePatch, ErrFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Apply([]byte(test.doc), []byte(test.patch), test.contentType); !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
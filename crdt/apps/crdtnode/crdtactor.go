@@ -1,8 +1,15 @@
 package crdtnode
 
 import (
+	"chadcommon/audit"
+	"chadcommon/content"
+	"chadcommon/jsonpatch"
 	opt "chadcrdt/internal/options"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strconv"
 	"time"
 
 	// "math/rand"
@@ -28,6 +35,11 @@ type CrdtActor struct {
 	cancelRetry map[CancelFuncKey]gen.CancelFunc
 
 	data map[string]CrdtRowValue
+	// tree has the digests of the rows of data
+	tree *MerkleTree
+	// delivered has the writes of other nodes applied on this replica, so a
+	// retry whose ack was lost is applied and audited once
+	delivered map[NodeId]*writeSet
 
     stopReplication bool
 }
@@ -41,6 +53,8 @@ func (a *CrdtActor) Init(args ...any) error {
 	a.clock = make(VectorClock, opt.NodeCount)
 	a.cancelRetry = make(map[CancelFuncKey]gen.CancelFunc)
 	a.data = make(map[string]CrdtRowValue)
+	a.tree = NewMerkleTree()
+	a.delivered = make(map[NodeId]*writeSet)
 	a.Log().Info("started process with name %s", a.Name())
 	return nil
 }
@@ -74,24 +88,72 @@ func (a *CrdtActor) HandleCall(from gen.PID, ref gen.Ref, request any) (any, err
 	switch req := request.(type) {
 	case GetValueRequest:
 		return a.HandleGetValue(&from, &req)
+	case GetDigestRequest:
+		return a.HandleGetDigest(), nil
+	case GetLeafRequest:
+		return a.HandleGetLeaf(&req)
+	case PatchRowRequest:
+		return a.HandlePatchRow(&from, &req)
 	default:
 		return false, fmt.Errorf("Invalid request type: %T", request)
 	}
 }
 
+// HandleInspect invoked on the request made with gen.Process.Inspect(...)
+// and shows replication state in the observer.
+func (a *CrdtActor) HandleInspect(from gen.PID, item ...string) map[string]string {
+	retries := make(map[NodeId]int)
+	for key := range a.cancelRetry {
+		retries[key.To]++
+	}
+	result := map[string]string{
+		"clock":           fmt.Sprint(a.clock),
+		"keys":            strconv.Itoa(len(a.data)),
+		"stopReplication": strconv.FormatBool(a.stopReplication),
+	}
+	for i := 1; i <= opt.NodeCount; i++ {
+		if i == opt.NodeId {
+			continue
+		}
+		result[fmt.Sprintf("pending retries to node %d", i)] = strconv.Itoa(retries[NodeId(i)])
+	}
+	return result
+}
+
 func (a *CrdtActor) HandleGetValue(from *gen.PID, request *GetValueRequest) (any, error) {
 	value, ok := a.data[request.Key]
 	if ok {
-		return value.Value, nil
+		return value, nil
 	} else {
 		return KeyNotFound{}, nil
 	}
 }
 
+func (a *CrdtActor) HandleGetDigest() DigestResult {
+	result := DigestResult{Root: a.tree.Root().String(), Clock: slices.Clone(a.clock), Leaves: make([]string, MerkleLeaves)}
+	for i := range result.Leaves {
+		result.Leaves[i] = a.tree.Leaf(i).String()
+	}
+	return result
+}
+
+func (a *CrdtActor) HandleGetLeaf(request *GetLeafRequest) (any, error) {
+	if request.Leaf < 0 || request.Leaf >= MerkleLeaves {
+		return InvalidLeaf{}, nil
+	}
+	result := LeafResult{Leaf: request.Leaf, Digest: a.tree.Leaf(request.Leaf).String(), Rows: make(map[string]string)}
+	for key, row := range a.data {
+		if LeafOf(key) == request.Leaf {
+			result.Rows[key] = RowDigest(key, row).String()
+		}
+	}
+	return result, nil
+}
+
 func (a *CrdtActor) HandleNewClientRowMessage(from *gen.PID, message *NewClientRowMessage) error {
 	a.clock.Inc()
-	msg := NewRowMessage{From: NodeId(opt.NodeId), Row: CrdtRow{Key: message.Key, Value: message.Value, Timestamp: a.clock}}
-	a.ApplyNewRow(msg.From, &msg.Row)
+	msg := NewRowMessage{From: NodeId(opt.NodeId), Row: CrdtRow{Key: message.Key, Value: message.Value, ContentType: message.ContentType, Timestamp: a.clock, Op: message.Op, Principal: message.Principal, Client: message.Client}}
+	a.Audit(&msg.Row, a.ApplyNewRow(msg.From, &msg.Row))
 	for i := 1; i <= opt.NodeCount; i++ {
 		if i == opt.NodeId {
 			continue
@@ -101,6 +163,38 @@ func (a *CrdtActor) HandleNewClientRowMessage(from *gen.PID, message *NewClientR
 	return nil
 }
 
+// HandlePatchRow patches the document of the key on this replica and writes
+// the result like a client write, so concurrent writes of other replicas
+// still win by their clock. A missing key is patched as null.
+func (a *CrdtActor) HandlePatchRow(from *gen.PID, request *PatchRowRequest) (any, error) {
+	var doc []byte
+	if row, ok := a.data[request.Key]; ok {
+		switch row.ContentType {
+		case content.TypeJSON:
+			doc = []byte(row.Value)
+		case "":
+			doc = Must1(json.Marshal(row.Value))
+		default:
+			return PatchFailed{Reason: "the value is not a JSON document"}, nil
+		}
+	}
+	patched, err := jsonpatch.Apply(doc, []byte(request.Patch), request.ContentType)
+	if errors.Is(err, jsonpatch.ErrInvalid) {
+		return InvalidPatch{Reason: err.Error()}, nil
+	} else if err != nil {
+		return PatchFailed{Reason: err.Error()}, nil
+	}
+	// a JSON string is stored as text, like one in a request body
+	message := NewClientRowMessage{Key: request.Key, Value: string(patched), ContentType: content.TypeJSON, Op: OpPatch, Principal: request.Principal, Client: request.Client}
+	if err := json.Unmarshal(patched, &message.Value); err == nil {
+		message.ContentType = ""
+	}
+	if err := a.HandleNewClientRowMessage(from, &message); err != nil {
+		return nil, err
+	}
+	return a.data[request.Key], nil
+}
+
 func (a *CrdtActor) HandleRetryNewRowMessage(from *gen.PID, message *RetryNewRowMessage) error {
     if !a.stopReplication {
         err := a.Send(a.SelfOnNode(message.To), message.Msg)
@@ -114,7 +208,11 @@ func (a *CrdtActor) HandleRetryNewRowMessage(from *gen.PID, message *RetryNewRow
 
 func (a *CrdtActor) HandleNewRowMessage(from *gen.PID, message *NewRowMessage) error {
 	a.clock.Sync(&message.Row.Timestamp)
-	a.ApplyNewRow(message.From, &message.Row)
+	if a.markDelivered(message.From, message.Row.Timestamp[message.From-1]) {
+		a.Audit(&message.Row, a.ApplyNewRow(message.From, &message.Row))
+	} else {
+		a.Log().Info("NewRowMessage of node %d at %v was delivered before", message.From, message.Row.Timestamp)
+	}
     err := a.Send(a.SelfOnNode(message.From), NewRowAckMessage{SelfId: message.Row.Timestamp[message.From - 1], From: NodeId(opt.NodeId)})
 	if err != nil {
 		a.Log().Warning("Sending of NewRowAckMessage to node %d failed: %s", message.From, err)
@@ -131,27 +229,62 @@ func (a *CrdtActor) HandleNewRowAckMessage(from *gen.PID, message *NewRowAckMess
 	return nil
 }
 
-func (a *CrdtActor) ApplyNewRow(from NodeId, message *CrdtRow) {
+// ApplyNewRow reports whether the row replaced the value of the key.
+func (a *CrdtActor) ApplyNewRow(from NodeId, message *CrdtRow) bool {
     ts := make(VectorClock, opt.NodeCount)
     copy(ts, message.Timestamp)
-    newValue := CrdtRowValue{Value: message.Value, Timestamp: ts}
+    newValue := CrdtRowValue{Value: message.Value, ContentType: message.ContentType, Timestamp: ts, Origin: from}
 
 	val, ok := a.data[message.Key]
 	if !ok {
-		a.data[message.Key] = newValue
-		return
+		a.setRow(message.Key, newValue)
+		return true
 	}
 
 	switch val.Timestamp.Compare(&message.Timestamp) {
 	case Before:
-		a.data[message.Key] = newValue
+		a.setRow(message.Key, newValue)
+		return true
 	case Equal:
 		panic("Impossible situation")
 	case Conflict:
-		if from < NodeId(opt.NodeId) {
-			a.data[message.Key] = newValue
+		if val.LosesTo(message.Timestamp, from) {
+			a.setRow(message.Key, newValue)
+			return true
 		}
 	}
+	return false
+}
+
+func (a *CrdtActor) setRow(key string, row CrdtRowValue) {
+	if old, ok := a.data[key]; ok {
+		a.tree.Toggle(key, RowDigest(key, old))
+	}
+	a.data[key] = row
+	a.tree.Toggle(key, RowDigest(key, row))
+}
+
+// markDelivered reports whether the write of node from with the clock entry
+// seq of that node is new to this replica, and remembers it.
+func (a *CrdtActor) markDelivered(from NodeId, seq int) bool {
+	writes, ok := a.delivered[from]
+	if !ok {
+		writes = &writeSet{ahead: make(map[int]bool)}
+		a.delivered[from] = writes
+	}
+	return writes.Add(seq)
+}
+
+// Audit records a client write applied on this replica in the audit log. The
+// write stands whatever the audit log says, so a failure is only logged.
+func (a *CrdtActor) Audit(row *CrdtRow, applied bool) {
+	entry := audit.Entry{Principal: row.Principal, Client: row.Client, Op: row.Op, Key: row.Key, Clock: slices.Clone(row.Timestamp), Outcome: audit.OutcomeOk}
+	if !applied {
+		entry.Outcome = audit.OutcomeSuperseded
+	}
+	if err := opt.Audit.Append(entry); err != nil {
+		a.Log().Error("unable to write %s of %q at %v to the audit log: %s", entry.Op, entry.Key, entry.Clock, err)
+	}
 }
 
 func (a *CrdtActor) ReliableSend(to NodeId, msg *NewRowMessage) {
@@ -174,13 +307,77 @@ func (a *CrdtActor) SelfOnNode(id NodeId) gen.ProcessID {
 	return gen.ProcessID{Name: "crdtactor", Node: gen.Atom(opt.MakeNodeName(int(id)))}
 }
 
+// GetValueRequest is answered with the CrdtRowValue of the key or KeyNotFound.
 type GetValueRequest struct {
 	Key string
 }
 
+// Operations of client writes in the audit log.
+const (
+	OpSet   = "set"
+	OpPatch = "patch"
+)
+
+// NewClientRowMessage is a write of an api request, Op, Principal and Client
+// tell what it was and who made it for the audit log. ContentType is stored
+// with Value, see package content.
 type NewClientRowMessage struct {
-	Key   string
-	Value string
+	Key         string
+	Value       string
+	ContentType string
+	Op          string
+	Principal   string
+	Client      string
+}
+
+// PatchRowRequest applies the JSON Merge Patch or JSON Patch in Patch, as
+// told by ContentType, to the document of the key. It is answered with the
+// resulting CrdtRowValue, PatchFailed or InvalidPatch.
+type PatchRowRequest struct {
+	Key         string
+	Patch       string
+	ContentType string
+	Principal   string
+	Client      string
+}
+
+// PatchFailed means the patch can not be applied to the value of the key,
+// the value is left as it was.
+type PatchFailed struct {
+	Reason string
+}
+
+// InvalidPatch means the patch can not be applied to any document.
+type InvalidPatch struct {
+	Reason string
+}
+
+// GetDigestRequest is answered with DigestResult.
+type GetDigestRequest struct {
+}
+
+// DigestResult has the root and leaves of the Merkle tree over the rows of
+// a replica, with its vector clock.
+type DigestResult struct {
+	Root   string   `json:"root"`
+	Clock  []int    `json:"clock"`
+	Leaves []string `json:"leaves"`
+}
+
+// GetLeafRequest is answered with LeafResult, or InvalidLeaf if there is no
+// such leaf.
+type GetLeafRequest struct {
+	Leaf int
+}
+
+// LeafResult has the digests of the rows of a leaf by key.
+type LeafResult struct {
+	Leaf   int               `json:"leaf"`
+	Digest string            `json:"digest"`
+	Rows   map[string]string `json:"rows"`
+}
+
+type InvalidLeaf struct {
 }
 
 type RetryNewRowMessage struct {
@@ -210,14 +407,34 @@ type KeyNotFound struct {
 }
 
 type CrdtRow struct {
-	Key       string
-	Value     string
-	Timestamp VectorClock
+	Key         string
+	Value       string
+	ContentType string
+	Timestamp   VectorClock
+	Op          string
+	Principal   string
+	Client      string
 }
 
+// CrdtRowValue is the value of a key with the clock and the node of the
+// write that set it.
 type CrdtRowValue struct {
-	Value     string
-	Timestamp VectorClock
+	Value       string
+	ContentType string
+	Timestamp   VectorClock
+	Origin      NodeId
+}
+
+// LosesTo reports whether the row loses to the concurrent write at clock of
+// node origin. Every replica picks the same winner whatever order the writes
+// arrive in: the write that saw more writes, as a write always saw more than
+// the ones before it, then the one of the lowest node id, as writes of one
+// node are never concurrent.
+func (row CrdtRowValue) LosesTo(clock VectorClock, origin NodeId) bool {
+	if sum, rowSum := clock.Sum(), row.Timestamp.Sum(); sum != rowSum {
+		return sum > rowSum
+	}
+	return origin < row.Origin
 }
 
 type CancelFuncKey struct {
@@ -225,6 +442,27 @@ type CancelFuncKey struct {
     To NodeId
 }
 
+// writeSet holds the writes of a node by their clock entry of that node,
+// which grows by one with every write: all up to upTo and those in ahead,
+// delivered out of order.
+type writeSet struct {
+	upTo  int
+	ahead map[int]bool
+}
+
+// Add reports whether seq is new and adds it.
+func (s *writeSet) Add(seq int) bool {
+	if seq <= s.upTo || s.ahead[seq] {
+		return false
+	}
+	s.ahead[seq] = true
+	for s.ahead[s.upTo+1] {
+		delete(s.ahead, s.upTo+1)
+		s.upTo++
+	}
+	return true
+}
+
 type VectorClock []int
 
 type VectorClockCompareResult int
@@ -258,6 +496,15 @@ func (c *VectorClock) Compare(o *VectorClock) VectorClockCompareResult {
 	}
 }
 
+// Sum is the number of writes the clock saw.
+func (c *VectorClock) Sum() int {
+	sum := 0
+	for _, t := range *c {
+		sum += t
+	}
+	return sum
+}
+
 func (c *VectorClock) Self() int {
 	return (*c)[opt.NodeId - 1]
 }
@@ -0,0 +1,21 @@
+package crdtnode
+
+import "testing"
+
+func TestWriteSetDeliversOnce(t *testing.T) {
+	writes := &writeSet{ahead: make(map[int]bool)}
+	// retries arrive again and out of order
+	for _, step := range []struct {
+		seq int
+		new bool
+	}{
+		{1, true}, {1, false}, {3, true}, {2, true}, {3, false}, {2, false}, {5, true}, {4, true}, {5, false},
+	} {
+		if got := writes.Add(step.seq); got != step.new {
+			t.Fatalf("Add(%d) = %t, want %t", step.seq, got, step.new)
+		}
+	}
+	if writes.upTo != 5 || len(writes.ahead) != 0 {
+		t.Fatalf("writes up to %d and %v ahead, want all up to 5", writes.upTo, writes.ahead)
+	}
+}
@@ -0,0 +1,87 @@
+package crdtnode
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+)
+
+// merkleDepth is the depth of the binary Merkle tree over the keys, a key
+// belongs to the leaf of the first bits of its sha256.
+const merkleDepth = 8
+
+// MerkleLeaves is the number of leaves of the Merkle tree.
+const MerkleLeaves = 1 << merkleDepth
+
+type Digest [sha256.Size]byte
+
+func (d Digest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+// RowDigest is the digest of a key with its value, content type and
+// timestamp, replicas that converged have the same rows.
+func RowDigest(key string, row CrdtRowValue) Digest {
+	h := sha256.New()
+	h.Write(binary.AppendUvarint(nil, uint64(len(key))))
+	h.Write([]byte(key))
+	h.Write(binary.AppendUvarint(nil, uint64(len(row.Value))))
+	h.Write([]byte(row.Value))
+	h.Write(binary.AppendUvarint(nil, uint64(len(row.ContentType))))
+	h.Write([]byte(row.ContentType))
+	for _, t := range row.Timestamp {
+		h.Write(binary.AppendUvarint(nil, uint64(t)))
+	}
+	return Digest(h.Sum(nil))
+}
+
+// LeafOf is the leaf of the Merkle tree that key belongs to.
+func LeafOf(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return int(binary.BigEndian.Uint16(sum[:2]) >> (16 - merkleDepth))
+}
+
+// MerkleTree keeps the XOR of the digests of the rows of every leaf, so a
+// write updates its leaf without reading the other rows, and the hashes of
+// the inner nodes up to the root.
+type MerkleTree struct {
+	// nodes in heap order: the root is 0, the children of i are 2i+1 and
+	// 2i+2 and the leaves are the last MerkleLeaves
+	nodes [2*MerkleLeaves - 1]Digest
+}
+
+func NewMerkleTree() *MerkleTree {
+	t := &MerkleTree{}
+	for i := MerkleLeaves - 2; i >= 0; i-- {
+		t.rehash(i)
+	}
+	return t
+}
+
+// Toggle adds the digest of a row of key to the tree, or removes it if it
+// was added before.
+func (t *MerkleTree) Toggle(key string, row Digest) {
+	i := MerkleLeaves - 1 + LeafOf(key)
+	for j := range row {
+		t.nodes[i][j] ^= row[j]
+	}
+	for i > 0 {
+		i = (i - 1) / 2
+		t.rehash(i)
+	}
+}
+
+func (t *MerkleTree) rehash(i int) {
+	h := sha256.New()
+	h.Write(t.nodes[2*i+1][:])
+	h.Write(t.nodes[2*i+2][:])
+	t.nodes[i] = Digest(h.Sum(nil))
+}
+
+func (t *MerkleTree) Root() Digest {
+	return t.nodes[0]
+}
+
+func (t *MerkleTree) Leaf(leaf int) Digest {
+	return t.nodes[MerkleLeaves-1+leaf]
+}
@@ -0,0 +1,160 @@
+package crdtnode
+
+import (
+	"fmt"
+	"maps"
+	"testing"
+
+	opt "chadcrdt/internal/options"
+)
+
+type testWrite struct {
+	from NodeId
+	row  CrdtRow
+}
+
+// testWrites are writes of three replicas: a and b are concurrent writes of
+// x with as many writes seen, c saw b but not a, d and e are concurrent
+// writes of y and f is the only write of z.
+var testWrites = []testWrite{
+	{2, CrdtRow{Key: "x", Value: "a", Timestamp: VectorClock{0, 1, 0}}},
+	{1, CrdtRow{Key: "x", Value: "b", Timestamp: VectorClock{1, 0, 0}}},
+	{3, CrdtRow{Key: "x", Value: "c", Timestamp: VectorClock{1, 0, 1}}},
+	{3, CrdtRow{Key: "y", Value: "d", Timestamp: VectorClock{1, 0, 2}}},
+	{2, CrdtRow{Key: "y", Value: "e", ContentType: "application/octet-stream", Timestamp: VectorClock{1, 2, 0}}},
+	{1, CrdtRow{Key: "z", Value: "f", Timestamp: VectorClock{2, 0, 0}}},
+}
+
+func newTestActor() *CrdtActor {
+	return &CrdtActor{data: make(map[string]CrdtRowValue), tree: NewMerkleTree()}
+}
+
+// permutations calls f with every order of n writes.
+func permutations(n int, f func(order []int)) {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	var permute func(k int)
+	permute = func(k int) {
+		if k == n {
+			f(order)
+			return
+		}
+		for i := k; i < n; i++ {
+			order[k], order[i] = order[i], order[k]
+			permute(k + 1)
+			order[k], order[i] = order[i], order[k]
+		}
+	}
+	permute(0)
+}
+
+func TestApplyNewRowConverges(t *testing.T) {
+	opt.NodeCount = 3
+	want := map[string]string{"x": "c", "y": "e", "z": "f"}
+
+	var root Digest
+	permutations(len(testWrites), func(order []int) {
+		a := newTestActor()
+		for _, i := range order {
+			a.ApplyNewRow(testWrites[i].from, &testWrites[i].row)
+		}
+		values := make(map[string]string)
+		for key, row := range a.data {
+			values[key] = row.Value
+		}
+		if !maps.Equal(values, want) {
+			t.Fatalf("writes in order %v give %v, want %v", order, values, want)
+		}
+		if root == (Digest{}) {
+			root = a.tree.Root()
+		} else if a.tree.Root() != root {
+			t.Fatalf("writes in order %v give root %s, want %s", order, a.tree.Root(), root)
+		}
+	})
+}
+
+func TestLosesTo(t *testing.T) {
+	for _, test := range []struct {
+		row    CrdtRowValue
+		clock  VectorClock
+		origin NodeId
+		loses  bool
+	}{
+		{CrdtRowValue{Timestamp: VectorClock{1, 0, 0}, Origin: 1}, VectorClock{0, 1, 0}, 2, false},
+		{CrdtRowValue{Timestamp: VectorClock{0, 1, 0}, Origin: 2}, VectorClock{1, 0, 0}, 1, true},
+		{CrdtRowValue{Timestamp: VectorClock{0, 1, 0}, Origin: 2}, VectorClock{0, 0, 2}, 3, true},
+		{CrdtRowValue{Timestamp: VectorClock{0, 0, 2}, Origin: 3}, VectorClock{0, 1, 0}, 2, false},
+	} {
+		if loses := test.row.LosesTo(test.clock, test.origin); loses != test.loses {
+			t.Errorf("%v of node %d LosesTo(%v of node %d) = %t, want %t", test.row.Timestamp, test.row.Origin, test.clock, test.origin, loses, test.loses)
+		}
+	}
+}
+
+func TestMerkleTreeFindsDivergentKey(t *testing.T) {
+	opt.NodeCount = 3
+	a, b := newTestActor(), newTestActor()
+	for i := 0; i < 1000; i++ {
+		row := CrdtRow{Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprint(i), Timestamp: VectorClock{i + 1, 0, 0}}
+		a.ApplyNewRow(1, &row)
+	}
+	for i := 999; i >= 0; i-- {
+		row := CrdtRow{Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprint(i), Timestamp: VectorClock{i + 1, 0, 0}}
+		b.ApplyNewRow(1, &row)
+	}
+	if a.tree.Root() != b.tree.Root() {
+		t.Fatalf("the same rows give roots %s and %s", a.tree.Root(), b.tree.Root())
+	}
+	rebuilt := NewMerkleTree()
+	for key, row := range a.data {
+		rebuilt.Toggle(key, RowDigest(key, row))
+	}
+	if rebuilt.Root() != a.tree.Root() {
+		t.Fatalf("rows give root %s, the tree updated by writes %s", rebuilt.Root(), a.tree.Root())
+	}
+
+	// b misses a later write of key-42
+	row := CrdtRow{Key: "key-42", Value: "diverged", Timestamp: VectorClock{1001, 0, 0}}
+	a.ApplyNewRow(1, &row)
+	if a.tree.Root() == b.tree.Root() {
+		t.Fatalf("diverged replicas have the same root")
+	}
+	var leaves []int
+	for leaf := 0; leaf < MerkleLeaves; leaf++ {
+		if a.tree.Leaf(leaf) != b.tree.Leaf(leaf) {
+			leaves = append(leaves, leaf)
+		}
+	}
+	if len(leaves) != 1 || leaves[0] != LeafOf("key-42") {
+		t.Fatalf("divergent leaves %v, want [%d]", leaves, LeafOf("key-42"))
+	}
+	rowsA := leafRows(t, a, leaves[0])
+	rowsB := leafRows(t, b, leaves[0])
+	var keys []string
+	for key, digest := range rowsA.Rows {
+		if rowsB.Rows[key] != digest {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) != 1 || keys[0] != "key-42" || len(rowsA.Rows) != len(rowsB.Rows) {
+		t.Fatalf("divergent keys %v, want [key-42]", keys)
+	}
+
+	// the same write brings b back
+	b.ApplyNewRow(1, &row)
+	if a.tree.Root() != b.tree.Root() {
+		t.Fatalf("converged replicas have roots %s and %s", a.tree.Root(), b.tree.Root())
+	}
+}
+
+// leafRows returns the digests of the rows of leaf on a.
+func leafRows(t *testing.T, a *CrdtActor, leaf int) LeafResult {
+	t.Helper()
+	result, err := a.HandleGetLeaf(&GetLeafRequest{Leaf: leaf})
+	if err != nil {
+		t.Fatalf("HandleGetLeaf: %s", err)
+	}
+	return result.(LeafResult)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+
+	"chadcommon/audit"
+	"chadcommon/auth"
+	"chadcrdt/apps/crdtnode"
+	opt "chadcrdt/internal/options"
+	. "chadcrdt/internal/utils"
+)
+
+// authorize lets requests through to next if the user of the request passes
+// check, authentication is off without -auth-file.
+func authorize(next http.Handler, check func(*auth.Principal, *http.Request) bool) http.Handler {
+	if opt.Auth == nil {
+		return next
+	}
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		principal, err := opt.Auth.Authenticate(request)
+		if err != nil {
+			auditDenied(request, nil, audit.OutcomeUnauthenticated)
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="chadcrdt"`)
+			http.Error(writer, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !check(principal, request) {
+			auditDenied(request, principal, audit.OutcomeForbidden)
+			http.Error(writer, auth.ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(auth.WithPrincipal(request.Context(), principal)))
+	})
+}
+
+func adminOnly(principal *auth.Principal, _ *http.Request) bool {
+	return principal.IsAdmin()
+}
+
+// keyAccess checks the permission on the key of a /{id} route: reads for GET,
+// writes for PUT. POST runs an op such as stopReplication, which is for
+// admins only.
+func keyAccess(principal *auth.Principal, request *http.Request) bool {
+	key := request.PathValue("id")
+	switch request.Method {
+	case http.MethodGet, http.MethodHead:
+		return principal.CanRead(key)
+	case http.MethodPost:
+		return principal.IsAdmin()
+	}
+	return principal.CanWrite(key)
+}
+
+// auditDenied records a refused write of a key in the audit log, refused
+// reads and ops are not audited.
+func auditDenied(request *http.Request, principal *auth.Principal, outcome string) {
+	op := map[string]string{http.MethodPut: crdtnode.OpSet, http.MethodPatch: crdtnode.OpPatch}[request.Method]
+	if op == "" || request.PathValue("id") == "" {
+		return
+	}
+	Must(opt.Audit.Append(audit.Entry{Principal: principal.User(), Client: request.RemoteAddr, Op: op, Key: request.PathValue("id"), Outcome: outcome}))
+}
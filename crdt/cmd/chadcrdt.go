@@ -2,7 +2,10 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
 
+	"chadcommon/cluster"
 	"chadcrdt/apps/crdtnode"
 	opt "chadcrdt/internal/options"
 
@@ -16,18 +19,42 @@ func main() {
 	var options gen.NodeOptions
 
 	flag.Parse()
-	opt.ObserverPort = 4000 + opt.NodeId
-	opt.ApiPort = 5000 + opt.NodeId
+	if err := opt.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	observerHost, observerPort, err := cluster.SplitAddress(opt.Self().Observer)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	networkHost, networkPort, err := cluster.SplitAddress(opt.Self().Network)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	// create applications that must be started
 	apps := []gen.ApplicationBehavior{
-		observer.CreateApp(observer.Options{Port: uint16(opt.ObserverPort)}),
+		observer.CreateApp(observer.Options{Host: observerHost, Port: observerPort}),
 		crdtnode.CreateDbNode(),
 	}
 	options.Applications = apps
 
 	// set network options
 	options.Network.Cookie = opt.NodeCookie
+	options.Network.Acceptors = []gen.AcceptorOptions{
+		{Cookie: opt.NodeCookie, Host: networkHost, Port: networkPort, PortRange: 1},
+	}
+	if opt.Certs != nil {
+		// ergo verifies the certificates of other replicas with the system
+		// roots, which are read from SSL_CERT_FILE on first use
+		if opt.TLSCA != "" {
+			os.Setenv("SSL_CERT_FILE", opt.TLSCA)
+		}
+		options.CertManager = opt.CertManager
+		options.Network.Acceptors[0].CertManager = options.CertManager
+	}
 
     options.Log.DefaultLogger.IncludeBehavior = true
 
@@ -37,6 +64,18 @@ func main() {
 		panic(err)
 	}
 
+	if opt.Certs != nil {
+		if _, err := node.SpawnRegister("certreloader", factory_CertReloader, gen.ProcessOptions{}); err != nil {
+			panic(err)
+		}
+	}
+
+	// starting process Discovery, messages sent to other replicas before it
+	// added the routes are lost and retried by ReliableSend
+	if _, err := node.SpawnRegister("discovery", factory_Discovery, gen.ProcessOptions{}); err != nil {
+		panic(err)
+	}
+
 	// starting process HttpApi
 	if _, err := node.SpawnRegister("httpapi", factory_HttpApi, gen.ProcessOptions{}); err != nil {
 		panic(err)
@@ -0,0 +1,184 @@
+// Command crdtcli reads and writes keys of a chadcrdt cluster. Every replica
+// serves every request, without -node the first one that answers is used.
+//
+// Exit codes: 0 success, 1 error, 2 usage, 3 key not found, 4 replicas
+// differ, 5 cluster unavailable.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"chadcommon/certs"
+	"chadcommon/cluster"
+)
+
+const (
+	exitError       = 1
+	exitUsage       = 2
+	exitNotFound    = 3
+	exitDiverged    = 4
+	exitUnavailable = 5
+)
+
+const usage = `Usage: crdtcli [flags] <command> [args]
+
+Commands:
+  get <key>          read a key
+  set <key> <value>  write a key
+  op <op>            stopReplication or resumeReplication
+  verify             compare the data of the replicas and report the keys
+                     they differ in
+
+Flags:
+`
+
+var (
+	clusterFile = flag.String("cluster", os.Getenv("CHADCRDT_CLUSTER"), "cluster file, $CHADCRDT_CLUSTER by default")
+	endpoints   = flag.String("endpoints", "", "comma separated api addresses, overrides -cluster")
+	node        = flag.String("node", "", "talk to this node only, an api address or port")
+	output      = flag.String("o", "table", "output format: table or json")
+	timeout     = flag.Duration("timeout", 10*time.Second, "timeout of the whole command")
+	token       = flag.String("token", os.Getenv("CHADCRDT_TOKEN"), "api token, $CHADCRDT_TOKEN by default")
+	useTLS      = flag.Bool("tls", false, "use HTTPS, implied by the other -tls flags")
+	tlsCA       = flag.String("tls-ca", "", "CA certificates to verify the replicas with instead of the system roots")
+	tlsCert     = flag.String("tls-cert", "", "client certificate, for replicas started with -tls-client-auth")
+	tlsKey      = flag.String("tls-key", "", "private key of -tls-cert")
+)
+
+var (
+	scheme     = "http"
+	httpClient = http.DefaultClient
+)
+
+var (
+	errNotFound    = errors.New("key not found")
+	errUnavailable = errors.New("no replica answered")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || (*output != "table" && *output != "json") {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+	addresses, err := resolveEndpoints()
+	check(err)
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		config, err := certs.ClientConfig(*tlsCA, *tlsCert, *tlsKey)
+		check(err)
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		scheme, httpClient = "https", &http.Client{Transport: transport}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	command, args := flag.Arg(0), flag.Args()[1:]
+	switch {
+	case command == "get" && len(args) == 1:
+		body, err := send(ctx, addresses, http.MethodGet, "/"+url.PathEscape(args[0]), nil)
+		check(err)
+		var value string
+		check(json.Unmarshal(body, &value))
+		if *output == "json" {
+			json.NewEncoder(os.Stdout).Encode(map[string]string{"key": args[0], "value": value})
+		} else {
+			fmt.Println(value)
+		}
+	case command == "set" && len(args) == 2:
+		value, _ := json.Marshal(args[1])
+		_, err := send(ctx, addresses, http.MethodPut, "/"+url.PathEscape(args[0]), value)
+		check(err)
+	case command == "op" && len(args) == 1 && (args[0] == "stopReplication" || args[0] == "resumeReplication"):
+		op, _ := json.Marshal(args[0])
+		_, err := send(ctx, addresses, http.MethodPost, "/op", op)
+		check(err)
+	case command == "verify" && len(args) == 0:
+		verify(ctx, addresses)
+	default:
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// resolveEndpoints returns the api addresses to talk to, in order of
+// precedence -node, -endpoints, -cluster and the default local cluster.
+func resolveEndpoints() ([]string, error) {
+	switch {
+	case *node != "":
+		if _, err := strconv.Atoi(*node); err == nil {
+			return []string{"localhost:" + *node}, nil
+		}
+		return []string{*node}, nil
+	case *endpoints != "":
+		return strings.Split(*endpoints, ","), nil
+	case *clusterFile != "":
+		c, err := cluster.Load(*clusterFile)
+		return c.Endpoints(), err
+	}
+	return cluster.Default(3).Endpoints(), nil
+}
+
+// send tries the replicas in order until one answers.
+func send(ctx context.Context, addresses []string, method string, path string, body []byte) ([]byte, error) {
+	var lastErr error
+	for _, address := range addresses {
+		request, err := http.NewRequestWithContext(ctx, method, scheme+"://"+address+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		if *token != "" {
+			request.Header.Set("Authorization", "Bearer "+*token)
+		}
+		response, err := httpClient.Do(request)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := io.ReadAll(response.Body)
+		response.Body.Close()
+		switch {
+		case err != nil:
+			lastErr = err
+		case response.StatusCode == http.StatusNotFound:
+			return nil, errNotFound
+		case response.StatusCode != http.StatusOK:
+			return nil, fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(data)))
+		default:
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %w", errUnavailable, lastErr)
+}
+
+// check exits with the code matching err, if any.
+func check(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "crdtcli: %s\n", err)
+	switch {
+	case errors.Is(err, errNotFound):
+		os.Exit(exitNotFound)
+	case errors.Is(err, errUnavailable):
+		os.Exit(exitUnavailable)
+	}
+	os.Exit(exitError)
+}
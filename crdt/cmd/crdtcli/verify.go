@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// verifyAttempts and verifyInterval give replicas time to converge before
+// their differences are reported.
+const (
+	verifyAttempts = 3
+	verifyInterval = time.Second
+)
+
+// digest and leaf are the answers of GET /admin/digest and
+// GET /admin/digest/{leaf}.
+type digest struct {
+	Root   string   `json:"root"`
+	Clock  []int    `json:"clock"`
+	Leaves []string `json:"leaves"`
+}
+
+type leaf struct {
+	Leaf   int               `json:"leaf"`
+	Digest string            `json:"digest"`
+	Rows   map[string]string `json:"rows"`
+}
+
+type verifyResult struct {
+	Consistent bool              `json:"consistent"`
+	Roots      map[string]string `json:"roots"`
+	Clocks     map[string][]int  `json:"clocks"`
+	Leaves     []divergentLeaf   `json:"leaves,omitempty"`
+}
+
+// divergentLeaf is a leaf of the Merkle tree whose digests differ, Keys are
+// the keys of the leaf that differ with the digest of their row on every
+// replica, "-" if the replica does not have the key.
+type divergentLeaf struct {
+	Leaf int                          `json:"leaf"`
+	Keys map[string]map[string]string `json:"keys"`
+}
+
+// verify compares the Merkle trees of the replicas, a few times while they
+// differ, and reports the leaves and keys they differ in.
+func verify(ctx context.Context, addresses []string) {
+	var digests map[string]digest
+	for attempt := 1; ; attempt++ {
+		digests = make(map[string]digest, len(addresses))
+		for _, address := range addresses {
+			var d digest
+			check(query(ctx, address, "/admin/digest", &d))
+			digests[address] = d
+		}
+		if sameRoots(digests) || attempt == verifyAttempts {
+			break
+		}
+		select {
+		case <-time.After(verifyInterval):
+		case <-ctx.Done():
+			check(ctx.Err())
+		}
+	}
+	result := verifyResult{Consistent: sameRoots(digests), Roots: make(map[string]string), Clocks: make(map[string][]int)}
+	for address, d := range digests {
+		result.Roots[address], result.Clocks[address] = d.Root, d.Clock
+	}
+	if !result.Consistent {
+		first := digests[addresses[0]]
+		for i := range first.Leaves {
+			same := true
+			for _, d := range digests {
+				same = same && d.Leaves[i] == first.Leaves[i]
+			}
+			if !same {
+				result.Leaves = append(result.Leaves, divergentLeaf{Leaf: i, Keys: differingKeys(ctx, addresses, i)})
+			}
+		}
+	}
+	if *output == "json" {
+		json.NewEncoder(os.Stdout).Encode(result)
+	} else {
+		for _, address := range addresses {
+			fmt.Printf("%s  %s  %v\n", address, result.Roots[address], result.Clocks[address])
+		}
+		for _, l := range result.Leaves {
+			fmt.Printf("divergent leaf %d: %v\n", l.Leaf, slices.Sorted(maps.Keys(l.Keys)))
+		}
+	}
+	if !result.Consistent {
+		os.Exit(exitDiverged)
+	}
+}
+
+func sameRoots(digests map[string]digest) bool {
+	var root string
+	for _, d := range digests {
+		if root != "" && d.Root != root {
+			return false
+		}
+		root = d.Root
+	}
+	return true
+}
+
+// differingKeys are the keys of the leaf whose rows differ on the replicas.
+func differingKeys(ctx context.Context, addresses []string, i int) map[string]map[string]string {
+	leaves := make(map[string]leaf, len(addresses))
+	all := make(map[string]bool)
+	for _, address := range addresses {
+		var l leaf
+		check(query(ctx, address, "/admin/digest/"+strconv.Itoa(i), &l))
+		leaves[address] = l
+		for key := range l.Rows {
+			all[key] = true
+		}
+	}
+	keys := make(map[string]map[string]string)
+	for key := range all {
+		byReplica := make(map[string]string, len(addresses))
+		for address, l := range leaves {
+			byReplica[address] = "-"
+			if row, ok := l.Rows[key]; ok {
+				byReplica[address] = row
+			}
+		}
+		if len(slices.Compact(slices.Sorted(maps.Values(byReplica)))) > 1 {
+			keys[key] = byReplica
+		}
+	}
+	return keys
+}
+
+// query reads the JSON answer of a GET of path from a single replica.
+func query(ctx context.Context, address string, path string, result any) error {
+	body, err := send(ctx, []string{address}, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, result)
+}
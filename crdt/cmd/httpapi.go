@@ -1,11 +1,14 @@
 package main
 
 import (
+	"net"
 	"net/http"
+	"strconv"
 
 	"ergo.services/ergo/act"
 	"ergo.services/ergo/gen"
 	"ergo.services/ergo/meta"
+    "chadcommon/cluster"
     opt "chadcrdt/internal/options"
 )
 
@@ -15,6 +18,9 @@ func factory_HttpApi() gen.ProcessBehavior {
 
 type HttpApi struct {
 	act.Pool
+	// server serves the api with -tls-cert instead of the web server
+	// meta-process
+	server *http.Server
 }
 
 // Init invoked on a start this process.
@@ -32,14 +38,32 @@ func (w *HttpApi) Init(args ...any) (act.PoolOptions, error) {
 		return poolOptions, err
 	}
 
-	mux.Handle("/{id}", root)
+	mux.Handle("/{id}", authorize(root, keyAccess))
+	mux.Handle("GET /admin/digest", authorize(root, adminOnly))
+	mux.Handle("GET /admin/digest/{leaf}", authorize(root, adminOnly))
+	if opt.Audit != nil {
+		mux.Handle("GET /admin/audit", authorize(opt.Audit.Handler(), adminOnly))
+	}
 	w.Log().Info("started WebHandler to serve '/' (meta-process: %s)", rootid)
 
-	webOptions.Port = uint16(opt.ApiPort)
-	webOptions.Host = "localhost"
+	webOptions.Host, webOptions.Port, err = cluster.SplitAddress(opt.Self().Api)
+	if err != nil {
+		return poolOptions, err
+	}
 
 	webOptions.Handler = mux
 
+	if opt.Certs != nil {
+		address := net.JoinHostPort(webOptions.Host, strconv.Itoa(int(webOptions.Port)))
+		if err := w.serveTLS(address, webOptions.Handler); err != nil {
+			w.Log().Error("unable to start HTTPS server: %s", err)
+			return poolOptions, err
+		}
+		w.Log().Info("started HTTPS server: use https://%s/", address)
+		poolOptions.WorkerFactory = factory_HttpApiWebWorker
+		return poolOptions, nil
+	}
+
 	webserver, err := meta.CreateWebServer(webOptions)
 	if err != nil {
 		w.Log().Error("unable to create Web server meta-process: %s", err)
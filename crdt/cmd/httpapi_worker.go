@@ -1,12 +1,17 @@
 package main
 
 import (
+	"chadcommon/auth"
+	"chadcommon/content"
+	"chadcrdt/apps/crdtnode"
+	opt "chadcrdt/internal/options"
+	. "chadcrdt/internal/utils"
 	"encoding/json"
 	"ergo.services/ergo/act"
 	"ergo.services/ergo/gen"
 	"net/http"
-	"chadcrdt/apps/crdtnode"
-	. "chadcrdt/internal/utils"
+	"strconv"
+	"strings"
 )
 
 func factory_HttpApiWebWorker() gen.ProcessBehavior {
@@ -23,41 +28,96 @@ func (w *HttpApiWebWorker) Init(args ...any) error {
 }
 
 func (w *HttpApiWebWorker) HandleGet(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
-    key := request.PathValue("id")
+	if strings.HasPrefix(request.URL.Path, "/admin/digest") {
+		return w.handleDigest(writer, request)
+	}
+	key := request.PathValue("id")
 	w.Log().Info("got HTTP GET for key %s", key)
-    val := Must1(w.Call(gen.Atom("crdtactor"), crdtnode.GetValueRequest{Key: key}))
-    if _, ok := val.(crdtnode.KeyNotFound); ok {
-        writer.Header().Set("Content-Type", "text/plain")
-        writer.WriteHeader(404)
-        writer.Write([]byte("Key not found"))
-        return nil
-    }
+	val := Must1(w.Call(gen.Atom("crdtactor"), crdtnode.GetValueRequest{Key: key}))
+	if _, ok := val.(crdtnode.KeyNotFound); ok {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(404)
+		writer.Write([]byte("Key not found"))
+		return nil
+	}
+	row := val.(crdtnode.CrdtRowValue)
+	content.Write(writer, row.Value, row.ContentType)
+	return nil
+}
+
+// handleDigest serves GET /admin/digest with the crdtnode.DigestResult of
+// the replica and GET /admin/digest/{leaf} with the crdtnode.LeafResult of
+// a leaf.
+func (w *HttpApiWebWorker) handleDigest(writer http.ResponseWriter, request *http.Request) error {
+	var query any = crdtnode.GetDigestRequest{}
+	if request.PathValue("leaf") != "" {
+		leaf, err := strconv.Atoi(request.PathValue("leaf"))
+		if err != nil {
+			http.Error(writer, "Invalid leaf", http.StatusBadRequest)
+			return nil
+		}
+		query = crdtnode.GetLeafRequest{Leaf: leaf}
+	}
+	res := Must1(w.Call(gen.Atom("crdtactor"), query))
+	if _, ok := res.(crdtnode.InvalidLeaf); ok {
+		http.Error(writer, "Leaf is out of range", http.StatusBadRequest)
+		return nil
+	}
 	writer.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(writer).Encode(val)
+	json.NewEncoder(writer).Encode(res)
 	return nil
 }
 
 func (w *HttpApiWebWorker) HandlePut(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
-    key := request.PathValue("id");
-    var val string
-    json.NewDecoder(request.Body).Decode(&val)
-	w.Log().Info("got HTTP Put for key %s with value %s", key, val)
-    Must(w.Send(gen.Atom("crdtactor"), crdtnode.NewClientRowMessage{Key: key, Value: val}))
+	key := request.PathValue("id")
+	val, contentType, err := content.Read(writer, request, opt.MaxValueBytes())
+	if err != nil {
+		content.Error(writer, err)
+		return nil
+	}
+	w.Log().Info("got HTTP Put for key %s with a %d byte value", key, len(val))
+	principal := auth.FromContext(request.Context()).User()
+	Must(w.Send(gen.Atom("crdtactor"), crdtnode.NewClientRowMessage{Key: key, Value: val, ContentType: contentType, Op: crdtnode.OpSet, Principal: principal, Client: request.RemoteAddr}))
 
 	writer.WriteHeader(200)
 	return nil
 }
 
+// HandlePatch serves PATCH /{id} with a JSON Merge Patch or JSON Patch body
+// and answers with the resulting document.
+func (w *HttpApiWebWorker) HandlePatch(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
+	key := request.PathValue("id")
+	patch, contentType, err := content.ReadPatch(writer, request, opt.MaxValueBytes())
+	if err != nil {
+		content.Error(writer, err)
+		return nil
+	}
+	w.Log().Info("got HTTP Patch for key %s with %s", key, contentType)
+	principal := auth.FromContext(request.Context()).User()
+	res := Must1(w.Call(gen.Atom("crdtactor"), crdtnode.PatchRowRequest{Key: key, Patch: patch, ContentType: contentType, Principal: principal, Client: request.RemoteAddr}))
+	switch failed := res.(type) {
+	case crdtnode.InvalidPatch:
+		http.Error(writer, failed.Reason, http.StatusBadRequest)
+		return nil
+	case crdtnode.PatchFailed:
+		http.Error(writer, failed.Reason, http.StatusConflict)
+		return nil
+	}
+	row := res.(crdtnode.CrdtRowValue)
+	content.Write(writer, row.Value, row.ContentType)
+	return nil
+}
+
 func (w *HttpApiWebWorker) HandlePost(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
-    // key := request.PathValue("id");
-    var val string
-    json.NewDecoder(request.Body).Decode(&val)
+	// key := request.PathValue("id");
+	var val string
+	json.NewDecoder(request.Body).Decode(&val)
 	w.Log().Info("got HTTP Put for op %s", val)
-    if val == "stopReplication" {
-        Must(w.Send(gen.Atom("crdtactor"), crdtnode.StopReplicationMessage{}))
-    } else if val == "resumeReplication" {
-        Must(w.Send(gen.Atom("crdtactor"), crdtnode.ResumeReplicationMessage{}))
-    }
+	if val == "stopReplication" {
+		Must(w.Send(gen.Atom("crdtactor"), crdtnode.StopReplicationMessage{}))
+	} else if val == "resumeReplication" {
+		Must(w.Send(gen.Atom("crdtactor"), crdtnode.ResumeReplicationMessage{}))
+	}
 
 	writer.WriteHeader(200)
 	return nil
@@ -0,0 +1,130 @@
+package options
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"chadcommon/cluster"
+	"chadcommon/discovery"
+)
+
+var (
+	// Resolver finds the replicas of the cluster, it is set by Validate.
+	Resolver discovery.Resolver
+
+	clusterMutex sync.RWMutex
+	current      cluster.Cluster
+	self         cluster.Node
+)
+
+func init() {
+	cluster.NamePrefix = "chadcrdt-node"
+}
+
+// fixedIds fails resolutions with ids other than 1..count, vector clocks are
+// indexed by node id so the replicas can not change.
+type fixedIds struct {
+	discovery.Resolver
+	count int
+}
+
+func (r fixedIds) Resolve(ctx context.Context) (cluster.Cluster, error) {
+	c, err := r.Resolver.Resolve(ctx)
+	if err != nil {
+		return c, err
+	}
+	ids := c.Ids()
+	if r.count == 0 {
+		r.count = len(ids)
+	}
+	for i, id := range ids {
+		if id != i+1 || len(ids) != r.count {
+			return c, fmt.Errorf("replica ids must be 1..%d, got %v", r.count, ids)
+		}
+	}
+	return c, nil
+}
+
+// newResolver returns the resolver chosen by -discovery-srv, -cluster or the
+// static cluster of -node-count local replicas.
+func newResolver() (discovery.Resolver, error) {
+	switch {
+	case DiscoverySrv != "":
+		var lookup discovery.Lookup
+		if SrvRecords != "" {
+			records, err := discovery.LoadRecords(SrvRecords)
+			if err != nil {
+				return nil, err
+			}
+			lookup = records
+		}
+		return discovery.NewSRV(DiscoverySrv, lookup), nil
+	case ClusterFile != "":
+		c, err := cluster.Load(ClusterFile)
+		return discovery.Static{Cluster: c}, err
+	}
+	return discovery.Static{Cluster: cluster.Default(NodeCount)}, nil
+}
+
+func loadCluster() error {
+	resolver, err := newResolver()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := fixedIds{Resolver: resolver}.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+	NodeCount = len(c.Nodes)
+	Resolver = fixedIds{Resolver: resolver, count: NodeCount}
+	var ok bool
+	if self, ok = c.Node(NodeId); !ok {
+		return fmt.Errorf("node %d is not in the cluster", NodeId)
+	}
+	if ApiPort != 0 {
+		self.Api = overridePort(self.Api, ApiPort)
+	}
+	if ObserverPort != 0 {
+		self.Observer = overridePort(self.Observer, ObserverPort)
+	}
+	SetCluster(c)
+	return nil
+}
+
+func overridePort(address string, port int) string {
+	host, _, _ := net.SplitHostPort(address)
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Cluster returns the replicas last resolved.
+func Cluster() cluster.Cluster {
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+	return current
+}
+
+// SetCluster replaces the replicas after they are resolved again.
+func SetCluster(c cluster.Cluster) {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+	current = c
+}
+
+// Self is this replica with the ports given by flags.
+func Self() cluster.Node {
+	return self
+}
+
+func MakeNodeName(id int) string {
+	if id == NodeId {
+		return self.Name
+	}
+	node, _ := Cluster().Node(id)
+	return node.Name
+}
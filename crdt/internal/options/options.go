@@ -3,7 +3,13 @@ package options
 import (
 	"flag"
 	"fmt"
+	"time"
 
+	"chadcommon/audit"
+	"chadcommon/auth"
+	"chadcommon/certs"
+
+	"ergo.services/ergo/gen"
 	"ergo.services/ergo/lib"
 )
 
@@ -13,16 +19,108 @@ var (
 	ObserverPort int
 	ApiPort      int
 	NodeCount    int
+
+	ClusterFile       string
+	DiscoverySrv      string
+	SrvRecords        string
+	DiscoveryInterval time.Duration
+
+	TLSCert           string
+	TLSKey            string
+	TLSCA             string
+	TLSClientAuth     bool
+	TLSReloadInterval time.Duration
+
+	// Certs are loaded by Validate if -tls-cert is given, nil otherwise.
+	Certs *certs.Certs
+	// CertManager serves the current certificate of Certs to ergo.
+	CertManager gen.CertManager
+
+	AuthFile string
+	// Auth is loaded by Validate from -auth-file, nil if it is not given.
+	Auth *auth.Authorizer
+
+	AuditLog      string
+	AuditMaxSize  int
+	AuditMaxFiles int
+	// Audit is opened by Validate from -audit-log, nil if it is not given.
+	Audit *audit.Log
+
+	MaxValueSize int
 )
 
 func init() {
 	flag.IntVar(&NodeId, "node-id", 1, "node id")
 	flag.StringVar(&NodeCookie, "cookie", lib.RandomString(16), "a secret cookie for the network messaging")
-	flag.IntVar(&ObserverPort, "observer-port", 4000, "port for observer")
-	flag.IntVar(&ApiPort, "api-port", 5000, "port for api")
-	flag.IntVar(&NodeCount, "node-count", 3, "amount of replicas")
+	flag.IntVar(&ObserverPort, "observer-port", 0, "port for observer, overrides the one of the cluster")
+	flag.IntVar(&ApiPort, "api-port", 0, "port for api, overrides the one of the cluster")
+	flag.IntVar(&NodeCount, "node-count", 3, "amount of replicas, ignored with -cluster")
+	flag.StringVar(&ClusterFile, "cluster", "", "cluster file with the names and addresses of the replicas")
+	flag.StringVar(&DiscoverySrv, "discovery-srv", "", "find the replicas in the DNS SRV records of this domain instead of -cluster")
+	flag.StringVar(&SrvRecords, "srv-records", "", "file with the SRV records for -discovery-srv, instead of DNS")
+	flag.DurationVar(&DiscoveryInterval, "discovery-interval", 30*time.Second, "interval of resolving the replicas again")
+	flag.StringVar(&TLSCert, "tls-cert", "", "certificate of the replica, enables HTTPS on the api and TLS between replicas")
+	flag.StringVar(&TLSKey, "tls-key", "", "private key of -tls-cert")
+	flag.StringVar(&TLSCA, "tls-ca", "", "CA certificates that replica and client certificates are verified with")
+	flag.BoolVar(&TLSClientAuth, "tls-client-auth", false, "require api clients to present a certificate signed by -tls-ca")
+	flag.DurationVar(&TLSReloadInterval, "tls-reload-interval", time.Minute, "interval of checking the certificate files for changes")
+	flag.StringVar(&AuthFile, "auth-file", "", "users, tokens and roles, enables authentication of api requests")
+	flag.StringVar(&AuditLog, "audit-log", "", "file of the audit log of client writes, auditing is off if empty")
+	flag.IntVar(&AuditMaxSize, "audit-max-size", 100, "size in megabytes at which the audit log is rotated")
+	flag.IntVar(&AuditMaxFiles, "audit-max-files", 10, "amount of rotated audit log files to keep")
+
+	flag.IntVar(&MaxValueSize, "max-value-size", 1024, "size in kilobytes of the largest value the api accepts")
+}
+
+// Validate checks combinations of flags and loads the cluster, call it after
+// flag.Parse.
+func Validate() error {
+	if DiscoverySrv != "" && ClusterFile != "" {
+		return fmt.Errorf("-discovery-srv and -cluster are exclusive")
+	}
+	if MaxValueSize <= 0 {
+		return fmt.Errorf("-max-value-size must be positive")
+	}
+	if err := loadCerts(); err != nil {
+		return err
+	}
+	if AuthFile != "" {
+		var err error
+		if Auth, err = auth.Load(AuthFile); err != nil {
+			return err
+		}
+	}
+	if AuditLog != "" {
+		var err error
+		if Audit, err = audit.Open(AuditLog, int64(AuditMaxSize)<<20, AuditMaxFiles); err != nil {
+			return err
+		}
+	}
+	return loadCluster()
+}
+
+func loadCerts() error {
+	if (TLSCert == "") != (TLSKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	if TLSCert == "" {
+		if TLSCA != "" || TLSClientAuth {
+			return fmt.Errorf("-tls-ca and -tls-client-auth require -tls-cert")
+		}
+		return nil
+	}
+	if TLSClientAuth && TLSCA == "" {
+		return fmt.Errorf("-tls-client-auth requires -tls-ca")
+	}
+	var err error
+	if Certs, err = certs.Load(TLSCert, TLSKey, TLSCA); err != nil {
+		return err
+	}
+	CertManager = gen.CreateCertManager(Certs.Certificate())
+	return nil
 }
 
-func MakeNodeName(id int) string {
-    return fmt.Sprintf("chaddb-node-%d@localhost", id)
+// MaxValueBytes is -max-value-size in bytes.
+func MaxValueBytes() int64 {
+	return int64(MaxValueSize) << 10
 }
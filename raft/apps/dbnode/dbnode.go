@@ -4,11 +4,13 @@ import (
 	"ergo.services/ergo/gen"
 )
 
-func CreateDbNode() gen.ApplicationBehavior {
-	return &DbNode{}
+func CreateDbNode(options Options) gen.ApplicationBehavior {
+	return &DbNode{options: options}
 }
 
-type DbNode struct{}
+type DbNode struct {
+	options Options
+}
 
 // Load invoked on loading application using method ApplicationLoad of gen.Node interface.
 func (app *DbNode) Load(node gen.Node, args ...any) (gen.ApplicationSpec, error) {
@@ -17,13 +19,15 @@ func (app *DbNode) Load(node gen.Node, args ...any) (gen.ApplicationSpec, error)
 		Description: "description of this application",
 		Mode:        gen.ApplicationModeTransient,
 		Group: []gen.ApplicationMemberSpec{
-			{
-				Name:    "raftsup",
-				Factory: factory_RaftSup,
-			},
+			// storage goes first, raftactor asks it what was applied
 			{
 				Name:    "storagesup",
 				Factory: factory_StorageSup,
+				Args:    []any{app.options.StateMachine},
+			},
+			{
+				Name:    "raftsup",
+				Factory: factory_RaftSup,
 			},
 		},
 	}, nil
@@ -0,0 +1,145 @@
+package dbnode
+
+import (
+	"math/rand"
+	"time"
+
+	"chaddb/consensus"
+	opt "chaddb/internal/options"
+
+	. "chaddb/internal/utils"
+	"ergo.services/ergo/gen"
+)
+
+// Faults are injected into the raft actor to reproduce partitions, slow
+// links, stalls and crashes in tests, the raft counterpart of the CRDT
+// node's stopReplication.
+type Faults struct {
+	// Outgoing and Incoming faults by peer id, peer 0 stands for every peer
+	// without an entry of its own.
+	Outgoing map[int]LinkFaults `json:"outgoing,omitempty"`
+	Incoming map[int]LinkFaults `json:"incoming,omitempty"`
+	// PauseHeartbeats stops the periodic AppendEntries of a leader, entries
+	// are still replicated as they are proposed.
+	PauseHeartbeats bool `json:"pauseHeartbeats"`
+	// PauseApply queues committed entries instead of applying them, so the
+	// proposers wait for their results.
+	PauseApply bool `json:"pauseApply"`
+	// Crashed makes the node ignore messages and timers and refuse proposals.
+	// Volatile state is lost: clearing it reopens the state machine, so a
+	// memory engine starts empty, and restarts raft from the persisted term,
+	// vote and log, which restores the snapshot and reapplies the entries the
+	// state machine has not recorded.
+	Crashed bool `json:"crashed"`
+}
+
+// LinkFaults apply to every message on a link, Drop and Duplicate are
+// probabilities.
+type LinkFaults struct {
+	Drop      float64 `json:"drop,omitempty"`
+	Duplicate float64 `json:"duplicate,omitempty"`
+	DelayMs   int     `json:"delayMs,omitempty"`
+}
+
+// GetFaults is answered with the current Faults.
+type GetFaults struct {
+}
+
+// SetFaults replaces all faults and is answered with the new Faults.
+type SetFaults struct {
+	Faults Faults
+}
+
+// delayedMessage is an incoming message held back by a delay fault, it is
+// dropped if the node crashed in the meantime.
+type delayedMessage struct {
+	Incarnation int
+	Message     any
+}
+
+func (f Faults) active() bool {
+	return len(f.Outgoing) > 0 || len(f.Incoming) > 0 || f.PauseHeartbeats || f.PauseApply || f.Crashed
+}
+
+func (f Faults) link(links map[int]LinkFaults, peer int) LinkFaults {
+	if link, ok := links[peer]; ok {
+		return link
+	}
+	return links[0]
+}
+
+// copies is how many times a message on the link is delivered.
+func (l LinkFaults) copies(random *rand.Rand) int {
+	if random.Float64() < l.Drop {
+		return 0
+	}
+	if random.Float64() < l.Duplicate {
+		return 2
+	}
+	return 1
+}
+
+func (a *RaftActor) setFaults(faults Faults) {
+	a.Log().Warning("fault injection: %+v", faults)
+	previous := a.faults
+	a.faults = faults
+	switch {
+	case faults.Crashed && !previous.Crashed:
+		a.crash()
+	case !faults.Crashed && previous.Crashed:
+		Must1(a.Call(gen.Atom("storageactor"), StorageReopen{}))
+		Must(a.startNode())
+	}
+	if previous.PauseHeartbeats && !faults.PauseHeartbeats && a.heartbeatSkipped {
+		a.heartbeatSkipped = false
+		a.node.Tick(consensus.HeartbeatTimer)
+	}
+	if !faults.PauseApply && !faults.Crashed {
+		committed := a.unapplied
+		a.unapplied = nil
+		for _, entry := range committed {
+			a.apply(entry)
+		}
+	}
+}
+
+// crash drops all volatile state and fails pending requests the way a
+// process crash would for clients.
+func (a *RaftActor) crash() {
+	for kind, timer := range a.timers {
+		timer.cancel()
+		delete(a.timers, kind)
+	}
+	for req := range a.pending {
+		a.respond(req, consensus.ShuttingDown{})
+	}
+	a.unapplied = nil
+	a.heartbeatSkipped = false
+	a.appendSent = make(map[int]time.Time)
+	a.incarnation++
+}
+
+// receive applies incoming faults to a message from a peer and reports
+// whether it is delivered now.
+func (a *RaftActor) receive(from gen.PID, message any) bool {
+	if a.faults.Crashed {
+		return false
+	}
+	peer, ok := opt.ParseNodeName(string(from.Node))
+	if !ok {
+		return true
+	}
+	link := a.faults.link(a.faults.Incoming, peer)
+	copies := link.copies(a.random)
+	if link.DelayMs > 0 {
+		for range copies {
+			Must1(a.SendAfter(a.PID(), delayedMessage{Incarnation: a.incarnation, Message: message},
+				time.Duration(link.DelayMs)*time.Millisecond))
+		}
+		return false
+	}
+	for range copies - 1 {
+		a.node.Step(message)
+	}
+	return copies > 0
+}
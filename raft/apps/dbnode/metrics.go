@@ -0,0 +1,39 @@
+package dbnode
+
+import (
+	"chaddb/consensus"
+	"chaddb/internal/metrics"
+)
+
+var (
+	termMetric       = metrics.NewGauge("chaddb_raft_term", "Current raft term.")
+	roleMetric       = metrics.NewGaugeVec("chaddb_raft_role", "1 for the current raft role of this node, 0 for others.", "role")
+	commitIdMetric   = metrics.NewGauge("chaddb_raft_commit_index", "Index of the last committed log entry.")
+	appliedIdMetric  = metrics.NewGauge("chaddb_raft_applied_index", "Index of the last log entry applied to storage.")
+	logEntriesMetric = metrics.NewGauge("chaddb_raft_log_entries", "Number of entries in the raft log.")
+	electionsMetric  = metrics.NewCounterVec("chaddb_raft_elections_total", "Elections started by this node by result.", "result")
+	proposalMetric   = metrics.NewHistogram("chaddb_raft_proposal_duration_seconds", "Time from accepting a proposal on the leader until it is applied.", metrics.DefBuckets)
+	appendRpcMetric  = metrics.NewHistogramVec("chaddb_raft_append_entries_duration_seconds", "AppendEntries round trip latency per peer.", metrics.DefBuckets, "peer")
+	appendFailMetric = metrics.NewCounterVec("chaddb_raft_append_entries_failures_total", "Failed AppendEntries sends per peer.", "peer")
+)
+
+// reportMetrics refreshes gauges derived from the raft node state.
+func (a *RaftActor) reportMetrics() {
+	status := a.node.Status()
+	termMetric.Set(float64(status.Term))
+	for _, role := range []consensus.Role{consensus.Follower, consensus.Candidate, consensus.Leader, consensus.Learner} {
+		active := 0.0
+		if role.String() == status.Role {
+			active = 1
+		}
+		roleMetric.WithLabelValues(role.String()).Set(active)
+	}
+	commitIdMetric.Set(float64(status.CommitId))
+	appliedIdMetric.Set(float64(status.LastApplied))
+	logEntriesMetric.Set(float64(status.LastLogId + 1))
+
+	stats := a.node.Stats()
+	electionsMetric.WithLabelValues("won").Add(float64(stats.ElectionsWon - a.stats.ElectionsWon))
+	electionsMetric.WithLabelValues("lost").Add(float64(stats.ElectionsLost - a.stats.ElectionsLost))
+	a.stats = stats
+}
@@ -1,9 +1,11 @@
 package dbnode
 
 import (
+	"chaddb/consensus"
 	opt "chaddb/internal/options"
+	"fmt"
 	"math/rand"
-	"sync"
+	"strconv"
 	"time"
 
 	. "chaddb/internal/utils"
@@ -16,291 +18,406 @@ func factory_RaftActor() gen.ProcessBehavior {
 	return &RaftActor{}
 }
 
+// RaftActor hosts consensus.Node: raft messages travel between raftactor
+// processes of the nodes, timers are SendAfter to itself and committed
+// entries are applied by storageactor.
 type RaftActor struct {
 	act.Actor
-	role           Role
-	term           int
-	cancelElection *gen.CancelFunc
-	votedFor       int
-	lastApplied    int
-
-	commitId       int
-	log            []LogEntry
-	nodeToCommitId map[int]int
-
-	addEntryQueue []AddEntryQueueEntry
+	node     *consensus.Node
+	raftLog  *consensus.RaftLog
+	timers   map[consensus.TimerKind]raftTimer
+	timerSeq int
+	stats    consensus.Stats
+
+	appendSent map[int]time.Time
+	// requests answered once the operation they started completes
+	pending map[*PendingRequest]struct{}
+
+	faults           Faults
+	random           *rand.Rand
+	unapplied        []consensus.Committed
+	heartbeatSkipped bool
+	// incarnation changes with every simulated crash
+	incarnation int
+	// applied is the id of the last entry given to the state machine
+	applied int
 }
 
-type AddEntryQueueEntry struct {
-	From gen.PID
-	Ref  gen.Ref
-	Id   int
+type raftTimer struct {
+	seq    int
+	cancel gen.CancelFunc
 }
 
-type Role int
-
-const (
-	Follower Role = iota
-	Candidate
-	Leader
-)
-
-type LogEntry struct {
-	Id    int
-	Term  int
-	Key   string
-    Tombstone bool
-	Value string
+// TimerFired is sent by the actor to itself, Seq tells apart timers replaced
+// after they were scheduled.
+type TimerFired struct {
+	Kind consensus.TimerKind
+	Seq  int
 }
 
-type ActorMessage int
-
-const (
-	StartElection ActorMessage = iota
-	SendAppendEntries
-)
-
-func (a *RaftActor) Init(args ...any) error {
-	a.Log().Info("started process with name %s and args %v", a.Name(), args)
-
-    Must(edf.RegisterTypeOf(LogEntry{}))
-    Must(edf.RegisterTypeOf(AppendEntries{}))
-    Must(edf.RegisterTypeOf(AppendEntriesResult{}))
-	Must(edf.RegisterTypeOf(RequestVote{}))
+// PendingRequest is a call that is answered asynchronously once the
+// operation it started completes.
+type PendingRequest struct {
+	From  gen.PID
+	Ref   gen.Ref
+	Start time.Time
+}
 
-	a.nodeToCommitId = make(map[int]int)
+// AddEntry proposes a command for the state machine, the leader answers with
+// the result of applying it once it is committed.
+type AddEntry struct {
+	Command []byte
+}
 
-	a.term = 0
-    a.commitId = -1
-	a.FollowerInit()
+type GetMembership struct {
+}
 
-	return nil
+// GetStatus is answered with consensus.RaftStatus.
+type GetStatus struct {
 }
 
-func (a *RaftActor) FollowerInit() {
-    a.Log().Info("Role changed: Follower")
-	a.role = Follower
+// GetLog is answered with log entries From..To inclusive, at most
+// consensus.MaxLogEntries of them.
+type GetLog struct {
+	From int
+	To   int
+}
 
-	a.ScheduleElection()
+// TransferLeadership hands leadership over to the voter To. The response is
+// sent once To becomes the leader or after an election timeout.
+type TransferLeadership struct {
+	To int
 }
 
-func (a *RaftActor) ScheduleElection() {
-    if a.role != Follower {
-        a.Log().Info("Role changed: Follower")
-    }
-    a.role = Follower
-	if a.cancelElection != nil {
-		(*a.cancelElection)()
-        // a.Log().Info("Election rescheduled")
-	}
-	leaderTimeout := time.Duration((rand.Intn(1000) + 10000) * 1000 * 1000)
-	cancel := Must1(a.SendAfter(a.PID(), StartElection, leaderTimeout))
-	a.cancelElection = &cancel
+// PrepareShutdown makes the node stop accepting proposals, wait for pending
+// ones to commit, hand over leadership and sync the log. The response is sent
+// when done; whatever is left after Timeout is failed.
+type PrepareShutdown struct {
+	Timeout time.Duration
 }
 
-func (a *RaftActor) HandleMessage(from gen.PID, message any) error {
-	switch message.(type) {
-	case ActorMessage:
-		if message == StartElection {
-			return a.Election()
-		} else if message == SendAppendEntries {
-			return a.SendAppendEntries()
-		}
+// BootstrapMembership is the configuration used until the log contains a
+// configuration entry: the nodes of -initial-voters, or all nodes of the
+// cluster. Nodes started with -join have no configuration and wait for the
+// leader to replicate one to them.
+func BootstrapMembership() consensus.Membership {
+	if opt.Join {
+		return consensus.Membership{}
 	}
-
-	return nil
+	if opt.Voters != nil {
+		return consensus.Membership{Voters: opt.Voters}
+	}
+	return consensus.Membership{Voters: opt.Cluster().Ids()}
 }
 
-func (a *RaftActor) Election() error {
-    a.Log().Info("Started Election")
-    a.Log().Info("Role changed: Candidate")
-	a.role = Candidate
-	a.term++
-	a.votedFor = opt.NodeId
-	votes := 1
-
-	var wg sync.WaitGroup
-	wg.Add(opt.NodeCount - 1)
-	for i := 1; i <= opt.NodeCount; i++ {
-		if i == opt.NodeId {
-			continue
-		}
-		go func() {
-			defer wg.Done()
-			res, err := a.Call(gen.ProcessID{
-				Name: "raftactor",
-				Node: gen.Atom(opt.MakeNodeName(i))},
-				RequestVote{Term: a.term, CommitId: a.commitId})
-			if err != nil {
-				a.Log().Warning("Error while sending RequestVote to node %d: %s", i, err)
-			} else if res.(bool) {
-				votes += 1
-			}
-		}()
-	}
-	wg.Wait()
+func (a *RaftActor) Init(args ...any) error {
+	a.Log().Info("started process with name %s and args %v", a.Name(), args)
 
-	if votes <= (opt.NodeCount - votes) {
-        a.Log().Info("election failed with %d votes", votes)
-		a.ScheduleElection()
-		return nil
+	Must(edf.RegisterTypeOf(consensus.Membership{}))
+	Must(edf.RegisterTypeOf(consensus.LogEntry{}))
+	Must(edf.RegisterTypeOf(consensus.Snapshot{}))
+	Must(edf.RegisterTypeOf(consensus.InstallSnapshot{}))
+	Must(edf.RegisterTypeOf(consensus.AppendEntries{}))
+	Must(edf.RegisterTypeOf(consensus.AppendEntriesResult{}))
+	Must(edf.RegisterTypeOf(consensus.RequestVote{}))
+	Must(edf.RegisterTypeOf(consensus.RequestVoteResult{}))
+	Must(edf.RegisterTypeOf(consensus.TimeoutNow{}))
+
+	a.timers = make(map[consensus.TimerKind]raftTimer)
+	a.appendSent = make(map[int]time.Time)
+	a.pending = make(map[*PendingRequest]struct{})
+	a.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	if err := a.startNode(); err != nil {
+		return err
 	}
-    a.Log().Info("election success with term %d", a.term)
-    a.Log().Info("Role changed: Leader")
-    a.role = Leader
-    a.ScheduleAppendEntries()
+	a.reportMetrics()
 
 	return nil
 }
 
-func (a *RaftActor) ScheduleAppendEntries() error {
-	leaderTimeout := time.Duration(3000 * 1000 * 1000)
-	Must1(a.SendAfter(a.PID(), SendAppendEntries, leaderTimeout))
+// startNode creates the consensus node from the persisted state, at start
+// and after a simulated crash.
+func (a *RaftActor) startNode() error {
+	config := consensus.Config{
+		Id:        opt.NodeId,
+		Bootstrap: BootstrapMembership(),
+		Logger:    a.Log(),
+	}
+	if a.node != nil {
+		state, snapshot, entries := a.node.Persisted()
+		config.Storage = a.raftLog
+		config.State = state
+		config.Snapshot = snapshot
+		config.Entries = entries
+	} else if opt.DataDir != "" {
+		raftLog, state, snapshot, entries, err := consensus.OpenRaftLog(opt.DataDir)
+		if err != nil {
+			a.Log().Error("unable to open raft log in %s: %s", opt.DataDir, err)
+			return err
+		}
+		a.raftLog = raftLog
+		config.Storage = raftLog
+		config.State = state
+		config.Snapshot = snapshot
+		config.Entries = entries
+		a.Log().Info("loaded %d log entries with term %d from %s", len(entries), state.Term, opt.DataDir)
+	}
+	// persistent storage engines already hold a prefix of the log, others
+	// are restored from the snapshot by the first Ready
+	config.Applied = Must1(a.Call(gen.Atom("storageactor"), StorageAppliedIndex{})).(int)
+	a.applied = config.Applied
+
+	node, err := consensus.NewNode(config)
+	if err != nil {
+		return err
+	}
+	a.node = node
+	// election counters start over with the node
+	a.stats = consensus.Stats{}
+	a.processReady()
 	return nil
 }
 
-type RequestVote struct {
-	NodeId   int
-	Term     int
-	CommitId int
+func (a *RaftActor) Terminate(reason error) {
+	if err := a.raftLog.Close(); err != nil {
+		a.Log().Error("unable to close raft log: %s", err)
+	}
 }
 
-type AppendEntries struct {
-	Entries  []LogEntry
-	CommitId int
-}
+func (a *RaftActor) HandleMessage(from gen.PID, message any) error {
+	defer a.reportMetrics()
+	defer a.processReady()
+	switch msg := message.(type) {
+	case TimerFired:
+		timer, ok := a.timers[msg.Kind]
+		if !ok || timer.seq != msg.Seq {
+			return nil
+		}
+		delete(a.timers, msg.Kind)
+		if msg.Kind == consensus.HeartbeatTimer && a.faults.PauseHeartbeats {
+			a.heartbeatSkipped = true
+			return nil
+		}
+		a.node.Tick(msg.Kind)
+	case delayedMessage:
+		if msg.Incarnation == a.incarnation && !a.faults.Crashed {
+			a.step(msg.Message)
+		}
+	default:
+		if a.receive(from, message) {
+			a.step(message)
+		}
+	}
 
-type AppendEntriesResult struct {
-	CommitId int
+	return nil
 }
 
-type AddEntry struct {
-	Key   string
-	Value string
-    Tombstone bool
+func (a *RaftActor) step(message any) {
+	if result, ok := message.(consensus.AppendEntriesResult); ok {
+		if sent, ok := a.appendSent[result.NodeId]; ok {
+			appendRpcMetric.WithLabelValues(strconv.Itoa(result.NodeId)).Observe(time.Since(sent).Seconds())
+			delete(a.appendSent, result.NodeId)
+		}
+	}
+	a.node.Step(message)
 }
 
 func (a *RaftActor) HandleCall(from gen.PID, ref gen.Ref, request any) (any, error) {
-    // a.Log().Info("Handling call")
+	defer a.reportMetrics()
+	defer a.processReady()
+	pending := &PendingRequest{From: from, Ref: ref, Start: time.Now()}
+	switch val := request.(type) {
+	case GetFaults:
+		return a.faults, nil
+	case SetFaults:
+		a.setFaults(val.Faults)
+		return a.faults, nil
+	case AddEntry, consensus.ChangeMembership, TransferLeadership, PrepareShutdown:
+		if a.faults.Crashed {
+			return consensus.ShuttingDown{}, nil
+		}
+	}
 	switch val := request.(type) {
-	case RequestVote:
-		return a.RequestVote(from, ref, val)
-	case AppendEntries:
-        // a.Log().Info("Before handling append entries")
-		return a.AppendEntries(from, ref, val)
 	case AddEntry:
-		return a.AddEntry(from, ref, val)
+		return a.track(pending, a.node.Propose(val.Command, pending)), nil
+	case consensus.ChangeMembership:
+		return a.track(pending, a.node.ChangeMembership(val, pending)), nil
+	case GetMembership:
+		return a.node.Membership(), nil
+	case GetStatus:
+		return a.node.Status(), nil
+	case GetLog:
+		return a.node.LogRange(val.From, val.To), nil
+	case TransferLeadership:
+		return a.track(pending, a.node.TransferLeadership(val.To, pending)), nil
+	case PrepareShutdown:
+		return a.track(pending, a.node.PrepareShutdown(val.Timeout, pending)), nil
 	}
 
 	return false, nil
 }
 
-func (a *RaftActor) RequestVote(from gen.PID, ref gen.Ref, request RequestVote) (bool, error) {
-	if a.term < request.Term && a.commitId <= request.CommitId {
-		a.term = request.Term
-		a.votedFor = request.NodeId
-		a.ScheduleElection()
-        a.Log().Info("Voted for node %d", request.NodeId)
-		return true, nil
+// track remembers req if the node answers it later, i.e. result is nil.
+func (a *RaftActor) track(req *PendingRequest, result any) any {
+	if result == nil {
+		a.pending[req] = struct{}{}
 	}
-
-    a.Log().Info("Not Voted for node %d", request.NodeId)
-	return false, nil
+	return result
 }
 
-func (a *RaftActor) SendAppendEntries() error {
-    // a.Log().Info("Sending AppendEntries")
-    defer a.ScheduleAppendEntries()
-
-	replicatedTo := 1
-
-	for i := 1; i <= opt.NodeCount; i++ {
-		if i == opt.NodeId {
-			continue
-		}
-        // TODO: Parallalize this (just spawining goroutines doesn't work sadly, requires rewrite from rpc calls to async messages)
-        res, err := a.Call(gen.ProcessID{
-            Name: "raftactor",
-            Node: gen.Atom(opt.MakeNodeName(i))},
-            AppendEntries{Entries: a.getLogUpdatesForNode(i), CommitId: a.commitId})
-        if err != nil {
-            a.Log().Warning("Error while sending AppendEntries to node %d: %s", i, err)
-        } else if val, ok := res.(AppendEntriesResult); ok {
-            a.nodeToCommitId[i] = val.CommitId
-            replicatedTo += 1
-        }
-	}
-
-	if replicatedTo <= (opt.NodeCount - replicatedTo) {
-		return nil
-	}
-	a.MoveStateMachine(len(a.log) - 1)
-	return nil
+func (a *RaftActor) respond(req *PendingRequest, result any) {
+	delete(a.pending, req)
+	a.SendResponse(req.From, req.Ref, result)
 }
 
-func (a *RaftActor) getLogUpdatesForNode(nodeId int) []LogEntry {
-	if commitId, ok := a.nodeToCommitId[nodeId]; !ok {
-		return []LogEntry{}
-	} else {
-		return a.log[commitId+1 : min(len(a.log), commitId+1+10)]
+// processReady carries out what the node asked for.
+func (a *RaftActor) processReady() {
+	if a.faults.Crashed {
+		return
+	}
+	ready := a.node.Ready()
+	for _, timer := range ready.Timers {
+		a.setTimer(timer)
+	}
+	if ready.Snapshot != nil {
+		a.restore(*ready.Snapshot)
+	}
+	for _, committed := range ready.Committed {
+		if a.faults.PauseApply {
+			a.unapplied = append(a.unapplied, committed)
+		} else {
+			a.apply(committed)
+		}
+	}
+	a.compact()
+	for _, response := range ready.Responses {
+		if req, ok := response.Token.(*PendingRequest); ok {
+			a.respond(req, response.Result)
+		}
+	}
+	for _, envelope := range ready.Messages {
+		a.send(envelope)
 	}
 }
 
-func (a *RaftActor) AppendEntries(from gen.PID, ref gen.Ref, request AppendEntries) (any, error) {
-	a.ScheduleElection()
-
-	for _, newEntry := range request.Entries {
-		if newEntry.Id < len(a.log) {
-			if a.log[newEntry.Id] == newEntry {
-				continue
-			} else if a.log[newEntry.Id].Term >= newEntry.Term {
-				panic("AppendEntries encountered impossible situation 1")
-			} else {
-				a.log[newEntry.Id] = newEntry
-			}
-		} else if newEntry.Id == len(a.log) {
-			a.log = append(a.log, newEntry)
-		} else {
-			panic("AppendEntries encountered impossible situation 2")
+// restore replaces the state machine with a snapshot, entries queued by
+// PauseApply are part of it.
+func (a *RaftActor) restore(snapshot consensus.Snapshot) {
+	for _, committed := range a.unapplied {
+		if req, ok := committed.Token.(*PendingRequest); ok {
+			a.respond(req, consensus.NotLeader{LeaderId: a.node.Status().LeaderId})
 		}
 	}
+	a.unapplied = nil
+	Must1(a.CallWithTimeout(gen.Atom("storageactor"), StorageRestore{Snapshot: snapshot.Data}, snapshotTimeout))
+	a.applied = snapshot.Id
+}
 
-	a.MoveStateMachine(min(request.CommitId, len(a.log)-1))
+// snapshotTimeout limits taking and restoring a snapshot of the state
+// machine, in seconds.
+const snapshotTimeout = 60
 
-    // a.Log().Info("Handled AppendEntries")
-	return AppendEntriesResult{CommitId: a.commitId}, nil
+// compact replaces the applied entries of the raft log with a snapshot of
+// the state machine every opt.SnapshotEntries entries.
+func (a *RaftActor) compact() {
+	if opt.SnapshotEntries == 0 || a.applied-a.node.Status().SnapshotId < opt.SnapshotEntries {
+		return
+	}
+	res := Must1(a.CallWithTimeout(gen.Atom("storageactor"), StorageSnapshot{}, snapshotTimeout)).(StorageSnapshotResult)
+	if err := a.node.Compact(res.Index, res.Snapshot); err != nil {
+		a.Log().Error("unable to compact the raft log: %s", err)
+	}
 }
 
-func (a *RaftActor) MoveStateMachine(toId int) {
-	if a.commitId > toId {
-		panic("MoveStateMachine encountered impossible situation 1")
+func (a *RaftActor) apply(committed consensus.Committed) {
+	entry := committed.Entry
+	a.applied = entry.Id
+	result := Must1(a.Call(gen.Atom("storageactor"), StorageApply{Index: entry.Id, Command: entry.Command}))
+	if req, ok := committed.Token.(*PendingRequest); ok {
+		proposalMetric.Observe(time.Since(req.Start).Seconds())
+		a.respond(req, result)
 	}
+}
 
-	for _, entry := range a.log[a.commitId + 1 : toId+1] {
-		var op any
-		if !entry.Tombstone {
-			op = StorageSet{Key: entry.Key, Value: entry.Value}
+func (a *RaftActor) setTimer(timer consensus.Timer) {
+	if pending, ok := a.timers[timer.Kind]; ok {
+		pending.cancel()
+		delete(a.timers, timer.Kind)
+	}
+	if timer.Stop {
+		return
+	}
+	a.timerSeq++
+	cancel := Must1(a.SendAfter(a.PID(), TimerFired{Kind: timer.Kind, Seq: a.timerSeq}, timer.After))
+	a.timers[timer.Kind] = raftTimer{seq: a.timerSeq, cancel: cancel}
+}
+
+func (a *RaftActor) send(envelope consensus.Envelope) {
+	to := gen.ProcessID{Name: "raftactor", Node: gen.Atom(opt.MakeNodeName(envelope.To))}
+	_, isAppend := envelope.Message.(consensus.AppendEntries)
+	if isAppend {
+		if _, ok := a.appendSent[envelope.To]; !ok {
+			a.appendSent[envelope.To] = time.Now()
+		}
+	}
+	link := a.faults.link(a.faults.Outgoing, envelope.To)
+	copies := link.copies(a.random)
+	if copies == 0 {
+		return
+	}
+	for range copies {
+		var err error
+		if link.DelayMs > 0 {
+			_, err = a.SendAfter(to, envelope.Message, time.Duration(link.DelayMs)*time.Millisecond)
 		} else {
-			op = StorageDel{Key: entry.Key}
+			err = a.Send(to, envelope.Message)
+		}
+		if err != nil {
+			if isAppend {
+				appendFailMetric.WithLabelValues(strconv.Itoa(envelope.To)).Inc()
+				delete(a.appendSent, envelope.To)
+			}
+			a.Log().Warning("Error while sending %T to node %d: %s", envelope.Message, envelope.To, err)
+			return
 		}
-		Must1(a.Call(gen.Atom("storageactor"), op))
-        a.Log().Info("Moved state machine to id %d", entry.Id)
-
-        if len(a.addEntryQueue) == 0 {
-            continue
-        }
-        req := a.addEntryQueue[0]
-        if req.Id != entry.Id {
-            continue  
-        }
-        a.SendResponse(req.From, req.Ref, true)
 	}
-
-	a.commitId = toId
 }
 
-func (a *RaftActor) AddEntry(from gen.PID, ref gen.Ref, request AddEntry) (any, error) {
-	a.log = append(a.log, LogEntry{Id: len(a.log), Term: a.term, Key: request.Key, Value: request.Value})
-	a.addEntryQueue = append(a.addEntryQueue, AddEntryQueueEntry{From: from, Ref: ref, Id: len(a.log) - 1})
-	return nil, nil
+// HandleInspect invoked on the request made with gen.Process.Inspect(...)
+// and shows raft state in the observer.
+func (a *RaftActor) HandleInspect(from gen.PID, item ...string) map[string]string {
+	status := a.node.Status()
+	result := map[string]string{
+		"role":         status.Role,
+		"term":         strconv.Itoa(status.Term),
+		"votedFor":     strconv.Itoa(status.VotedFor),
+		"leaderId":     strconv.Itoa(status.LeaderId),
+		"lastLogIndex": strconv.Itoa(status.LastLogId),
+		"lastLogTerm":  strconv.Itoa(status.LastLogTerm),
+		"commitIndex":  strconv.Itoa(status.CommitId),
+		"appliedIndex": strconv.Itoa(status.LastApplied),
+		"voters":       fmt.Sprint(status.Membership.Voters),
+	}
+	if status.Membership.IsJoint() {
+		result["newVoters"] = fmt.Sprint(status.Membership.NewVoters)
+	}
+	if len(status.Membership.Learners) > 0 {
+		result["learners"] = fmt.Sprint(status.Membership.Learners)
+	}
+	if status.TransferTarget != 0 {
+		result["transferTarget"] = strconv.Itoa(status.TransferTarget)
+	}
+	if a.faults.active() {
+		result["faults"] = fmt.Sprintf("%+v", a.faults)
+	}
+	for _, follower := range status.Followers {
+		lastContact := "never"
+		if !follower.LastContact.IsZero() {
+			lastContact = time.Since(follower.LastContact).Round(time.Millisecond).String() + " ago"
+		}
+		result[fmt.Sprintf("peer %d", follower.NodeId)] = fmt.Sprintf("match=%d next=%d lastContact=%s",
+			follower.MatchId, follower.NextId, lastContact)
+	}
+	return result
 }
@@ -0,0 +1,27 @@
+package dbnode
+
+import (
+	"chaddb/consensus"
+)
+
+type StateMachine = consensus.StateMachine
+
+// Querier is implemented by state machines that serve read requests. Any
+// call to storageactor that is not part of the raft protocol is passed to
+// Query.
+type Querier interface {
+	Query(request any) (any, error)
+}
+
+// Inspector is implemented by state machines that show their state in the
+// observer.
+type Inspector interface {
+	Inspect() map[string]string
+}
+
+type StateMachineFactory func() (StateMachine, error)
+
+// Options of the dbnode application.
+type Options struct {
+	StateMachine StateMachineFactory
+}
@@ -1,7 +1,10 @@
 package dbnode
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"strconv"
 
 	"ergo.services/ergo/act"
 	"ergo.services/ergo/gen"
@@ -22,6 +25,7 @@ func (sup *StorageSup) Init(args ...any) (act.SupervisorSpec, error) {
 		{
 			Name:    "storageactor",
 			Factory: factory_StorageActor,
+			Args:    args,
 		},
 	}
 	spec.Restart.Strategy = act.SupervisorStrategyTransient
@@ -35,32 +39,74 @@ func factory_StorageActor() gen.ProcessBehavior {
 	return &StorageActor{}
 }
 
+// StorageActor hosts the replicated state machine. The first argument is the
+// StateMachineFactory.
 type StorageActor struct {
 	act.Actor
-    data map[string]string
+	factory StateMachineFactory
+	machine StateMachine
 }
 
 func (a *StorageActor) Init(args ...any) error {
 	a.Log().Info("started process with name %s and args %v", a.Name(), args)
-    a.data = make(map[string]string)
+	a.factory = args[0].(StateMachineFactory)
+	machine, err := a.factory()
+	if err != nil {
+		a.Log().Error("unable to open state machine: %s", err)
+		return err
+	}
+	a.machine = machine
+	a.Log().Info("opened state machine applied up to %d", a.machine.AppliedIndex())
 
 	return nil
 }
 
-type StorageGet struct {
-    Key string
+func (a *StorageActor) Terminate(reason error) {
+	if err := a.machine.Close(); err != nil {
+		a.Log().Error("unable to close state machine: %s", err)
+	}
+}
+
+// StorageApply applies the command of a committed log entry.
+type StorageApply struct {
+	Index   int
+	Command []byte
+}
+
+// StorageAppliedIndex is answered with the index of the last applied entry
+// that survived a restart.
+type StorageAppliedIndex struct {
+}
+
+// StorageSnapshot is answered with StorageSnapshotResult, the state of the
+// state machine at the last applied, so committed, index.
+type StorageSnapshot struct {
 }
 
-type StorageSet struct {
-    Key string
-    Value string
+type StorageSnapshotResult struct {
+	Index    int
+	Snapshot []byte
 }
 
-type StorageDel struct {
-    Key string
+// StorageWriteSnapshot streams the snapshot of StorageSnapshot instead of
+// keeping it in memory: Write is called with the index of the snapshot and a
+// function writing it. It is answered with the index, or with the error of
+// Write, which does not stop the actor as e.g. a full disk is no failure of
+// the state machine.
+type StorageWriteSnapshot struct {
+	Write func(index int, snapshot func(io.Writer) error) error
 }
 
-type KeyNotFound struct {
+// StorageRestore replaces the state of the state machine with a snapshot
+// made by StorageSnapshot, e.g. one the leader sent with InstallSnapshot.
+type StorageRestore struct {
+	Snapshot []byte
+}
+
+// StorageReopen closes the state machine and opens it again, losing what a
+// restart of the process would, e.g. all of it with a memory engine. It is
+// answered with the applied index of the reopened state machine.
+type StorageReopen struct {
 }
 
 func (a *StorageActor) HandleMessage(from gen.PID, message any) error {
@@ -68,33 +114,56 @@ func (a *StorageActor) HandleMessage(from gen.PID, message any) error {
 }
 
 func (a *StorageActor) HandleCall(from gen.PID, ref gen.Ref, request any) (any, error) {
-    switch request.(type) {
-    case StorageGet:
-        return a.HandleGet(from, request.(StorageGet));
-    case StorageSet:
-        return a.HandleSet(from, request.(StorageSet));
-    case StorageDel:
-        return a.HandleDel(from, request.(StorageDel));
-    default:
-        return nil, fmt.Errorf("Invalid request type: %T", request);
-    }
-}
-
-func (a *StorageActor) HandleGet(from gen.PID, message StorageGet) (any, error) {
-    value, ok := a.data[message.Key]
-    if ok {
-        return value, nil
-    } else {
-        return KeyNotFound{}, nil;
-    }
-}
-
-func (a *StorageActor) HandleSet(from gen.PID, message StorageSet) (any, error) {
-    a.data[message.Key] = message.Value
-    return true, nil
-}
-
-func (a *StorageActor) HandleDel(from gen.PID, message StorageDel) (any, error) {
-    delete(a.data, message.Key)
-    return true, nil
+	switch req := request.(type) {
+	case StorageApply:
+		return a.machine.Apply(req.Index, req.Command), nil
+	case StorageAppliedIndex:
+		return a.machine.AppliedIndex(), nil
+	case StorageSnapshot:
+		var snapshot bytes.Buffer
+		if err := a.machine.Snapshot(&snapshot); err != nil {
+			return nil, err
+		}
+		return StorageSnapshotResult{Index: a.machine.AppliedIndex(), Snapshot: snapshot.Bytes()}, nil
+	case StorageWriteSnapshot:
+		if err := req.Write(a.machine.AppliedIndex(), a.machine.Snapshot); err != nil {
+			return err, nil
+		}
+		return a.machine.AppliedIndex(), nil
+	case StorageReopen:
+		if err := a.machine.Close(); err != nil {
+			return nil, err
+		}
+		machine, err := a.factory()
+		if err != nil {
+			a.Log().Error("unable to reopen state machine: %s", err)
+			return nil, err
+		}
+		a.machine = machine
+		a.Log().Info("reopened state machine applied up to %d", a.machine.AppliedIndex())
+		return a.machine.AppliedIndex(), nil
+	case StorageRestore:
+		if err := a.machine.Restore(bytes.NewReader(req.Snapshot)); err != nil {
+			return nil, err
+		}
+		a.Log().Info("restored state machine from a snapshot at %d", a.machine.AppliedIndex())
+		return a.machine.AppliedIndex(), nil
+	}
+	if querier, ok := a.machine.(Querier); ok {
+		return querier.Query(request)
+	}
+	return nil, fmt.Errorf("Invalid request type: %T", request)
+}
+
+// HandleInspect invoked on the request made with gen.Process.Inspect(...)
+func (a *StorageActor) HandleInspect(from gen.PID, item ...string) map[string]string {
+	result := map[string]string{
+		"revision": strconv.Itoa(a.machine.AppliedIndex()),
+	}
+	if inspector, ok := a.machine.(Inspector); ok {
+		for k, v := range inspector.Inspect() {
+			result[k] = v
+		}
+	}
+	return result
 }
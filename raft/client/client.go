@@ -0,0 +1,631 @@
+// Package client talks to a chaddb cluster over its HTTP API. It finds and
+// remembers the leader, follows redirects and retries requests with backoff.
+// Writes carry the client id and a sequence number, so a retried write is
+// applied at most once.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"chaddb/consensus"
+)
+
+var (
+	ErrNotFound = errors.New("key not found")
+	// ErrUnavailable is returned when no node served the request after all
+	// retries.
+	ErrUnavailable = errors.New("chaddb: cluster unavailable")
+	// ErrCompacted is returned by Watch when changes after the requested
+	// index are no longer kept by the node.
+	ErrCompacted = errors.New("changes are compacted")
+)
+
+// StatusError is an unexpected response of the node.
+type StatusError struct {
+	Code    int
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("chaddb: %d %s", e.Code, e.Message)
+}
+
+type Config struct {
+	// Endpoints are api addresses of the nodes, e.g. localhost:5001.
+	Endpoints []string
+	// ClientId identifies the client for exactly-once writes, random if
+	// empty. Two clients must not share an id.
+	ClientId string
+	// Timeout of a single attempt, 10s if zero; negative disables it.
+	Timeout time.Duration
+	// Retries after the first attempt, 10 if zero; negative disables them.
+	Retries int
+	// Backoff before the first retry, doubled up to MaxBackoff. 50ms and 2s
+	// if zero.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// WatchInterval is the pause between polls of Watch, 200ms if zero.
+	WatchInterval time.Duration
+	// Token is sent as bearer token to clusters with authentication.
+	Token string
+	// TLS switches to HTTPS with this configuration, e.g. with the CA of the
+	// cluster and a client certificate. The transport of HTTPClient is used
+	// as is if both are set.
+	TLS        *tls.Config
+	HTTPClient *http.Client
+}
+
+// KeyValue holds values of keys set with PutValue as stored: JSON documents
+// compacted and bytes in base64, as told by ContentType.
+type KeyValue struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// Event is a change delivered by Watch. Op is "set" or "del", Err is set on
+// the last event if watching stopped due to an error.
+type Event struct {
+	Index int    `json:"index"`
+	Op    string `json:"op"`
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	// ContentType is that of a value set with PutValue, see KeyValue.
+	ContentType string `json:"contentType,omitempty"`
+	Err         error  `json:"-"`
+}
+
+type Client struct {
+	config Config
+	http   *http.Client
+
+	lock   sync.Mutex
+	leader string
+	next   int
+	seq    int
+	// sequence numbers of writes waiting for a response
+	inFlight map[int]bool
+}
+
+func New(config Config) (*Client, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, errors.New("chaddb: no endpoints")
+	}
+	if config.ClientId == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		config.ClientId = hex.EncodeToString(id)
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.Retries == 0 {
+		config.Retries = 10
+	}
+	if config.Backoff == 0 {
+		config.Backoff = 50 * time.Millisecond
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 2 * time.Second
+	}
+	if config.WatchInterval == 0 {
+		config.WatchInterval = 200 * time.Millisecond
+	}
+	httpClient := &http.Client{}
+	if config.HTTPClient != nil {
+		*httpClient = *config.HTTPClient
+	} else if config.TLS != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config.TLS
+		httpClient.Transport = transport
+	}
+	// redirects to the leader are followed by do, which remembers it
+	httpClient.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &Client{config: config, http: httpClient, leader: config.Endpoints[0], inFlight: make(map[int]bool)}, nil
+}
+
+// Leader returns the endpoint believed to be the leader.
+func (c *Client) Leader() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.leader
+}
+
+// Get reads the value through the raft log, so it reflects every write that
+// completed before the call.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	return c.get(ctx, key, "?linearizable")
+}
+
+// GetStale reads the state of the node serving the request, which may lag
+// behind the leader.
+func (c *Client) GetStale(ctx context.Context, key string) (string, error) {
+	return c.get(ctx, key, "")
+}
+
+func (c *Client) get(ctx context.Context, key string, query string) (string, error) {
+	var value string
+	body, err := c.getValue(ctx, key, query)
+	if err == nil {
+		err = json.Unmarshal(body, &value)
+	}
+	return value, err
+}
+
+// GetValue reads a value set with PutValue through the raft log, it is
+// returned in the content type it was put with.
+func (c *Client) GetValue(ctx context.Context, key string) ([]byte, error) {
+	return c.getValue(ctx, key, "?linearizable")
+}
+
+func (c *Client) getValue(ctx context.Context, key string, query string) ([]byte, error) {
+	var value []byte
+	err := c.do(ctx, request{method: http.MethodGet, path: keyPath(key) + query}, func(code int, body []byte) error {
+		if code == http.StatusNotFound {
+			return ErrNotFound
+		}
+		value = body
+		return nil
+	})
+	return value, err
+}
+
+func (c *Client) Put(ctx context.Context, key string, value string) error {
+	body, _ := json.Marshal(value)
+	return c.PutValue(ctx, key, "application/json", body)
+}
+
+// PutValue sets key to a JSON document with content type application/json,
+// or to bytes with application/octet-stream.
+func (c *Client) PutValue(ctx context.Context, key string, contentType string, value []byte) error {
+	req := c.write(http.MethodPost, keyPath(key), value)
+	req.header.Set("Content-Type", contentType)
+	defer c.done(req)
+	return c.do(ctx, req, nil)
+}
+
+// Patch applies a JSON Merge Patch (application/merge-patch+json) or a JSON
+// Patch (application/json-patch+json) to the document of key and returns the
+// resulting document. A patch that does not apply to the document fails with
+// a StatusError of code 409.
+func (c *Client) Patch(ctx context.Context, key string, contentType string, patch []byte) ([]byte, error) {
+	var doc []byte
+	req := c.write(http.MethodPatch, keyPath(key), patch)
+	req.header.Set("Content-Type", contentType)
+	defer c.done(req)
+	err := c.do(ctx, req, func(_ int, body []byte) error {
+		doc = body
+		return nil
+	})
+	return doc, err
+}
+
+// Delete succeeds whether or not the key exists.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	req := c.write(http.MethodDelete, keyPath(key), nil)
+	defer c.done(req)
+	return c.do(ctx, req, nil)
+}
+
+// CAS sets key to value if it holds expect and reports whether it did.
+func (c *Client) CAS(ctx context.Context, key string, expect string, value string) (bool, error) {
+	return c.putIf(ctx, keyPath(key)+"?expect="+url.QueryEscape(expect), value)
+}
+
+// Create sets key to value if it does not exist and reports whether it did.
+func (c *Client) Create(ctx context.Context, key string, value string) (bool, error) {
+	return c.putIf(ctx, keyPath(key)+"?absent", value)
+}
+
+// putIf sets the value of a conditional write to path, false means the
+// condition did not hold.
+func (c *Client) putIf(ctx context.Context, path string, value string) (bool, error) {
+	body, _ := json.Marshal(value)
+	swapped := true
+	req := c.write(http.MethodPost, path, body)
+	defer c.done(req)
+	err := c.do(ctx, req, func(code int, _ []byte) error {
+		if code == http.StatusPreconditionFailed {
+			swapped = false
+		}
+		return nil
+	})
+	return swapped && err == nil, err
+}
+
+// Range returns up to limit keys in [from, to) from the leader's state. Empty
+// to means no upper bound, limit <= 0 no limit.
+func (c *Client) Range(ctx context.Context, from string, to string, limit int) ([]KeyValue, error) {
+	query := url.Values{"from": {from}, "to": {to}, "limit": {strconv.Itoa(limit)}}
+	var result []KeyValue
+	err := c.do(ctx, request{method: http.MethodGet, path: "/?" + query.Encode()}, func(_ int, body []byte) error {
+		return json.Unmarshal(body, &result)
+	})
+	return result, err
+}
+
+// Watch delivers changes to keys with prefix applied after log index until
+// ctx is done, the Index of the last event received is where to resume. The
+// channel is closed when watching stops, after an event with ErrCompacted if
+// the node no longer keeps changes that old.
+func (c *Client) Watch(ctx context.Context, prefix string, index int) <-chan Event {
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for {
+			list, err := c.changes(ctx, prefix, index)
+			if err != nil {
+				if ctx.Err() == nil {
+					select {
+					case events <- Event{Index: index, Err: err}:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+			for _, event := range list.Changes {
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			index = list.Index
+			if len(list.Changes) > 0 {
+				continue
+			}
+			select {
+			case <-time.After(c.config.WatchInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// Txn applies Then if all comparisons of If hold and Else otherwise, as a
+// single write. Branches consist of set, del and get ops.
+type Txn struct {
+	If   []Compare `json:"if"`
+	Then []Op      `json:"then"`
+	Else []Op      `json:"else,omitempty"`
+}
+
+// Compare holds if the key has Value, or does not exist if Missing.
+type Compare struct {
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+// Op sets a JSON string unless ContentType is given, Value is then as in
+// KeyValue.
+type Op struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// TxnResult has an entry per op of the applied branch, Value, ContentType
+// and Found are set for gets.
+type TxnResult struct {
+	Succeeded bool `json:"succeeded"`
+	Results   []struct {
+		Op          string `json:"op"`
+		Key         string `json:"key"`
+		Value       string `json:"value,omitempty"`
+		ContentType string `json:"contentType,omitempty"`
+		Found       bool   `json:"found,omitempty"`
+	} `json:"results"`
+}
+
+func (c *Client) Txn(ctx context.Context, txn Txn) (TxnResult, error) {
+	var result TxnResult
+	body, err := json.Marshal(txn)
+	if err != nil {
+		return result, err
+	}
+	req := c.write(http.MethodPost, "/", body)
+	defer c.done(req)
+	err = c.do(ctx, req, func(_ int, body []byte) error {
+		return json.Unmarshal(body, &result)
+	})
+	return result, err
+}
+
+// Status asks the node at endpoint for its raft status, without retries.
+func (c *Client) Status(ctx context.Context, endpoint string) (consensus.RaftStatus, error) {
+	var status consensus.RaftStatus
+	code, body, _, err := c.send(ctx, endpoint, request{method: http.MethodGet, path: "/admin/status"})
+	if err != nil {
+		return status, err
+	}
+	if code != http.StatusOK {
+		return status, &StatusError{Code: code, Message: strings.TrimSpace(string(body))}
+	}
+	return status, json.Unmarshal(body, &status)
+}
+
+// Digest is the digest of the state of a node at Index, empty if the node
+// does not know it.
+type Digest struct {
+	Applied int    `json:"applied"`
+	Index   int    `json:"index"`
+	Digest  string `json:"digest"`
+}
+
+// RangeDigest is the digest of the keys of a range on a node. Keys has the
+// digest of every key if the range has few enough keys.
+type RangeDigest struct {
+	Applied int               `json:"applied"`
+	Digest  string            `json:"digest"`
+	Count   int               `json:"count"`
+	Middle  string            `json:"middle"`
+	Keys    map[string]string `json:"keys"`
+}
+
+// Digest asks the node at endpoint for the digest of its state at index, at
+// the last applied index if it is 0.
+func (c *Client) Digest(ctx context.Context, endpoint string, index int) (Digest, error) {
+	var digest Digest
+	path := "/admin/digest?index=" + strconv.Itoa(index)
+	return digest, c.query(ctx, endpoint, path, &digest)
+}
+
+// RangeDigest asks the node at endpoint for the digest of the keys in
+// [from, to), with the digests of the keys if there are at most keys.
+func (c *Client) RangeDigest(ctx context.Context, endpoint string, from string, to string, keys int) (RangeDigest, error) {
+	var digest RangeDigest
+	query := url.Values{"from": {from}, "to": {to}, "keys": {strconv.Itoa(keys)}}
+	return digest, c.query(ctx, endpoint, "/admin/digest/range?"+query.Encode(), &digest)
+}
+
+// query reads the JSON of a GET of path from the node at endpoint, without
+// retries.
+func (c *Client) query(ctx context.Context, endpoint string, path string, result any) error {
+	code, body, _, err := c.send(ctx, endpoint, request{method: http.MethodGet, path: path})
+	if err != nil {
+		return err
+	}
+	if code != http.StatusOK {
+		return &StatusError{Code: code, Message: strings.TrimSpace(string(body))}
+	}
+	return json.Unmarshal(body, result)
+}
+
+// Members returns the membership known to the node believed to be the
+// leader.
+func (c *Client) Members(ctx context.Context) (consensus.Membership, error) {
+	var membership consensus.Membership
+	err := c.do(ctx, request{method: http.MethodGet, path: "/admin/members"}, func(_ int, body []byte) error {
+		return json.Unmarshal(body, &membership)
+	})
+	return membership, err
+}
+
+// Snapshot returns a backup of the state of the leader, as served by POST
+// /admin/snapshot.
+func (c *Client) Snapshot(ctx context.Context) ([]byte, error) {
+	var snapshot []byte
+	err := c.do(ctx, request{method: http.MethodPost, path: "/admin/snapshot"}, func(_ int, body []byte) error {
+		snapshot = body
+		return nil
+	})
+	return snapshot, err
+}
+
+// SetFaults replaces the faults injected into the node at endpoint, see
+// dbnode.Faults for the fields. A nil faults heals the node.
+func (c *Client) SetFaults(ctx context.Context, endpoint string, faults any) error {
+	req := request{method: http.MethodDelete, path: "/admin/faults"}
+	if faults != nil {
+		body, err := json.Marshal(faults)
+		if err != nil {
+			return err
+		}
+		req = request{method: http.MethodPut, path: "/admin/faults", body: body}
+	}
+	code, body, _, err := c.send(ctx, endpoint, req)
+	if err == nil && code != http.StatusOK {
+		err = &StatusError{Code: code, Message: strings.TrimSpace(string(body))}
+	}
+	return err
+}
+
+type changeList struct {
+	Index   int     `json:"index"`
+	Changes []Event `json:"changes"`
+}
+
+func (c *Client) changes(ctx context.Context, prefix string, index int) (changeList, error) {
+	query := url.Values{"watch": {""}, "prefix": {prefix}, "index": {strconv.Itoa(index)}, "limit": {"1000"}}
+	var list changeList
+	err := c.do(ctx, request{method: http.MethodGet, path: "/?" + query.Encode()}, func(code int, body []byte) error {
+		if code == http.StatusGone {
+			return ErrCompacted
+		}
+		return json.Unmarshal(body, &list)
+	})
+	return list, err
+}
+
+type request struct {
+	method string
+	path   string
+	body   []byte
+	header http.Header
+	seq    int
+}
+
+// write is a request that the node applies once however many times it is
+// retried. It acknowledges the writes that got a response, call done once
+// it got one as well.
+func (c *Client) write(method string, path string, body []byte) request {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	ack := c.seq - 1
+	for seq := range c.inFlight {
+		ack = min(ack, seq-1)
+	}
+	c.inFlight[c.seq] = true
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Set("X-Client-Id", c.config.ClientId)
+	header.Set("X-Request-Seq", strconv.Itoa(c.seq))
+	header.Set("X-Request-Ack", strconv.Itoa(ack))
+	return request{method: method, path: path, body: body, header: header, seq: c.seq}
+}
+
+// done is called when a write returns, even without a response: its outcome
+// is unknown then and a later retry of the same seq would be refused anyway.
+func (c *Client) done(req request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.inFlight, req.seq)
+}
+
+// handled are the status codes passed to the result callback besides 200.
+var handled = map[int]bool{
+	http.StatusNotFound:           true,
+	http.StatusPreconditionFailed: true,
+	http.StatusGone:               true,
+}
+
+// do sends req to the leader and retries on redirects, transport errors and
+// unavailable nodes. result is called with the final response.
+func (c *Client) do(ctx context.Context, req request, result func(code int, body []byte) error) error {
+	backoff := c.config.Backoff
+	var lastErr error
+	for attempt := 0; attempt <= max(c.config.Retries, 0); attempt++ {
+		if attempt > 0 && !lastRedirect(lastErr) {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			backoff = min(2*backoff, c.config.MaxBackoff)
+		}
+		endpoint := c.Leader()
+		code, body, location, err := c.send(ctx, endpoint, req)
+		switch {
+		case ctx.Err() != nil:
+			return ctx.Err()
+		case err != nil:
+			lastErr = err
+			c.failed(endpoint)
+		case code == http.StatusTemporaryRedirect && location != "":
+			lastErr = redirect{location}
+			c.setLeader(location)
+		case code == http.StatusOK || handled[code]:
+			if result == nil {
+				return nil
+			}
+			return result(code, body)
+		case code == http.StatusServiceUnavailable || code >= 500:
+			// no leader yet, shutting down or handing over leadership
+			lastErr = &StatusError{Code: code, Message: strings.TrimSpace(string(body))}
+			c.failed(endpoint)
+		default:
+			return &StatusError{Code: code, Message: strings.TrimSpace(string(body))}
+		}
+	}
+	return fmt.Errorf("%w after %d attempts: %w", ErrUnavailable, max(c.config.Retries, 0)+1, lastErr)
+}
+
+// redirect is the reason of a retry that needs no backoff.
+type redirect struct {
+	location string
+}
+
+func (r redirect) Error() string {
+	return "redirected to " + r.location
+}
+
+func lastRedirect(err error) bool {
+	_, ok := err.(redirect)
+	return ok
+}
+
+func (c *Client) send(ctx context.Context, endpoint string, req request) (int, []byte, string, error) {
+	if c.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.config.Timeout)
+		defer cancel()
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, c.scheme()+"://"+endpoint+req.path, bytes.NewReader(req.body))
+	if err != nil {
+		return 0, nil, "", err
+	}
+	for name, values := range req.header {
+		httpReq.Header[name] = values
+	}
+	if c.config.Token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.config.Token)
+	}
+	response, err := c.http.Do(httpReq)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, nil, "", err
+	}
+	location := ""
+	if loc, err := response.Location(); err == nil {
+		location = loc.Host
+	}
+	return response.StatusCode, body, location, nil
+}
+
+func (c *Client) scheme() string {
+	if c.config.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+func (c *Client) setLeader(endpoint string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.leader = endpoint
+}
+
+// failed moves on to the next endpoint unless another request already did.
+func (c *Client) failed(endpoint string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.leader != endpoint {
+		return
+	}
+	c.next = (c.next + 1) % len(c.config.Endpoints)
+	if c.config.Endpoints[c.next] == endpoint {
+		c.next = (c.next + 1) % len(c.config.Endpoints)
+	}
+	c.leader = c.config.Endpoints[c.next]
+}
+
+func keyPath(key string) string {
+	return "/" + url.PathEscape(key)
+}
@@ -0,0 +1,180 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testNode answers api requests with handler and records them.
+type testNode struct {
+	*httptest.Server
+	lock     sync.Mutex
+	requests []*http.Request
+}
+
+func newTestNode(t *testing.T, handler http.HandlerFunc) *testNode {
+	n := &testNode{}
+	n.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		n.lock.Lock()
+		n.requests = append(n.requests, request)
+		n.lock.Unlock()
+		handler(writer, request)
+	}))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *testNode) endpoint() string {
+	return strings.TrimPrefix(n.URL, "http://")
+}
+
+func (n *testNode) received() []*http.Request {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.requests
+}
+
+func newTestClient(t *testing.T, endpoints ...string) *Client {
+	c, err := New(Config{Endpoints: endpoints, ClientId: "test", Token: "secret", Backoff: time.Millisecond, Retries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestLeaderDiscovery(t *testing.T) {
+	leader := newTestNode(t, func(writer http.ResponseWriter, request *http.Request) {})
+	follower := newTestNode(t, func(writer http.ResponseWriter, request *http.Request) {
+		http.Redirect(writer, request, leader.URL+request.URL.RequestURI(), http.StatusTemporaryRedirect)
+	})
+	down := newTestNode(t, func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, "no leader", http.StatusServiceUnavailable)
+	})
+
+	c := newTestClient(t, down.endpoint(), follower.endpoint(), leader.endpoint())
+	if err := c.Put(context.Background(), "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if c.Leader() != leader.endpoint() {
+		t.Fatalf("leader is %s, want %s", c.Leader(), leader.endpoint())
+	}
+	if err := c.Delete(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+	if len(down.received()) != 1 || len(follower.received()) != 1 || len(leader.received()) != 2 {
+		t.Fatalf("requests sent %d, %d and %d, want 1, 1 and 2", len(down.received()), len(follower.received()), len(leader.received()))
+	}
+	request := leader.received()[0]
+	if request.Header.Get("Authorization") != "Bearer secret" || request.Header.Get("X-Client-Id") != "test" {
+		t.Fatalf("request headers %v", request.Header)
+	}
+}
+
+func TestRetriedWriteKeepsSeq(t *testing.T) {
+	attempts := 0
+	node := newTestNode(t, func(writer http.ResponseWriter, request *http.Request) {
+		if attempts++; attempts < 3 {
+			http.Error(writer, "shutting down", http.StatusServiceUnavailable)
+		}
+	})
+	c := newTestClient(t, node.endpoint())
+	for range 2 {
+		if err := c.Put(context.Background(), "key", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var seqs, acks []string
+	for _, request := range node.received() {
+		seqs = append(seqs, request.Header.Get("X-Request-Seq"))
+		acks = append(acks, request.Header.Get("X-Request-Ack"))
+	}
+	if strings.Join(seqs, ",") != "1,1,1,2" || strings.Join(acks, ",") != "0,0,0,1" {
+		t.Fatalf("sent seqs %v with acks %v", seqs, acks)
+	}
+}
+
+func TestAckWaitsForWritesInFlight(t *testing.T) {
+	c := newTestClient(t, "localhost:1")
+	first := c.write(http.MethodPost, "/a", nil)
+	second := c.write(http.MethodPost, "/b", nil)
+	c.done(second)
+	if ack := c.write(http.MethodPost, "/c", nil).header.Get("X-Request-Ack"); ack != "0" {
+		t.Fatalf("ack %s while write 1 is in flight, want 0", ack)
+	}
+	c.done(first)
+	if ack := c.write(http.MethodPost, "/d", nil).header.Get("X-Request-Ack"); ack != "2" {
+		t.Fatalf("ack %s while write 3 is in flight, want 2", ack)
+	}
+}
+
+func TestResponses(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		body string
+		call func(c *Client) error
+		want error
+	}{
+		{"get", http.StatusOK, `"value"` + "\n", func(c *Client) error {
+			value, err := c.Get(context.Background(), "key")
+			if err == nil && value != "value" {
+				return errors.New("got " + value)
+			}
+			return err
+		}, nil},
+		{"get missing key", http.StatusNotFound, "", func(c *Client) error {
+			_, err := c.Get(context.Background(), "key")
+			return err
+		}, ErrNotFound},
+		{"cas swapped", http.StatusOK, "", func(c *Client) error {
+			if swapped, err := c.CAS(context.Background(), "key", "old", "new"); err != nil || !swapped {
+				return errors.New("not swapped")
+			}
+			return nil
+		}, nil},
+		{"cas failed", http.StatusPreconditionFailed, "", func(c *Client) error {
+			if swapped, err := c.CAS(context.Background(), "key", "old", "new"); err != nil || swapped {
+				return errors.New("swapped")
+			}
+			return nil
+		}, nil},
+		{"create exists", http.StatusPreconditionFailed, "", func(c *Client) error {
+			if created, err := c.Create(context.Background(), "key", "new"); err != nil || created {
+				return errors.New("created")
+			}
+			return nil
+		}, nil},
+		{"watch compacted", http.StatusGone, "", func(c *Client) error {
+			_, err := c.changes(context.Background(), "", 0)
+			return err
+		}, ErrCompacted},
+		{"unavailable", http.StatusServiceUnavailable, "", func(c *Client) error {
+			return c.Put(context.Background(), "key", "value")
+		}, ErrUnavailable},
+		{"refused", http.StatusForbidden, "", func(c *Client) error {
+			err := c.Put(context.Background(), "key", "value")
+			if statusErr := (*StatusError)(nil); errors.As(err, &statusErr) && statusErr.Code == http.StatusForbidden {
+				return nil
+			}
+			return err
+		}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newTestNode(t, func(writer http.ResponseWriter, request *http.Request) {
+				writer.WriteHeader(test.code)
+				writer.Write([]byte(test.body))
+			})
+			err := test.call(newTestClient(t, node.endpoint()))
+			if test.want == nil && err != nil || test.want != nil && !errors.Is(err, test.want) {
+				t.Fatalf("error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"ergo.services/ergo/act"
+	"ergo.services/ergo/gen"
+)
+
+func factory_AdminApi() gen.ProcessBehavior {
+	return &AdminApi{}
+}
+
+// AdminApi serves cluster management requests routed to it by the WebHandler
+// spawned in HttpApi.
+type AdminApi struct {
+	act.Pool
+}
+
+func (w *AdminApi) Init(args ...any) (act.PoolOptions, error) {
+	var poolOptions act.PoolOptions
+	poolOptions.WorkerFactory = factory_AdminApiWebWorker
+	return poolOptions, nil
+}
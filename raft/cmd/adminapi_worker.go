@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"chaddb/apps/dbnode"
+	"chaddb/consensus"
+	"chaddb/internal/backup"
+	"chaddb/internal/kvstore"
+	. "chaddb/internal/utils"
+
+	"ergo.services/ergo/act"
+	"ergo.services/ergo/gen"
+)
+
+// membershipChangeTimeout is in seconds. A change commits two configuration
+// entries, so it takes at least two heartbeats.
+const membershipChangeTimeout = 60
+
+// transferLeaderTimeout is in seconds, the raft actor itself aborts the
+// transfer after an election timeout.
+const transferLeaderTimeout = 30
+
+// snapshotTimeout is in seconds, the state machine writes the whole snapshot
+// to a file within it.
+const snapshotTimeout = 60
+
+func factory_AdminApiWebWorker() gen.ProcessBehavior {
+	return &AdminApiWebWorker{}
+}
+
+type AdminApiWebWorker struct {
+	act.WebWorker
+}
+
+type MemberRequest struct {
+	Id      int  `json:"id"`
+	Learner bool `json:"learner"`
+}
+
+func (w *AdminApiWebWorker) Init(args ...any) error {
+	w.Log().Info("started admin web worker process with args %v", args)
+	return nil
+}
+
+func (w *AdminApiWebWorker) HandleGet(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
+	var query any
+	switch request.URL.Path {
+	case "/admin/members":
+		query = dbnode.GetMembership{}
+	case "/admin/status":
+		query = dbnode.GetStatus{}
+	case "/admin/faults":
+		query = dbnode.GetFaults{}
+	case "/admin/auth":
+		w.getAuthTable(writer)
+		return nil
+	case "/admin/digest", "/admin/digest/range":
+		return w.getDigest(writer, request)
+	case "/admin/log":
+		logRange, err := parseLogRange(request)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		query = logRange
+	default:
+		http.NotFound(writer, request)
+		return nil
+	}
+	res := Must1(w.Call(gen.Atom("raftactor"), query))
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(res)
+	return nil
+}
+
+// getDigest serves GET /admin/digest with the kvstore.DigestAt of the
+// "index" query parameter, the last applied index by default, and GET
+// /admin/digest/range with the kvstore.RangeDigestResult of the keys in
+// ["from", "to"), with the digests of the keys if there are at most "keys".
+func (w *AdminApiWebWorker) getDigest(writer http.ResponseWriter, request *http.Request) error {
+	params := request.URL.Query()
+	var query any
+	if request.URL.Path == "/admin/digest" {
+		index, err := optionalInt(params.Get("index"))
+		if err != nil || index < 0 {
+			http.Error(writer, "Invalid index", http.StatusBadRequest)
+			return nil
+		}
+		query = kvstore.StateDigest{At: index}
+	} else {
+		keys, err := optionalInt(params.Get("keys"))
+		if err != nil {
+			http.Error(writer, "Invalid keys", http.StatusBadRequest)
+			return nil
+		}
+		query = kvstore.RangeDigest{From: params.Get("from"), To: params.Get("to"), Keys: keys}
+	}
+	res := Must1(w.Call(gen.Atom("storageactor"), query))
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(res)
+	return nil
+}
+
+func optionalInt(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// parseLogRange reads the inclusive "from" and "to" query parameters, both
+// are optional.
+func parseLogRange(request *http.Request) (dbnode.GetLog, error) {
+	logRange := dbnode.GetLog{From: 0, To: math.MaxInt}
+	query := request.URL.Query()
+	if from := query.Get("from"); from != "" {
+		id, err := strconv.Atoi(from)
+		if err != nil {
+			return logRange, fmt.Errorf("invalid from: %w", err)
+		}
+		logRange.From = id
+	}
+	if to := query.Get("to"); to != "" {
+		id, err := strconv.Atoi(to)
+		if err != nil {
+			return logRange, fmt.Errorf("invalid to: %w", err)
+		}
+		logRange.To = id
+	}
+	return logRange, nil
+}
+
+func (w *AdminApiWebWorker) HandlePost(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
+	switch {
+	case request.URL.Path == "/admin/transfer-leader":
+		return w.handleTransferLeader(writer, request)
+	case strings.HasSuffix(request.URL.Path, "/promote"):
+		return w.handlePromote(writer, request)
+	case request.URL.Path == "/admin/snapshot":
+		return w.handleSnapshot(writer)
+	case request.URL.Path != "/admin/members":
+		http.NotFound(writer, request)
+		return nil
+	}
+	var member MemberRequest
+	if err := json.NewDecoder(request.Body).Decode(&member); err != nil || member.Id <= 0 {
+		http.Error(writer, "Expected body {\"id\": <node id>, \"learner\": <bool>}", http.StatusBadRequest)
+		return nil
+	}
+	w.Log().Info("got HTTP Post to add member %d (learner: %t)", member.Id, member.Learner)
+	w.changeMembership(writer, request, consensus.ChangeMembership{Add: member.Id, Learner: member.Learner})
+	return nil
+}
+
+// handlePromote turns a caught up learner into a voter.
+func (w *AdminApiWebWorker) handlePromote(writer http.ResponseWriter, request *http.Request) error {
+	id, err := strconv.Atoi(request.PathValue("id"))
+	if err != nil || id <= 0 {
+		http.Error(writer, "Invalid node id", http.StatusBadRequest)
+		return nil
+	}
+	w.Log().Info("got HTTP Post to promote learner %d", id)
+	w.changeMembership(writer, request, consensus.ChangeMembership{Promote: id})
+	return nil
+}
+
+// handleSnapshot serves POST /admin/snapshot with a backup of the state of
+// this node, see -restore-from. The storage actor streams the snapshot into a
+// temporary file, so that neither holds it in memory and a slow client does
+// not keep the storage actor from applying entries.
+func (w *AdminApiWebWorker) handleSnapshot(writer http.ResponseWriter) error {
+	file, err := os.CreateTemp("", "chaddb-*.backup")
+	if err != nil {
+		w.Log().Error("unable to create a file for the snapshot: %s", err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	header := backup.Header{ClusterId: currentClusterId(), Created: time.Now().UTC()}
+	write := func(index int, snapshot func(io.Writer) error) error {
+		header.Index = index
+		return backup.Write(file, header, snapshot)
+	}
+	res, err := w.CallWithTimeout(gen.Atom("storageactor"), dbnode.StorageWriteSnapshot{Write: write}, snapshotTimeout)
+	if failed, ok := res.(error); ok && err == nil {
+		err = failed
+	}
+	if err != nil {
+		w.Log().Warning("unable to make a snapshot: %s", err)
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	size, err := file.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	w.Log().Info("got HTTP Post for a snapshot at index %d of %d bytes", res, size)
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	writer.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="chaddb-%d.backup"`, res))
+	if _, err := io.Copy(writer, file); err != nil {
+		w.Log().Warning("unable to send the snapshot: %s", err)
+	}
+	return nil
+}
+
+// HandlePut replaces the injected faults, see dbnode.Faults, or the users
+// table.
+func (w *AdminApiWebWorker) HandlePut(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
+	switch request.URL.Path {
+	case "/admin/auth":
+		w.putAuthTable(writer, request)
+		return nil
+	case "/admin/faults":
+	default:
+		http.NotFound(writer, request)
+		return nil
+	}
+	var faults dbnode.Faults
+	if err := json.NewDecoder(request.Body).Decode(&faults); err != nil {
+		http.Error(writer, "Invalid faults: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	w.setFaults(writer, faults)
+	return nil
+}
+
+func (w *AdminApiWebWorker) setFaults(writer http.ResponseWriter, faults dbnode.Faults) {
+	w.Log().Warning("got HTTP request to inject faults %+v", faults)
+	res := Must1(w.Call(gen.Atom("raftactor"), dbnode.SetFaults{Faults: faults}))
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(res)
+}
+
+func (w *AdminApiWebWorker) HandleDelete(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
+	if request.URL.Path == "/admin/faults" {
+		w.setFaults(writer, dbnode.Faults{})
+		return nil
+	}
+	id, err := strconv.Atoi(request.PathValue("id"))
+	if err != nil || id <= 0 {
+		http.Error(writer, "Invalid node id", http.StatusBadRequest)
+		return nil
+	}
+	w.Log().Info("got HTTP Delete to remove member %d", id)
+	w.changeMembership(writer, request, consensus.ChangeMembership{Remove: id})
+	return nil
+}
+
+func (w *AdminApiWebWorker) changeMembership(writer http.ResponseWriter, request *http.Request, change consensus.ChangeMembership) {
+	res, err := w.CallWithTimeout(gen.Atom("raftactor"), change, membershipChangeTimeout)
+	if err != nil {
+		w.Log().Warning("membership change %v failed: %s", change, err)
+		http.Error(writer, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
+	if respondNotServed(writer, request, res) {
+		return
+	}
+	if rejected, ok := res.(consensus.MembershipChangeRejected); ok {
+		http.Error(writer, rejected.Reason, http.StatusConflict)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(res)
+}
+
+// handleTransferLeader moves leadership to the node given by the "to" query
+// parameter and returns once it is the leader.
+func (w *AdminApiWebWorker) handleTransferLeader(writer http.ResponseWriter, request *http.Request) error {
+	to, err := strconv.Atoi(request.URL.Query().Get("to"))
+	if err != nil || to <= 0 {
+		http.Error(writer, "Expected query parameter to=<node id>", http.StatusBadRequest)
+		return nil
+	}
+	w.Log().Info("got HTTP Post to transfer leadership to %d", to)
+	res, err := w.CallWithTimeout(gen.Atom("raftactor"), dbnode.TransferLeadership{To: to}, transferLeaderTimeout)
+	if err != nil {
+		w.Log().Warning("leadership transfer to %d failed: %s", to, err)
+		http.Error(writer, err.Error(), http.StatusGatewayTimeout)
+		return nil
+	}
+	switch val := res.(type) {
+	case consensus.NotLeader:
+		redirectToLeader(writer, request, val.LeaderId)
+	case consensus.TransferRejected:
+		http.Error(writer, val.Reason, http.StatusConflict)
+	default:
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(val)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"chadcommon/audit"
+	"chadcommon/auth"
+	"chaddb/internal/kvstore"
+	opt "chaddb/internal/options"
+	. "chaddb/internal/utils"
+)
+
+// authorizer authenticates api requests, nil if authentication is off. It is
+// the one of -auth-file until AuthTable loads the replicated one.
+var authorizer atomic.Pointer[auth.Authorizer]
+
+// initAuthorizer must be called before the api is served.
+func initAuthorizer() {
+	switch {
+	case opt.Auth != nil:
+		authorizer.Store(opt.Auth)
+	case opt.AuthReplicated:
+		// nobody is let in until the table is loaded
+		authorizer.Store(Must1(auth.New(auth.Config{})))
+	}
+}
+
+// authorize lets requests through to next if the user of the request passes
+// check. The user is put into the request context for the web workers.
+func authorize(next http.Handler, check func(*auth.Principal, *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		current := authorizer.Load()
+		if current == nil {
+			next.ServeHTTP(writer, request)
+			return
+		}
+		principal, err := current.Authenticate(request)
+		if err != nil {
+			auditDenied(request, nil, audit.OutcomeUnauthenticated)
+			writer.Header().Set("WWW-Authenticate", `Bearer realm="chaddb"`)
+			http.Error(writer, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !check(principal, request) {
+			auditDenied(request, principal, audit.OutcomeForbidden)
+			http.Error(writer, auth.ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(writer, request.WithContext(auth.WithPrincipal(request.Context(), principal)))
+	})
+}
+
+// anyUser leaves the checks to the web worker.
+func anyUser(*auth.Principal, *http.Request) bool {
+	return true
+}
+
+func adminOnly(principal *auth.Principal, _ *http.Request) bool {
+	return principal.IsAdmin()
+}
+
+// keyAccess checks the permission on the key of a /{id} route, reads for GET
+// and writes otherwise.
+func keyAccess(principal *auth.Principal, request *http.Request) bool {
+	key := request.PathValue("id")
+	if request.Method == http.MethodGet || request.Method == http.MethodHead {
+		return principal.CanRead(key)
+	}
+	return principal.CanWrite(key)
+}
+
+// respondForbidden is used by the web workers for checks the routes can not
+// make, e.g. on the keys of a transaction.
+func respondForbidden(writer http.ResponseWriter) error {
+	http.Error(writer, auth.ErrForbidden.Error(), http.StatusForbidden)
+	return nil
+}
+
+// auditDenied records a refused write of a client in the audit log, other
+// refused requests are not audited.
+func auditDenied(request *http.Request, principal *auth.Principal, outcome string) {
+	op, key := requestOp(request)
+	if op == "" {
+		return
+	}
+	Must(opt.Audit.Append(audit.Entry{Principal: principal.User(), Client: request.RemoteAddr, Op: op, Key: key, Outcome: outcome}))
+}
+
+// requestOp is the op and key of a write to the key routes, empty for
+// reads and admin requests.
+func requestOp(request *http.Request) (string, string) {
+	if strings.HasPrefix(request.URL.Path, "/admin/") {
+		return "", ""
+	}
+	key := request.PathValue("id")
+	switch {
+	case request.Method == http.MethodDelete:
+		return kvstore.OpDel, key
+	case request.Method == http.MethodPatch:
+		return kvstore.OpPatch, key
+	case request.Method != http.MethodPost:
+		return "", ""
+	case key == "":
+		return kvstore.OpTxn, ""
+	case request.URL.Query().Has("expect"), request.URL.Query().Has("absent"):
+		return kvstore.OpCas, key
+	}
+	return kvstore.OpSet, key
+}
+
+// withAuditInfo tells the state machine who sent command, for the audit log.
+func withAuditInfo(request *http.Request, command *kvstore.Command) {
+	command.Principal = auth.FromContext(request.Context()).User()
+	command.RemoteAddr = request.RemoteAddr
+}
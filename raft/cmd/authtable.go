@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"chadcommon/auth"
+	"chaddb/apps/dbnode"
+	"chaddb/internal/kvstore"
+	opt "chaddb/internal/options"
+	"chaddb/internal/store"
+	. "chaddb/internal/utils"
+
+	"ergo.services/ergo/act"
+	"ergo.services/ergo/gen"
+)
+
+// authTableKey holds the replicated users table as a JSON auth.Config with
+// hashed tokens.
+const authTableKey = opt.AuthPrefix + "users"
+
+// authTableInterval is how often AuthTable looks for changes made through
+// other nodes.
+const authTableInterval = time.Second
+
+func factory_AuthTable() gen.ProcessBehavior {
+	return &AuthTable{}
+}
+
+// AuthTable replaces the authorizer of -auth-file with the replicated users
+// table once it is set and whenever it changes.
+type AuthTable struct {
+	act.Actor
+	// value is the table last loaded
+	value string
+}
+
+type loadAuthTable struct{}
+
+func (t *AuthTable) Init(args ...any) error {
+	t.Send(t.PID(), loadAuthTable{})
+	return nil
+}
+
+func (t *AuthTable) HandleMessage(from gen.PID, message any) error {
+	switch message.(type) {
+	case loadAuthTable:
+		t.load()
+		t.SendAfter(t.PID(), loadAuthTable{}, authTableInterval)
+	default:
+		t.Log().Error("unknown message %v", message)
+	}
+	return nil
+}
+
+func (t *AuthTable) load() {
+	res := Must1(t.Call(gen.Atom("storageactor"), kvstore.Get{Key: authTableKey}))
+	kv, ok := res.(store.KeyValue)
+	if !ok || kv.Value == t.value {
+		return
+	}
+	loaded, err := auth.Parse([]byte(kv.Value), opt.ReservedPrefixes...)
+	if err != nil {
+		// the table is validated before it is written
+		t.Log().Error("invalid users table, keeping the previous one: %s", err)
+		return
+	}
+	t.value = kv.Value
+	authorizer.Store(loaded)
+	t.Log().Info("loaded users table")
+}
+
+// getAuthTable serves GET /admin/auth with the replicated users table.
+func (w *AdminApiWebWorker) getAuthTable(writer http.ResponseWriter) {
+	res := Must1(w.Call(gen.Atom("storageactor"), kvstore.Get{Key: authTableKey}))
+	kv, ok := res.(store.KeyValue)
+	if !ok {
+		http.Error(writer, "Users table is not set", http.StatusNotFound)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	io.WriteString(writer, kv.Value)
+}
+
+// putAuthTable serves PUT /admin/auth, replacing the replicated users table
+// with the auth.Config of the body in YAML or JSON. Plain tokens are stored
+// hashed.
+func (w *AdminApiWebWorker) putAuthTable(writer http.ResponseWriter, request *http.Request) {
+	if !opt.AuthReplicated {
+		http.Error(writer, "Node is not started with -auth-replicated", http.StatusConflict)
+		return
+	}
+	data, err := io.ReadAll(request.Body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config, err := auth.ParseConfig(data)
+	if err == nil {
+		_, err = auth.New(config, opt.ReservedPrefixes...)
+	}
+	if err != nil {
+		http.Error(writer, "Invalid users table: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	value := Must1(json.Marshal(config.Hashed()))
+	w.Log().Warning("got HTTP Put to replace the users table with %d users", len(config.Users))
+	command := kvstore.Command{Op: kvstore.OpSet, Key: authTableKey, Value: string(value)}
+	withAuditInfo(request, &command)
+	res := Must1(w.CallWithTimeout(gen.Atom("raftactor"), dbnode.AddEntry{Command: command.Encode()}, 10))
+	if respondNotServed(writer, request, res) || respondInvalid(writer, res) {
+		return
+	}
+	// do not wait for the next poll to let the new users in on this node
+	w.Send(gen.Atom("authtable"), loadAuthTable{})
+	writer.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,353 @@
+// Command bench drives a mix of reads, writes and scans against a chaddb or
+// chadcrdt cluster and reports throughput and latency percentiles.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"chadcommon/certs"
+	"chadcommon/cluster"
+)
+
+const (
+	opRead  = "read"
+	opWrite = "write"
+	opScan  = "scan"
+)
+
+type Config struct {
+	Store        string         `json:"store"`
+	Endpoints    []string       `json:"endpoints"`
+	Concurrency  int            `json:"concurrency"`
+	Duration     time.Duration  `json:"duration"`
+	Mix          map[string]int `json:"mix"`
+	Keys         int            `json:"keys"`
+	Distribution string         `json:"distribution"`
+	ZipfS        float64        `json:"zipfS,omitempty"`
+	ValueSize    int            `json:"valueSize"`
+	ScanLimit    int            `json:"scanLimit"`
+	StaleReads   bool           `json:"staleReads"`
+	Token        string         `json:"-"`
+	TLS          *tls.Config    `json:"-"`
+}
+
+func main() {
+	var config Config
+	clusterFile := flag.String("cluster", "", "cluster file, default is three nodes on localhost")
+	endpoints := flag.String("endpoints", "", "comma separated api addresses, overrides -cluster")
+	mix := flag.String("mix", "read=80,write=20", "weights of read, write and scan operations")
+	jsonOut := flag.String("json", "", "write the report as JSON to this file, - for stdout")
+	preload := flag.Bool("preload", false, "write every key once before the run")
+	flag.StringVar(&config.Token, "token", os.Getenv("CHADDB_TOKEN"), "api token, $CHADDB_TOKEN by default")
+	useTLS := flag.Bool("tls", false, "use HTTPS, implied by the other -tls flags")
+	tlsCA := flag.String("tls-ca", "", "CA certificates to verify the nodes with instead of the system roots")
+	tlsCert := flag.String("tls-cert", "", "client certificate, for nodes started with -tls-client-auth")
+	tlsKey := flag.String("tls-key", "", "private key of -tls-cert")
+	flag.StringVar(&config.Store, "store", "chaddb", "chaddb or chadcrdt")
+	flag.IntVar(&config.Concurrency, "concurrency", 16, "number of concurrent clients")
+	flag.DurationVar(&config.Duration, "duration", 30*time.Second, "length of the run")
+	flag.IntVar(&config.Keys, "keys", 10000, "number of distinct keys")
+	flag.StringVar(&config.Distribution, "dist", "uniform", "key distribution: uniform or zipfian")
+	flag.Float64Var(&config.ZipfS, "zipf-s", 1.1, "skew of the zipfian distribution, greater than 1")
+	flag.IntVar(&config.ValueSize, "value-size", 100, "bytes per written value")
+	flag.IntVar(&config.ScanLimit, "scan-limit", 100, "keys per scan")
+	flag.BoolVar(&config.StaleReads, "stale-reads", false, "chaddb reads the local state of a node instead of going through the raft log")
+	flag.Parse()
+
+	var err error
+	if config.Mix, err = parseMix(*mix); err != nil {
+		fail(err)
+	}
+	switch {
+	case *endpoints != "":
+		config.Endpoints = strings.Split(*endpoints, ",")
+	case *clusterFile != "":
+		c, err := cluster.Load(*clusterFile)
+		if err != nil {
+			fail(err)
+		}
+		config.Endpoints = c.Endpoints()
+	default:
+		config.Endpoints = cluster.Default(3).Endpoints()
+	}
+	if config.Distribution != "uniform" && (config.Distribution != "zipfian" || config.ZipfS <= 1) {
+		fail(fmt.Errorf("unknown distribution %q or -zipf-s not greater than 1", config.Distribution))
+	}
+	if config.Keys <= 0 || config.Concurrency <= 0 {
+		fail(fmt.Errorf("-keys and -concurrency must be positive"))
+	}
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		if config.TLS, err = certs.ClientConfig(*tlsCA, *tlsCert, *tlsKey); err != nil {
+			fail(err)
+		}
+	}
+
+	var target Target
+	switch config.Store {
+	case "chaddb":
+		target, err = newChaddb(config)
+	case "chadcrdt":
+		target, err = newChadcrdt(config)
+	default:
+		err = fmt.Errorf("unknown store %q", config.Store)
+	}
+	if err != nil {
+		fail(err)
+	}
+	if config.Mix[opScan] > 0 && !target.CanScan() {
+		fail(fmt.Errorf("%s does not support scans", config.Store))
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	if *preload {
+		if err := preloadKeys(ctx, target, config); err != nil {
+			fail(err)
+		}
+	}
+	report := run(ctx, target, config)
+	printReport(report)
+	if *jsonOut != "" {
+		if err := writeJson(*jsonOut, report); err != nil {
+			fail(err)
+		}
+	}
+}
+
+// Target is the store under test. Missing keys are not errors.
+type Target interface {
+	Read(ctx context.Context, key string) error
+	Write(ctx context.Context, key string, value string) error
+	Scan(ctx context.Context, from string, limit int) error
+	CanScan() bool
+}
+
+func parseMix(mix string) (map[string]int, error) {
+	weights := make(map[string]int)
+	total := 0
+	for _, part := range strings.Split(mix, ",") {
+		name, weight, ok := strings.Cut(strings.TrimSpace(part), "=")
+		n, err := strconv.Atoi(weight)
+		if !ok || err != nil || n < 0 || (name != opRead && name != opWrite && name != opScan) {
+			return nil, fmt.Errorf("invalid mix %q, expected e.g. read=80,write=15,scan=5", mix)
+		}
+		weights[name] = n
+		total += n
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("mix %q has no operations", mix)
+	}
+	return weights, nil
+}
+
+func key(n int) string {
+	return fmt.Sprintf("bench-%08d", n)
+}
+
+// keyChooser draws key numbers from the configured distribution, it is not
+// safe for concurrent use.
+type keyChooser func() int
+
+func newKeyChooser(config Config, random *rand.Rand) keyChooser {
+	if config.Distribution == "zipfian" {
+		zipf := rand.NewZipf(random, config.ZipfS, 1, uint64(config.Keys-1))
+		return func() int { return int(zipf.Uint64()) }
+	}
+	return func() int { return random.Intn(config.Keys) }
+}
+
+func preloadKeys(ctx context.Context, target Target, config Config) error {
+	fmt.Fprintf(os.Stderr, "preloading %d keys\n", config.Keys)
+	value := strings.Repeat("x", config.ValueSize)
+	next := make(chan int)
+	errs := make(chan error, config.Concurrency)
+	var wg sync.WaitGroup
+	for range config.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range next {
+				if err := target.Write(ctx, key(n), value); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	var err error
+	for n := 0; n < config.Keys && err == nil; n++ {
+		select {
+		case next <- n:
+		case err = <-errs:
+		}
+	}
+	close(next)
+	wg.Wait()
+	if err == nil && len(errs) > 0 {
+		err = <-errs
+	}
+	return err
+}
+
+// samples are the latencies of successful operations of one kind.
+type samples struct {
+	latencies []time.Duration
+	errors    int
+}
+
+func run(ctx context.Context, target Target, config Config) Report {
+	ctx, cancel := context.WithTimeout(ctx, config.Duration)
+	defer cancel()
+	ops := []string{opRead, opWrite, opScan}
+	total := 0
+	for _, op := range ops {
+		total += config.Mix[op]
+	}
+
+	results := make([]map[string]*samples, config.Concurrency)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for worker := range config.Concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(start.UnixNano() + int64(worker)))
+			choose := newKeyChooser(config, random)
+			value := make([]byte, config.ValueSize)
+			result := map[string]*samples{opRead: {}, opWrite: {}, opScan: {}}
+			results[worker] = result
+			for ctx.Err() == nil {
+				n := random.Intn(total)
+				op := opScan
+				if n < config.Mix[opRead] {
+					op = opRead
+				} else if n < config.Mix[opRead]+config.Mix[opWrite] {
+					op = opWrite
+				}
+				var err error
+				began := time.Now()
+				switch op {
+				case opRead:
+					err = target.Read(ctx, key(choose()))
+				case opWrite:
+					for i := range value {
+						value[i] = 'a' + byte(random.Intn(26))
+					}
+					err = target.Write(ctx, key(choose()), string(value))
+				case opScan:
+					err = target.Scan(ctx, key(choose()), config.ScanLimit)
+				}
+				if ctx.Err() != nil {
+					// cut off by the end of the run
+					break
+				}
+				if err != nil {
+					result[op].errors++
+				} else {
+					result[op].latencies = append(result[op].latencies, time.Since(began))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report := Report{Config: config, Elapsed: elapsed, Ops: make(map[string]Stats)}
+	all := &samples{}
+	for _, op := range ops {
+		merged := &samples{}
+		for _, result := range results {
+			merged.latencies = append(merged.latencies, result[op].latencies...)
+			merged.errors += result[op].errors
+		}
+		if config.Mix[op] > 0 {
+			report.Ops[op] = merged.stats(elapsed)
+		}
+		all.latencies = append(all.latencies, merged.latencies...)
+		all.errors += merged.errors
+	}
+	report.Total = all.stats(elapsed)
+	return report
+}
+
+type Report struct {
+	Config  Config           `json:"config"`
+	Elapsed time.Duration    `json:"elapsed"`
+	Ops     map[string]Stats `json:"ops"`
+	Total   Stats            `json:"total"`
+}
+
+// Stats are over successful operations, latencies in microseconds.
+type Stats struct {
+	Count      int     `json:"count"`
+	Errors     int     `json:"errors"`
+	Throughput float64 `json:"opsPerSecond"`
+	P50        int64   `json:"p50Us"`
+	P95        int64   `json:"p95Us"`
+	P99        int64   `json:"p99Us"`
+	Max        int64   `json:"maxUs"`
+}
+
+func (s *samples) stats(elapsed time.Duration) Stats {
+	slices.Sort(s.latencies)
+	stats := Stats{Count: len(s.latencies), Errors: s.errors, Throughput: float64(len(s.latencies)) / elapsed.Seconds()}
+	if len(s.latencies) == 0 {
+		return stats
+	}
+	percentile := func(p float64) int64 {
+		i := int(p * float64(len(s.latencies)-1))
+		return s.latencies[i].Microseconds()
+	}
+	stats.P50, stats.P95, stats.P99 = percentile(0.50), percentile(0.95), percentile(0.99)
+	stats.Max = s.latencies[len(s.latencies)-1].Microseconds()
+	return stats
+}
+
+func printReport(report Report) {
+	fmt.Printf("%s, %d clients, %s, %d keys %s, %d byte values\n\n", report.Config.Store, report.Config.Concurrency,
+		report.Elapsed.Round(time.Millisecond), report.Config.Keys, report.Config.Distribution, report.Config.ValueSize)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "op\tcount\terrors\tops/s\tp50\tp95\tp99\tmax\t")
+	line := func(name string, s Stats) {
+		us := func(v int64) time.Duration { return (time.Duration(v) * time.Microsecond).Round(10 * time.Microsecond) }
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%s\t%s\t%s\t%s\t\n", name, s.Count, s.Errors, s.Throughput,
+			us(s.P50), us(s.P95), us(s.P99), us(s.Max))
+	}
+	for _, op := range []string{opRead, opWrite, opScan} {
+		if stats, ok := report.Ops[op]; ok {
+			line(op, stats)
+		}
+	}
+	line("total", report.Total)
+	w.Flush()
+}
+
+func writeJson(path string, report Report) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if path == "-" {
+		_, err = fmt.Println(string(data))
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "bench: %s\n", err)
+	os.Exit(2)
+}
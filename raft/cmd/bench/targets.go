@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"chaddb/client"
+)
+
+// chaddb goes through the client, which sends every request to the leader.
+type chaddb struct {
+	client *client.Client
+	stale  bool
+}
+
+func newChaddb(config Config) (Target, error) {
+	c, err := client.New(client.Config{Endpoints: config.Endpoints, Retries: 3, Token: config.Token, TLS: config.TLS})
+	if err != nil {
+		return nil, err
+	}
+	return &chaddb{client: c, stale: config.StaleReads}, nil
+}
+
+func (t *chaddb) Read(ctx context.Context, key string) error {
+	read := t.client.Get
+	if t.stale {
+		read = t.client.GetStale
+	}
+	_, err := read(ctx, key)
+	if errors.Is(err, client.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (t *chaddb) Write(ctx context.Context, key string, value string) error {
+	return t.client.Put(ctx, key, value)
+}
+
+func (t *chaddb) Scan(ctx context.Context, from string, limit int) error {
+	_, err := t.client.Range(ctx, from, "", limit)
+	return err
+}
+
+func (t *chaddb) CanScan() bool {
+	return true
+}
+
+// chadcrdt spreads requests over all replicas, any of them serves any
+// request.
+type chadcrdt struct {
+	endpoints []string
+	scheme    string
+	token     string
+	next      atomic.Int64
+	http      *http.Client
+}
+
+func newChadcrdt(config Config) (Target, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = config.Concurrency
+	scheme := "http"
+	if config.TLS != nil {
+		transport.TLSClientConfig = config.TLS
+		scheme = "https"
+	}
+	return &chadcrdt{endpoints: config.Endpoints, scheme: scheme, token: config.Token, http: &http.Client{Transport: transport}}, nil
+}
+
+func (t *chadcrdt) Read(ctx context.Context, key string) error {
+	return t.send(ctx, http.MethodGet, key, nil)
+}
+
+func (t *chadcrdt) Write(ctx context.Context, key string, value string) error {
+	body, _ := json.Marshal(value)
+	return t.send(ctx, http.MethodPut, key, body)
+}
+
+func (t *chadcrdt) Scan(ctx context.Context, from string, limit int) error {
+	return errors.New("scans are not supported")
+}
+
+func (t *chadcrdt) CanScan() bool {
+	return false
+}
+
+func (t *chadcrdt) send(ctx context.Context, method string, key string, body []byte) error {
+	endpoint := t.endpoints[int(t.next.Add(1))%len(t.endpoints)]
+	request, err := http.NewRequestWithContext(ctx, method, t.scheme+"://"+endpoint+"/"+url.PathEscape(key), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if t.token != "" {
+		request.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	response, err := t.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, response.Body)
+	if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("%s %s: %s", method, endpoint, response.Status)
+	}
+	return nil
+}
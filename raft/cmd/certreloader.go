@@ -0,0 +1,14 @@
+package main
+
+import (
+	"chadcommon/certs"
+	opt "chaddb/internal/options"
+
+	"ergo.services/ergo/gen"
+)
+
+// factory_CertReloader checks the files of -tls-cert, -tls-key and -tls-ca
+// every -tls-reload-interval and loads them again when they changed.
+func factory_CertReloader() gen.ProcessBehavior {
+	return certs.NewReloader(opt.Certs, opt.CertManager, opt.TLSReloadInterval)
+}
@@ -0,0 +1,365 @@
+// Command chadcli reads and writes keys of a chaddb cluster and shows its
+// state. Requests go to the leader, which is found automatically.
+//
+// Exit codes: 0 success, 1 error, 2 usage, 3 key not found, 4 cas, create or
+// txn condition failed or replicas differ, 5 cluster unavailable.
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"chadcommon/certs"
+	"chadcommon/cluster"
+	"chaddb/client"
+	"chaddb/consensus"
+	"chaddb/internal/backup"
+)
+
+const (
+	exitError       = 1
+	exitUsage       = 2
+	exitNotFound    = 3
+	exitFailed      = 4
+	exitUnavailable = 5
+)
+
+const usage = `Usage: chadcli [flags] <command> [args]
+
+Commands:
+  get <key>                   read a key, through the raft log unless -stale
+  set <key> <value>           write a key
+  del <key>                   delete a key
+  cas <key> <expect> <value>  write a key if it holds expect
+  create <key> <value>        write a key if it does not exist
+  scan [from] [to]            list keys in [from, to)
+  watch [prefix]              print changes to keys with prefix
+  txn <json|->                apply a transaction, e.g.
+                              {"if": [{"key": "a", "value": "1"}], "then": [{"op": "set", "key": "a", "value": "2"}]}
+  status                      raft status of every node
+  members                     cluster membership
+  faults <json>               inject faults into every node, or the one given
+                              with -node, e.g. {"pauseApply": true}
+  heal                        remove injected faults
+  backup <file>               save a snapshot of the leader for -restore-from
+  verify                      compare the state of the nodes and report the
+                              ranges of keys they differ in
+
+Flags:
+`
+
+var (
+	clusterFile = flag.String("cluster", os.Getenv("CHADDB_CLUSTER"), "cluster file, $CHADDB_CLUSTER by default")
+	endpoints   = flag.String("endpoints", "", "comma separated api addresses, overrides -cluster")
+	node        = flag.String("node", "", "talk to this node only, an api address or port")
+	output      = flag.String("o", "table", "output format: table or json")
+	timeout     = flag.Duration("timeout", 10*time.Second, "timeout of the whole command, 0 for none")
+	retries     = flag.Int("retries", 3, "retries of a request")
+	stale       = flag.Bool("stale", false, "get reads the state of the node instead of going through the raft log")
+	limit       = flag.Int("limit", 0, "scan at most this many keys, 0 for no limit")
+	index       = flag.Int("index", 0, "watch changes after this log index")
+	token       = flag.String("token", os.Getenv("CHADDB_TOKEN"), "api token, $CHADDB_TOKEN by default")
+	useTLS      = flag.Bool("tls", false, "use HTTPS, implied by the other -tls flags")
+	tlsCA       = flag.String("tls-ca", "", "CA certificates to verify the nodes with instead of the system roots")
+	tlsCert     = flag.String("tls-cert", "", "client certificate, for nodes started with -tls-client-auth")
+	tlsKey      = flag.String("tls-key", "", "private key of -tls-cert")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 || (*output != "table" && *output != "json") {
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+
+	addresses, err := resolveEndpoints()
+	if err != nil {
+		fail(err)
+	}
+	// the client takes 0 for its defaults
+	if *retries == 0 {
+		*retries = -1
+	}
+	attemptTimeout := *timeout
+	if attemptTimeout == 0 {
+		attemptTimeout = -1
+	}
+	config := client.Config{Endpoints: addresses, Retries: *retries, Timeout: attemptTimeout, Token: *token}
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		if config.TLS, err = certs.ClientConfig(*tlsCA, *tlsCert, *tlsKey); err != nil {
+			fail(err)
+		}
+	}
+	c, err := client.New(config)
+	if err != nil {
+		fail(err)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	command, args := flag.Arg(0), flag.Args()[1:]
+	if *timeout > 0 && command != "watch" {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	switch {
+	case command == "get" && len(args) == 1:
+		get(ctx, c, args[0])
+	case command == "set" && len(args) == 2:
+		check(c.Put(ctx, args[0], args[1]))
+		show(map[string]any{"key": args[0], "value": args[1]}, nil)
+	case command == "del" && len(args) == 1:
+		check(c.Delete(ctx, args[0]))
+		show(map[string]any{"key": args[0], "deleted": true}, nil)
+	case command == "cas" && len(args) == 3:
+		swapped, err := c.CAS(ctx, args[0], args[1], args[2])
+		check(err)
+		show(map[string]any{"key": args[0], "swapped": swapped}, func(w io.Writer) {
+			fmt.Fprintln(w, swapped)
+		})
+		if !swapped {
+			os.Exit(exitFailed)
+		}
+	case command == "create" && len(args) == 2:
+		created, err := c.Create(ctx, args[0], args[1])
+		check(err)
+		show(map[string]any{"key": args[0], "created": created}, func(w io.Writer) {
+			fmt.Fprintln(w, created)
+		})
+		if !created {
+			os.Exit(exitFailed)
+		}
+	case command == "scan" && len(args) <= 2:
+		scan(ctx, c, args)
+	case command == "watch" && len(args) <= 1:
+		watch(ctx, c, append(args, "")[0])
+	case command == "txn" && len(args) == 1:
+		txn(ctx, c, args[0])
+	case command == "status" && len(args) == 0:
+		status(ctx, c, addresses)
+	case command == "members" && len(args) == 0:
+		members, err := c.Members(ctx)
+		check(err)
+		show(members, func(w io.Writer) {
+			fmt.Fprintf(w, "voters\t%s\n", ids(members.Voters))
+			if members.IsJoint() {
+				fmt.Fprintf(w, "new voters\t%s\n", ids(members.NewVoters))
+			}
+			fmt.Fprintf(w, "learners\t%s\n", ids(members.Learners))
+		})
+	case command == "faults" && len(args) == 1:
+		var faults json.RawMessage
+		if err := json.Unmarshal([]byte(args[0]), &faults); err != nil {
+			fmt.Fprintf(os.Stderr, "chadcli: invalid faults: %s\n", err)
+			os.Exit(exitUsage)
+		}
+		for _, address := range addresses {
+			check(c.SetFaults(ctx, address, faults))
+		}
+	case command == "heal" && len(args) == 0:
+		for _, address := range addresses {
+			check(c.SetFaults(ctx, address, nil))
+		}
+	case command == "verify" && len(args) == 0:
+		verify(ctx, c, addresses)
+	case command == "backup" && len(args) == 1:
+		saveBackup(ctx, c, args[0])
+	default:
+		flag.Usage()
+		os.Exit(exitUsage)
+	}
+}
+
+// saveBackup verifies the snapshot before it is written to file.
+func saveBackup(ctx context.Context, c *client.Client, file string) {
+	snapshot, err := c.Snapshot(ctx)
+	check(err)
+	header, _, err := backup.Read(bytes.NewReader(snapshot))
+	check(err)
+	check(os.WriteFile(file, snapshot, 0o600))
+	show(map[string]any{"file": file, "clusterId": header.ClusterId, "index": header.Index, "size": header.Size}, func(w io.Writer) {
+		fmt.Fprintf(w, "file\t%s\ncluster id\t%s\nindex\t%d\nsize\t%d\n", file, header.ClusterId, header.Index, header.Size)
+	})
+}
+
+// resolveEndpoints returns the api addresses to talk to, in order of
+// precedence -node, -endpoints, -cluster and the default local cluster.
+func resolveEndpoints() ([]string, error) {
+	switch {
+	case *node != "":
+		if _, err := strconv.Atoi(*node); err == nil {
+			return []string{"localhost:" + *node}, nil
+		}
+		return []string{*node}, nil
+	case *endpoints != "":
+		return strings.Split(*endpoints, ","), nil
+	case *clusterFile != "":
+		c, err := cluster.Load(*clusterFile)
+		return c.Endpoints(), err
+	}
+	return cluster.Default(3).Endpoints(), nil
+}
+
+func get(ctx context.Context, c *client.Client, key string) {
+	read := c.Get
+	if *stale {
+		read = c.GetStale
+	}
+	value, err := read(ctx, key)
+	check(err)
+	show(map[string]any{"key": key, "value": value}, func(w io.Writer) {
+		fmt.Fprintln(w, value)
+	})
+}
+
+func scan(ctx context.Context, c *client.Client, args []string) {
+	args = append(args, "", "")
+	keys, err := c.Range(ctx, args[0], args[1], *limit)
+	check(err)
+	show(keys, func(w io.Writer) {
+		fmt.Fprintln(w, "KEY\tVALUE")
+		for _, kv := range keys {
+			fmt.Fprintf(w, "%s\t%s\n", kv.Key, kv.Value)
+		}
+	})
+}
+
+func watch(ctx context.Context, c *client.Client, prefix string) {
+	for event := range c.Watch(ctx, prefix, *index) {
+		check(event.Err)
+		if *output == "json" {
+			json.NewEncoder(os.Stdout).Encode(event)
+		} else {
+			fmt.Printf("%d\t%s\t%s\t%s\n", event.Index, event.Op, event.Key, event.Value)
+		}
+	}
+}
+
+func txn(ctx context.Context, c *client.Client, arg string) {
+	data := []byte(arg)
+	if arg == "-" {
+		var err error
+		if data, err = io.ReadAll(os.Stdin); err != nil {
+			fail(err)
+		}
+	}
+	var request client.Txn
+	if err := json.Unmarshal(data, &request); err != nil {
+		fmt.Fprintf(os.Stderr, "chadcli: invalid txn: %s\n", err)
+		os.Exit(exitUsage)
+	}
+	result, err := c.Txn(ctx, request)
+	check(err)
+	show(result, func(w io.Writer) {
+		fmt.Fprintf(w, "succeeded\t%t\n", result.Succeeded)
+		for _, r := range result.Results {
+			switch {
+			case r.Op != "get":
+				fmt.Fprintf(w, "%s\t%s\n", r.Op, r.Key)
+			case r.Found:
+				fmt.Fprintf(w, "get\t%s\t%s\n", r.Key, r.Value)
+			default:
+				fmt.Fprintf(w, "get\t%s\t(not found)\n", r.Key)
+			}
+		}
+	})
+	if !result.Succeeded {
+		os.Exit(exitFailed)
+	}
+}
+
+type nodeStatus struct {
+	Address string `json:"address"`
+	Status  any    `json:"status,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func status(ctx context.Context, c *client.Client, addresses []string) {
+	var statuses []nodeStatus
+	reachable := 0
+	for _, address := range addresses {
+		s, err := c.Status(ctx, address)
+		if err != nil {
+			statuses = append(statuses, nodeStatus{Address: address, Error: err.Error()})
+			continue
+		}
+		reachable++
+		statuses = append(statuses, nodeStatus{Address: address, Status: s})
+	}
+	show(statuses, func(w io.Writer) {
+		fmt.Fprintln(w, "ADDRESS\tNODE\tROLE\tTERM\tLEADER\tLAST INDEX\tCOMMIT\tAPPLIED")
+		for _, ns := range statuses {
+			if ns.Error != "" {
+				fmt.Fprintf(w, "%s\t-\tunreachable\t\t\t\t\t\n", ns.Address)
+				continue
+			}
+			s := ns.Status.(consensus.RaftStatus)
+			fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%d\t%d\t%d\t%d\n",
+				ns.Address, s.NodeId, s.Role, s.Term, s.LeaderId, s.LastLogId, s.CommitId, s.LastApplied)
+		}
+	})
+	if reachable == 0 {
+		os.Exit(exitUnavailable)
+	}
+}
+
+// show writes value as JSON or, for table output, calls table if given.
+func show(value any, table func(w io.Writer)) {
+	if *output == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(value)
+		return
+	}
+	if table == nil {
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	table(w)
+	w.Flush()
+}
+
+func ids(ids []int) string {
+	if len(ids) == 0 {
+		return "-"
+	}
+	return strings.Trim(fmt.Sprint(ids), "[]")
+}
+
+// check exits with the code matching err, if any.
+func check(err error) {
+	if err == nil {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "chadcli: %s\n", err)
+	var statusErr *client.StatusError
+	switch {
+	case errors.Is(err, client.ErrNotFound):
+		os.Exit(exitNotFound)
+	case errors.As(err, &statusErr) && statusErr.Code < 500:
+		os.Exit(exitError)
+	case errors.Is(err, client.ErrUnavailable), errors.Is(err, context.DeadlineExceeded):
+		os.Exit(exitUnavailable)
+	}
+	os.Exit(exitError)
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "chadcli: %s\n", err)
+	os.Exit(exitError)
+}
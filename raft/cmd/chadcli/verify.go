@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+
+	"chaddb/client"
+)
+
+// leafKeys is the size of a range verify does not split any further but
+// compares key by key.
+const leafKeys = 64
+
+type verifyResult struct {
+	Consistent bool              `json:"consistent"`
+	Index      int               `json:"index"`
+	Digests    map[string]string `json:"digests"`
+	Ranges     []divergentRange  `json:"ranges,omitempty"`
+	// Moving is set if the nodes applied writes while their ranges were
+	// compared, so some of the ranges may not differ after all.
+	Moving bool `json:"moving,omitempty"`
+}
+
+// divergentRange is a range of keys [From, To) whose digests differ, Keys
+// are the keys that differ with their digest on every node, "-" if the node
+// does not have the key.
+type divergentRange struct {
+	From string                       `json:"from"`
+	To   string                       `json:"to"`
+	Keys map[string]map[string]string `json:"keys,omitempty"`
+}
+
+// verify compares the state digests of the nodes at the last index all of
+// them applied and, if they differ, looks for the ranges of keys they differ
+// in.
+func verify(ctx context.Context, c *client.Client, addresses []string) {
+	common := -1
+	for _, address := range addresses {
+		digest, err := c.Digest(ctx, address, 0)
+		check(err)
+		if common < 0 || digest.Applied < common {
+			common = digest.Applied
+		}
+	}
+	result := verifyResult{Consistent: true, Index: common, Digests: make(map[string]string)}
+	for _, address := range addresses {
+		digest, err := c.Digest(ctx, address, common)
+		check(err)
+		result.Digests[address] = digest.Digest
+		if digest.Digest == "" || digest.Digest != result.Digests[addresses[0]] {
+			result.Consistent = false
+		}
+	}
+	if !result.Consistent {
+		v := &verifier{c: c, addresses: addresses, applied: make(map[string]int)}
+		v.bisect(ctx, "", "")
+		result.Ranges, result.Moving = v.ranges, v.moving
+		// a node too far behind to know the digest at the common index may
+		// have caught up since
+		result.Consistent = len(v.ranges) == 0 && !v.moving
+	}
+	show(result, func(w io.Writer) {
+		fmt.Fprintf(w, "index\t%d\n", result.Index)
+		for _, address := range addresses {
+			digest := result.Digests[address]
+			if digest == "" {
+				digest = "unknown"
+			}
+			fmt.Fprintf(w, "%s\t%s\n", address, digest)
+		}
+		for _, r := range result.Ranges {
+			keys := slices.Sorted(maps.Keys(r.Keys))
+			fmt.Fprintf(w, "divergent\t[%q, %q)\t%s\n", r.From, r.To, strings.Join(keys, " "))
+		}
+		if result.Moving {
+			fmt.Fprintln(w, "warning\tnodes applied writes during the comparison")
+		}
+	})
+	if !result.Consistent {
+		os.Exit(exitFailed)
+	}
+}
+
+type verifier struct {
+	c         *client.Client
+	addresses []string
+	ranges    []divergentRange
+	// applied is the index of every node when its first range was compared
+	applied map[string]int
+	moving  bool
+}
+
+// bisect compares the digests of the range on all nodes and splits ranges
+// that differ until they are small enough to compare their keys.
+func (v *verifier) bisect(ctx context.Context, from string, to string) {
+	digests := make(map[string]client.RangeDigest, len(v.addresses))
+	var largest client.RangeDigest
+	same := true
+	for _, address := range v.addresses {
+		digest, err := v.c.RangeDigest(ctx, address, from, to, leafKeys)
+		check(err)
+		if applied, ok := v.applied[address]; !ok {
+			v.applied[address] = digest.Applied
+		} else if applied != digest.Applied {
+			v.moving = true
+		}
+		digests[address] = digest
+		same = same && digest.Digest == digests[v.addresses[0]].Digest
+		if digest.Count > largest.Count {
+			largest = digest
+		}
+	}
+	switch {
+	case same:
+	case largest.Count <= leafKeys || largest.Middle == "" || largest.Middle == from:
+		v.ranges = append(v.ranges, divergentRange{From: from, To: to, Keys: differingKeys(digests)})
+	default:
+		v.bisect(ctx, from, largest.Middle)
+		v.bisect(ctx, largest.Middle, to)
+	}
+}
+
+// differingKeys are the keys of a range whose digest is not the same on all
+// nodes, nil if some node has too many keys to list them.
+func differingKeys(digests map[string]client.RangeDigest) map[string]map[string]string {
+	all := make(map[string]bool)
+	for _, digest := range digests {
+		if digest.Keys == nil {
+			return nil
+		}
+		for key := range digest.Keys {
+			all[key] = true
+		}
+	}
+	keys := make(map[string]map[string]string)
+	for key := range all {
+		byNode := make(map[string]string, len(digests))
+		for address, digest := range digests {
+			byNode[address] = "-"
+			if entry, ok := digest.Keys[key]; ok {
+				byNode[address] = entry
+			}
+		}
+		if len(slices.Compact(slices.Sorted(maps.Values(byNode)))) > 1 {
+			keys[key] = byNode
+		}
+	}
+	return keys
+}
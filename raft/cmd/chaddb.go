@@ -2,8 +2,14 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"chadcommon/cluster"
 	"chaddb/apps/dbnode"
+	"chaddb/internal/kvstore"
 	opt "chaddb/internal/options"
 
 	"ergo.services/application/observer"
@@ -12,22 +18,50 @@ import (
 	"ergo.services/ergo/gen"
 )
 
+func openKVStore() (dbnode.StateMachine, error) {
+	return kvstore.Open()
+}
+
 func main() {
 	var options gen.NodeOptions
 
 	flag.Parse()
-	opt.ObserverPort = 4000 + opt.NodeId
-	opt.ApiPort = 5000 + opt.NodeId
+	if err := opt.Validate(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	observerHost, observerPort, err := cluster.SplitAddress(opt.Self().Observer)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	networkHost, networkPort, err := cluster.SplitAddress(opt.Self().Network)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	// create applications that must be started
 	apps := []gen.ApplicationBehavior{
-		observer.CreateApp(observer.Options{Port: uint16(opt.ObserverPort)}),
-		dbnode.CreateDbNode(),
+		observer.CreateApp(observer.Options{Host: observerHost, Port: observerPort}),
+		dbnode.CreateDbNode(dbnode.Options{StateMachine: openKVStore}),
 	}
 	options.Applications = apps
 
 	// set network options
 	options.Network.Cookie = opt.NodeCookie
+	options.Network.Acceptors = []gen.AcceptorOptions{
+		{Cookie: opt.NodeCookie, Host: networkHost, Port: networkPort, PortRange: 1},
+	}
+	if opt.Certs != nil {
+		// ergo verifies the certificates of other nodes with the system
+		// roots, which are read from SSL_CERT_FILE on first use
+		if opt.TLSCA != "" {
+			os.Setenv("SSL_CERT_FILE", opt.TLSCA)
+		}
+		options.CertManager = opt.CertManager
+		options.Network.Acceptors[0].CertManager = options.CertManager
+	}
 
 	// starting node
 	node, err := ergo.StartNode(gen.Atom(opt.MakeNodeName(opt.NodeId)), options)
@@ -35,10 +69,49 @@ func main() {
 		panic(err)
 	}
 
+	if opt.Certs != nil {
+		if _, err := node.SpawnRegister("certreloader", factory_CertReloader, gen.ProcessOptions{}); err != nil {
+			panic(err)
+		}
+	}
+
+	// starting process Discovery, messages sent to other nodes before it
+	// added the routes are lost and retried by raft
+	if _, err := node.SpawnRegister("discovery", factory_Discovery, gen.ProcessOptions{}); err != nil {
+		panic(err)
+	}
+
+	// starting process AdminApi
+	if _, err := node.SpawnRegister("adminapi", factory_AdminApi, gen.ProcessOptions{}); err != nil {
+		panic(err)
+	}
+
+	initAuthorizer()
+	if opt.AuthReplicated {
+		if _, err := node.SpawnRegister("authtable", factory_AuthTable, gen.ProcessOptions{}); err != nil {
+			panic(err)
+		}
+	}
+
+	if _, err := node.SpawnRegister("clusterid", factory_ClusterId, gen.ProcessOptions{}); err != nil {
+		panic(err)
+	}
+
 	// starting process HttpApi
 	if _, err := node.SpawnRegister("httpapi", factory_HttpApi, gen.ProcessOptions{}); err != nil {
 		panic(err)
 	}
 
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		node.Log().Info("got signal %s, shutting down", sig)
+		go shutdown(node)
+		// second signal skips the graceful part
+		<-signals
+		node.StopForce()
+	}()
+
 	node.Wait()
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"chaddb/apps/dbnode"
+	"chaddb/internal/kvstore"
+	"chaddb/internal/store"
+	. "chaddb/internal/utils"
+
+	"ergo.services/ergo/act"
+	"ergo.services/ergo/gen"
+	"ergo.services/ergo/lib"
+)
+
+// clusterIdInterval is how often ClusterId looks for the id and proposes
+// one while it is not set.
+const clusterIdInterval = time.Second
+
+// clusterId is the id of the cluster once the node applied it.
+var clusterId atomic.Value
+
+func factory_ClusterId() gen.ProcessBehavior {
+	return &ClusterId{}
+}
+
+// ClusterId waits for the cluster id to be applied and proposes a random one
+// while there is none: only proposals of the leader get through and a txn
+// keeps the first one, so every cluster, including one restored from a
+// backup, ends up with an id of its own.
+type ClusterId struct {
+	act.Actor
+}
+
+type loadClusterId struct{}
+
+func (c *ClusterId) Init(args ...any) error {
+	c.Send(c.PID(), loadClusterId{})
+	return nil
+}
+
+func (c *ClusterId) HandleMessage(from gen.PID, message any) error {
+	switch message.(type) {
+	case loadClusterId:
+		if c.load() {
+			return gen.TerminateReasonNormal
+		}
+		c.SendAfter(c.PID(), loadClusterId{}, clusterIdInterval)
+	default:
+		c.Log().Error("unknown message %v", message)
+	}
+	return nil
+}
+
+// load reports whether the id is known, otherwise it proposes one.
+func (c *ClusterId) load() bool {
+	res := Must1(c.Call(gen.Atom("storageactor"), kvstore.Get{Key: kvstore.ClusterIdKey}))
+	if kv, ok := res.(store.KeyValue); ok {
+		clusterId.Store(kv.Value)
+		c.Log().Info("cluster id is %s", kv.Value)
+		return true
+	}
+	txn := kvstore.Txn{
+		If:   []kvstore.Compare{{Key: kvstore.ClusterIdKey, Missing: true}},
+		Then: []kvstore.Command{{Op: kvstore.OpSet, Key: kvstore.ClusterIdKey, Value: lib.RandomString(16)}},
+	}
+	command := kvstore.Command{Op: kvstore.OpTxn, Txn: &txn}
+	// followers answer with consensus.NotLeader and try again later
+	if _, err := c.CallWithTimeout(gen.Atom("raftactor"), dbnode.AddEntry{Command: command.Encode()}, 10); err != nil {
+		c.Log().Warning("unable to propose a cluster id: %s", err)
+	}
+	return false
+}
+
+// currentClusterId is empty until the id is applied.
+func currentClusterId() string {
+	id, _ := clusterId.Load().(string)
+	return id
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"chadcommon/discovery"
+	opt "chaddb/internal/options"
+
+	"ergo.services/ergo/gen"
+)
+
+func factory_Discovery() gen.ProcessBehavior {
+	return discovery.NewRouter(discovery.RouterConfig{
+		Self:        opt.NodeId,
+		Resolver:    opt.Resolver,
+		Interval:    opt.DiscoveryInterval,
+		Cookie:      opt.NodeCookie,
+		CertManager: opt.CertManager,
+		Cluster:     opt.Cluster,
+		SetCluster:  opt.SetCluster,
+	})
+}
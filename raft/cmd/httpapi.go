@@ -1,11 +1,15 @@
 package main
 
 import (
+	"net"
 	"net/http"
+	"strconv"
 
 	"ergo.services/ergo/act"
 	"ergo.services/ergo/gen"
 	"ergo.services/ergo/meta"
+    "chadcommon/cluster"
+    "chaddb/internal/metrics"
     opt "chaddb/internal/options"
 )
 
@@ -15,6 +19,9 @@ func factory_HttpApi() gen.ProcessBehavior {
 
 type HttpApi struct {
 	act.Pool
+	// server serves the api with -tls-cert instead of the web server
+	// meta-process
+	server *http.Server
 }
 
 // Init invoked on a start this process.
@@ -32,13 +39,55 @@ func (w *HttpApi) Init(args ...any) (act.PoolOptions, error) {
 		return poolOptions, err
 	}
 
-	mux.Handle("/{id}", root)
+	// ranges, watches and transactions are checked by the web worker
+	mux.Handle("/{id}", authorize(root, keyAccess))
+	mux.Handle("GET /{$}", authorize(root, anyUser))
+	mux.Handle("POST /{$}", authorize(root, anyUser))
 	w.Log().Info("started WebHandler to serve '/' (meta-process: %s)", rootid)
 
-	webOptions.Port = uint16(opt.ApiPort)
-	webOptions.Host = "localhost"
+	// admin requests are handled by the separate "adminapi" pool
+	adminHandler := meta.CreateWebHandler(meta.WebHandlerOptions{Worker: "adminapi"})
+	adminid, err := w.SpawnMeta(adminHandler, gen.MetaOptions{})
+	if err != nil {
+		w.Log().Error("unable to spawn admin WebHandler meta-process: %s", err)
+		return poolOptions, err
+	}
+	admin := authorize(adminHandler, adminOnly)
 
-	webOptions.Handler = mux
+	mux.Handle("/admin/members", admin)
+	mux.Handle("/admin/members/{id}", admin)
+	mux.Handle("POST /admin/members/{id}/promote", admin)
+	mux.Handle("POST /admin/transfer-leader", admin)
+	mux.Handle("GET /admin/status", admin)
+	mux.Handle("GET /admin/log", admin)
+	mux.Handle("/admin/faults", admin)
+	mux.Handle("/admin/auth", admin)
+	mux.Handle("POST /admin/snapshot", admin)
+	mux.Handle("GET /admin/digest", admin)
+	mux.Handle("GET /admin/digest/range", admin)
+	if opt.Audit != nil {
+		mux.Handle("GET /admin/audit", authorize(opt.Audit.Handler(), adminOnly))
+	}
+	mux.Handle("GET /metrics", authorize(metrics.Handler(), anyUser))
+	w.Log().Info("started WebHandler to serve '/admin/' (meta-process: %s)", adminid)
+
+	webOptions.Host, webOptions.Port, err = cluster.SplitAddress(opt.Self().Api)
+	if err != nil {
+		return poolOptions, err
+	}
+
+	webOptions.Handler = instrument(mux)
+
+	if opt.Certs != nil {
+		address := net.JoinHostPort(webOptions.Host, strconv.Itoa(int(webOptions.Port)))
+		if err := w.serveTLS(address, webOptions.Handler); err != nil {
+			w.Log().Error("unable to start HTTPS server: %s", err)
+			return poolOptions, err
+		}
+		w.Log().Info("started HTTPS server: use https://%s/", address)
+		poolOptions.WorkerFactory = factory_HttpApiWebWorker
+		return poolOptions, nil
+	}
 
 	webserver, err := meta.CreateWebServer(webOptions)
 	if err != nil {
@@ -1,12 +1,22 @@
 package main
 
 import (
+	"chadcommon/audit"
+	"chadcommon/auth"
+	"chadcommon/content"
+	"chaddb/apps/dbnode"
+	"chaddb/consensus"
+	"chaddb/internal/kvstore"
+	opt "chaddb/internal/options"
+	"chaddb/internal/store"
+	. "chaddb/internal/utils"
 	"encoding/json"
 	"ergo.services/ergo/act"
 	"ergo.services/ergo/gen"
+	"fmt"
 	"net/http"
-	"chaddb/apps/dbnode"
-	. "chaddb/internal/utils"
+	"slices"
+	"strconv"
 )
 
 func factory_HttpApiWebWorker() gen.ProcessBehavior {
@@ -23,37 +33,308 @@ func (w *HttpApiWebWorker) Init(args ...any) error {
 }
 
 func (w *HttpApiWebWorker) HandleGet(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
-    key := request.PathValue("id")
+	key := request.PathValue("id")
+	if key == "" {
+		return w.handleScan(writer, request)
+	}
 	w.Log().Info("got HTTP GET for key %s", key)
-    val := Must1(w.Call(gen.Atom("storageactor"), dbnode.StorageGet{Key: key}))
-    if _, ok := val.(dbnode.KeyNotFound); ok {
-        writer.Header().Set("Content-Type", "text/plain")
-        writer.WriteHeader(404)
-        writer.Write([]byte("Key not found"))
-        return nil
-    }
-	writer.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(writer).Encode(val)
+	var val any
+	if request.URL.Query().Has("linearizable") {
+		// read through the raft log instead of the local, possibly stale, state
+		val = Must1(w.CallWithTimeout(gen.Atom("raftactor"), dbnode.AddEntry{Command: kvstore.GetCommand(key)}, 10))
+		if respondNotServed(writer, request, val) {
+			return nil
+		}
+	} else {
+		val = Must1(w.Call(gen.Atom("storageactor"), kvstore.Get{Key: key}))
+	}
+	if _, ok := val.(kvstore.KeyNotFound); ok {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(404)
+		writer.Write([]byte("Key not found"))
+		return nil
+	}
+	kv := val.(store.KeyValue)
+	content.Write(writer, kv.Value, kv.ContentType)
 	return nil
 }
 
 func (w *HttpApiWebWorker) HandlePost(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
-    key := request.PathValue("id");
-    var val string
-    json.NewDecoder(request.Body).Decode(&val)
-	w.Log().Info("got HTTP Post for key %s with value %s", key, val)
-    // Must1(w.Call(gen.Atom("storageactor"), dbnode.StorageSet{Key: key, Value: val}))
-    Must1(w.CallWithTimeout(gen.Atom("raftactor"), dbnode.AddEntry{Key: key, Value: val, Tombstone: false}, 10 * 1000))
+	if draining.Load() {
+		return respondDraining(writer)
+	}
+	key := request.PathValue("id")
+	if key == "" {
+		return w.handleTxn(writer, request)
+	}
+	val, contentType, err := content.Read(writer, request, opt.MaxValueBytes())
+	if err != nil {
+		content.Error(writer, err)
+		return nil
+	}
+	w.Log().Info("got HTTP Post for key %s with a %d byte value", key, len(val))
+	command := kvstore.Command{Op: kvstore.OpSet, Key: key, Value: val, ContentType: contentType}
+	if request.URL.Query().Has("absent") {
+		command.Op, command.Missing = kvstore.OpCas, true
+	} else if request.URL.Query().Has("expect") {
+		command.Op, command.Expect = kvstore.OpCas, content.Expect(request.URL.Query().Get("expect"), contentType)
+	}
+	withAuditInfo(request, &command)
+	if !withSession(writer, request, &command) {
+		return nil
+	}
+	res := Must1(w.CallWithTimeout(gen.Atom("raftactor"), dbnode.AddEntry{Command: command.Encode()}, 10))
+	if respondNotServed(writer, request, res) || respondInvalid(writer, res) {
+		return nil
+	}
+	if _, ok := res.(kvstore.CasFailed); ok && command.Missing {
+		http.Error(writer, "Key exists", http.StatusPreconditionFailed)
+		return nil
+	} else if ok {
+		http.Error(writer, "Value does not match expect", http.StatusPreconditionFailed)
+		return nil
+	}
 
 	writer.WriteHeader(200)
 	return nil
 }
 
+// HandlePatch serves PATCH /{id} with a JSON Merge Patch or JSON Patch body,
+// which is applied to the document of the key through the log. It answers
+// with the resulting document.
+func (w *HttpApiWebWorker) HandlePatch(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
+	if draining.Load() {
+		return respondDraining(writer)
+	}
+	key := request.PathValue("id")
+	patch, contentType, err := content.ReadPatch(writer, request, opt.MaxValueBytes())
+	if err != nil {
+		content.Error(writer, err)
+		return nil
+	}
+	w.Log().Info("got HTTP Patch for key %s with %s", key, contentType)
+	command := kvstore.Command{Op: kvstore.OpPatch, Key: key, Value: patch, ContentType: contentType}
+	withAuditInfo(request, &command)
+	if !withSession(writer, request, &command) {
+		return nil
+	}
+	res := Must1(w.CallWithTimeout(gen.Atom("raftactor"), dbnode.AddEntry{Command: command.Encode()}, 10))
+	if respondNotServed(writer, request, res) || respondInvalid(writer, res) {
+		return nil
+	}
+	if failed, ok := res.(kvstore.PatchFailed); ok {
+		http.Error(writer, failed.Reason, http.StatusConflict)
+		return nil
+	}
+	kv := res.(store.KeyValue)
+	content.Write(writer, kv.Value, kv.ContentType)
+	return nil
+}
+
 func (w *HttpApiWebWorker) HandleDelete(from gen.PID, writer http.ResponseWriter, request *http.Request) error {
-    key := request.PathValue("id");
+	if draining.Load() {
+		return respondDraining(writer)
+	}
+	key := request.PathValue("id")
 	w.Log().Info("got HTTP Delete for key %s", key)
-    // Must1(w.Call(gen.Atom("storageactor"), dbnode.StorageDel{Key: key}));
-    Must1(w.CallWithTimeout(gen.Atom("raftactor"), dbnode.AddEntry{Key: key, Tombstone: true}, 1000))
+	command := kvstore.Command{Op: kvstore.OpDel, Key: key}
+	withAuditInfo(request, &command)
+	if !withSession(writer, request, &command) {
+		return nil
+	}
+	res := Must1(w.CallWithTimeout(gen.Atom("raftactor"), dbnode.AddEntry{Command: command.Encode()}, 10))
+	if respondNotServed(writer, request, res) || respondInvalid(writer, res) {
+		return nil
+	}
 	writer.WriteHeader(200)
 	return nil
 }
+
+// handleScan serves GET / with the keys in [from, to) or, with the "watch"
+// parameter, the changes to keys with prefix applied after index.
+func (w *HttpApiWebWorker) handleScan(writer http.ResponseWriter, request *http.Request) error {
+	principal := auth.FromContext(request.Context())
+	query := request.URL.Query()
+	limit := 0
+	if query.Has("limit") {
+		var err error
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil {
+			http.Error(writer, "Invalid limit", http.StatusBadRequest)
+			return nil
+		}
+	}
+	var res any
+	if query.Has("watch") {
+		index, err := strconv.Atoi(query.Get("index"))
+		if err != nil {
+			http.Error(writer, "Expected query parameter index=<log index>", http.StatusBadRequest)
+			return nil
+		}
+		res = Must1(w.Call(gen.Atom("storageactor"), kvstore.Changes{From: index, Prefix: query.Get("prefix"), Limit: limit}))
+		if compacted, ok := res.(kvstore.ChangesCompacted); ok {
+			http.Error(writer, fmt.Sprintf("Changes up to index %d are compacted", compacted.Since), http.StatusGone)
+			return nil
+		}
+		res = readableChanges(principal, res)
+	} else {
+		res = Must1(w.Call(gen.Atom("storageactor"), kvstore.Range{From: query.Get("from"), To: query.Get("to"), Limit: limit}))
+		res = readableKeys(principal, res)
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(res)
+	return nil
+}
+
+// readableKeys leaves out keys of a range the user may not read, so a page
+// may be shorter than its limit.
+func readableKeys(principal *auth.Principal, res any) any {
+	keys, ok := res.([]store.KeyValue)
+	if !ok || principal.IsAdmin() {
+		return res
+	}
+	readable := []store.KeyValue{}
+	for _, kv := range keys {
+		if principal.CanRead(kv.Key) {
+			readable = append(readable, kv)
+		}
+	}
+	return readable
+}
+
+// readableChanges leaves out changes to keys the user may not read, the index
+// to resume from is kept.
+func readableChanges(principal *auth.Principal, res any) any {
+	list, ok := res.(kvstore.ChangeList)
+	if !ok || principal.IsAdmin() {
+		return res
+	}
+	readable := kvstore.ChangeList{Index: list.Index, Changes: []kvstore.Change{}}
+	for _, change := range list.Changes {
+		if principal.CanRead(change.Key) {
+			readable.Changes = append(readable.Changes, change)
+		}
+	}
+	return readable
+}
+
+// handleTxn serves POST / with a kvstore.Txn body and answers with
+// kvstore.TxnResult once it is applied.
+func (w *HttpApiWebWorker) handleTxn(writer http.ResponseWriter, request *http.Request) error {
+	var txn kvstore.Txn
+	if err := json.NewDecoder(request.Body).Decode(&txn); err != nil {
+		http.Error(writer, "Invalid txn: "+err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	for _, command := range append(slices.Clone(txn.Then), txn.Else...) {
+		if command.Op != kvstore.OpSet {
+			continue
+		}
+		if err := content.Check(command.Value, command.ContentType, opt.MaxValueBytes()); err != nil {
+			content.Error(writer, fmt.Errorf("value of %s: %w", command.Key, err))
+			return nil
+		}
+	}
+	principal := auth.FromContext(request.Context())
+	if !txnAllowed(principal, txn) {
+		auditDenied(request, principal, audit.OutcomeForbidden)
+		return respondForbidden(writer)
+	}
+	w.Log().Info("got HTTP Post for txn with %d comparisons", len(txn.If))
+	command := kvstore.Command{Op: kvstore.OpTxn, Txn: &txn}
+	withAuditInfo(request, &command)
+	if !withSession(writer, request, &command) {
+		return nil
+	}
+	res := Must1(w.CallWithTimeout(gen.Atom("raftactor"), dbnode.AddEntry{Command: command.Encode()}, 10))
+	if respondNotServed(writer, request, res) || respondInvalid(writer, res) {
+		return nil
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(writer).Encode(res)
+	return nil
+}
+
+// txnAllowed checks that the user may read the compared keys and the keys of
+// gets, and write the keys of the other commands of both branches.
+func txnAllowed(principal *auth.Principal, txn kvstore.Txn) bool {
+	for _, compare := range txn.If {
+		if !principal.CanRead(compare.Key) {
+			return false
+		}
+	}
+	for _, command := range append(slices.Clone(txn.Then), txn.Else...) {
+		allowed := principal.CanWrite
+		if command.Op == kvstore.OpGet {
+			allowed = principal.CanRead
+		}
+		if !allowed(command.Key) {
+			return false
+		}
+	}
+	return true
+}
+
+// withSession copies the X-Client-Id, X-Request-Seq and X-Request-Ack
+// headers of a write to command, so that a retried write is applied once. It
+// responds with 400 and returns false if they are malformed.
+func withSession(writer http.ResponseWriter, request *http.Request, command *kvstore.Command) bool {
+	command.ClientId = request.Header.Get("X-Client-Id")
+	if command.ClientId == "" {
+		return true
+	}
+	seq, err := strconv.Atoi(request.Header.Get("X-Request-Seq"))
+	if err != nil || seq <= 0 {
+		http.Error(writer, "X-Client-Id requires a positive X-Request-Seq", http.StatusBadRequest)
+		return false
+	}
+	command.Seq = seq
+	if ack := request.Header.Get("X-Request-Ack"); ack != "" {
+		if command.Ack, err = strconv.Atoi(ack); err != nil || command.Ack >= seq {
+			http.Error(writer, "X-Request-Ack must be less than X-Request-Seq", http.StatusBadRequest)
+			return false
+		}
+	}
+	return true
+}
+
+func respondInvalid(writer http.ResponseWriter, res any) bool {
+	invalid, ok := res.(kvstore.InvalidCommand)
+	if ok {
+		http.Error(writer, invalid.Reason, http.StatusBadRequest)
+	}
+	return ok
+}
+
+func respondDraining(writer http.ResponseWriter) error {
+	http.Error(writer, "Node is shutting down", http.StatusServiceUnavailable)
+	return nil
+}
+
+// respondNotServed writes the response for proposals the raft actor refused
+// to handle and reports whether it did so.
+func respondNotServed(writer http.ResponseWriter, request *http.Request, res any) bool {
+	switch val := res.(type) {
+	case consensus.NotLeader:
+		redirectToLeader(writer, request, val.LeaderId)
+	case consensus.ShuttingDown:
+		http.Error(writer, "Node is shutting down", http.StatusServiceUnavailable)
+	case consensus.TransferInProgress:
+		writer.Header().Set("Retry-After", "1")
+		http.Error(writer, "Leadership transfer is in progress", http.StatusServiceUnavailable)
+	default:
+		return false
+	}
+	return true
+}
+
+// redirectToLeader points the client to the same request on the leader's api.
+func redirectToLeader(writer http.ResponseWriter, request *http.Request, leaderId int) {
+	if leaderId == 0 {
+		writer.Header().Set("Content-Type", "text/plain")
+		writer.WriteHeader(503)
+		writer.Write([]byte("Leader is unknown"))
+		return
+	}
+	location := fmt.Sprintf("%s://%s%s", opt.ApiScheme(), opt.MakeApiAddress(leaderId), request.URL.RequestURI())
+	http.Redirect(writer, request, location, http.StatusTemporaryRedirect)
+}
@@ -0,0 +1,287 @@
+// Command lincheck runs concurrent clients against a chaddb cluster, records
+// the history of their operations and checks that it is linearizable.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"chaddb/internal/linearizability"
+)
+
+// record is an operation as saved to the history file.
+type record struct {
+	ClientId int    `json:"client"`
+	Input    Input  `json:"input"`
+	Output   Output `json:"output"`
+	Call     int64  `json:"call"`
+	Return   int64  `json:"return"`
+}
+
+func main() {
+	nodes := flag.String("nodes", "localhost:5001,localhost:5002,localhost:5003", "comma separated api addresses")
+	clients := flag.Int("clients", 5, "number of concurrent clients")
+	keys := flag.Int("keys", 3, "number of keys")
+	duration := flag.Duration("duration", 10*time.Second, "how long clients run")
+	timeout := flag.Duration("timeout", 5*time.Second, "request timeout, the outcome of timed out writes is unknown")
+	staleReads := flag.Bool("stale-reads", false, "read the local state of a node instead of going through the raft log")
+	out := flag.String("out", "", "save the history to this file")
+	check := flag.String("check", "", "check a saved history instead of running clients")
+	flag.Parse()
+
+	var history []linearizability.Operation
+	if *check != "" {
+		history = load(*check)
+	} else {
+		workload := workload{
+			nodes:      strings.Split(*nodes, ","),
+			keys:       *keys,
+			staleReads: *staleReads,
+			client:     &http.Client{Timeout: *timeout},
+			start:      time.Now(),
+		}
+		history = workload.run(*clients, *duration)
+		if *out != "" {
+			save(*out, history)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, op := range history {
+		if op.Output.(Output).Unknown {
+			counts["unknown"]++
+		} else {
+			counts[op.Input.(Input).Op]++
+		}
+	}
+	fmt.Printf("%d operations: %d get, %d set, %d del, %d cas, %d with unknown outcome\n",
+		len(history), counts[OpGet], counts[OpSet], counts[OpDel], counts[OpCas], counts["unknown"])
+
+	result := linearizability.Check(kvModel, history)
+	if result.Ok {
+		fmt.Println("history is linearizable")
+		return
+	}
+	key := result.History[0].Input.(Input).Key
+	fmt.Printf("history of key %s is not linearizable, %d of %d operations reproduce it:\n\n",
+		key, len(result.Counterexample), len(result.History))
+	fmt.Print(timeline(result.Counterexample))
+	fmt.Println("\nlongest linearizable prefix:")
+	for _, op := range result.Linearized {
+		fmt.Printf("  client %d: %s\n", op.ClientId, describe(op))
+	}
+	os.Exit(1)
+}
+
+type workload struct {
+	nodes      []string
+	keys       int
+	staleReads bool
+	client     *http.Client
+	start      time.Time
+
+	lock    sync.Mutex
+	history []linearizability.Operation
+}
+
+func (w *workload) run(clients int, duration time.Duration) []linearizability.Operation {
+	deadline := w.start.Add(duration)
+	var wg sync.WaitGroup
+	for id := 1; id <= clients; id++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(w.start.UnixNano() + int64(id)))
+			// values written by this client are unique, the last one read is
+			// the expected value of the next cas
+			written, lastRead := 0, ""
+			process := id
+			for time.Now().Before(deadline) {
+				input := Input{Key: fmt.Sprintf("lincheck-%d", random.Intn(w.keys))}
+				switch n := random.Intn(10); {
+				case n < 4:
+					input.Op = OpGet
+				case n < 7:
+					written++
+					input.Op, input.Value = OpSet, fmt.Sprintf("%d-%d", id, written)
+				case n < 8:
+					input.Op = OpDel
+				default:
+					written++
+					input.Op, input.Value, input.Expect = OpCas, fmt.Sprintf("%d-%d", id, written), lastRead
+				}
+				node := w.nodes[random.Intn(len(w.nodes))]
+				call := time.Since(w.start).Nanoseconds()
+				output, ok := w.execute(node, input)
+				if !ok {
+					// refused before it was proposed
+					continue
+				}
+				ret := time.Since(w.start).Nanoseconds()
+				if output.Unknown {
+					ret = linearizability.Unknown
+				}
+				if input.Op == OpGet && output.Found {
+					lastRead = output.Value
+				}
+				w.lock.Lock()
+				w.history = append(w.history, linearizability.Operation{
+					ClientId: process, Input: input, Output: output, Call: call, Return: ret,
+				})
+				w.lock.Unlock()
+				if output.Unknown {
+					// the operation stays pending forever, go on as a new
+					// process as a client must not overlap its own operations
+					process += clients
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return w.history
+}
+
+// execute reports false if the operation has certainly not been applied.
+func (w *workload) execute(node string, input Input) (Output, bool) {
+	target := fmt.Sprintf("http://%s/%s", node, url.PathEscape(input.Key))
+	var request *http.Request
+	switch input.Op {
+	case OpGet:
+		if !w.staleReads {
+			target += "?linearizable"
+		}
+		request, _ = http.NewRequest(http.MethodGet, target, nil)
+	case OpSet, OpCas:
+		if input.Op == OpCas {
+			target += "?expect=" + url.QueryEscape(input.Expect)
+		}
+		body, _ := json.Marshal(input.Value)
+		request, _ = http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	case OpDel:
+		request, _ = http.NewRequest(http.MethodDelete, target, nil)
+	}
+	// redirects to the leader are followed by the client
+	response, err := w.client.Do(request)
+	if err != nil {
+		var urlErr *url.Error
+		if input.Op == OpGet || (errors.As(err, &urlErr) && isDialError(urlErr)) {
+			return Output{}, false
+		}
+		return Output{Unknown: true}, true
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return Output{Unknown: true}, input.Op != OpGet
+	}
+	switch response.StatusCode {
+	case http.StatusOK:
+		output := Output{Ok: true}
+		if input.Op == OpGet {
+			output.Found = true
+			if json.Unmarshal(body, &output.Value) != nil {
+				return Output{}, false
+			}
+		}
+		return output, true
+	case http.StatusNotFound:
+		return Output{}, input.Op == OpGet
+	case http.StatusPreconditionFailed:
+		return Output{}, input.Op == OpCas
+	}
+	// a proposal may still commit after the node gave up on it, e.g. while
+	// it steps down or shuts down
+	return Output{Unknown: true}, input.Op != OpGet
+}
+
+func isDialError(err *url.Error) bool {
+	return strings.Contains(err.Error(), "connection refused")
+}
+
+// timeline draws every operation as a bar from its call to its return, an
+// operation with unknown outcome extends to the right edge.
+func timeline(history []linearizability.Operation) string {
+	const width = 60
+	history = slices.Clone(history)
+	slices.SortFunc(history, func(a, b linearizability.Operation) int {
+		return int(a.Call - b.Call)
+	})
+	first, last := history[0].Call, history[0].Call
+	for _, op := range history {
+		if op.Return != linearizability.Unknown {
+			last = max(last, op.Return)
+		}
+		last = max(last, op.Call)
+	}
+	span := max(last-first, 1)
+	column := func(t int64) int {
+		return int((t - first) * (width - 1) / span)
+	}
+	var out strings.Builder
+	for _, op := range history {
+		bar := []byte(strings.Repeat(" ", width))
+		from, to := column(op.Call), width-1
+		if op.Return != linearizability.Unknown {
+			to = column(op.Return)
+		}
+		for i := from; i <= to; i++ {
+			bar[i] = '-'
+		}
+		bar[from] = '|'
+		if op.Return == linearizability.Unknown {
+			bar[to] = '>'
+		} else {
+			bar[to] = '|'
+		}
+		fmt.Fprintf(&out, "%s %8.3fms client %d: %s\n", bar, float64(op.Call-first)/1e6, op.ClientId, describe(op))
+	}
+	return out.String()
+}
+
+func save(path string, history []linearizability.Operation) {
+	records := make([]record, 0, len(history))
+	for _, op := range history {
+		records = append(records, record{
+			ClientId: op.ClientId, Input: op.Input.(Input), Output: op.Output.(Output), Call: op.Call, Return: op.Return,
+		})
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to save history: %v\n", err)
+		os.Exit(2)
+	}
+}
+
+func load(path string) []linearizability.Operation {
+	data, err := os.ReadFile(path)
+	var records []record
+	if err == nil {
+		err = json.Unmarshal(data, &records)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load history: %v\n", err)
+		os.Exit(2)
+	}
+	history := make([]linearizability.Operation, 0, len(records))
+	for _, r := range records {
+		history = append(history, linearizability.Operation{
+			ClientId: r.ClientId, Input: r.Input, Output: r.Output, Call: r.Call, Return: r.Return,
+		})
+	}
+	return history
+}
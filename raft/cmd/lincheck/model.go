@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"chaddb/internal/linearizability"
+)
+
+const (
+	OpGet = "get"
+	OpSet = "set"
+	OpDel = "del"
+	OpCas = "cas"
+)
+
+type Input struct {
+	Op     string `json:"op"`
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Expect string `json:"expect,omitempty"`
+}
+
+// Output of an operation, Unknown if no response was received.
+type Output struct {
+	Unknown bool   `json:"unknown,omitempty"`
+	Found   bool   `json:"found,omitempty"`
+	Value   string `json:"value,omitempty"`
+	// Ok is false for a failed cas
+	Ok bool `json:"ok,omitempty"`
+}
+
+type kvState struct {
+	found bool
+	value string
+}
+
+var kvModel = linearizability.Model{
+	Partition: partitionByKey,
+	Init:      func() any { return kvState{} },
+	Step: func(state any, input any, output any) (bool, any) {
+		s, in, out := state.(kvState), input.(Input), output.(Output)
+		switch in.Op {
+		case OpGet:
+			return out.Unknown || (out.Found == s.found && out.Value == s.value), s
+		case OpSet:
+			return true, kvState{found: true, value: in.Value}
+		case OpDel:
+			return true, kvState{}
+		case OpCas:
+			matches := s.found && s.value == in.Expect
+			if out.Unknown {
+				if matches {
+					return true, kvState{found: true, value: in.Value}
+				}
+				return true, s
+			}
+			if out.Ok != matches {
+				return false, s
+			}
+			if matches {
+				return true, kvState{found: true, value: in.Value}
+			}
+			return true, s
+		}
+		return false, s
+	},
+	ReadOnly: func(op linearizability.Operation) bool {
+		in, out := op.Input.(Input), op.Output.(Output)
+		return in.Op == OpGet || (in.Op == OpCas && !out.Unknown && !out.Ok)
+	},
+}
+
+func partitionByKey(history []linearizability.Operation) [][]linearizability.Operation {
+	byKey := make(map[string][]linearizability.Operation)
+	for _, op := range history {
+		key := op.Input.(Input).Key
+		byKey[key] = append(byKey[key], op)
+	}
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	partitions := make([][]linearizability.Operation, 0, len(keys))
+	for _, key := range keys {
+		partitions = append(partitions, byKey[key])
+	}
+	return partitions
+}
+
+func describe(op linearizability.Operation) string {
+	in, out := op.Input.(Input), op.Output.(Output)
+	var call string
+	switch in.Op {
+	case OpGet:
+		call = fmt.Sprintf("get(%s)", in.Key)
+	case OpSet:
+		call = fmt.Sprintf("set(%s, %q)", in.Key, in.Value)
+	case OpDel:
+		call = fmt.Sprintf("del(%s)", in.Key)
+	case OpCas:
+		call = fmt.Sprintf("cas(%s, %q, %q)", in.Key, in.Expect, in.Value)
+	}
+	switch {
+	case out.Unknown:
+		return call + " -> ?"
+	case in.Op == OpGet && !out.Found:
+		return call + " -> not found"
+	case in.Op == OpGet:
+		return fmt.Sprintf("%s -> %q", call, out.Value)
+	case in.Op == OpCas:
+		return fmt.Sprintf("%s -> %t", call, out.Ok)
+	}
+	return call + " -> ok"
+}
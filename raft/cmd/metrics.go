@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"chaddb/internal/metrics"
+)
+
+var (
+	httpRequestsMetric = metrics.NewCounterVec("chaddb_http_requests_total", "HTTP requests by method and status code.", "method", "status")
+	httpDurationMetric = metrics.NewHistogramVec("chaddb_http_request_duration_seconds", "HTTP request latency by method.", metrics.DefBuckets, "method")
+)
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// instrument counts requests served by next and measures their latency.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: writer, status: http.StatusOK}
+		next.ServeHTTP(recorder, request)
+		httpRequestsMetric.WithLabelValues(request.Method, strconv.Itoa(recorder.status)).Inc()
+		httpDurationMetric.WithLabelValues(request.Method).Observe(time.Since(start).Seconds())
+	})
+}
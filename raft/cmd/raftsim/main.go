@@ -0,0 +1,63 @@
+// Command raftsim runs deterministic simulations of a raft cluster and
+// reports the seed of the first run that violates a safety invariant.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"chaddb/consensus/sim"
+)
+
+func main() {
+	defaults := sim.DefaultConfig(0)
+	seed := flag.Int64("seed", 0, "seed of the first run, random if 0")
+	runs := flag.Int("runs", 100, "number of runs, seeds are consecutive")
+	verbose := flag.Bool("v", false, "print every event")
+	flag.IntVar(&defaults.Nodes, "nodes", defaults.Nodes, "cluster size")
+	flag.IntVar(&defaults.Steps, "steps", defaults.Steps, "events per run")
+	flag.Float64Var(&defaults.DropRate, "drop", defaults.DropRate, "probability to drop a message")
+	flag.Float64Var(&defaults.DuplicateRate, "duplicate", defaults.DuplicateRate, "probability to duplicate a message")
+	flag.Float64Var(&defaults.PartitionRate, "partition", defaults.PartitionRate, "probability to partition the cluster per client tick")
+	flag.Float64Var(&defaults.CrashRate, "crash", defaults.CrashRate, "probability to crash a node per client tick")
+	flag.Float64Var(&defaults.TransferRate, "transfer", defaults.TransferRate, "probability to transfer leadership per client tick")
+	flag.Float64Var(&defaults.MembershipRate, "membership", defaults.MembershipRate, "probability to remove or add back a voter per client tick")
+	flag.IntVar(&defaults.SnapshotEntries, "snapshot-entries", defaults.SnapshotEntries, "applied entries after which a node compacts its log, 0 disables snapshots")
+	flag.DurationVar(&defaults.MaxDelay, "max-delay", defaults.MaxDelay, "maximum message delay")
+	flag.Parse()
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	for i := range *runs {
+		config := defaults
+		config.Seed = *seed + int64(i)
+		if *verbose {
+			config.Trace = func(line string) { fmt.Println(line) }
+		}
+		result := sim.Run(config)
+		if result.Failed() {
+			for _, line := range result.Trace {
+				fmt.Println(line)
+			}
+			fmt.Printf("\nseed %d: %s\n", result.Seed, result.Violation)
+			fmt.Printf("replay with: go run ./cmd/raftsim -runs 1 -seed %d %s\n", result.Seed, nonDefaultFlags())
+			os.Exit(1)
+		}
+		fmt.Printf("seed %d: ok, %d steps, %s simulated, %d entries committed, %d terms with a leader, %d crashes, %d membership changes\n",
+			result.Seed, result.Steps, result.Elapsed.Round(time.Millisecond), result.Committed, result.Elections, result.Crashes, result.MembershipChanges)
+	}
+}
+
+// nonDefaultFlags returns the simulation flags given on the command line.
+func nonDefaultFlags() string {
+	args := ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "seed" && f.Name != "runs" && f.Name != "v" {
+			args += fmt.Sprintf(" -%s %s", f.Name, f.Value)
+		}
+	})
+	return args
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"chaddb/apps/dbnode"
+	opt "chaddb/internal/options"
+
+	"ergo.services/ergo/act"
+	"ergo.services/ergo/gen"
+)
+
+// draining is set once shutdown started, the api refuses writes after that.
+var draining atomic.Bool
+
+type StartShutdown struct {
+}
+
+func factory_Shutdown() gen.ProcessBehavior {
+	return &Shutdown{}
+}
+
+// Shutdown prepares the node for leaving the cluster: it stops the api from
+// accepting writes and asks raftactor to drain pending proposals, hand over
+// leadership and sync the log. The channel passed as the first argument is
+// closed when done.
+type Shutdown struct {
+	act.Actor
+	done chan struct{}
+}
+
+func (s *Shutdown) Init(args ...any) error {
+	s.done = args[0].(chan struct{})
+	return nil
+}
+
+func (s *Shutdown) HandleMessage(from gen.PID, message any) error {
+	if _, ok := message.(StartShutdown); !ok {
+		return nil
+	}
+	defer close(s.done)
+
+	draining.Store(true)
+	// leave raftactor some time to answer before the node is stopped anyway
+	timeout := opt.ShutdownTimeout * 4 / 5
+	_, err := s.CallWithTimeout(gen.Atom("raftactor"), dbnode.PrepareShutdown{Timeout: timeout}, max(1, int(opt.ShutdownTimeout.Seconds())))
+	if err != nil {
+		s.Log().Warning("raftactor did not prepare for shutdown: %s", err)
+	}
+	return gen.TerminateReasonNormal
+}
+
+// shutdown runs the Shutdown process and stops the node once it is done or
+// -shutdown-timeout passed.
+func shutdown(node gen.Node) {
+	done := make(chan struct{})
+	pid, err := node.Spawn(factory_Shutdown, gen.ProcessOptions{}, done)
+	if err == nil {
+		err = node.Send(pid, StartShutdown{})
+	}
+	if err != nil {
+		node.Log().Error("unable to start graceful shutdown: %s", err)
+	} else {
+		select {
+		case <-done:
+		case <-time.After(opt.ShutdownTimeout):
+			node.Log().Warning("graceful shutdown deadline exceeded")
+		}
+	}
+	node.Stop()
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+
+	"chadcommon/certs"
+	opt "chaddb/internal/options"
+)
+
+// serveTLS serves handler over HTTPS with the certificates of -tls-cert. The
+// web server meta-process takes a certificate but no client CAs, so a server
+// of our own is used to verify client certificates with -tls-client-auth.
+func (w *HttpApi) serveTLS(address string, handler http.Handler) error {
+	server, err := certs.Serve(address, opt.Certs.ServerConfig(opt.TLSClientAuth), handler, func(err error) {
+		w.Log().Error("HTTPS server stopped: %s", err)
+	})
+	w.server = server
+	return err
+}
+
+func (w *HttpApi) Terminate(reason error) {
+	if w.server != nil {
+		w.server.Close()
+	}
+}
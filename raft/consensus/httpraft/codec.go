@@ -0,0 +1,70 @@
+package httpraft
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"chaddb/consensus"
+)
+
+// envelope is the body of a raft message request.
+type envelope struct {
+	Type    string          `json:"type"`
+	Message json.RawMessage `json:"message"`
+}
+
+func encodeMessage(message any) ([]byte, error) {
+	var kind string
+	switch message.(type) {
+	case consensus.RequestVote:
+		kind = "RequestVote"
+	case consensus.RequestVoteResult:
+		kind = "RequestVoteResult"
+	case consensus.AppendEntries:
+		kind = "AppendEntries"
+	case consensus.AppendEntriesResult:
+		kind = "AppendEntriesResult"
+	case consensus.InstallSnapshot:
+		kind = "InstallSnapshot"
+	case consensus.TimeoutNow:
+		kind = "TimeoutNow"
+	default:
+		return nil, fmt.Errorf("unknown message type %T", message)
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope{Type: kind, Message: data})
+}
+
+func decodeMessage(r io.Reader) (any, error) {
+	var env envelope
+	if err := json.NewDecoder(r).Decode(&env); err != nil {
+		return nil, err
+	}
+	switch env.Type {
+	case "RequestVote":
+		return decodeAs[consensus.RequestVote](env.Message)
+	case "RequestVoteResult":
+		return decodeAs[consensus.RequestVoteResult](env.Message)
+	case "AppendEntries":
+		return decodeAs[consensus.AppendEntries](env.Message)
+	case "AppendEntriesResult":
+		return decodeAs[consensus.AppendEntriesResult](env.Message)
+	case "InstallSnapshot":
+		return decodeAs[consensus.InstallSnapshot](env.Message)
+	case "TimeoutNow":
+		return decodeAs[consensus.TimeoutNow](env.Message)
+	}
+	return nil, fmt.Errorf("unknown message type %q", env.Type)
+}
+
+func decodeAs[T any](data json.RawMessage) (any, error) {
+	var message T
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
@@ -0,0 +1,350 @@
+// Package httpraft runs consensus.Node without ergo: nodes exchange raft
+// messages as JSON over HTTP and committed entries are applied to a
+// consensus.StateMachine in process.
+//
+//	node, err := httpraft.NewNode(httpraft.Config{
+//		Raft:         consensus.Config{Id: 1, Bootstrap: consensus.StaticMembership(3)},
+//		Peers:        map[int]string{1: "http://10.0.0.1:7001", 2: "http://10.0.0.2:7001", 3: "http://10.0.0.3:7001"},
+//		Token:        clusterToken,
+//		StateMachine: machine,
+//	})
+//	http.Handle(httpraft.MessagePath, node)
+//	node.Start()
+//	result, err := node.Propose(ctx, command)
+package httpraft
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"chaddb/consensus"
+)
+
+// MessagePath is where Node expects raft messages of its peers.
+const MessagePath = "/raft/message"
+
+// outboxSize is the number of messages queued per peer, further messages are
+// dropped until the peer catches up; raft retransmits on the next heartbeat.
+const outboxSize = 256
+
+var ErrStopped = errors.New("raft node is stopped")
+
+type Config struct {
+	Raft consensus.Config
+	// Peers maps node ids to base URLs of their Node handlers.
+	Peers map[int]string
+	// Token is the secret shared by the nodes of the cluster, they send it
+	// as a bearer token and refuse messages without it. With ClientCerts
+	// messages are accepted only over TLS with a verified client
+	// certificate, the server must request one with -tls-ca. At least one of
+	// them is required.
+	Token        string
+	ClientCerts  bool
+	StateMachine consensus.StateMachine
+	// Client must present a client certificate with ClientCerts.
+	Client *http.Client
+	// SnapshotEntries is the number of applied entries after which the log
+	// is compacted into a snapshot of StateMachine, 0 disables compaction.
+	SnapshotEntries int
+}
+
+// Node owns a consensus.Node and serializes access to it with a single
+// goroutine.
+type Node struct {
+	config   Config
+	raft     *consensus.Node
+	inbox    chan func()
+	stop     chan struct{}
+	timers   map[consensus.TimerKind]*time.Timer
+	timerSeq map[consensus.TimerKind]int
+	outboxes map[int]chan []byte
+	// applied is the id of the last entry applied to StateMachine
+	applied int
+}
+
+func NewNode(config Config) (*Node, error) {
+	if config.Token == "" && !config.ClientCerts {
+		return nil, errors.New("raft messages must be authenticated with Token or ClientCerts")
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: 5 * time.Second}
+	}
+	if config.Raft.Logger == nil {
+		config.Raft.Logger = stdLogger{}
+	}
+	config.Raft.Applied = config.StateMachine.AppliedIndex()
+	raft, err := consensus.NewNode(config.Raft)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{
+		config:   config,
+		raft:     raft,
+		inbox:    make(chan func(), 1024),
+		stop:     make(chan struct{}),
+		timers:   make(map[consensus.TimerKind]*time.Timer),
+		timerSeq: make(map[consensus.TimerKind]int),
+		outboxes: make(map[int]chan []byte),
+		applied:  config.Raft.Applied,
+	}, nil
+}
+
+// Start runs the node until Stop.
+func (n *Node) Start() {
+	for id, url := range n.config.Peers {
+		if id == n.config.Raft.Id {
+			continue
+		}
+		outbox := make(chan []byte, outboxSize)
+		n.outboxes[id] = outbox
+		go n.deliver(url+MessagePath, outbox)
+	}
+	go n.run()
+}
+
+func (n *Node) Stop() {
+	close(n.stop)
+}
+
+func (n *Node) run() {
+	n.processReady()
+	for {
+		select {
+		case <-n.stop:
+			for _, timer := range n.timers {
+				timer.Stop()
+			}
+			return
+		case f := <-n.inbox:
+			f()
+			n.processReady()
+		}
+	}
+}
+
+// do runs f on the node goroutine.
+func (n *Node) do(ctx context.Context, f func()) error {
+	select {
+	case n.inbox <- f:
+		return nil
+	case <-n.stop:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// call runs a request on the node goroutine and waits for its result, which
+// is either returned right away or delivered later with the token.
+func (n *Node) call(ctx context.Context, request func(token any) any) (any, error) {
+	token := make(chan any, 1)
+	err := n.do(ctx, func() {
+		if result := request(token); result != nil {
+			token <- result
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case result := <-token:
+		return result, nil
+	case <-n.stop:
+		return nil, ErrStopped
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Propose replicates command and returns the result of applying it, or
+// consensus.NotLeader and other refusals of the raft node.
+func (n *Node) Propose(ctx context.Context, command []byte) (any, error) {
+	return n.call(ctx, func(token any) any { return n.raft.Propose(command, token) })
+}
+
+func (n *Node) ChangeMembership(ctx context.Context, change consensus.ChangeMembership) (any, error) {
+	return n.call(ctx, func(token any) any { return n.raft.ChangeMembership(change, token) })
+}
+
+func (n *Node) TransferLeadership(ctx context.Context, to int) (any, error) {
+	return n.call(ctx, func(token any) any { return n.raft.TransferLeadership(to, token) })
+}
+
+// PrepareShutdown returns once the node handed over leadership and synced
+// its log, or after timeout.
+func (n *Node) PrepareShutdown(ctx context.Context, timeout time.Duration) (any, error) {
+	return n.call(ctx, func(token any) any { return n.raft.PrepareShutdown(timeout, token) })
+}
+
+func (n *Node) Status(ctx context.Context) (consensus.RaftStatus, error) {
+	var status consensus.RaftStatus
+	_, err := n.call(ctx, func(token any) any {
+		status = n.raft.Status()
+		return true
+	})
+	return status, err
+}
+
+func (n *Node) processReady() {
+	ready := n.raft.Ready()
+	for _, timer := range ready.Timers {
+		n.setTimer(timer)
+	}
+	if ready.Snapshot != nil {
+		if err := n.config.StateMachine.Restore(bytes.NewReader(ready.Snapshot.Data)); err != nil {
+			panic(fmt.Sprintf("unable to restore snapshot at %d: %s", ready.Snapshot.Id, err))
+		}
+		n.applied = ready.Snapshot.Id
+	}
+	for _, committed := range ready.Committed {
+		result := n.config.StateMachine.Apply(committed.Entry.Id, committed.Entry.Command)
+		n.applied = committed.Entry.Id
+		if token, ok := committed.Token.(chan any); ok {
+			token <- result
+		}
+	}
+	n.compact()
+	for _, response := range ready.Responses {
+		if token, ok := response.Token.(chan any); ok {
+			token <- response.Result
+		}
+	}
+	for _, envelope := range ready.Messages {
+		n.send(envelope)
+	}
+}
+
+// compact replaces the applied entries of the log with a snapshot of the
+// state machine every SnapshotEntries entries.
+func (n *Node) compact() {
+	if n.config.SnapshotEntries == 0 || n.applied-n.raft.Status().SnapshotId < n.config.SnapshotEntries {
+		return
+	}
+	var snapshot bytes.Buffer
+	if err := n.config.StateMachine.Snapshot(&snapshot); err != nil {
+		n.config.Raft.Logger.Error("unable to take a snapshot: %s", err)
+		return
+	}
+	if err := n.raft.Compact(n.config.StateMachine.AppliedIndex(), snapshot.Bytes()); err != nil {
+		n.config.Raft.Logger.Error("unable to compact the raft log: %s", err)
+	}
+}
+
+func (n *Node) setTimer(timer consensus.Timer) {
+	if pending, ok := n.timers[timer.Kind]; ok {
+		pending.Stop()
+		delete(n.timers, timer.Kind)
+	}
+	n.timerSeq[timer.Kind]++
+	if timer.Stop {
+		return
+	}
+	kind, seq := timer.Kind, n.timerSeq[timer.Kind]
+	n.timers[kind] = time.AfterFunc(timer.After, func() {
+		n.do(context.Background(), func() {
+			// the timer may have been replaced while this was queued
+			if n.timerSeq[kind] == seq {
+				delete(n.timers, kind)
+				n.raft.Tick(kind)
+			}
+		})
+	})
+}
+
+func (n *Node) send(envelope consensus.Envelope) {
+	outbox, ok := n.outboxes[envelope.To]
+	if !ok {
+		n.config.Raft.Logger.Warning("No address of node %d", envelope.To)
+		return
+	}
+	data, err := encodeMessage(envelope.Message)
+	if err != nil {
+		n.config.Raft.Logger.Error("unable to encode %T: %s", envelope.Message, err)
+		return
+	}
+	select {
+	case outbox <- data:
+	default:
+		// peer is slow or down
+	}
+}
+
+func (n *Node) deliver(url string, outbox chan []byte) {
+	for {
+		select {
+		case <-n.stop:
+			return
+		case data := <-outbox:
+			request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			request.Header.Set("Content-Type", "application/json")
+			if n.config.Token != "" {
+				request.Header.Set("Authorization", "Bearer "+n.config.Token)
+			}
+			res, err := n.config.Client.Do(request)
+			if err != nil {
+				continue
+			}
+			res.Body.Close()
+		}
+	}
+}
+
+// ServeHTTP accepts raft messages of peers at MessagePath.
+func (n *Node) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !n.authenticated(request) {
+		writer.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	message, err := decodeMessage(request.Body)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid raft message: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := n.do(request.Context(), func() { n.raft.Step(message) }); err != nil {
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+// authenticated reports whether request comes from a node of the cluster.
+func (n *Node) authenticated(request *http.Request) bool {
+	if n.config.ClientCerts && (request.TLS == nil || len(request.TLS.VerifiedChains) == 0) {
+		return false
+	}
+	if n.config.Token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(n.config.Token)) == 1
+}
+
+// stdLogger writes to the standard logger.
+type stdLogger struct{}
+
+func (stdLogger) Info(format string, args ...any) {
+	log.Printf("[info] "+format, args...)
+}
+
+func (stdLogger) Warning(format string, args ...any) {
+	log.Printf("[warning] "+format, args...)
+}
+
+func (stdLogger) Error(format string, args ...any) {
+	log.Printf("[error] "+format, args...)
+}
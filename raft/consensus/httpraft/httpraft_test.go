@@ -0,0 +1,265 @@
+package httpraft
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"chaddb/consensus"
+)
+
+const testToken = "cluster-secret"
+
+// listMachine applies commands by appending them to a list.
+type listMachine struct {
+	mu       sync.Mutex
+	Applied  int      `json:"applied"`
+	Commands []string `json:"commands"`
+}
+
+func newListMachine() *listMachine {
+	return &listMachine{Applied: -1}
+}
+
+func (m *listMachine) Apply(index int, command []byte) any {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Applied = index
+	m.Commands = append(m.Commands, string(command))
+	return index
+}
+
+func (m *listMachine) AppliedIndex() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.Applied
+}
+
+func (m *listMachine) Snapshot(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.NewEncoder(w).Encode(m)
+}
+
+func (m *listMachine) Restore(r io.Reader) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return json.NewDecoder(r).Decode(m)
+}
+
+func (m *listMachine) Close() error {
+	return nil
+}
+
+func (m *listMachine) commands() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.Commands)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Info(format string, args ...any)    {}
+func (nopLogger) Warning(format string, args ...any) {}
+func (nopLogger) Error(format string, args ...any)   {}
+
+// testCluster runs nodes behind httptest servers, a node can be replaced
+// while its server keeps the address.
+type testCluster struct {
+	t        *testing.T
+	peers    map[int]string
+	nodes    map[int]*atomic.Pointer[Node]
+	machines map[int]*listMachine
+}
+
+func newTestCluster(t *testing.T, size int) *testCluster {
+	c := &testCluster{t: t, peers: make(map[int]string), nodes: make(map[int]*atomic.Pointer[Node]), machines: make(map[int]*listMachine)}
+	for id := 1; id <= size; id++ {
+		current := &atomic.Pointer[Node]{}
+		c.nodes[id] = current
+		server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			if n := current.Load(); n != nil {
+				n.ServeHTTP(writer, request)
+			} else {
+				http.Error(writer, "node is down", http.StatusServiceUnavailable)
+			}
+		}))
+		t.Cleanup(server.Close)
+		c.peers[id] = server.URL
+	}
+	for id := 1; id <= size; id++ {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for id := range c.nodes {
+			c.stop(id)
+		}
+	})
+	return c
+}
+
+// start runs the node with empty storage and state machine.
+func (c *testCluster) start(id int) {
+	machine := newListMachine()
+	n, err := NewNode(Config{
+		Raft: consensus.Config{
+			Id:                id,
+			Bootstrap:         consensus.StaticMembership(len(c.peers)),
+			Logger:            nopLogger{},
+			ElectionTimeout:   150 * time.Millisecond,
+			ElectionJitter:    150 * time.Millisecond,
+			HeartbeatInterval: 30 * time.Millisecond,
+		},
+		Peers:           c.peers,
+		Token:           testToken,
+		StateMachine:    machine,
+		SnapshotEntries: 5,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.machines[id] = machine
+	c.nodes[id].Store(n)
+	n.Start()
+}
+
+func (c *testCluster) stop(id int) {
+	if n := c.nodes[id].Swap(nil); n != nil {
+		n.Stop()
+	}
+}
+
+func (c *testCluster) status(id int) consensus.RaftStatus {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	status, err := c.nodes[id].Load().Status(ctx)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return status
+}
+
+// eventually fails the test if condition does not hold within 10 seconds.
+func (c *testCluster) eventually(what string, condition func() bool) {
+	c.t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// propose retries command on the nodes until one of them is the leader and
+// commits it.
+func (c *testCluster) propose(command string) {
+	c.t.Helper()
+	c.eventually("commit of "+command, func() bool {
+		for id, current := range c.nodes {
+			n := current.Load()
+			if n == nil || c.status(id).Role != consensus.Leader.String() {
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			result, err := n.Propose(ctx, []byte(command))
+			cancel()
+			if _, ok := result.(int); ok && err == nil {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func (c *testCluster) waitApplied(ids []int, commands []string) {
+	c.t.Helper()
+	for _, id := range ids {
+		c.eventually("node to apply all commands", func() bool {
+			return slices.Equal(c.machines[id].commands(), commands)
+		})
+	}
+}
+
+func TestCluster(t *testing.T) {
+	c := newTestCluster(t, 3)
+	var commands []string
+	for i := range 10 {
+		commands = append(commands, "first-"+string(rune('a'+i)))
+		c.propose(commands[len(commands)-1])
+	}
+	c.waitApplied([]int{1, 2, 3}, commands)
+
+	// a node that lost its storage catches up from a snapshot
+	down := 3
+	if c.status(3).Role == consensus.Leader.String() {
+		down = 1
+	}
+	c.stop(down)
+	for i := range 10 {
+		commands = append(commands, "second-"+string(rune('a'+i)))
+		c.propose(commands[len(commands)-1])
+	}
+	c.start(down)
+	c.waitApplied([]int{1, 2, 3}, commands)
+	if status := c.status(down); status.SnapshotId < 0 {
+		t.Fatalf("node %d caught up without a snapshot", down)
+	}
+}
+
+func TestUnauthenticatedMessages(t *testing.T) {
+	if _, err := NewNode(Config{Raft: consensus.Config{Id: 1}, StateMachine: newListMachine()}); err == nil {
+		t.Fatal("node without Token or ClientCerts created")
+	}
+
+	tests := []struct {
+		name        string
+		token       string
+		clientCerts bool
+		header      string
+		code        int
+	}{
+		{"no token", testToken, false, "", http.StatusUnauthorized},
+		{"wrong token", testToken, false, "Bearer other", http.StatusUnauthorized},
+		{"token", testToken, false, "Bearer " + testToken, http.StatusAccepted},
+		{"token without client certificate", testToken, true, "Bearer " + testToken, http.StatusUnauthorized},
+		{"no client certificate", "", true, "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n, err := NewNode(Config{
+				Raft:         consensus.Config{Id: 1, Bootstrap: consensus.StaticMembership(3), Logger: nopLogger{}},
+				Token:        test.token,
+				ClientCerts:  test.clientCerts,
+				StateMachine: newListMachine(),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.Start()
+			defer n.Stop()
+
+			data, err := encodeMessage(consensus.RequestVote{NodeId: 2, Term: 1, LastLogId: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			request := httptest.NewRequest(http.MethodPost, MessagePath, strings.NewReader(string(data)))
+			if test.header != "" {
+				request.Header.Set("Authorization", test.header)
+			}
+			recorder := httptest.NewRecorder()
+			n.ServeHTTP(recorder, request)
+			if recorder.Code != test.code {
+				t.Fatalf("status %d, want %d", recorder.Code, test.code)
+			}
+		})
+	}
+}
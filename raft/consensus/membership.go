@@ -0,0 +1,75 @@
+package consensus
+
+import (
+	"slices"
+)
+
+// Membership is a cluster configuration stored in the log. While a change is
+// in progress the configuration is joint: both Voters and NewVoters are set and
+// every decision requires a majority in each of them. Learners receive the log
+// but neither vote nor count toward commit.
+type Membership struct {
+	Voters    []int `json:"voters"`
+	NewVoters []int `json:"newVoters,omitempty"`
+	Learners  []int `json:"learners,omitempty"`
+}
+
+// StaticMembership returns a configuration of voters 1..count.
+func StaticMembership(count int) Membership {
+	voters := make([]int, 0, count)
+	for i := 1; i <= count; i++ {
+		voters = append(voters, i)
+	}
+	return Membership{Voters: voters}
+}
+
+func (m Membership) IsJoint() bool {
+	return len(m.NewVoters) > 0
+}
+
+func (m Membership) IsVoter(id int) bool {
+	return slices.Contains(m.Voters, id) || slices.Contains(m.NewVoters, id)
+}
+
+func (m Membership) IsLearner(id int) bool {
+	return slices.Contains(m.Learners, id)
+}
+
+// VotingNodes returns voters of both configurations in ascending order.
+func (m Membership) VotingNodes() []int {
+	nodes := append(slices.Clone(m.Voters), m.NewVoters...)
+	slices.Sort(nodes)
+	return slices.Compact(nodes)
+}
+
+// Nodes returns all nodes of the configuration including learners in
+// ascending order.
+func (m Membership) Nodes() []int {
+	nodes := append(m.VotingNodes(), m.Learners...)
+	slices.Sort(nodes)
+	return slices.Compact(nodes)
+}
+
+// Leave returns the final configuration of a joint one.
+func (m Membership) Leave() Membership {
+	return Membership{Voters: m.NewVoters, Learners: m.Learners}
+}
+
+// HasQuorum reports whether acked holds for a majority of voters (of both
+// configurations when joint).
+func (m Membership) HasQuorum(acked func(id int) bool) bool {
+	if !hasMajority(m.Voters, acked) {
+		return false
+	}
+	return !m.IsJoint() || hasMajority(m.NewVoters, acked)
+}
+
+func hasMajority(voters []int, acked func(id int) bool) bool {
+	count := 0
+	for _, id := range voters {
+		if acked(id) {
+			count++
+		}
+	}
+	return count > len(voters)/2
+}
@@ -0,0 +1,173 @@
+package consensus
+
+import (
+	"time"
+)
+
+type Role int
+
+const (
+	Follower Role = iota
+	Candidate
+	Leader
+	Learner
+)
+
+func (r Role) String() string {
+	switch r {
+	case Follower:
+		return "Follower"
+	case Candidate:
+		return "Candidate"
+	case Leader:
+		return "Leader"
+	case Learner:
+		return "Learner"
+	}
+	return "Unknown"
+}
+
+type EntryKind int
+
+const (
+	DataEntry EntryKind = iota
+	ConfigEntry
+	// NoopEntry is appended by a new leader, committing it commits the
+	// entries of previous terms.
+	NoopEntry
+)
+
+type LogEntry struct {
+	Id      int        `json:"id"`
+	Term    int        `json:"term"`
+	Kind    EntryKind  `json:"kind"`
+	Command []byte     `json:"command,omitempty"`
+	Config  Membership `json:"config"`
+}
+
+// Messages exchanged between nodes. Every message is one way, results carry
+// the id of the node that sent them.
+
+// RequestVote is ignored by nodes that hear from a leader unless Transfer is
+// set, the leader asked the candidate to campaign with TimeoutNow.
+type RequestVote struct {
+	NodeId      int
+	Term        int
+	LastLogId   int
+	LastLogTerm int
+	Transfer    bool
+}
+
+type RequestVoteResult struct {
+	NodeId  int
+	Term    int
+	Granted bool
+}
+
+type AppendEntries struct {
+	Term     int
+	LeaderId int
+	Entries  []LogEntry
+	CommitId int
+}
+
+// Snapshot is the state of the state machine after applying entries up to
+// Id, Term and Membership are those of that entry. Data is opaque to raft.
+type Snapshot struct {
+	Id         int        `json:"id"`
+	Term       int        `json:"term"`
+	Membership Membership `json:"membership"`
+	Data       []byte     `json:"data"`
+}
+
+// InstallSnapshot is sent by the leader instead of AppendEntries to a node
+// that needs entries the leader has compacted. The node answers with
+// AppendEntriesResult.
+type InstallSnapshot struct {
+	Term     int
+	LeaderId int
+	Snapshot Snapshot
+}
+
+// AppendEntriesResult reports the commit id of the follower and LastId, the
+// id of the last entry of the request it holds (its commit id if the request
+// had no entries).
+type AppendEntriesResult struct {
+	NodeId   int
+	Term     int
+	CommitId int
+	LastId   int
+}
+
+// TimeoutNow is sent by the leader to the transfer target once it is up to
+// date and makes it start an election immediately.
+type TimeoutNow struct {
+	Term int
+}
+
+// Results of client requests.
+
+// NotLeader is returned to client requests that can only be served by the
+// leader. LeaderId is 0 if the leader is unknown.
+type NotLeader struct {
+	LeaderId int
+}
+
+// ChangeMembership adds, promotes or removes a single node. Voter changes
+// go through joint consensus, learner changes take a single configuration
+// entry. The result is the new Membership once the final configuration is
+// committed.
+type ChangeMembership struct {
+	Add     int
+	Learner bool
+	Promote int
+	Remove  int
+}
+
+type MembershipChangeRejected struct {
+	Reason string
+}
+
+type LeadershipTransferred struct {
+	LeaderId int
+}
+
+type TransferRejected struct {
+	Reason string
+}
+
+// ShuttingDown is returned to proposals refused or failed due to shutdown.
+type ShuttingDown struct {
+}
+
+// TransferInProgress is returned to proposals while the leader hands over
+// leadership.
+type TransferInProgress struct {
+	To int
+}
+
+type RaftStatus struct {
+	NodeId         int              `json:"nodeId"`
+	Role           string           `json:"role"`
+	Term           int              `json:"term"`
+	VotedFor       int              `json:"votedFor"`
+	LeaderId       int              `json:"leaderId"`
+	SnapshotId     int              `json:"snapshotIndex"`
+	LastLogId      int              `json:"lastLogIndex"`
+	LastLogTerm    int              `json:"lastLogTerm"`
+	CommitId       int              `json:"commitIndex"`
+	LastApplied    int              `json:"appliedIndex"`
+	Membership     Membership       `json:"membership"`
+	TransferTarget int              `json:"transferTarget,omitempty"`
+	Followers      []FollowerStatus `json:"followers,omitempty"`
+}
+
+// FollowerStatus is the replication progress of a peer as seen by the leader.
+type FollowerStatus struct {
+	NodeId      int       `json:"nodeId"`
+	MatchId     int       `json:"matchIndex"`
+	NextId      int       `json:"nextIndex"`
+	LastContact time.Time `json:"lastContact"`
+}
+
+const MaxLogEntries = 1000
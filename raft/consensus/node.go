@@ -0,0 +1,1123 @@
+// Package consensus is the raft implementation of chaddb without any I/O.
+//
+// A Node is driven by its host: incoming messages are passed to Step, fired
+// timers to Tick and client requests to Propose, ChangeMembership,
+// TransferLeadership and PrepareShutdown. After each of these calls the host
+// takes Ready and sends the messages, (re)arms the timers, applies the
+// committed entries and answers the requests it contains. Node is not safe
+// for concurrent use, the host serializes all calls.
+package consensus
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"time"
+
+	. "chaddb/internal/utils"
+)
+
+type Config struct {
+	Id int
+	// Bootstrap is the configuration used until the log contains a
+	// configuration entry.
+	Bootstrap Membership
+
+	// State, Snapshot and Entries are restored from Storage, Entries follow
+	// the snapshot. Applied is the index of the last entry the state machine
+	// already has, if it is behind the snapshot the first Ready restores it.
+	State    RaftState
+	Snapshot *Snapshot
+	Entries  []LogEntry
+	Applied  int
+	// Storage persists term, vote and entries, nil keeps them in memory.
+	Storage Storage
+
+	Logger Logger
+	Rand   *rand.Rand
+	Now    func() time.Time
+
+	// The election timeout is chosen randomly in
+	// [ElectionTimeout, ElectionTimeout+ElectionJitter).
+	ElectionTimeout   time.Duration
+	ElectionJitter    time.Duration
+	HeartbeatInterval time.Duration
+	// MaxAppendEntries limits the number of entries in one AppendEntries.
+	MaxAppendEntries int
+}
+
+// Storage is implemented by *RaftLog.
+type Storage interface {
+	Append(entries ...LogEntry) error
+	SaveState(state RaftState) error
+	// SaveSnapshot persists snapshot and replaces the log with entries, the
+	// ones that follow it.
+	SaveSnapshot(snapshot Snapshot, entries []LogEntry) error
+	Sync() error
+}
+
+// Logger is implemented by gen.Log of ergo.
+type Logger interface {
+	Info(format string, args ...any)
+	Warning(format string, args ...any)
+	Error(format string, args ...any)
+}
+
+type TimerKind int
+
+const (
+	ElectionTimer TimerKind = iota
+	HeartbeatTimer
+	TransferTimer
+	ShutdownTimer
+)
+
+// Timer replaces the pending timer of the same kind, Stop cancels it. When it
+// fires the host calls Tick.
+type Timer struct {
+	Kind  TimerKind
+	After time.Duration
+	Stop  bool
+}
+
+type Envelope struct {
+	To      int
+	Message any
+}
+
+// Committed is a data entry to apply. Token is the one given to Propose on
+// this node, nil for entries proposed elsewhere; the result of applying the
+// entry is the response to it.
+type Committed struct {
+	Entry LogEntry
+	Token any
+}
+
+// Response completes a request accepted earlier with Token.
+type Response struct {
+	Token  any
+	Result any
+}
+
+// Ready is carried out in order: Snapshot, if set, replaces the state of the
+// state machine before Committed entries are applied to it.
+type Ready struct {
+	Snapshot  *Snapshot
+	Messages  []Envelope
+	Timers    []Timer
+	Committed []Committed
+	Responses []Response
+}
+
+// Stats are counters since the start of the node.
+type Stats struct {
+	ElectionsWon  int
+	ElectionsLost int
+}
+
+type Node struct {
+	config   Config
+	id       int
+	storage  Storage
+	logger   Logger
+	ready    Ready
+	stats    Stats
+	role     Role
+	term     int
+	votedFor int
+	leaderId int
+	votes    map[int]bool
+	// leaderContact is when this node last heard from the leader
+	leaderContact time.Time
+
+	commitId    int
+	lastApplied int
+	// log holds the entries following the snapshot, Id -1 if there is none
+	snapshot       Snapshot
+	log            []LogEntry
+	nodeToCommitId map[int]int
+	nodeToLastId   map[int]int
+	nodeToContact  map[int]time.Time
+
+	membership       Membership
+	membershipId     int
+	membershipChange any
+
+	transferTarget  int
+	transferRequest any
+
+	shuttingDown     bool
+	shutdownExpired  bool
+	shutdownTransfer bool
+	shutdownRequest  any
+
+	proposals []proposal
+}
+
+type proposal struct {
+	Id    int
+	Term  int
+	Token any
+}
+
+func NewNode(config Config) (*Node, error) {
+	if config.Storage == nil {
+		config.Storage = (*RaftLog)(nil)
+	}
+	if config.Logger == nil {
+		config.Logger = nopLogger{}
+	}
+	if config.Rand == nil {
+		config.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if config.Now == nil {
+		config.Now = time.Now
+	}
+	if config.ElectionTimeout == 0 {
+		config.ElectionTimeout = 10 * time.Second
+		config.ElectionJitter = time.Second
+	}
+	if config.HeartbeatInterval == 0 {
+		config.HeartbeatInterval = 3 * time.Second
+	}
+	if config.MaxAppendEntries == 0 {
+		config.MaxAppendEntries = 10
+	}
+	snapshot := Snapshot{Id: -1}
+	if config.Snapshot != nil {
+		snapshot = *config.Snapshot
+	}
+	if len(config.Entries) > 0 && config.Entries[0].Id != snapshot.Id+1 {
+		return nil, fmt.Errorf("the raft log starts with entry %d but the snapshot ends with %d", config.Entries[0].Id, snapshot.Id)
+	}
+	if config.Applied > snapshot.Id+len(config.Entries) {
+		return nil, fmt.Errorf("storage applied entry %d but the raft log ends with %d", config.Applied, snapshot.Id+len(config.Entries))
+	}
+
+	n := &Node{
+		config:         config,
+		id:             config.Id,
+		storage:        config.Storage,
+		logger:         config.Logger,
+		term:           config.State.Term,
+		votedFor:       config.State.VotedFor,
+		snapshot:       snapshot,
+		log:            slices.Clone(config.Entries),
+		commitId:       config.Applied,
+		lastApplied:    config.Applied,
+		nodeToCommitId: make(map[int]int),
+		nodeToLastId:   make(map[int]int),
+		nodeToContact:  make(map[int]time.Time),
+	}
+	if config.Applied < snapshot.Id {
+		n.logger.Info("Restoring the state machine from the snapshot at %d", snapshot.Id)
+		n.ready.Snapshot = &snapshot
+		n.commitId = snapshot.Id
+		n.lastApplied = snapshot.Id
+	}
+	n.reloadMembership()
+	n.logger.Info("Role changed: %s", n.passiveRole())
+	n.role = n.passiveRole()
+	n.scheduleElection()
+	return n, nil
+}
+
+// Ready returns everything the node asked for since the previous call.
+// Appended entries are synced to disk before messages that acknowledge them
+// are handed out.
+func (n *Node) Ready() Ready {
+	Must(n.storage.Sync())
+	ready := n.ready
+	n.ready = Ready{}
+	return ready
+}
+
+func (n *Node) Stats() Stats {
+	return n.stats
+}
+
+func (n *Node) Role() Role {
+	return n.role
+}
+
+func (n *Node) Membership() Membership {
+	return n.membership
+}
+
+// Step handles a message from another node.
+func (n *Node) Step(message any) {
+	switch msg := message.(type) {
+	case RequestVote:
+		n.requestVote(msg)
+	case RequestVoteResult:
+		n.requestVoteResult(msg)
+	case AppendEntries:
+		n.appendEntries(msg)
+	case AppendEntriesResult:
+		n.appendEntriesResult(msg)
+	case InstallSnapshot:
+		n.installSnapshot(msg)
+	case TimeoutNow:
+		n.timeoutNow(msg)
+	default:
+		n.logger.Warning("Unknown message type %T", message)
+	}
+}
+
+// Tick handles a fired timer.
+func (n *Node) Tick(kind TimerKind) {
+	switch kind {
+	case ElectionTimer:
+		if n.role != Leader {
+			n.election(false)
+		}
+	case HeartbeatTimer:
+		if n.role == Leader {
+			n.sendAppendEntries()
+		}
+	case TransferTimer:
+		n.abortTransfer()
+	case ShutdownTimer:
+		n.shutdownDeadline()
+	}
+}
+
+func (n *Node) send(to int, message any) {
+	n.ready.Messages = append(n.ready.Messages, Envelope{To: to, Message: message})
+}
+
+func (n *Node) setTimer(kind TimerKind, after time.Duration) {
+	n.ready.Timers = append(n.ready.Timers, Timer{Kind: kind, After: after})
+}
+
+func (n *Node) stopTimer(kind TimerKind) {
+	n.ready.Timers = append(n.ready.Timers, Timer{Kind: kind, Stop: true})
+}
+
+func (n *Node) respond(token any, result any) {
+	n.ready.Responses = append(n.ready.Responses, Response{Token: token, Result: result})
+}
+
+// persistState saves term and vote, must be called whenever they change.
+func (n *Node) persistState() {
+	Must(n.storage.SaveState(RaftState{Term: n.term, VotedFor: n.votedFor}))
+}
+
+// passiveRole is the role of this node when it is neither leading nor
+// campaigning.
+func (n *Node) passiveRole() Role {
+	if n.membership.IsLearner(n.id) {
+		return Learner
+	}
+	return Follower
+}
+
+func (n *Node) setRole(role Role) {
+	if n.role != role {
+		n.logger.Info("Role changed: %s", role)
+	}
+	if n.role == Leader && role != Leader {
+		n.dropMembershipChange()
+	}
+	n.role = role
+}
+
+// dropMembershipChange answers a pending ChangeMembership request when the
+// node stops leading. Only a former leader has its entries replaced, so this
+// also covers a configuration entry truncated by the next leader, which may
+// as well commit it.
+func (n *Node) dropMembershipChange() {
+	if n.membershipChange != nil {
+		n.respond(n.membershipChange, NotLeader{LeaderId: n.leaderId})
+		n.membershipChange = nil
+	}
+}
+
+// scheduleElection makes the node passive and restarts the election timer.
+func (n *Node) scheduleElection() {
+	n.setRole(n.passiveRole())
+	n.resetElectionTimer()
+}
+
+func (n *Node) resetElectionTimer() {
+	timeout := n.config.ElectionTimeout
+	if n.config.ElectionJitter > 0 {
+		timeout += time.Duration(n.config.Rand.Int63n(int64(n.config.ElectionJitter)))
+	}
+	n.setTimer(ElectionTimer, timeout)
+}
+
+// stepDown follows a node with a newer term.
+func (n *Node) stepDown(term int) {
+	if n.role == Candidate {
+		n.stats.ElectionsLost++
+	}
+	n.term = term
+	n.votedFor = 0
+	n.leaderId = 0
+	n.persistState()
+	n.scheduleElection()
+}
+
+// peers returns all nodes of the current configuration including learners
+// except this one.
+func (n *Node) peers() []int {
+	return slices.DeleteFunc(n.membership.Nodes(), func(id int) bool { return id == n.id })
+}
+
+// votingPeers returns voters of the current configuration except this one.
+func (n *Node) votingPeers() []int {
+	return slices.DeleteFunc(n.membership.VotingNodes(), func(id int) bool { return id == n.id })
+}
+
+// election makes the node campaign, transfer is set when the leader asked
+// for it with TimeoutNow.
+func (n *Node) election(transfer bool) {
+	if !n.membership.IsVoter(n.id) || n.shuttingDown {
+		// Nodes outside of the configuration must not disrupt the cluster.
+		n.scheduleElection()
+		return
+	}
+
+	if n.role == Candidate {
+		n.stats.ElectionsLost++
+		n.logger.Info("election failed with %d votes", len(n.votes))
+	}
+	n.logger.Info("Started Election")
+	n.setRole(Candidate)
+	n.term++
+	n.votedFor = n.id
+	n.leaderId = 0
+	n.persistState()
+	n.votes = map[int]bool{n.id: true}
+	// election may be started by TimeoutNow before the timer fires, the
+	// next one starts if this one does not succeed in time
+	n.resetElectionTimer()
+
+	lastLogId, lastLogTerm := n.lastLog()
+	for _, id := range n.votingPeers() {
+		n.send(id, RequestVote{NodeId: n.id, Term: n.term, LastLogId: lastLogId, LastLogTerm: lastLogTerm, Transfer: transfer})
+	}
+	n.countVotes()
+}
+
+func (n *Node) countVotes() {
+	if !n.membership.HasQuorum(func(id int) bool { return n.votes[id] }) {
+		return
+	}
+	n.stats.ElectionsWon++
+	n.logger.Info("election success with term %d", n.term)
+	n.setRole(Leader)
+	n.leaderId = n.id
+	n.votes = nil
+	n.nodeToCommitId = make(map[int]int)
+	n.nodeToLastId = make(map[int]int)
+	n.nodeToContact = make(map[int]time.Time)
+	n.stopTimer(ElectionTimer)
+	if n.membership.IsJoint() && n.membershipId <= n.commitId {
+		// previous leader committed the joint configuration but did not
+		// manage to append the final one
+		n.appendEntry(LogEntry{Kind: ConfigEntry, Config: n.membership.Leave()})
+	} else {
+		// entries of previous terms are committed only together with one
+		// of the current term
+		n.appendEntry(LogEntry{Kind: NoopEntry})
+	}
+	n.sendAppendEntries()
+}
+
+func (n *Node) requestVote(request RequestVote) {
+	// A node missing from its configuration may have been added by entries
+	// it has not received yet, the candidate may need its vote to make
+	// progress. Learners never vote.
+	if n.membership.IsLearner(n.id) {
+		n.logger.Info("Not Voted for node %d: learner", request.NodeId)
+		n.send(request.NodeId, RequestVoteResult{NodeId: n.id, Term: n.term})
+		return
+	}
+	if request.Term > n.term && !request.Transfer && n.hasLeader() {
+		// A removed node does not receive the configuration without it and
+		// keeps starting elections, nodes that hear from a leader ignore it.
+		n.logger.Info("Not Voted for node %d: leader %d is alive", request.NodeId, n.leaderId)
+		n.send(request.NodeId, RequestVoteResult{NodeId: n.id, Term: n.term})
+		return
+	}
+	if request.Term > n.term {
+		if n.role == Candidate {
+			n.stats.ElectionsLost++
+		}
+		n.term = request.Term
+		n.votedFor = 0
+		n.leaderId = 0
+		n.persistState()
+		if n.role == Leader || n.role == Candidate {
+			n.stopTimer(HeartbeatTimer)
+			n.scheduleElection()
+		}
+	}
+
+	lastLogId, lastLogTerm := n.lastLog()
+	upToDate := request.LastLogTerm > lastLogTerm || (request.LastLogTerm == lastLogTerm && request.LastLogId >= lastLogId)
+	if request.Term == n.term && (n.votedFor == 0 || n.votedFor == request.NodeId) && upToDate {
+		n.votedFor = request.NodeId
+		n.persistState()
+		n.scheduleElection()
+		n.logger.Info("Voted for node %d", request.NodeId)
+		n.send(request.NodeId, RequestVoteResult{NodeId: n.id, Term: n.term, Granted: true})
+		return
+	}
+
+	n.logger.Info("Not Voted for node %d", request.NodeId)
+	n.send(request.NodeId, RequestVoteResult{NodeId: n.id, Term: n.term})
+}
+
+// hasLeader reports whether this node leads or heard from the leader within
+// an election timeout.
+func (n *Node) hasLeader() bool {
+	if n.role == Leader {
+		return true
+	}
+	return n.leaderId != 0 && n.config.Now().Sub(n.leaderContact) < n.config.ElectionTimeout
+}
+
+// lastLog returns id and term of the last log entry, those of the snapshot
+// if there are no entries after it and -1 and 0 if the log is empty.
+func (n *Node) lastLog() (int, int) {
+	if len(n.log) == 0 {
+		return n.snapshot.Id, n.snapshot.Term
+	}
+	last := n.log[len(n.log)-1]
+	return last.Id, last.Term
+}
+
+// lastId returns the id of the last log entry including compacted ones, -1
+// if the log is empty.
+func (n *Node) lastId() int {
+	return n.snapshot.Id + len(n.log)
+}
+
+// entry returns the entry with id, which must follow the snapshot.
+func (n *Node) entry(id int) LogEntry {
+	return n.log[id-n.snapshot.Id-1]
+}
+
+// entries returns entries from..to inclusive, they must follow the
+// snapshot.
+func (n *Node) entries(from int, to int) []LogEntry {
+	return n.log[from-n.snapshot.Id-1 : to-n.snapshot.Id]
+}
+
+func (n *Node) requestVoteResult(result RequestVoteResult) {
+	if result.Term > n.term {
+		n.logger.Info("Node %d has newer term %d, stepping down", result.NodeId, result.Term)
+		n.stepDown(result.Term)
+		return
+	}
+	if n.role != Candidate || result.Term != n.term || !result.Granted {
+		return
+	}
+	n.votes[result.NodeId] = true
+	n.countVotes()
+}
+
+// sendAppendEntries replicates the log to all peers and schedules the next
+// heartbeat.
+func (n *Node) sendAppendEntries() {
+	for _, id := range n.peers() {
+		n.replicate(id)
+	}
+	n.setTimer(HeartbeatTimer, n.config.HeartbeatInterval)
+}
+
+// replicate sends the node entries following the last one known to match its
+// log, or the snapshot if they are compacted. Until the match is known the
+// request has no entries.
+func (n *Node) replicate(nodeId int) {
+	entries := []LogEntry{}
+	if lastId, ok := n.nodeToLastId[nodeId]; ok {
+		if lastId < n.snapshot.Id {
+			n.send(nodeId, InstallSnapshot{Term: n.term, LeaderId: n.id, Snapshot: n.snapshot})
+			return
+		}
+		next := min(lastId+1, n.lastId()+1)
+		// the message may outlive this slice of the log
+		entries = slices.Clone(n.entries(next, min(n.lastId(), next+n.config.MaxAppendEntries-1)))
+	}
+	n.send(nodeId, AppendEntries{Term: n.term, LeaderId: n.id, Entries: entries, CommitId: n.commitId})
+}
+
+func (n *Node) appendEntriesResult(result AppendEntriesResult) {
+	if result.Term > n.term {
+		n.logger.Info("Node %d has newer term %d, stepping down", result.NodeId, result.Term)
+		n.stepDown(result.Term)
+		return
+	}
+	if n.role != Leader || result.Term < n.term {
+		// late answer to a previous leadership of this node
+		return
+	}
+	previous, known := n.nodeToLastId[result.NodeId]
+	n.nodeToContact[result.NodeId] = n.config.Now()
+	n.nodeToCommitId[result.NodeId] = result.CommitId
+	n.nodeToLastId[result.NodeId] = result.LastId
+	if (!known || result.LastId > previous) && result.LastId < n.lastId() {
+		// the node is catching up, send the next entries without waiting
+		// for the heartbeat
+		n.replicate(result.NodeId)
+	}
+
+	n.moveStateMachine(n.quorumLastId())
+	n.tryTransferLeadership()
+	n.continueShutdown()
+}
+
+// quorumLastId returns the greatest log id replicated to a quorum of the
+// current configuration. Only entries of the current term are committed by
+// counting replicas, earlier ones are committed together with them.
+func (n *Node) quorumLastId() int {
+	for id := n.lastId(); id > n.commitId && n.entry(id).Term == n.term; id-- {
+		if n.membership.HasQuorum(func(node int) bool { return n.lastIdOf(node) >= id }) {
+			return id
+		}
+	}
+	return n.commitId
+}
+
+func (n *Node) lastIdOf(node int) int {
+	if node == n.id {
+		return n.lastId()
+	}
+	if lastId, ok := n.nodeToLastId[node]; ok {
+		return lastId
+	}
+	return -1
+}
+
+// followLeader makes the node follow the sender of a request of the leader
+// of term. It answers a request of an earlier term and returns false.
+func (n *Node) followLeader(term int, leaderId int) bool {
+	if term < n.term {
+		n.send(leaderId, AppendEntriesResult{NodeId: n.id, Term: n.term, CommitId: n.commitId, LastId: n.commitId})
+		return false
+	}
+	if term > n.term {
+		n.term = term
+		n.votedFor = 0
+		n.persistState()
+	}
+	if n.role == Candidate {
+		n.stats.ElectionsLost++
+	}
+	n.leaderId = leaderId
+	n.leaderContact = n.config.Now()
+	n.scheduleElection()
+	if n.transferTarget != 0 && n.transferTarget == leaderId {
+		n.logger.Info("Leadership transferred to node %d", leaderId)
+		n.finishTransfer(LeadershipTransferred{LeaderId: leaderId})
+	}
+	return true
+}
+
+func (n *Node) appendEntries(request AppendEntries) {
+	if !n.followLeader(request.Term, request.LeaderId) {
+		return
+	}
+
+	configChanged := false
+	gap := false
+	for _, newEntry := range request.Entries {
+		if newEntry.Id <= n.snapshot.Id {
+			// compacted entries are committed, so they match
+			continue
+		} else if newEntry.Id <= n.lastId() {
+			if n.entry(newEntry.Id).Term == newEntry.Term {
+				continue
+			} else {
+				// conflicting entry left by another leader, drop it together
+				// with everything after it
+				n.log = append(n.log[:newEntry.Id-n.snapshot.Id-1], newEntry)
+				Must(n.storage.Append(newEntry))
+				configChanged = true
+			}
+		} else if newEntry.Id == n.lastId()+1 {
+			n.log = append(n.log, newEntry)
+			Must(n.storage.Append(newEntry))
+			configChanged = configChanged || newEntry.Kind == ConfigEntry
+		} else {
+			// the node lost entries the leader believes it has, e.g. after
+			// a restart without persistent log
+			n.logger.Warning("AppendEntries from node %d skips entries %d..%d", request.LeaderId, n.lastId()+1, newEntry.Id-1)
+			gap = true
+			break
+		}
+	}
+	if configChanged {
+		n.reloadMembership()
+		n.updateRole()
+	}
+
+	// the log matches the leader only up to the last entry of the request,
+	// anything after it may be left from another leader
+	lastId := n.commitId
+	if len(request.Entries) > 0 && !gap {
+		lastId = request.Entries[len(request.Entries)-1].Id
+	}
+	if commitId := min(request.CommitId, lastId); commitId > n.commitId {
+		n.moveStateMachine(commitId)
+	}
+	n.send(request.LeaderId, AppendEntriesResult{NodeId: n.id, Term: n.term, CommitId: n.commitId, LastId: lastId})
+}
+
+// installSnapshot replaces the log up to the snapshot unless the node has
+// already committed it. Entries following the snapshot are kept if the log
+// matches it.
+func (n *Node) installSnapshot(request InstallSnapshot) {
+	if !n.followLeader(request.Term, request.LeaderId) {
+		return
+	}
+
+	snapshot := request.Snapshot
+	if snapshot.Id > n.commitId {
+		n.logger.Info("Installing snapshot at %d from node %d", snapshot.Id, request.LeaderId)
+		if snapshot.Id <= n.lastId() && n.entry(snapshot.Id).Term == snapshot.Term {
+			n.log = slices.Clone(n.log[snapshot.Id-n.snapshot.Id:])
+		} else {
+			n.log = nil
+		}
+		n.snapshot = snapshot
+		Must(n.storage.SaveSnapshot(snapshot, n.log))
+		n.commitId = snapshot.Id
+		n.lastApplied = snapshot.Id
+		// the snapshot includes whatever was committed but not handed out
+		// yet, proposals it covers may have been replaced
+		for _, committed := range n.ready.Committed {
+			if committed.Token != nil {
+				n.respond(committed.Token, NotLeader{LeaderId: n.leaderId})
+			}
+		}
+		n.ready.Committed = nil
+		for len(n.proposals) > 0 && n.proposals[0].Id <= snapshot.Id {
+			n.respond(n.proposals[0].Token, NotLeader{LeaderId: n.leaderId})
+			n.proposals = n.proposals[1:]
+		}
+		n.ready.Snapshot = &snapshot
+		n.reloadMembership()
+		n.updateRole()
+	}
+	n.send(request.LeaderId, AppendEntriesResult{NodeId: n.id, Term: n.term, CommitId: n.commitId, LastId: n.commitId})
+}
+
+// Compact replaces entries up to id with data, a snapshot the host took of
+// the state machine after applying them.
+func (n *Node) Compact(id int, data []byte) error {
+	if id <= n.snapshot.Id {
+		return nil
+	}
+	if id > n.commitId {
+		return fmt.Errorf("entry %d is not committed", id)
+	}
+	membership, _ := n.membershipAt(id)
+	snapshot := Snapshot{Id: id, Term: n.entry(id).Term, Membership: membership, Data: data}
+	n.log = slices.Clone(n.log[id-n.snapshot.Id:])
+	n.snapshot = snapshot
+	n.logger.Info("Compacted the raft log up to entry %d", id)
+	Must(n.storage.SaveSnapshot(n.snapshot, n.log))
+	return nil
+}
+
+func (n *Node) moveStateMachine(toId int) {
+	if n.commitId > toId {
+		panic("MoveStateMachine encountered impossible situation 1")
+	}
+
+	for _, entry := range n.entries(n.commitId+1, toId) {
+		n.commitId = entry.Id
+		n.lastApplied = entry.Id
+		if entry.Kind == ConfigEntry {
+			n.commitMembership(entry)
+			continue
+		} else if entry.Kind == NoopEntry {
+			continue
+		}
+		n.logger.Info("Moved state machine to id %d", entry.Id)
+		n.ready.Committed = append(n.ready.Committed, Committed{Entry: entry, Token: n.takeProposal(entry)})
+	}
+}
+
+// takeProposal returns the token of the proposal committed as entry. Earlier
+// proposals and the one replaced by an entry of another leader are answered
+// with NotLeader.
+func (n *Node) takeProposal(entry LogEntry) any {
+	for len(n.proposals) > 0 && n.proposals[0].Id <= entry.Id {
+		p := n.proposals[0]
+		n.proposals = n.proposals[1:]
+		if p.Id == entry.Id && p.Term == entry.Term {
+			return p.Token
+		}
+		n.respond(p.Token, NotLeader{LeaderId: n.leaderId})
+	}
+	return nil
+}
+
+// commitMembership drives the joint consensus on the leader: once the joint
+// configuration is committed the final one is appended, and once the final
+// one is committed the pending ChangeMembership request is answered.
+func (n *Node) commitMembership(entry LogEntry) {
+	n.logger.Info("Committed membership voters %v new voters %v", entry.Config.Voters, entry.Config.NewVoters)
+	if n.role != Leader || entry.Id != n.membershipId {
+		return
+	}
+
+	if entry.Config.IsJoint() {
+		n.appendEntry(LogEntry{Kind: ConfigEntry, Config: entry.Config.Leave()})
+		return
+	}
+
+	if n.membershipChange != nil {
+		n.respond(n.membershipChange, n.membership)
+		n.membershipChange = nil
+	}
+	if !n.membership.IsVoter(n.id) {
+		n.logger.Info("Removed from voters, stepping down")
+		n.leaderId = 0
+		n.stopTimer(HeartbeatTimer)
+		n.scheduleElection()
+	}
+}
+
+// reloadMembership sets the current configuration to the latest one in the
+// log, committed or not.
+func (n *Node) reloadMembership() {
+	n.membership, n.membershipId = n.membershipAt(n.lastId())
+}
+
+// membershipAt returns the configuration in effect at entry id and the id of
+// the entry it comes from, that of the snapshot if it was compacted and -1
+// for Bootstrap.
+func (n *Node) membershipAt(id int) (Membership, int) {
+	for ; id > n.snapshot.Id; id-- {
+		if entry := n.entry(id); entry.Kind == ConfigEntry {
+			return entry.Config, id
+		}
+	}
+	if n.snapshot.Id >= 0 {
+		return n.snapshot.Membership, n.snapshot.Id
+	}
+	return n.config.Bootstrap, -1
+}
+
+// updateRole switches between Follower and Learner after the configuration
+// of this node changed.
+func (n *Node) updateRole() {
+	if n.role == Follower || n.role == Learner {
+		n.setRole(n.passiveRole())
+	}
+}
+
+func (n *Node) appendEntry(entry LogEntry) LogEntry {
+	entry.Id = n.lastId() + 1
+	entry.Term = n.term
+	n.log = append(n.log, entry)
+	Must(n.storage.Append(entry))
+	if entry.Kind == ConfigEntry {
+		n.membership = entry.Config
+		n.membershipId = entry.Id
+	}
+	return entry
+}
+
+// Propose appends command to the log. It returns nil if the proposal is
+// accepted, the result is delivered with Token in Committed or Responses.
+// Otherwise the returned value is the result.
+func (n *Node) Propose(command []byte, token any) any {
+	if n.role != Leader {
+		return NotLeader{LeaderId: n.leaderId}
+	}
+	if n.transferTarget != 0 {
+		return TransferInProgress{To: n.transferTarget}
+	}
+	if n.shuttingDown {
+		return ShuttingDown{}
+	}
+	entry := n.appendEntry(LogEntry{Command: command})
+	n.proposals = append(n.proposals, proposal{Id: entry.Id, Term: entry.Term, Token: token})
+	return nil
+}
+
+// ChangeMembership starts a membership change and returns nil, the new
+// Membership is delivered with token in Responses. Otherwise the returned
+// value is the result.
+func (n *Node) ChangeMembership(request ChangeMembership, token any) any {
+	if n.role != Leader {
+		return NotLeader{LeaderId: n.leaderId}
+	}
+	if n.transferTarget != 0 {
+		return TransferInProgress{To: n.transferTarget}
+	}
+	if n.shuttingDown {
+		return ShuttingDown{}
+	}
+	if n.membershipChange != nil || n.membership.IsJoint() || n.membershipId > n.commitId {
+		return MembershipChangeRejected{Reason: "another membership change is in progress"}
+	}
+
+	current := n.membership
+	voters := slices.Clone(current.Voters)
+	learners := slices.Clone(current.Learners)
+	switch {
+	case request.Add != 0:
+		if slices.Contains(current.Nodes(), request.Add) {
+			return MembershipChangeRejected{Reason: "node is already a member"}
+		}
+		if request.Learner {
+			learners = insertSorted(learners, request.Add)
+		} else {
+			voters = insertSorted(voters, request.Add)
+		}
+	case request.Promote != 0:
+		if !current.IsLearner(request.Promote) {
+			return MembershipChangeRejected{Reason: "node is not a learner"}
+		}
+		if n.lastIdOf(request.Promote) < n.commitId {
+			return MembershipChangeRejected{Reason: "learner is not caught up yet"}
+		}
+		learners = slices.DeleteFunc(learners, func(id int) bool { return id == request.Promote })
+		voters = insertSorted(voters, request.Promote)
+	default:
+		if current.IsLearner(request.Remove) {
+			learners = slices.DeleteFunc(learners, func(id int) bool { return id == request.Remove })
+		} else if slices.Contains(voters, request.Remove) {
+			voters = slices.DeleteFunc(voters, func(id int) bool { return id == request.Remove })
+			if len(voters) == 0 {
+				return MembershipChangeRejected{Reason: "can not remove the last member"}
+			}
+		} else {
+			return MembershipChangeRejected{Reason: "node is not a member"}
+		}
+	}
+
+	next := Membership{Voters: current.Voters, Learners: learners}
+	if !slices.Equal(voters, current.Voters) {
+		next.NewVoters = voters
+	}
+	n.logger.Info("Changing membership from %v learners %v to %v learners %v", current.Voters, current.Learners, voters, learners)
+	n.appendEntry(LogEntry{Kind: ConfigEntry, Config: next})
+	n.membershipChange = token
+	return nil
+}
+
+func insertSorted(ids []int, id int) []int {
+	ids = append(ids, id)
+	slices.Sort(ids)
+	return ids
+}
+
+// TransferLeadership hands leadership over to the voter to and returns nil,
+// the result is delivered with token in Responses once to becomes the
+// leader or after an election timeout. Otherwise the returned value is the
+// result.
+func (n *Node) TransferLeadership(to int, token any) any {
+	if n.role != Leader {
+		return NotLeader{LeaderId: n.leaderId}
+	}
+	if to == n.id {
+		return LeadershipTransferred{LeaderId: n.id}
+	}
+	if !n.membership.IsVoter(to) {
+		return TransferRejected{Reason: "target is not a voter"}
+	}
+	if n.transferTarget != 0 {
+		return TransferRejected{Reason: "another leadership transfer is in progress"}
+	}
+	if n.shuttingDown {
+		return TransferRejected{Reason: "node is shutting down"}
+	}
+
+	n.startTransfer(to, token)
+	return nil
+}
+
+func (n *Node) startTransfer(target int, token any) {
+	n.logger.Info("Transferring leadership to node %d", target)
+	n.transferTarget = target
+	n.transferRequest = token
+	// give up after one election timeout
+	n.setTimer(TransferTimer, n.config.ElectionTimeout)
+	n.tryTransferLeadership()
+}
+
+// tryTransferLeadership sends TimeoutNow to the transfer target once it has
+// the whole log and the current commit id. Until then the target is caught up
+// by regular AppendEntries while no new proposals are accepted.
+func (n *Node) tryTransferLeadership() {
+	if n.role != Leader || n.transferTarget == 0 {
+		return
+	}
+	target := n.transferTarget
+	commitId, ok := n.nodeToCommitId[target]
+	if !ok || commitId < n.commitId || n.lastIdOf(target) < n.lastId() {
+		return
+	}
+
+	n.logger.Info("Node %d is up to date, sending TimeoutNow", target)
+	n.send(target, TimeoutNow{Term: n.term})
+}
+
+func (n *Node) timeoutNow(message TimeoutNow) {
+	if message.Term < n.term || n.role == Leader || !n.membership.IsVoter(n.id) {
+		return
+	}
+	n.logger.Info("Received TimeoutNow, starting election")
+	n.election(true)
+}
+
+func (n *Node) abortTransfer() {
+	if n.transferTarget == 0 {
+		return
+	}
+	n.logger.Info("Leadership transfer to node %d timed out", n.transferTarget)
+	n.finishTransfer(TransferRejected{Reason: "leadership transfer timed out"})
+}
+
+func (n *Node) finishTransfer(result any) {
+	n.stopTimer(TransferTimer)
+	if n.transferRequest != nil {
+		n.respond(n.transferRequest, result)
+		n.transferRequest = nil
+	}
+	n.transferTarget = 0
+	n.continueShutdown()
+}
+
+// PrepareShutdown makes the node stop accepting proposals, wait for pending
+// ones to commit, hand over leadership and sync the log. It returns nil and
+// delivers true with token in Responses when done; whatever is left after
+// timeout is failed. It returns false if a shutdown is already in progress.
+func (n *Node) PrepareShutdown(timeout time.Duration, token any) any {
+	if n.shuttingDown {
+		return false
+	}
+	n.logger.Info("Preparing for shutdown")
+	n.shuttingDown = true
+	n.shutdownRequest = token
+	n.setTimer(ShutdownTimer, timeout)
+	n.continueShutdown()
+	return nil
+}
+
+// continueShutdown completes the shutdown once the leader has no pending
+// proposals and made an attempt to hand over leadership.
+func (n *Node) continueShutdown() {
+	if n.shutdownRequest == nil {
+		return
+	}
+	if n.role == Leader && !n.shutdownExpired {
+		if len(n.proposals) > 0 || n.membershipChange != nil || n.transferTarget != 0 {
+			return
+		}
+		if target := n.transferCandidate(); target != 0 && !n.shutdownTransfer {
+			n.shutdownTransfer = true
+			n.startTransfer(target, nil)
+			return
+		}
+	}
+
+	n.failPendingProposals()
+	if err := n.storage.Sync(); err != nil {
+		n.logger.Error("unable to sync raft log: %s", err)
+	}
+	n.stopTimer(ShutdownTimer)
+	n.logger.Info("Ready for shutdown")
+	n.respond(n.shutdownRequest, true)
+	n.shutdownRequest = nil
+}
+
+func (n *Node) shutdownDeadline() {
+	if n.shutdownRequest == nil {
+		return
+	}
+	n.logger.Warning("Shutdown deadline exceeded, failing pending proposals")
+	n.shutdownExpired = true
+	if n.transferTarget != 0 {
+		n.finishTransfer(TransferRejected{Reason: "node is shutting down"})
+		return
+	}
+	n.continueShutdown()
+}
+
+// transferCandidate returns the voter with the longest log or 0 if there is
+// no other voter.
+func (n *Node) transferCandidate() int {
+	candidate := 0
+	for _, id := range n.votingPeers() {
+		if candidate == 0 || n.lastIdOf(id) > n.lastIdOf(candidate) {
+			candidate = id
+		}
+	}
+	return candidate
+}
+
+func (n *Node) failPendingProposals() {
+	for _, p := range n.proposals {
+		n.respond(p.Token, ShuttingDown{})
+	}
+	n.proposals = nil
+	if n.membershipChange != nil {
+		n.respond(n.membershipChange, MembershipChangeRejected{Reason: "node is shutting down"})
+		n.membershipChange = nil
+	}
+}
+
+func (n *Node) Status() RaftStatus {
+	status := RaftStatus{
+		NodeId:         n.id,
+		Role:           n.role.String(),
+		Term:           n.term,
+		VotedFor:       n.votedFor,
+		LeaderId:       n.leaderId,
+		SnapshotId:     n.snapshot.Id,
+		CommitId:       n.commitId,
+		LastApplied:    n.lastApplied,
+		Membership:     n.membership,
+		TransferTarget: n.transferTarget,
+	}
+	status.LastLogId, status.LastLogTerm = n.lastLog()
+	if n.role != Leader {
+		return status
+	}
+	for _, id := range n.peers() {
+		follower := FollowerStatus{NodeId: id, MatchId: n.lastIdOf(id), LastContact: n.nodeToContact[id]}
+		if lastId, ok := n.nodeToLastId[id]; ok {
+			follower.NextId = lastId + 1
+		}
+		status.Followers = append(status.Followers, follower)
+	}
+	return status
+}
+
+// Persisted returns the state, snapshot and entries handed to Storage, what
+// the node would recover after a restart. Call it after Ready.
+func (n *Node) Persisted() (RaftState, *Snapshot, []LogEntry) {
+	var snapshot *Snapshot
+	if n.snapshot.Id >= 0 {
+		snapshot = &n.snapshot
+	}
+	return RaftState{Term: n.term, VotedFor: n.votedFor}, snapshot, slices.Clone(n.log)
+}
+
+// LogRange returns entries from..to inclusive, at most MaxLogEntries of them.
+// Compacted entries are left out.
+func (n *Node) LogRange(from int, to int) []LogEntry {
+	from = max(from, n.snapshot.Id+1)
+	to = min(to, n.lastId(), from+MaxLogEntries-1)
+	if from > to {
+		return []LogEntry{}
+	}
+	return slices.Clone(n.entries(from, to))
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Info(format string, args ...any)    {}
+func (nopLogger) Warning(format string, args ...any) {}
+func (nopLogger) Error(format string, args ...any)   {}
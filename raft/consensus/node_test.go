@@ -0,0 +1,748 @@
+package consensus
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T, id int) *Node {
+	t.Helper()
+	n, err := NewNode(Config{Id: id, Bootstrap: StaticMembership(3), Applied: -1, Rand: rand.New(rand.NewSource(1))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Ready()
+	return n
+}
+
+func voteGranted(t *testing.T, n *Node) bool {
+	t.Helper()
+	for _, envelope := range n.Ready().Messages {
+		if result, ok := envelope.Message.(RequestVoteResult); ok {
+			return result.Granted
+		}
+	}
+	t.Fatal("no RequestVoteResult sent")
+	return false
+}
+
+func TestVoteIsResetWhenTermGoesUp(t *testing.T) {
+	tests := []struct {
+		name string
+		// newTerm moves node 1 to term 2 after it voted in term 1
+		newTerm func(n *Node)
+	}{
+		{"AppendEntries", func(n *Node) { n.Step(AppendEntries{Term: 2, LeaderId: 3, CommitId: -1}) }},
+		{"AppendEntriesResult", func(n *Node) { n.Step(AppendEntriesResult{NodeId: 3, Term: 2, CommitId: -1, LastId: -1}) }},
+		{"RequestVoteResult", func(n *Node) { n.Step(RequestVoteResult{NodeId: 3, Term: 2}) }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			n := newTestNode(t, 1)
+			n.Step(RequestVote{NodeId: 2, Term: 1, LastLogId: -1})
+			if !voteGranted(t, n) {
+				t.Fatal("vote in term 1 not granted")
+			}
+
+			test.newTerm(n)
+			n.Ready()
+			if status := n.Status(); status.Term != 2 || status.VotedFor != 0 {
+				t.Fatalf("term %d voted for %d, want term 2 without a vote", status.Term, status.VotedFor)
+			}
+			if state, _, _ := n.Persisted(); state.VotedFor != 0 {
+				t.Fatalf("persisted vote for %d in term 2", state.VotedFor)
+			}
+			n.Step(RequestVote{NodeId: 3, Term: 2, LastLogId: -1})
+			if !voteGranted(t, n) {
+				t.Fatal("vote in term 2 not granted")
+			}
+		})
+	}
+}
+
+func TestOneVotePerTerm(t *testing.T) {
+	n := newTestNode(t, 1)
+	n.Step(RequestVote{NodeId: 2, Term: 1, LastLogId: -1})
+	if !voteGranted(t, n) {
+		t.Fatal("first vote not granted")
+	}
+	n.Step(RequestVote{NodeId: 3, Term: 1, LastLogId: -1})
+	if voteGranted(t, n) {
+		t.Fatal("second vote in the same term granted")
+	}
+}
+
+// testCluster delivers messages between nodes until there are none left,
+// the state machine of a node is the list of commands it applied. Messages
+// from and to isolated nodes are dropped and the clock moves only in
+// elections.
+type testCluster struct {
+	t         *testing.T
+	nodes     map[int]*Node
+	applied   map[int][]string
+	responses map[any]any
+	isolated  map[int]bool
+	now       time.Time
+}
+
+const testElectionTimeout = time.Second
+
+func newTestCluster(t *testing.T) *testCluster {
+	return &testCluster{
+		t:         t,
+		nodes:     make(map[int]*Node),
+		applied:   make(map[int][]string),
+		responses: make(map[any]any),
+		isolated:  make(map[int]bool),
+	}
+}
+
+func (c *testCluster) start(id int, bootstrap Membership) {
+	n, err := NewNode(Config{
+		Id:              id,
+		Bootstrap:       bootstrap,
+		Applied:         -1,
+		Rand:            rand.New(rand.NewSource(int64(id))),
+		Now:             func() time.Time { return c.now },
+		ElectionTimeout: testElectionTimeout,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = n
+}
+
+func (c *testCluster) run() {
+	for c.round() {
+	}
+}
+
+// round carries out Ready of every node and delivers the messages, it
+// returns false if there were none.
+func (c *testCluster) round() bool {
+	var messages []Envelope
+	for _, id := range slices.Sorted(maps.Keys(c.nodes)) {
+		n := c.nodes[id]
+		ready := n.Ready()
+		if ready.Snapshot != nil {
+			var restored []string
+			if err := json.Unmarshal(ready.Snapshot.Data, &restored); err != nil {
+				c.t.Fatal(err)
+			}
+			c.applied[id] = restored
+		}
+		for _, committed := range ready.Committed {
+			c.applied[id] = append(c.applied[id], string(committed.Entry.Command))
+			if committed.Token != nil {
+				c.responses[committed.Token] = committed.Entry.Id
+			}
+		}
+		for _, response := range ready.Responses {
+			c.responses[response.Token] = response.Result
+		}
+		if !c.isolated[id] {
+			messages = append(messages, ready.Messages...)
+		}
+	}
+	if len(messages) == 0 {
+		return false
+	}
+	for _, envelope := range messages {
+		if n, ok := c.nodes[envelope.To]; ok && !c.isolated[envelope.To] {
+			n.Step(envelope.Message)
+		}
+	}
+	return true
+}
+
+// elect makes node id campaign once the previous leader was silent for an
+// election timeout and expects it to win.
+func (c *testCluster) elect(id int) *Node {
+	c.t.Helper()
+	c.now = c.now.Add(testElectionTimeout)
+	c.nodes[id].Tick(ElectionTimer)
+	c.run()
+	if role := c.nodes[id].Role(); role != Leader {
+		c.t.Fatalf("node %d is %s after its election", id, role)
+	}
+	return c.nodes[id]
+}
+
+// heartbeat makes leader replicate its log and commit id. A follower
+// commits only entries a request of the leader matched, so it takes two
+// heartbeats for followers to catch up with the commit id of the leader.
+func (c *testCluster) heartbeat(leader *Node) {
+	for range 2 {
+		leader.Tick(HeartbeatTimer)
+		c.run()
+	}
+}
+
+// await sends heartbeats of leader until the request with token is answered
+// and the followers know that it is, it returns the result.
+func (c *testCluster) await(leader *Node, token any) any {
+	for range 10 {
+		c.heartbeat(leader)
+		if result, ok := c.responses[token]; ok {
+			c.heartbeat(leader)
+			return result
+		}
+	}
+	return nil
+}
+
+// propose commits command through the leader.
+func (c *testCluster) propose(leader *Node, command string) {
+	c.t.Helper()
+	if result := leader.Propose([]byte(command), command); result != nil {
+		c.t.Fatalf("proposal %s refused: %v", command, result)
+	}
+	if result := c.await(leader, command); result == nil {
+		c.t.Fatalf("proposal %s not committed", command)
+	} else if _, ok := result.(int); !ok {
+		c.t.Fatalf("proposal %s failed: %v", command, result)
+	}
+}
+
+// changeMembership runs request on the leader and returns its result.
+func (c *testCluster) changeMembership(leader *Node, request ChangeMembership) any {
+	c.t.Helper()
+	token := fmt.Sprintf("%+v", request)
+	if result := leader.ChangeMembership(request, token); result != nil {
+		return result
+	}
+	return c.await(leader, token)
+}
+
+// configs returns the configurations in the log of n.
+func configs(n *Node) []string {
+	var configs []string
+	for _, entry := range n.LogRange(0, n.Status().LastLogId) {
+		if entry.Kind == ConfigEntry {
+			configs = append(configs, fmt.Sprint(entry.Config))
+		}
+	}
+	return configs
+}
+
+func TestLearnerReceivesSnapshot(t *testing.T) {
+	bootstrap := Membership{Voters: []int{1, 2}, Learners: []int{3}}
+	c := newTestCluster(t)
+	c.start(1, bootstrap)
+	c.start(2, bootstrap)
+	leader := c.elect(1)
+	for i := range 20 {
+		c.propose(leader, fmt.Sprint(i))
+	}
+
+	data, err := json.Marshal(c.applied[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	compacted := leader.Status().CommitId
+	if err := leader.Compact(compacted, data); err != nil {
+		t.Fatal(err)
+	}
+	if entries := leader.LogRange(0, compacted); len(entries) != 0 {
+		t.Fatalf("compacted entries %d..%d are still in the log", entries[0].Id, entries[len(entries)-1].Id)
+	}
+	c.propose(leader, "after")
+
+	c.start(3, Membership{})
+	c.heartbeat(leader)
+	learner := c.nodes[3].Status()
+	if learner.Role != Learner.String() || learner.SnapshotId != compacted || learner.CommitId != leader.Status().CommitId {
+		t.Fatalf("learner is %s with snapshot at %d and commit id %d, leader has %d and %d",
+			learner.Role, learner.SnapshotId, learner.CommitId, compacted, leader.Status().CommitId)
+	}
+	if !slices.Equal(c.applied[3], c.applied[1]) {
+		t.Fatalf("learner applied %v, leader %v", c.applied[3], c.applied[1])
+	}
+}
+
+func TestLearnerDoesNotVote(t *testing.T) {
+	bootstrap := Membership{Voters: []int{1, 2}, Learners: []int{3}}
+	c := newTestCluster(t)
+	for id := 1; id <= 3; id++ {
+		c.start(id, bootstrap)
+	}
+	learner := c.nodes[3]
+	learner.Ready()
+	learner.Step(RequestVote{NodeId: 2, Term: 1, LastLogId: -1, Transfer: true})
+	if voteGranted(t, learner) {
+		t.Fatal("learner granted its vote")
+	}
+	term := learner.Status().Term
+	learner.Tick(ElectionTimer)
+	for _, envelope := range learner.Ready().Messages {
+		t.Fatalf("learner sent %T after its election timeout", envelope.Message)
+	}
+	if status := learner.Status(); status.Role != Learner.String() || status.Term != term {
+		t.Fatalf("learner is %s in term %d, was in term %d", status.Role, status.Term, term)
+	}
+}
+
+func TestLearnerDoesNotCountTowardQuorum(t *testing.T) {
+	bootstrap := Membership{Voters: []int{1, 2}, Learners: []int{3}}
+	c := newTestCluster(t)
+	for id := 1; id <= 3; id++ {
+		c.start(id, bootstrap)
+	}
+	leader := c.elect(1)
+	c.propose(leader, "before")
+
+	// the leader and the learner alone are no majority of {1, 2}
+	c.isolated[2] = true
+	commitId := leader.Status().CommitId
+	if result := leader.Propose([]byte("isolated"), "isolated"); result != nil {
+		t.Fatalf("proposal refused: %v", result)
+	}
+	if result := c.await(leader, "isolated"); result != nil {
+		t.Fatalf("proposal resulted in %v without a majority of voters", result)
+	}
+	if status := c.nodes[3].Status(); status.LastLogId != leader.Status().LastLogId {
+		t.Fatalf("learner holds entries up to %d, leader %d", status.LastLogId, leader.Status().LastLogId)
+	}
+	if got := leader.Status().CommitId; got != commitId {
+		t.Fatalf("leader committed %d with the learner, was %d", got, commitId)
+	}
+
+	delete(c.isolated, 2)
+	if result := c.await(leader, "isolated"); result == nil {
+		t.Fatal("proposal not committed once node 2 is back")
+	}
+}
+
+func TestPromoteLearner(t *testing.T) {
+	c := newTestCluster(t)
+	for id := 1; id <= 3; id++ {
+		c.start(id, StaticMembership(3))
+	}
+	leader := c.elect(1)
+	c.propose(leader, "before")
+
+	if result := c.changeMembership(leader, ChangeMembership{Promote: 4}); result != (MembershipChangeRejected{Reason: "node is not a learner"}) {
+		t.Fatalf("promoting a non-member resulted in %v", result)
+	}
+	c.start(4, Membership{})
+	learners := Membership{Voters: []int{1, 2, 3}, Learners: []int{4}}
+	if result := c.changeMembership(leader, ChangeMembership{Add: 4, Learner: true}); fmt.Sprint(result) != fmt.Sprint(learners) {
+		t.Fatalf("adding learner 4 resulted in %v, want %v", result, learners)
+	}
+	if role := c.nodes[4].Role(); role != Learner {
+		t.Fatalf("node 4 is %s", role)
+	}
+
+	want := Membership{Voters: []int{1, 2, 3, 4}}
+	if result := c.changeMembership(leader, ChangeMembership{Promote: 4}); fmt.Sprint(result) != fmt.Sprint(want) {
+		t.Fatalf("promoting node 4 resulted in %v, want %v", result, want)
+	}
+	// Adding a learner takes a single configuration entry, the promotion
+	// goes through the joint configuration.
+	wantConfigs := []string{
+		fmt.Sprint(learners),
+		fmt.Sprint(Membership{Voters: []int{1, 2, 3}, NewVoters: []int{1, 2, 3, 4}}),
+		fmt.Sprint(want),
+	}
+	for id, n := range c.nodes {
+		if got := configs(n); !slices.Equal(got, wantConfigs) {
+			t.Fatalf("node %d has configurations %v, want %v", id, got, wantConfigs)
+		}
+	}
+	if role := c.nodes[4].Role(); role != Follower {
+		t.Fatalf("promoted node 4 is %s", role)
+	}
+
+	// node 4 votes now
+	c.isolated[1] = true
+	c.run()
+	leader = c.elect(4)
+	delete(c.isolated, 1)
+	c.propose(leader, "after")
+	if !slices.Equal(c.applied[1], c.applied[4]) {
+		t.Fatalf("node 1 applied %v, node 4 %v", c.applied[1], c.applied[4])
+	}
+}
+
+func TestChangeMembership(t *testing.T) {
+	c := newTestCluster(t)
+	for id := 1; id <= 3; id++ {
+		c.start(id, StaticMembership(3))
+	}
+	leader := c.elect(1)
+	c.propose(leader, "before")
+
+	c.start(4, Membership{})
+	want := Membership{Voters: []int{1, 2, 3, 4}}
+	if result := c.changeMembership(leader, ChangeMembership{Add: 4}); fmt.Sprint(result) != fmt.Sprint(want) {
+		t.Fatalf("adding node 4 resulted in %v, want %v", result, want)
+	}
+	// Voter changes go through the joint configuration.
+	wantConfigs := []string{
+		fmt.Sprint(Membership{Voters: []int{1, 2, 3}, NewVoters: []int{1, 2, 3, 4}}),
+		fmt.Sprint(want),
+	}
+	if got := configs(leader); !slices.Equal(got, wantConfigs) {
+		t.Fatalf("configurations %v, want %v", got, wantConfigs)
+	}
+	for id, n := range c.nodes {
+		if fmt.Sprint(n.Membership()) != fmt.Sprint(want) {
+			t.Fatalf("node %d has membership %v, want %v", id, n.Membership(), want)
+		}
+	}
+	if !slices.Equal(c.applied[4], c.applied[1]) {
+		t.Fatalf("node 4 applied %v, leader %v", c.applied[4], c.applied[1])
+	}
+
+	want = Membership{Voters: []int{1, 3, 4}}
+	if result := c.changeMembership(leader, ChangeMembership{Remove: 2}); fmt.Sprint(result) != fmt.Sprint(want) {
+		t.Fatalf("removing node 2 resulted in %v, want %v", result, want)
+	}
+	wantConfigs = append(wantConfigs,
+		fmt.Sprint(Membership{Voters: []int{1, 2, 3, 4}, NewVoters: []int{1, 3, 4}}),
+		fmt.Sprint(want),
+	)
+	if got := configs(leader); !slices.Equal(got, wantConfigs) {
+		t.Fatalf("configurations %v, want %v", got, wantConfigs)
+	}
+	c.propose(leader, "after")
+	if slices.Contains(c.applied[2], "after") {
+		t.Fatal("removed node 2 applied an entry proposed after its removal")
+	}
+	if !slices.Equal(c.applied[4], c.applied[1]) {
+		t.Fatalf("node 4 applied %v, leader %v %+v %+v", c.applied[4], c.applied[1], c.nodes[4].Status(), leader.Status())
+	}
+}
+
+func TestRemoveLeader(t *testing.T) {
+	c := newTestCluster(t)
+	for id := 1; id <= 3; id++ {
+		c.start(id, StaticMembership(3))
+	}
+	leader := c.elect(1)
+
+	want := Membership{Voters: []int{2, 3}}
+	if result := c.changeMembership(leader, ChangeMembership{Remove: 1}); fmt.Sprint(result) != fmt.Sprint(want) {
+		t.Fatalf("removing the leader resulted in %v, want %v", result, want)
+	}
+	if leader.Role() == Leader {
+		t.Fatal("removed leader is still leading")
+	}
+	term := leader.Status().Term
+	leader.Tick(ElectionTimer)
+	c.run()
+	if leader.Status().Term != term {
+		t.Fatal("removed node started an election")
+	}
+
+	leader = c.elect(2)
+	c.propose(leader, "after")
+	if slices.Contains(c.applied[1], "after") {
+		t.Fatal("removed node 1 applied an entry proposed after its removal")
+	}
+}
+
+func TestMembershipChangeLeaderLost(t *testing.T) {
+	t.Run("before the joint configuration is committed", func(t *testing.T) {
+		c := newTestCluster(t)
+		for id := 1; id <= 3; id++ {
+			c.start(id, StaticMembership(3))
+		}
+		leader := c.elect(1)
+		c.isolated[1] = true
+		if result := leader.ChangeMembership(ChangeMembership{Remove: 3}, "remove"); result != nil {
+			t.Fatalf("change refused: %v", result)
+		}
+		c.run()
+		c.elect(2)
+
+		// the new leader replaces the configuration entry of node 1
+		delete(c.isolated, 1)
+		c.heartbeat(c.nodes[2])
+		if result := c.responses["remove"]; result != (NotLeader{LeaderId: 2}) {
+			t.Fatalf("change resulted in %v, want NotLeader", result)
+		}
+		want := StaticMembership(3)
+		if fmt.Sprint(leader.Membership()) != fmt.Sprint(want) {
+			t.Fatalf("node 1 has membership %v, want %v", leader.Membership(), want)
+		}
+
+		// node 1 is not left with a pending change
+		c.elect(1)
+		want = Membership{Voters: []int{1, 2}}
+		if result := c.changeMembership(leader, ChangeMembership{Remove: 3}); fmt.Sprint(result) != fmt.Sprint(want) {
+			t.Fatalf("removing node 3 resulted in %v, want %v", result, want)
+		}
+	})
+
+	t.Run("after the joint configuration is committed", func(t *testing.T) {
+		c := newTestCluster(t)
+		for id := 1; id <= 3; id++ {
+			c.start(id, StaticMembership(3))
+		}
+		c.start(4, Membership{})
+		leader := c.elect(1)
+		// node 4 catches up as a learner first, the next leader needs its
+		// vote in the new configuration
+		want := Membership{Voters: []int{1, 2, 3}, Learners: []int{4}}
+		if result := c.changeMembership(leader, ChangeMembership{Add: 4, Learner: true}); fmt.Sprint(result) != fmt.Sprint(want) {
+			t.Fatalf("adding learner 4 resulted in %v, want %v", result, want)
+		}
+		if result := leader.ChangeMembership(ChangeMembership{Promote: 4}, "promote"); result != nil {
+			t.Fatalf("change refused: %v", result)
+		}
+		// lose node 1 once it appended the final configuration
+		leader.Tick(HeartbeatTimer)
+		for leader.Membership().IsJoint() {
+			if !c.round() {
+				t.Fatal("joint configuration not committed")
+			}
+		}
+		c.isolated[1] = true
+		c.run()
+
+		// the next leader completes the change
+		c.elect(2)
+		delete(c.isolated, 1)
+		for range 3 {
+			c.heartbeat(c.nodes[2])
+		}
+		if result := c.responses["promote"]; result != (NotLeader{LeaderId: 2}) {
+			t.Fatalf("change resulted in %v, want NotLeader", result)
+		}
+		want = Membership{Voters: []int{1, 2, 3, 4}}
+		for id, n := range c.nodes {
+			if fmt.Sprint(n.Membership()) != fmt.Sprint(want) {
+				t.Fatalf("node %d has membership %v, want %v", id, n.Membership(), want)
+			}
+			if status := n.Status(); status.CommitId != c.nodes[2].Status().CommitId {
+				t.Fatalf("node %d committed %d, the leader %d", id, status.CommitId, c.nodes[2].Status().CommitId)
+			}
+		}
+	})
+}
+
+func TestRemovedNodeDoesNotDisrupt(t *testing.T) {
+	c := newTestCluster(t)
+	for id := 1; id <= 3; id++ {
+		c.start(id, StaticMembership(3))
+	}
+	leader := c.elect(1)
+	// node 3 does not learn about its removal and campaigns
+	c.isolated[3] = true
+	want := Membership{Voters: []int{1, 2}}
+	if result := c.changeMembership(leader, ChangeMembership{Remove: 3}); fmt.Sprint(result) != fmt.Sprint(want) {
+		t.Fatalf("removing node 3 resulted in %v, want %v", result, want)
+	}
+	delete(c.isolated, 3)
+	removed := c.nodes[3]
+	if !removed.Membership().IsVoter(3) {
+		t.Fatalf("node 3 knows about its removal: %v", removed.Membership())
+	}
+	term := leader.Status().Term
+	// node 2 keeps hearing from the leader while node 3 times out
+	c.now = c.now.Add(testElectionTimeout)
+	c.heartbeat(leader)
+	removed.Tick(ElectionTimer)
+	c.run()
+	if removed.Status().Term == term {
+		t.Fatal("node 3 did not campaign")
+	}
+	if leader.Role() != Leader || leader.Status().Term != term {
+		t.Fatalf("leader is %s in term %d after node 3 campaigned, was leader in term %d", leader.Role(), leader.Status().Term, term)
+	}
+	c.propose(leader, "after")
+}
+
+func TestTransferLeadership(t *testing.T) {
+	// newCluster returns the leader of three voters and a learner, node 3
+	// missed the last proposals.
+	newCluster := func(t *testing.T) (*testCluster, *Node) {
+		bootstrap := Membership{Voters: []int{1, 2, 3}, Learners: []int{4}}
+		c := newTestCluster(t)
+		for id := 1; id <= 4; id++ {
+			c.start(id, bootstrap)
+		}
+		leader := c.elect(1)
+		c.propose(leader, "before")
+		c.isolated[3] = true
+		for i := range 3 {
+			c.propose(leader, fmt.Sprint(i))
+		}
+		return c, leader
+	}
+
+	t.Run("lagging target catches up first", func(t *testing.T) {
+		c, leader := newCluster(t)
+		delete(c.isolated, 3)
+		if result := leader.TransferLeadership(3, "transfer"); result != nil {
+			t.Fatalf("transfer refused: %v", result)
+		}
+		c.run()
+		if role := c.nodes[3].Role(); role == Leader {
+			t.Fatal("node 3 campaigned before it caught up")
+		}
+		if result := c.await(leader, "transfer"); result != (LeadershipTransferred{LeaderId: 3}) {
+			t.Fatalf("transfer resulted in %v", result)
+		}
+		if role := c.nodes[3].Role(); role != Leader {
+			t.Fatalf("node 3 is %s", role)
+		}
+		if role := leader.Role(); role != Follower {
+			t.Fatalf("node 1 is %s", role)
+		}
+		c.propose(c.nodes[3], "after")
+		if !slices.Equal(c.applied[3], c.applied[1]) {
+			t.Fatalf("node 3 applied %v, node 1 %v", c.applied[3], c.applied[1])
+		}
+	})
+
+	t.Run("times out", func(t *testing.T) {
+		c, leader := newCluster(t)
+		if result := leader.TransferLeadership(3, "transfer"); result != nil {
+			t.Fatalf("transfer refused: %v", result)
+		}
+		c.heartbeat(leader)
+		leader.Tick(TransferTimer)
+		c.run()
+		if result := c.responses["transfer"]; result != (TransferRejected{Reason: "leadership transfer timed out"}) {
+			t.Fatalf("transfer resulted in %v", result)
+		}
+		if role := leader.Role(); role != Leader {
+			t.Fatalf("node 1 is %s after the transfer timed out", role)
+		}
+		c.propose(leader, "after")
+	})
+
+	t.Run("refuses proposals while in progress", func(t *testing.T) {
+		c, leader := newCluster(t)
+		if result := leader.TransferLeadership(3, "transfer"); result != nil {
+			t.Fatalf("transfer refused: %v", result)
+		}
+		if result := leader.Propose([]byte("during"), "during"); result != (TransferInProgress{To: 3}) {
+			t.Fatalf("proposal during the transfer resulted in %v", result)
+		}
+		if result := leader.ChangeMembership(ChangeMembership{Remove: 2}, "remove"); result != (TransferInProgress{To: 3}) {
+			t.Fatalf("membership change during the transfer resulted in %v", result)
+		}
+		if result := leader.TransferLeadership(2, "again"); result != (TransferRejected{Reason: "another leadership transfer is in progress"}) {
+			t.Fatalf("second transfer resulted in %v", result)
+		}
+		c.run()
+	})
+
+	t.Run("rejects learners and non-members", func(t *testing.T) {
+		_, leader := newCluster(t)
+		for _, to := range []int{4, 5} {
+			if result := leader.TransferLeadership(to, "transfer"); result != (TransferRejected{Reason: "target is not a voter"}) {
+				t.Fatalf("transfer to %d resulted in %v", to, result)
+			}
+		}
+		if status := leader.Status(); status.TransferTarget != 0 {
+			t.Fatalf("transfer to %d in progress", status.TransferTarget)
+		}
+	})
+}
+
+func TestPrepareShutdown(t *testing.T) {
+	newCluster := func(t *testing.T) (*testCluster, *Node) {
+		c := newTestCluster(t)
+		for id := 1; id <= 3; id++ {
+			c.start(id, StaticMembership(3))
+		}
+		leader := c.elect(1)
+		c.propose(leader, "before")
+		return c, leader
+	}
+
+	t.Run("leader drains and hands off leadership", func(t *testing.T) {
+		c, leader := newCluster(t)
+		if result := leader.Propose([]byte("in flight"), "in flight"); result != nil {
+			t.Fatalf("proposal refused: %v", result)
+		}
+		if result := leader.PrepareShutdown(time.Minute, "shutdown"); result != nil {
+			t.Fatalf("shutdown refused: %v", result)
+		}
+		if result := leader.Propose([]byte("draining"), "draining"); result != (ShuttingDown{}) {
+			t.Fatalf("proposal while draining resulted in %v", result)
+		}
+		if result := leader.PrepareShutdown(time.Minute, "again"); result != false {
+			t.Fatalf("second shutdown resulted in %v", result)
+		}
+		c.run()
+		if _, ok := c.responses["shutdown"]; ok {
+			t.Fatal("leader ready for shutdown with a proposal in flight")
+		}
+
+		for range 10 {
+			leader.Tick(HeartbeatTimer)
+			c.run()
+			if _, ok := c.responses["shutdown"]; ok {
+				break
+			}
+			if _, ok := c.responses["in flight"]; ok && leader.Role() != Leader {
+				t.Fatal("leader stepped down before it reported ready")
+			}
+		}
+		if result := c.responses["shutdown"]; result != true {
+			t.Fatalf("shutdown resulted in %v", result)
+		}
+		if result, ok := c.responses["in flight"].(int); !ok {
+			t.Fatalf("proposal in flight resulted in %v", c.responses["in flight"])
+		} else if !slices.Contains(c.applied[2], "in flight") {
+			t.Fatalf("proposal committed at %d was not applied by node 2", result)
+		}
+		if role := leader.Role(); role == Leader {
+			t.Fatal("node 1 is still the leader after it reported ready")
+		}
+		newLeader := c.nodes[leader.Status().LeaderId]
+		if newLeader == nil || newLeader == leader || newLeader.Role() != Leader {
+			t.Fatalf("leadership was not handed off, node 1 follows %d", leader.Status().LeaderId)
+		}
+		c.propose(newLeader, "after")
+	})
+
+	t.Run("deadline fails pending proposals", func(t *testing.T) {
+		c, leader := newCluster(t)
+		c.isolated[2], c.isolated[3] = true, true
+		if result := leader.Propose([]byte("stuck"), "stuck"); result != nil {
+			t.Fatalf("proposal refused: %v", result)
+		}
+		if result := leader.PrepareShutdown(time.Minute, "shutdown"); result != nil {
+			t.Fatalf("shutdown refused: %v", result)
+		}
+		c.heartbeat(leader)
+		leader.Tick(ShutdownTimer)
+		c.run()
+		if result := c.responses["stuck"]; result != (ShuttingDown{}) {
+			t.Fatalf("pending proposal resulted in %v", result)
+		}
+		if result := c.responses["shutdown"]; result != true {
+			t.Fatalf("shutdown resulted in %v", result)
+		}
+	})
+
+	t.Run("follower is ready at once and does not campaign", func(t *testing.T) {
+		c, leader := newCluster(t)
+		follower := c.nodes[2]
+		if result := follower.PrepareShutdown(time.Minute, "shutdown"); result != nil {
+			t.Fatalf("shutdown refused: %v", result)
+		}
+		c.run()
+		if result := c.responses["shutdown"]; result != true {
+			t.Fatalf("shutdown resulted in %v", result)
+		}
+		term := follower.Status().Term
+		c.now = c.now.Add(testElectionTimeout)
+		follower.Tick(ElectionTimer)
+		c.run()
+		if follower.Status().Term != term || leader.Role() != Leader {
+			t.Fatalf("node 2 campaigned while shutting down, term %d was %d", follower.Status().Term, term)
+		}
+	})
+}
@@ -0,0 +1,226 @@
+package consensus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// RaftLog persists raft state in a directory: entries are appended to
+// log.jsonl, term with vote are kept in state.json and the latest snapshot in
+// snapshot.json. A record whose id is not past the end of the log replaces
+// that entry and everything after it, so the file is replayed exactly like
+// AppendEntries. Saving a snapshot rewrites log.jsonl with the entries that
+// follow it, so only those are replayed on open.
+//
+// A nil *RaftLog keeps everything in memory, all its methods are no-ops.
+type RaftLog struct {
+	dir    string
+	file   *os.File
+	writer *bufio.Writer
+	// dirty is set when entries were appended since the last Sync
+	dirty bool
+}
+
+type RaftState struct {
+	Term     int
+	VotedFor int
+}
+
+// OpenRaftLog opens the log in dir, creating it if needed, and returns the
+// persisted state, snapshot (nil if there is none) and the entries following
+// it.
+func OpenRaftLog(dir string) (*RaftLog, RaftState, *Snapshot, []LogEntry, error) {
+	var state RaftState
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, state, nil, nil, err
+	}
+	if err := readJSON(filepath.Join(dir, "state.json"), &state); err != nil {
+		return nil, state, nil, nil, fmt.Errorf("unable to read raft state: %w", err)
+	}
+	snapshot := &Snapshot{Id: -1}
+	if err := readJSON(filepath.Join(dir, "snapshot.json"), snapshot); err != nil {
+		return nil, state, nil, nil, fmt.Errorf("unable to read raft snapshot: %w", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, "log.jsonl"), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, state, nil, nil, err
+	}
+	entries, err := replayRaftLog(file, snapshot.Id)
+	if err != nil {
+		file.Close()
+		return nil, state, nil, nil, err
+	}
+	if snapshot.Id < 0 {
+		snapshot = nil
+	}
+
+	l := &RaftLog{dir: dir, file: file, writer: bufio.NewWriter(file)}
+	return l, state, snapshot, entries, nil
+}
+
+// readJSON leaves v as it is if the file does not exist.
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// replayRaftLog returns the entries following snapshotId. Earlier ones are
+// left if a crash interrupted SaveSnapshot.
+func replayRaftLog(r io.Reader, snapshotId int) ([]LogEntry, error) {
+	var entries []LogEntry
+	decoder := json.NewDecoder(r)
+	for {
+		var entry LogEntry
+		err := decoder.Decode(&entry)
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("corrupted raft log after entry %d: %w", snapshotId+len(entries), err)
+		}
+		if entry.Id <= snapshotId {
+			continue
+		}
+		if entry.Id > snapshotId+len(entries)+1 {
+			return nil, fmt.Errorf("raft log has a gap before entry %d", entry.Id)
+		}
+		entries = append(entries[:entry.Id-snapshotId-1], entry)
+	}
+}
+
+// Append writes entries to the buffer, they reach the disk on Sync.
+func (l *RaftLog) Append(entries ...LogEntry) error {
+	if l == nil {
+		return nil
+	}
+	l.dirty = true
+	encoder := json.NewEncoder(l.writer)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveState atomically and durably replaces the persisted term and vote.
+func (l *RaftLog) SaveState(state RaftState) error {
+	if l == nil {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return replaceFile(filepath.Join(l.dir, "state.json"), data)
+}
+
+// SaveSnapshot durably replaces the snapshot, then rewrites the log with
+// entries, the ones following it.
+func (l *RaftLog) SaveSnapshot(snapshot Snapshot, entries []LogEntry) error {
+	if l == nil {
+		return nil
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(filepath.Join(l.dir, "snapshot.json"), data); err != nil {
+		return err
+	}
+
+	var log bytes.Buffer
+	encoder := json.NewEncoder(&log)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	// entries buffered for the old file are part of entries
+	l.writer.Reset(l.file)
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	path := filepath.Join(l.dir, "log.jsonl")
+	if err := replaceFile(path, log.Bytes()); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.file = file
+	l.writer.Reset(file)
+	l.dirty = false
+	return nil
+}
+
+// replaceFile writes data to a temporary file, syncs it and renames it to
+// path, then syncs the directory so that the rename survives a crash.
+func replaceFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Sync flushes buffered entries and waits until they are on disk.
+func (l *RaftLog) Sync() error {
+	if l == nil || !l.dirty {
+		return nil
+	}
+	if err := l.writer.Flush(); err != nil {
+		return err
+	}
+	if err := l.file.Sync(); err != nil {
+		return err
+	}
+	l.dirty = false
+	return nil
+}
+
+func (l *RaftLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	if err := l.Sync(); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
@@ -0,0 +1,113 @@
+package consensus
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRaftLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, state, snapshot, entries, err := OpenRaftLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != (RaftState{}) || snapshot != nil || len(entries) != 0 {
+		t.Fatalf("new log has state %+v, snapshot %v and %d entries", state, snapshot, len(entries))
+	}
+
+	appended := []LogEntry{{Id: 0, Term: 1}, {Id: 1, Term: 1, Command: []byte("a")}, {Id: 2, Term: 1, Command: []byte("b")}}
+	if err := l.Append(appended...); err != nil {
+		t.Fatal(err)
+	}
+	// a conflicting entry replaces entry 1 and everything after it
+	replaced := LogEntry{Id: 1, Term: 2, Command: []byte("c")}
+	if err := l.Append(replaced); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.SaveState(RaftState{Term: 2, VotedFor: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "state.json.tmp")); !os.IsNotExist(err) {
+		t.Fatalf("temporary state file left behind: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, state, snapshot, entries, err = OpenRaftLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if state != (RaftState{Term: 2, VotedFor: 3}) {
+		t.Fatalf("state %+v after reopen", state)
+	}
+	want := []LogEntry{appended[0], replaced}
+	if !slices.EqualFunc(entries, want, func(a, b LogEntry) bool {
+		return a.Id == b.Id && a.Term == b.Term && string(a.Command) == string(b.Command)
+	}) {
+		t.Fatalf("entries %+v after reopen, want %+v", entries, want)
+	}
+}
+
+func TestRaftLogSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	l, _, _, _, err := OpenRaftLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id := range 10 {
+		if err := l.Append(LogEntry{Id: id, Term: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := Snapshot{Id: 6, Term: 1, Membership: StaticMembership(3), Data: []byte("state")}
+	if err := l.SaveSnapshot(snapshot, []LogEntry{{Id: 7, Term: 1}, {Id: 8, Term: 1}, {Id: 9, Term: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(LogEntry{Id: 10, Term: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, _, restored, entries, err := OpenRaftLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if restored == nil || restored.Id != 6 || restored.Term != 1 || string(restored.Data) != "state" || !slices.Equal(restored.Membership.Voters, []int{1, 2, 3}) {
+		t.Fatalf("snapshot %+v after reopen", restored)
+	}
+	ids := make([]int, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.Id
+	}
+	if !slices.Equal(ids, []int{7, 8, 9, 10}) {
+		t.Fatalf("entries %v after reopen, want 7..10", ids)
+	}
+}
+
+func TestReplaySkipsCompactedEntries(t *testing.T) {
+	// a crash after the snapshot was saved but before the log was rewritten
+	// leaves entries the snapshot covers
+	var log bytes.Buffer
+	for id := range 5 {
+		json.NewEncoder(&log).Encode(LogEntry{Id: id, Term: 1})
+	}
+	entries, err := replayRaftLog(&log, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Id != 3 || entries[1].Id != 4 {
+		t.Fatalf("replayed %+v, want entries 3 and 4", entries)
+	}
+}
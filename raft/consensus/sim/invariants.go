@@ -0,0 +1,137 @@
+package sim
+
+import (
+	"bytes"
+
+	"chaddb/consensus"
+)
+
+// check verifies the safety properties of raft (figure 3 of the paper)
+// against the current state of all nodes.
+func (s *simulation) check() {
+	if s.violation != "" {
+		return
+	}
+	s.checkElectionSafety()
+	s.checkLogMatching()
+	s.checkStateMachineSafety()
+	s.checkLeaderCompleteness()
+}
+
+// checkElectionSafety: at most one leader can be elected in a given term.
+func (s *simulation) checkElectionSafety() {
+	for _, id := range s.ids {
+		n := s.nodes[id]
+		if n.node == nil || n.node.Role() != consensus.Leader {
+			continue
+		}
+		term := n.node.Status().Term
+		if leader, ok := s.leaders[term]; ok && leader != id {
+			s.fail("election safety: nodes %d and %d are both leaders of term %d", leader, id, term)
+			return
+		}
+		s.leaders[term] = id
+	}
+}
+
+// checkLogMatching: if two logs contain an entry with the same index and
+// term, the logs are identical in all entries up through that index.
+func (s *simulation) checkLogMatching() {
+	for i, a := range s.ids {
+		for _, b := range s.ids[i+1:] {
+			// logs did not change since the pair was checked
+			versions := [2]int{s.nodes[a].storage.version, s.nodes[b].storage.version}
+			if s.matched[[2]int{a, b}] == versions {
+				continue
+			}
+			s.matched[[2]int{a, b}] = versions
+			// compacted entries are checked by state machine safety
+			left, right := s.nodes[a].storage, s.nodes[b].storage
+			first := max(left.snapshotId(), right.snapshotId()) + 1
+			last := min(left.lastId(), right.lastId())
+			for ; last >= first; last-- {
+				l, _ := left.entry(last)
+				r, _ := right.entry(last)
+				if l.Term == r.Term {
+					break
+				}
+			}
+			for id := last; id >= first; id-- {
+				l, _ := left.entry(id)
+				r, _ := right.entry(id)
+				if !sameEntry(l, r) {
+					s.fail("log matching: nodes %d and %d agree on entry %d but differ at entry %d", a, b, last, id)
+					return
+				}
+			}
+		}
+	}
+}
+
+// checkStateMachineSafety: once a node commits an entry at an index no node
+// ever commits a different entry at that index, and state machines apply
+// exactly the committed data entries in order.
+func (s *simulation) checkStateMachineSafety() {
+	for _, id := range s.ids {
+		n := s.nodes[id]
+		if n.node == nil {
+			continue
+		}
+		status := n.node.Status()
+		for index := n.commitId + 1; index <= status.CommitId; index++ {
+			entry, ok := n.storage.entry(index)
+			if !ok {
+				// came with a snapshot, its entries are checked as applied
+				continue
+			}
+			if previous, ok := s.committed[index]; !ok {
+				s.committed[index] = committedEntry{entry: entry, term: status.Term}
+				if entry.Kind == consensus.ConfigEntry && index > s.membershipId {
+					s.membership, s.membershipId = entry.Config, index
+				}
+			} else if !sameEntry(previous.entry, entry) {
+				s.fail("state machine safety: node %d committed %s at %d, previously %s", id, describe(entry), index, describe(previous.entry))
+				return
+			}
+		}
+		n.commitId = status.CommitId
+
+		for i := n.checked; i < len(n.applied); i++ {
+			entry := n.applied[i]
+			if i > 0 && n.applied[i-1].Id >= entry.Id {
+				s.fail("state machine safety: node %d applied entry %d after %d", id, entry.Id, n.applied[i-1].Id)
+				return
+			}
+			if committed, ok := s.committed[entry.Id]; !ok || !sameEntry(committed.entry, entry) {
+				s.fail("state machine safety: node %d applied %s at %d which is not committed", id, describe(entry), entry.Id)
+				return
+			}
+		}
+		n.checked = len(n.applied)
+	}
+}
+
+// checkLeaderCompleteness: an entry committed in a term is present in the
+// logs of the leaders of all later terms.
+func (s *simulation) checkLeaderCompleteness() {
+	for _, id := range s.ids {
+		n := s.nodes[id]
+		if n.node == nil || n.node.Role() != consensus.Leader {
+			continue
+		}
+		term := n.node.Status().Term
+		for index, committed := range s.committed {
+			if committed.term >= term || index <= n.storage.snapshotId() {
+				continue
+			}
+			if entry, ok := n.storage.entry(index); !ok || !sameEntry(entry, committed.entry) {
+				s.fail("leader completeness: leader %d of term %d misses entry %d committed in term %d", id, term, index, committed.term)
+				return
+			}
+		}
+	}
+}
+
+func sameEntry(a consensus.LogEntry, b consensus.LogEntry) bool {
+	return a.Id == b.Id && a.Term == b.Term && a.Kind == b.Kind && bytes.Equal(a.Command, b.Command)
+}
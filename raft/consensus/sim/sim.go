@@ -0,0 +1,609 @@
+// Package sim runs a cluster of consensus.Node in a single goroutine with a
+// virtual clock. Message delays, drops, duplicates, partitions, crashes and
+// membership changes are drawn from a seeded random source, so a run is fully
+// determined by its Config and a failing seed replays exactly. Raft safety
+// invariants are checked after every event.
+package sim
+
+import (
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"time"
+
+	"chaddb/consensus"
+)
+
+type Config struct {
+	Seed  int64
+	Nodes int
+	// Steps is the number of events to process.
+	Steps int
+
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// Probabilities per message.
+	DropRate      float64
+	DuplicateRate float64
+	// Probabilities per client tick (every ProposeInterval).
+	PartitionRate  float64
+	CrashRate      float64
+	TransferRate   float64
+	MembershipRate float64
+
+	ProposeInterval time.Duration
+	// Faults last between FaultDuration and twice as long.
+	FaultDuration time.Duration
+
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotEntries is the number of applied entries after which a node
+	// compacts its log, 0 disables snapshots.
+	SnapshotEntries int
+
+	// Trace receives every event when set.
+	Trace func(line string)
+}
+
+func DefaultConfig(seed int64) Config {
+	return Config{
+		Seed:              seed,
+		Nodes:             5,
+		Steps:             20000,
+		MinDelay:          time.Millisecond,
+		MaxDelay:          40 * time.Millisecond,
+		DropRate:          0.05,
+		DuplicateRate:     0.02,
+		PartitionRate:     0.01,
+		CrashRate:         0.01,
+		TransferRate:      0.005,
+		MembershipRate:    0.005,
+		ProposeInterval:   20 * time.Millisecond,
+		FaultDuration:     2 * time.Second,
+		ElectionTimeout:   300 * time.Millisecond,
+		HeartbeatInterval: 50 * time.Millisecond,
+		SnapshotEntries:   100,
+	}
+}
+
+type Result struct {
+	Seed      int64
+	Steps     int
+	Elapsed   time.Duration
+	Committed int
+	Elections int
+	Crashes   int
+	// MembershipChanges counts the changes the leader accepted.
+	MembershipChanges int
+	// Violation is empty if all invariants held. Trace holds the events
+	// leading to it.
+	Violation string
+	Trace     []string
+}
+
+func (r Result) Failed() bool {
+	return r.Violation != ""
+}
+
+// Run simulates a cluster until Steps events are processed or an invariant
+// is violated, then heals all faults and checks that the cluster converges.
+func Run(config Config) (result Result) {
+	s := newSimulation(config)
+	defer func() {
+		if err := recover(); err != nil {
+			s.violation = fmt.Sprintf("panic: %v", err)
+		}
+		result = s.result()
+	}()
+
+	for s.steps < config.Steps && s.violation == "" {
+		s.step()
+	}
+	if s.violation == "" {
+		s.converge()
+	}
+	return
+}
+
+type simulation struct {
+	config  Config
+	rand    *rand.Rand
+	now     time.Time
+	start   time.Time
+	events  eventQueue
+	seq     int
+	steps   int
+	nodes   map[int]*simNode
+	ids     []int
+	group   map[int]int  // partition side of every node, equal means connected
+	removed map[int]bool // out of the committed configuration, stopped until added again
+	faults  bool
+	trace   []string
+	command int
+
+	leaders   map[int]int // term -> leader
+	committed map[int]committedEntry
+	matched   map[[2]int][2]int // pair of nodes -> storage versions
+	violation string
+	stats     Result
+
+	// membership is the latest committed configuration
+	membership   consensus.Membership
+	membershipId int
+}
+
+type committedEntry struct {
+	entry consensus.LogEntry
+	// term of the first node that reported it committed
+	term int
+}
+
+type simNode struct {
+	id      int
+	node    *consensus.Node // nil while crashed
+	storage *memoryStorage
+	// incarnation changes on restart, events of a previous one are dropped
+	incarnation int
+	timers      map[consensus.TimerKind]int
+	commitId    int
+	// applied is the state machine, snapshots are its JSON
+	applied []consensus.LogEntry
+	checked int
+}
+
+func newSimulation(config Config) *simulation {
+	start := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &simulation{
+		config:    config,
+		rand:      rand.New(rand.NewSource(config.Seed)),
+		now:       start,
+		start:     start,
+		nodes:     make(map[int]*simNode),
+		group:     make(map[int]int),
+		removed:   make(map[int]bool),
+		faults:    true,
+		leaders:   make(map[int]int),
+		committed: make(map[int]committedEntry),
+		matched:   make(map[[2]int][2]int),
+
+		membership:   consensus.StaticMembership(config.Nodes),
+		membershipId: -1,
+	}
+	for id := 1; id <= config.Nodes; id++ {
+		s.ids = append(s.ids, id)
+		s.nodes[id] = &simNode{id: id, storage: &memoryStorage{}}
+		s.restart(id)
+	}
+	s.schedule(config.ProposeInterval, event{kind: clientTick})
+	return s
+}
+
+type eventKind int
+
+const (
+	deliver eventKind = iota
+	timer
+	clientTick
+	heal
+	restart
+)
+
+type event struct {
+	at          time.Time
+	seq         int
+	kind        eventKind
+	from        int
+	to          int
+	incarnation int
+	message     any
+	timer       consensus.TimerKind
+	timerSeq    int
+}
+
+func (s *simulation) schedule(after time.Duration, e event) {
+	s.seq++
+	e.at = s.now.Add(after)
+	e.seq = s.seq
+	heap.Push(&s.events, e)
+}
+
+func (s *simulation) logf(format string, args ...any) {
+	line := fmt.Sprintf("%10s ", s.now.Sub(s.start).Round(time.Microsecond)) + fmt.Sprintf(format, args...)
+	if s.config.Trace != nil {
+		s.config.Trace(line)
+	}
+	s.trace = append(s.trace, line)
+	if len(s.trace) > 200 {
+		s.trace = s.trace[len(s.trace)-100:]
+	}
+}
+
+func (s *simulation) step() {
+	e := heap.Pop(&s.events).(event)
+	s.now = e.at
+	s.steps++
+
+	switch e.kind {
+	case deliver:
+		n := s.nodes[e.to]
+		if n.node == nil || n.incarnation != e.incarnation || s.group[e.from] != s.group[e.to] {
+			return
+		}
+		s.logf("%d -> %d %s", e.from, e.to, describe(e.message))
+		n.node.Step(e.message)
+		s.process(n)
+	case timer:
+		n := s.nodes[e.to]
+		if n.node == nil || n.incarnation != e.incarnation || n.timers[e.timer] != e.timerSeq {
+			return
+		}
+		delete(n.timers, e.timer)
+		s.logf("%d timer %s", e.to, timerName(e.timer))
+		n.node.Tick(e.timer)
+		s.process(n)
+	case clientTick:
+		s.clientTick()
+		s.schedule(s.config.ProposeInterval, event{kind: clientTick})
+	case heal:
+		s.logf("partition healed")
+		clear(s.group)
+	case restart:
+		if !s.removed[e.to] {
+			s.restart(e.to)
+		}
+	}
+	s.check()
+}
+
+func (s *simulation) clientTick() {
+	s.followMembership()
+	if !s.faults {
+		// the cluster is converging
+		return
+	}
+	switch r := s.rand.Float64(); {
+	case r < s.config.PartitionRate:
+		s.partition()
+	case r < s.config.PartitionRate+s.config.CrashRate:
+		s.crash(s.ids[s.rand.Intn(len(s.ids))])
+	case r < s.config.PartitionRate+s.config.CrashRate+s.config.TransferRate:
+		if n := s.nodes[s.ids[s.rand.Intn(len(s.ids))]]; n.node != nil {
+			to := s.ids[s.rand.Intn(len(s.ids))]
+			s.logf("%d transfer leadership to %d: %s", n.id, to, describe(n.node.TransferLeadership(to, nil)))
+			s.process(n)
+		}
+	case r < s.config.PartitionRate+s.config.CrashRate+s.config.TransferRate+s.config.MembershipRate:
+		s.changeMembership(s.ids[s.rand.Intn(len(s.ids))])
+	}
+
+	// clients find the leader by trying nodes
+	for _, id := range s.ids {
+		n := s.nodes[id]
+		if n.node == nil || n.node.Role() != consensus.Leader {
+			continue
+		}
+		s.command++
+		command := fmt.Sprintf("c%d", s.command)
+		if res := n.node.Propose([]byte(command), command); res == nil {
+			s.logf("%d propose %s", id, command)
+		}
+		s.process(n)
+		return
+	}
+}
+
+// leader returns the running leader of the highest term, nil if there is
+// none.
+func (s *simulation) leader() *simNode {
+	var leader *simNode
+	for _, id := range s.ids {
+		n := s.nodes[id]
+		if n.node == nil || n.node.Role() != consensus.Leader {
+			continue
+		}
+		if leader == nil || n.node.Status().Term > leader.node.Status().Term {
+			leader = n
+		}
+	}
+	return leader
+}
+
+// changeMembership removes the voter id if there are more than three, or
+// adds it back if it is not a member.
+func (s *simulation) changeMembership(id int) {
+	leader := s.leader()
+	if leader == nil {
+		return
+	}
+	membership := leader.node.Membership()
+	var request consensus.ChangeMembership
+	if membership.IsVoter(id) && len(membership.VotingNodes()) > 3 {
+		request.Remove = id
+	} else if !slices.Contains(membership.Nodes(), id) {
+		request.Add = id
+	} else {
+		return
+	}
+	result := leader.node.ChangeMembership(request, nil)
+	s.logf("%d change membership %+v: %s", leader.id, request, describe(result))
+	if result == nil {
+		s.stats.MembershipChanges++
+	}
+	s.process(leader)
+}
+
+// followMembership stops nodes once their removal is committed and restarts
+// those the leader adds back. A node stays until its removal is committed as
+// the cluster may still need its vote.
+func (s *simulation) followMembership() {
+	leader := s.leader()
+	if leader == nil {
+		return
+	}
+	members := leader.node.Membership().Nodes()
+	for _, id := range s.ids {
+		n := s.nodes[id]
+		member := slices.Contains(members, id)
+		if !member && !s.removed[id] && !slices.Contains(s.membership.Nodes(), id) {
+			s.logf("%d removed from the cluster, stopped", id)
+			s.removed[id] = true
+			n.node = nil
+		} else if member && s.removed[id] {
+			s.logf("%d added to the cluster, restarting", id)
+			delete(s.removed, id)
+			s.restart(id)
+		}
+	}
+}
+
+func (s *simulation) partition() {
+	for _, id := range s.ids {
+		s.group[id] = s.rand.Intn(2)
+	}
+	s.logf("partition %v", s.group)
+	s.schedule(s.faultDuration(), event{kind: heal})
+}
+
+func (s *simulation) crash(id int) {
+	n := s.nodes[id]
+	if n.node == nil {
+		return
+	}
+	s.logf("%d crashed", id)
+	s.stats.Crashes++
+	n.node = nil
+	s.schedule(s.faultDuration(), event{kind: restart, to: id})
+}
+
+func (s *simulation) faultDuration() time.Duration {
+	return s.config.FaultDuration + time.Duration(s.rand.Int63n(int64(s.config.FaultDuration)))
+}
+
+// restart starts the node from its storage with an empty state machine.
+func (s *simulation) restart(id int) {
+	n := s.nodes[id]
+	if n.node != nil {
+		return
+	}
+	node, err := consensus.NewNode(consensus.Config{
+		Id:                id,
+		Bootstrap:         consensus.StaticMembership(s.config.Nodes),
+		State:             n.storage.state,
+		Snapshot:          n.storage.snapshot,
+		Entries:           n.storage.entries,
+		Applied:           -1,
+		Storage:           n.storage,
+		Rand:              rand.New(rand.NewSource(s.rand.Int63())),
+		Now:               func() time.Time { return s.now },
+		ElectionTimeout:   s.config.ElectionTimeout,
+		ElectionJitter:    s.config.ElectionTimeout,
+		HeartbeatInterval: s.config.HeartbeatInterval,
+	})
+	if err != nil {
+		panic(err)
+	}
+	if n.incarnation > 0 {
+		s.logf("%d restarted with snapshot at %d and %d entries", id, n.storage.snapshotId(), len(n.storage.entries))
+	}
+	n.node = node
+	n.incarnation++
+	n.timers = make(map[consensus.TimerKind]int)
+	n.commitId = -1
+	n.applied = nil
+	n.checked = 0
+	s.process(n)
+}
+
+// process carries out Ready of the node.
+func (s *simulation) process(n *simNode) {
+	// entries applied before this event were checked as committed before
+	// they are compacted
+	s.compact(n)
+	ready := n.node.Ready()
+	for _, t := range ready.Timers {
+		s.seq++
+		n.timers[t.Kind] = s.seq
+		if !t.Stop {
+			s.schedule(t.After, event{kind: timer, to: n.id, incarnation: n.incarnation, timer: t.Kind, timerSeq: s.seq})
+		}
+	}
+	if ready.Snapshot != nil {
+		s.logf("%d restored snapshot at %d", n.id, ready.Snapshot.Id)
+		n.applied = nil
+		if err := json.Unmarshal(ready.Snapshot.Data, &n.applied); err != nil {
+			panic(err)
+		}
+		n.checked = 0
+	}
+	for _, committed := range ready.Committed {
+		n.applied = append(n.applied, committed.Entry)
+	}
+	for _, envelope := range ready.Messages {
+		s.send(n.id, envelope)
+	}
+}
+
+// compact takes a snapshot of the node once SnapshotEntries were applied
+// since the previous one.
+func (s *simulation) compact(n *simNode) {
+	if s.config.SnapshotEntries == 0 || len(n.applied) == 0 {
+		return
+	}
+	last := n.applied[len(n.applied)-1].Id
+	if last-n.storage.snapshotId() < s.config.SnapshotEntries {
+		return
+	}
+	data, err := json.Marshal(n.applied)
+	if err != nil {
+		panic(err)
+	}
+	if err := n.node.Compact(last, data); err != nil {
+		s.fail("compaction: node %d: %s", n.id, err)
+	}
+}
+
+func (s *simulation) send(from int, envelope consensus.Envelope) {
+	to := s.nodes[envelope.To]
+	if to == nil {
+		return
+	}
+	if s.faults && s.rand.Float64() < s.config.DropRate {
+		return
+	}
+	copies := 1
+	if s.faults && s.rand.Float64() < s.config.DuplicateRate {
+		copies = 2
+	}
+	for range copies {
+		delay := s.config.MinDelay + time.Duration(s.rand.Int63n(int64(s.config.MaxDelay-s.config.MinDelay)+1))
+		s.schedule(delay, event{kind: deliver, from: from, to: envelope.To, incarnation: to.incarnation, message: envelope.Message})
+	}
+}
+
+// converge stops all faults and client requests and expects all nodes to
+// agree on a leader and commit the same log before convergeTimeout.
+func (s *simulation) converge() {
+	s.logf("healing all faults")
+	s.faults = false
+	clear(s.group)
+	for _, id := range s.ids {
+		if !s.removed[id] {
+			s.restart(id)
+		}
+	}
+	deadline := s.now.Add(convergeTimeout)
+	for s.now.Before(deadline) && s.violation == "" {
+		s.step()
+		if s.converged() == "" {
+			return
+		}
+	}
+	if s.violation == "" {
+		s.fail("liveness: %s %s after healing all faults", s.converged(), convergeTimeout)
+	}
+}
+
+const convergeTimeout = time.Minute
+
+// converged describes why the cluster has not converged yet, empty if it did.
+// Removed nodes are left out.
+func (s *simulation) converged() string {
+	leaders := 0
+	maxCommit := -1
+	for _, id := range s.ids {
+		if s.removed[id] {
+			continue
+		}
+		status := s.nodes[id].node.Status()
+		if status.Role == consensus.Leader.String() {
+			leaders++
+		}
+		maxCommit = max(maxCommit, status.CommitId)
+	}
+	if leaders != 1 {
+		return fmt.Sprintf("%d leaders", leaders)
+	}
+	for _, id := range s.ids {
+		if s.removed[id] {
+			continue
+		}
+		if commitId := s.nodes[id].node.Status().CommitId; commitId != maxCommit {
+			return fmt.Sprintf("node %d committed %d of %d entries", id, commitId+1, maxCommit+1)
+		}
+	}
+	return ""
+}
+
+func (s *simulation) fail(format string, args ...any) {
+	if s.violation == "" {
+		s.violation = fmt.Sprintf(format, args...)
+		s.logf("VIOLATION: %s", s.violation)
+	}
+}
+
+func (s *simulation) result() Result {
+	result := s.stats
+	result.Seed = s.config.Seed
+	result.Steps = s.steps
+	result.Elapsed = s.now.Sub(s.start)
+	result.Committed = len(s.committed)
+	result.Elections = len(s.leaders)
+	result.Violation = s.violation
+	if s.violation != "" {
+		result.Trace = slices.Clone(s.trace)
+	}
+	return result
+}
+
+func timerName(kind consensus.TimerKind) string {
+	switch kind {
+	case consensus.ElectionTimer:
+		return "election"
+	case consensus.HeartbeatTimer:
+		return "heartbeat"
+	case consensus.TransferTimer:
+		return "transfer"
+	case consensus.ShutdownTimer:
+		return "shutdown"
+	}
+	return "unknown"
+}
+
+func describe(message any) string {
+	switch msg := message.(type) {
+	case consensus.AppendEntries:
+		ids := make([]string, len(msg.Entries))
+		for i, entry := range msg.Entries {
+			ids[i] = fmt.Sprintf("%d/%d", entry.Id, entry.Term)
+		}
+		return fmt.Sprintf("AppendEntries{Term:%d Commit:%d Entries:[%s]}", msg.Term, msg.CommitId, strings.Join(ids, " "))
+	case consensus.InstallSnapshot:
+		return fmt.Sprintf("InstallSnapshot{Term:%d Id:%d/%d}", msg.Term, msg.Snapshot.Id, msg.Snapshot.Term)
+	case consensus.LogEntry:
+		return fmt.Sprintf("entry %d/%d %q", msg.Id, msg.Term, msg.Command)
+	case nil:
+		return "accepted"
+	}
+	return fmt.Sprintf("%T%+v", message, message)
+}
+
+type eventQueue []event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at.Equal(q[j].at) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].at.Before(q[j].at)
+}
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x any)   { *q = append(*q, x.(event)) }
+func (q *eventQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
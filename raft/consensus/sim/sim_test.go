@@ -0,0 +1,53 @@
+package sim
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestSimulation runs the simulator over fixed seeds, a failure prints the
+// events leading to the violation and the seed to replay with
+// go run ./cmd/raftsim -runs 1 -seed <seed>.
+func TestSimulation(t *testing.T) {
+	seeds := 10
+	if testing.Short() {
+		seeds = 2
+	}
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			t.Parallel()
+			result := Run(DefaultConfig(seed))
+			if result.Failed() {
+				t.Fatalf("%s\n%s", result.Violation, strings.Join(result.Trace, "\n"))
+			}
+			if result.Committed == 0 {
+				t.Fatal("no entries committed")
+			}
+		})
+	}
+}
+
+// TestMembershipChanges removes and adds back voters while the cluster is
+// partitioned more often than by default.
+func TestMembershipChanges(t *testing.T) {
+	seeds := 5
+	if testing.Short() {
+		seeds = 1
+	}
+	for seed := int64(1); seed <= int64(seeds); seed++ {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			t.Parallel()
+			config := DefaultConfig(seed)
+			config.MembershipRate = 0.05
+			config.PartitionRate = 0.05
+			result := Run(config)
+			if result.Failed() {
+				t.Fatalf("%s\n%s", result.Violation, strings.Join(result.Trace, "\n"))
+			}
+			if result.MembershipChanges == 0 {
+				t.Fatal("no membership changes")
+			}
+		})
+	}
+}
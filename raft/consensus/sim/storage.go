@@ -0,0 +1,65 @@
+package sim
+
+import (
+	"slices"
+
+	"chaddb/consensus"
+)
+
+// memoryStorage survives crashes of the simulated node, every write is
+// durable at once.
+type memoryStorage struct {
+	state consensus.RaftState
+	// snapshot is nil until the first one, entries follow it
+	snapshot *consensus.Snapshot
+	entries  []consensus.LogEntry
+	// version changes with every append
+	version int
+}
+
+// snapshotId returns the id of the last compacted entry, -1 if there is none.
+func (m *memoryStorage) snapshotId() int {
+	if m.snapshot == nil {
+		return -1
+	}
+	return m.snapshot.Id
+}
+
+// entry returns the entry with id unless it is compacted or past the end of
+// the log.
+func (m *memoryStorage) entry(id int) (consensus.LogEntry, bool) {
+	i := id - m.snapshotId() - 1
+	if i < 0 || i >= len(m.entries) {
+		return consensus.LogEntry{}, false
+	}
+	return m.entries[i], true
+}
+
+func (m *memoryStorage) lastId() int {
+	return m.snapshotId() + len(m.entries)
+}
+
+func (m *memoryStorage) Append(entries ...consensus.LogEntry) error {
+	for _, entry := range entries {
+		// same as replaying consensus.RaftLog
+		m.entries = append(m.entries[:entry.Id-m.snapshotId()-1], entry)
+	}
+	m.version++
+	return nil
+}
+
+func (m *memoryStorage) SaveState(state consensus.RaftState) error {
+	m.state = state
+	return nil
+}
+
+func (m *memoryStorage) SaveSnapshot(snapshot consensus.Snapshot, entries []consensus.LogEntry) error {
+	m.snapshot = &snapshot
+	m.entries = slices.Clone(entries)
+	m.version++
+	return nil
+}
+
+func (m *memoryStorage) Sync() error {
+	return nil
+}
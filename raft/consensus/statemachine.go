@@ -0,0 +1,20 @@
+package consensus
+
+import (
+	"io"
+)
+
+// StateMachine is what raft replicates. Apply is called on every node with
+// committed commands in log order, the result is returned to the proposer
+// by the leader. Commands are opaque to raft. Snapshot writes the state up to
+// AppliedIndex, the log is compacted up to that index; Restore replaces the
+// state with a snapshot, one the leader sent or the last one on start.
+type StateMachine interface {
+	Apply(index int, command []byte) any
+	// AppliedIndex is the index of the last applied command that survives a
+	// restart, -1 if none. Raft applies commands after it again on start.
+	AppliedIndex() int
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+	Close() error
+}
@@ -3,11 +3,16 @@ module chaddb
 go 1.23.3
 
 require (
+	chadcommon v0.0.0-00010101000000-000000000000
 	ergo.services/application v0.0.0-20240904055159-7f2e1a954c05
 	ergo.services/ergo v1.999.300
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	ergo.services/meta v0.0.0-20240904054930-a97f6add8a78 // indirect
+	github.com/BurntSushi/toml v1.5.0 // indirect
 	github.com/gorilla/websocket v1.5.0 // indirect
 )
+
+replace chadcommon => ../common
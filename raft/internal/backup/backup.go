@@ -0,0 +1,125 @@
+// Package backup frames a snapshot of the state machine for backups: a JSON
+// header line with the cluster and the index of the snapshot, the snapshot
+// itself and a JSON trailer line with its size and checksum. The trailer comes
+// last so that the snapshot can be streamed.
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Format tells backups apart from other files and versions the layout.
+const Format = "chaddb-backup/1"
+
+var ErrChecksum = errors.New("backup checksum mismatch")
+
+type Header struct {
+	Format    string    `json:"format"`
+	ClusterId string    `json:"clusterId,omitempty"`
+	Index     int       `json:"index"`
+	Created   time.Time `json:"created"`
+	// Size and Sha256 are those of the snapshot, they are read from the
+	// trailer.
+	Size   int64  `json:"size,omitempty"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+type trailer struct {
+	Size   int64  `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+// Write writes header, the snapshot that snapshot writes and the trailer,
+// Format of the header is set.
+func Write(w io.Writer, header Header, snapshot func(io.Writer) error) error {
+	header.Format = Format
+	header.Size, header.Sha256 = 0, ""
+	line, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	digest := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(w, digest)}
+	if err := snapshot(counter); err != nil {
+		return err
+	}
+	line, err = json.Marshal(trailer{Size: counter.n, Sha256: hex.EncodeToString(digest.Sum(nil))})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(append([]byte{'\n'}, line...), '\n'))
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Read reads a backup and verifies the size and checksum of its snapshot.
+func Read(r io.Reader) (Header, []byte, error) {
+	var header Header
+	buffered := bufio.NewReader(r)
+	line, err := buffered.ReadBytes('\n')
+	if err != nil {
+		return header, nil, fmt.Errorf("invalid backup header: %w", err)
+	}
+	if err := json.Unmarshal(line, &header); err != nil {
+		return header, nil, fmt.Errorf("invalid backup header: %w", err)
+	}
+	if header.Format != Format {
+		return header, nil, fmt.Errorf("unknown backup format %q", header.Format)
+	}
+	rest, err := io.ReadAll(buffered)
+	if err != nil {
+		return header, nil, err
+	}
+	// the trailer is the last line, the snapshot may hold newlines itself
+	end := bytes.LastIndexByte(bytes.TrimSuffix(rest, []byte{'\n'}), '\n')
+	var t trailer
+	if end < 0 || !bytes.HasSuffix(rest, []byte{'\n'}) || json.Unmarshal(rest[end+1:], &t) != nil || t.Sha256 == "" {
+		return header, nil, errors.New("invalid backup trailer, the backup may be truncated")
+	}
+	header.Size, header.Sha256 = t.Size, t.Sha256
+	snapshot := rest[:end]
+	if int64(len(snapshot)) != header.Size {
+		return header, nil, fmt.Errorf("backup snapshot has %d bytes instead of %d", len(snapshot), header.Size)
+	}
+	digest := sha256.Sum256(snapshot)
+	if hex.EncodeToString(digest[:]) != header.Sha256 {
+		return header, nil, ErrChecksum
+	}
+	return header, snapshot, nil
+}
+
+// Load reads the backup file at path.
+func Load(path string) (Header, []byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	defer file.Close()
+	header, snapshot, err := Read(file)
+	if err != nil {
+		return header, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return header, snapshot, nil
+}
@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeBackup(t *testing.T, snapshot string) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	header := Header{ClusterId: "cluster", Index: 42, Created: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	err := Write(&buffer, header, func(w io.Writer) error {
+		// snapshots are written in pieces
+		for _, line := range strings.SplitAfter(snapshot, "\n") {
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, snapshot := range []string{
+		"",
+		"{\"appliedIndex\":42}\n{\"key\":\"a\",\"value\":\"1\"}\n",
+		"no newline at the end",
+		"\n\n",
+	} {
+		data := writeBackup(t, snapshot)
+		header, read, err := Read(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%q: %v", snapshot, err)
+		}
+		if string(read) != snapshot {
+			t.Fatalf("read %q, want %q", read, snapshot)
+		}
+		if header.Format != Format || header.ClusterId != "cluster" || header.Index != 42 || header.Size != int64(len(snapshot)) {
+			t.Fatalf("read header %+v", header)
+		}
+	}
+}
+
+func TestCorruptBackups(t *testing.T) {
+	snapshot := "{\"appliedIndex\":42}\n{\"key\":\"a\",\"value\":\"1\"}\n"
+	data := string(writeBackup(t, snapshot))
+	headerEnd := strings.IndexByte(data, '\n') + 1
+	trailerStart := headerEnd + len(snapshot) + 1
+
+	tests := []struct {
+		name string
+		data string
+		err  error
+	}{
+		{"flipped byte", strings.Replace(data, `"value":"1"`, `"value":"2"`, 1), ErrChecksum},
+		{"missing trailer", data[:trailerStart], nil},
+		{"truncated trailer", data[:len(data)-5], nil},
+		{"truncated snapshot", data[:headerEnd+10], nil},
+		{"extra byte", data[:trailerStart-1] + "x" + data[trailerStart-1:], nil},
+		{"missing byte", data[:headerEnd] + data[headerEnd+1:], nil},
+		{"no header", "", nil},
+		{"unknown format", strings.Replace(data, Format, "chaddb-backup/0", 1), nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := Read(strings.NewReader(test.data))
+			if err == nil {
+				t.Fatal("corrupt backup read")
+			}
+			if test.err != nil && !errors.Is(err, test.err) {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestSnapshotError(t *testing.T) {
+	failed := errors.New("disk full")
+	var buffer bytes.Buffer
+	err := Write(&buffer, Header{}, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("error %v, want %v", err, failed)
+	}
+	if _, _, err := Read(&buffer); err == nil {
+		t.Fatal("backup of a failed snapshot read")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chaddb.backup")
+	if err := os.WriteFile(path, writeBackup(t, "snapshot"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, snapshot, err := Load(path); err != nil || string(snapshot) != "snapshot" {
+		t.Fatalf("loaded %q, %v", snapshot, err)
+	}
+	if _, _, err := Load(path + ".missing"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("error %v for a missing file", err)
+	}
+}
@@ -0,0 +1,180 @@
+package kvstore
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"slices"
+
+	"chaddb/internal/store"
+	. "chaddb/internal/utils"
+)
+
+// maxDigests bounds the history of state digests.
+const maxDigests = 10000
+
+// Digest is the digest of a state: the XOR of the digests of its keys, so a
+// write updates it without reading the other keys, and replicas with the
+// same keys and values have the same digest whatever order they were written
+// in.
+type Digest [sha256.Size]byte
+
+func (d Digest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+// EntryDigest is the digest of a key holding a value with its content type.
+func EntryDigest(kv store.KeyValue) Digest {
+	h := sha256.New()
+	h.Write(binary.AppendUvarint(nil, uint64(len(kv.Key))))
+	h.Write([]byte(kv.Key))
+	h.Write(binary.AppendUvarint(nil, uint64(len(kv.ContentType))))
+	h.Write([]byte(kv.ContentType))
+	h.Write([]byte(kv.Value))
+	return Digest(h.Sum(nil))
+}
+
+func (d *Digest) toggle(entry Digest) {
+	for i := range d {
+		d[i] ^= entry[i]
+	}
+}
+
+// IndexDigest is the digest of the state after the entry at Index was
+// applied. It does not change until the next IndexDigest of the history.
+type IndexDigest struct {
+	Index  int
+	Digest Digest
+}
+
+// StateDigest is answered with DigestAt of the state at index At, or at the
+// last applied index if At is 0.
+type StateDigest struct {
+	At int
+}
+
+type DigestAt struct {
+	Applied int `json:"applied"`
+	Index   int `json:"index"`
+	// Digest is empty if the state at Index is not known: it is not applied
+	// yet or older than the history of digests.
+	Digest string `json:"digest,omitempty"`
+}
+
+// RangeDigest is answered with RangeDigestResult of the keys in [From, To),
+// empty To means no upper bound. The digests of the keys are added if there
+// are at most Keys of them.
+type RangeDigest struct {
+	From string
+	To   string
+	Keys int
+}
+
+type RangeDigestResult struct {
+	Applied int    `json:"applied"`
+	Digest  string `json:"digest"`
+	Count   int    `json:"count"`
+	// Middle splits the range into halves with about as many keys.
+	Middle string            `json:"middle,omitempty"`
+	Keys   map[string]string `json:"keys,omitempty"`
+}
+
+// resetDigest computes the digest of the whole state and starts the history
+// over, after the state was opened or restored.
+func (m *StateMachine) resetDigest() {
+	m.digest = Digest{}
+	for _, kv := range Must1(m.store.Range("", "", 0)) {
+		m.digest.toggle(EntryDigest(kv))
+	}
+	m.applied = max(m.store.AppliedIndex(), 0)
+	m.digests = []IndexDigest{{Index: m.applied, Digest: m.digest}}
+}
+
+// write adds ops to the writes of the entry being applied, commit applies
+// them together.
+func (m *StateMachine) write(ops ...store.Op) {
+	m.batch = append(m.batch, ops...)
+}
+
+// commit applies the writes of the entry at index and updates the digest with
+// the keys they changed.
+func (m *StateMachine) commit(index int) {
+	ops := m.batch
+	m.batch = nil
+	// a persistent engine ignores entries it applied before a restart
+	if len(ops) == 0 || index <= m.store.AppliedIndex() {
+		return
+	}
+	before := make(map[string]*store.KeyValue, len(ops))
+	for _, op := range ops {
+		if _, ok := before[op.Key]; !ok {
+			before[op.Key] = m.lookup(op.Key)
+		}
+	}
+	Must(m.store.Apply(index, ops...))
+	for key, value := range before {
+		if value != nil {
+			m.digest.toggle(EntryDigest(*value))
+		}
+		if value = m.lookup(key); value != nil {
+			m.digest.toggle(EntryDigest(*value))
+		}
+	}
+	if len(m.digests) == maxDigests {
+		m.digests = m.digests[1:]
+	}
+	m.digests = append(m.digests, IndexDigest{Index: index, Digest: m.digest})
+	keysMetric.Set(float64(m.store.Len()))
+}
+
+func (m *StateMachine) queryDigest(req StateDigest) DigestAt {
+	result := DigestAt{Applied: m.applied, Index: req.At}
+	if req.At == 0 {
+		result.Index = m.applied
+	}
+	if result.Index > m.applied || result.Index < m.digests[0].Index {
+		return result
+	}
+	// the last write not after the index
+	i, found := slices.BinarySearchFunc(m.digests, result.Index, func(d IndexDigest, index int) int {
+		return cmp.Compare(d.Index, index)
+	})
+	if !found {
+		i--
+	}
+	result.Digest = m.digests[i].Digest.String()
+	return result
+}
+
+func (m *StateMachine) lookup(key string) *store.KeyValue {
+	kv, ok := Must2(m.store.Get(key))
+	if !ok {
+		return nil
+	}
+	return &kv
+}
+
+func (m *StateMachine) queryRangeDigest(req RangeDigest) (any, error) {
+	keys, err := m.store.Range(req.From, req.To, 0)
+	if err != nil {
+		return nil, err
+	}
+	result := RangeDigestResult{Applied: m.applied, Count: len(keys)}
+	var digest Digest
+	if len(keys) <= req.Keys {
+		result.Keys = make(map[string]string, len(keys))
+	}
+	for _, kv := range keys {
+		entry := EntryDigest(kv)
+		digest.toggle(entry)
+		if result.Keys != nil {
+			result.Keys[kv.Key] = entry.String()
+		}
+	}
+	result.Digest = digest.String()
+	if len(keys) > 1 {
+		result.Middle = keys[len(keys)/2].Key
+	}
+	return result, nil
+}
@@ -0,0 +1,149 @@
+package kvstore
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"chadcommon/content"
+)
+
+func (m *testMachine) digest(at int) DigestAt {
+	m.t.Helper()
+	result, err := m.Query(StateDigest{At: at})
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return result.(DigestAt)
+}
+
+func (m *testMachine) rangeDigest(req RangeDigest) RangeDigestResult {
+	m.t.Helper()
+	result, err := m.Query(req)
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return result.(RangeDigestResult)
+}
+
+func TestDigestIgnoresApplyOrder(t *testing.T) {
+	a := newTestMachine(t)
+	a.apply(Command{Op: OpSet, Key: "a", Value: "1"})
+	a.apply(Command{Op: OpSet, Key: "b", Value: "2"})
+	a.apply(Command{Op: OpSet, Key: "c", Value: `{"c":3}`, ContentType: content.TypeJSON})
+
+	// the same keys written in another order, over other values and with a
+	// key that is gone again
+	b := newTestMachine(t)
+	b.apply(Command{Op: OpSet, Key: "d", Value: "4"})
+	b.apply(Command{Op: OpSet, Key: "c", Value: `{"c":3}`, ContentType: content.TypeJSON})
+	b.apply(Command{Op: OpSet, Key: "b", Value: "old"})
+	b.apply(Command{Op: OpTxn, Txn: &Txn{Then: []Command{{Op: OpSet, Key: "a", Value: "1"}, {Op: OpSet, Key: "b", Value: "2"}, {Op: OpDel, Key: "d"}}}})
+	b.apply(Command{Op: OpCas, Key: "a", Expect: "1", Value: "1"})
+
+	digest := a.digest(0).Digest
+	if digest == "" || digest != b.digest(0).Digest {
+		t.Fatalf("the same state has digests %q and %q", digest, b.digest(0).Digest)
+	}
+	if r1, r2 := a.rangeDigest(RangeDigest{}), b.rangeDigest(RangeDigest{}); r1.Digest != digest || r2.Digest != digest || r1.Count != 3 || r2.Count != 3 {
+		t.Fatalf("range digests %+v and %+v, want %s of 3 keys", r1, r2, digest)
+	}
+
+	// the digest of a restored state is computed from its keys
+	var snapshot bytes.Buffer
+	if err := b.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	c := newTestMachine(t)
+	c.apply(Command{Op: OpSet, Key: "e", Value: "5"})
+	if err := c.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if restored := c.digest(0); restored.Digest != digest || restored.Index != b.index {
+		t.Fatalf("restored state has %+v, want %s at %d", restored, digest, b.index)
+	}
+
+	// the content type is part of the state
+	b.apply(Command{Op: OpSet, Key: "c", Value: `{"c":3}`})
+	if b.digest(0).Digest == digest {
+		t.Fatalf("the digest did not change with the content type")
+	}
+	// an empty state has the digest of no keys
+	for _, key := range []string{"a", "b", "c"} {
+		b.apply(Command{Op: OpDel, Key: key})
+	}
+	if empty := b.digest(0).Digest; empty != (Digest{}).String() {
+		t.Fatalf("empty state has digest %s", empty)
+	}
+}
+
+func TestDigestHistory(t *testing.T) {
+	m := newTestMachine(t)
+	empty := m.digest(0)
+	m.apply(Command{Op: OpSet, Key: "a", Value: "1"})
+	one := m.digest(0)
+	m.apply(Command{Op: OpGet, Key: "a"})
+	m.apply(Command{Op: OpSet, Key: "b", Value: "2"})
+
+	for _, test := range []struct {
+		at   int
+		want string
+	}{
+		{0, m.digest(m.index).Digest},
+		{1, one.Digest},
+		// a read changes nothing
+		{2, one.Digest},
+		{m.index + 1, ""},
+	} {
+		if got := m.digest(test.at); got.Digest != test.want || got.Applied != m.index {
+			t.Errorf("digest at %d = %+v, want %q applied at %d", test.at, got, test.want, m.index)
+		}
+	}
+	if empty.Digest != (Digest{}).String() || one.Digest == m.digest(0).Digest {
+		t.Fatalf("digests did not change with the state: %s, %s, %s", empty.Digest, one.Digest, m.digest(0).Digest)
+	}
+}
+
+// TestRangeDigestFindsDivergentKey finds a diverging key by halving the
+// range whose digests differ, like an admin comparing two replicas would.
+func TestRangeDigestFindsDivergentKey(t *testing.T) {
+	a, b := newTestMachine(t), newTestMachine(t)
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		a.apply(Command{Op: OpSet, Key: key, Value: "v"})
+	}
+	for i := 199; i >= 0; i-- {
+		key := fmt.Sprintf("key-%03d", i)
+		value := "v"
+		if key == "key-137" {
+			value = "diverged"
+		}
+		b.apply(Command{Op: OpSet, Key: key, Value: value})
+	}
+
+	req := RangeDigest{Keys: 4}
+	for {
+		ra, rb := a.rangeDigest(req), b.rangeDigest(req)
+		if ra.Digest == rb.Digest {
+			t.Fatalf("range [%q, %q) has the same digest", req.From, req.To)
+		}
+		if ra.Keys != nil {
+			var keys []string
+			for key, digest := range ra.Keys {
+				if rb.Keys[key] != digest {
+					keys = append(keys, key)
+				}
+			}
+			if len(keys) != 1 || keys[0] != "key-137" {
+				t.Fatalf("divergent keys %v, want [key-137]", keys)
+			}
+			return
+		}
+		lower := RangeDigest{From: req.From, To: ra.Middle, Keys: req.Keys}
+		if a.rangeDigest(lower).Digest != b.rangeDigest(lower).Digest {
+			req = lower
+		} else {
+			req = RangeDigest{From: ra.Middle, To: req.To, Keys: req.Keys}
+		}
+	}
+}
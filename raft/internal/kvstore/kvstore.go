@@ -0,0 +1,675 @@
+// Package kvstore is the key-value state machine replicated by chaddb.
+package kvstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"chadcommon/audit"
+	"chadcommon/content"
+	"chadcommon/jsonpatch"
+	"chaddb/internal/backup"
+	"chaddb/internal/metrics"
+	opt "chaddb/internal/options"
+	"chaddb/internal/store"
+	. "chaddb/internal/utils"
+)
+
+var (
+	keysMetric        = metrics.NewGauge("chaddb_storage_keys", "Number of keys in storage.")
+	auditErrorsMetric = metrics.NewCounter("chaddb_audit_errors_total", "Audit log entries that could not be written.")
+)
+
+const (
+	OpSet = "set"
+	OpDel = "del"
+	// OpCas sets Value if the key holds Expect with the ContentType of
+	// Value, or if Missing and the key does not exist.
+	OpCas = "cas"
+	// OpGet reads through the log, so the value is linearizable.
+	OpGet = "get"
+	// OpTxn applies the set, del and get commands of Txn.Then if all
+	// comparisons of Txn.If hold and those of Txn.Else otherwise.
+	OpTxn = "txn"
+	// OpPatch applies the JSON Merge Patch or JSON Patch in Value, as told by
+	// ContentType, to the JSON document of the key and sets the result.
+	OpPatch = "patch"
+)
+
+// ClusterIdKey holds the id of the cluster, the first leader sets it.
+const ClusterIdKey = "_cluster/id"
+
+// Sessions are stored under sessionPrefix, so that they are in snapshots and
+// survive restarts of a persistent engine. Their keys end before sessionsEnd.
+const (
+	sessionPrefix = "_cluster/sessions/"
+	sessionsEnd   = "_cluster/sessions0"
+)
+
+// maxSessions and maxChanges bound the memory used for deduplication of
+// client requests and for the change feed of watchers.
+const (
+	maxSessions       = 10000
+	maxSessionResults = 1000
+	maxChanges        = 10000
+)
+
+// Command is the payload of a raft log entry. Commands with ClientId are
+// applied at most once per Seq, a retried command gets the result of the
+// first attempt. Ack tells that the client received the results of all its
+// commands up to that Seq, so they are no longer kept. Principal and
+// RemoteAddr tell who sent the command, for the audit log. ContentType of a
+// set is stored with Value, see package content.
+type Command struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Expect      string `json:"expect,omitempty"`
+	Missing     bool   `json:"missing,omitempty"`
+	ClientId    string `json:"client,omitempty"`
+	Seq         int    `json:"seq,omitempty"`
+	Ack         int    `json:"ack,omitempty"`
+	Txn         *Txn   `json:"txn,omitempty"`
+
+	Principal  string `json:"principal,omitempty"`
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+}
+
+type Txn struct {
+	If   []Compare `json:"if"`
+	Then []Command `json:"then"`
+	Else []Command `json:"else,omitempty"`
+}
+
+// Compare holds if the key has Value, or does not exist if Missing. The
+// content type of the value is not compared.
+type Compare struct {
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Missing bool   `json:"missing,omitempty"`
+}
+
+// TxnResult has an entry per command of the branch that was applied, for
+// get commands it tells the value and its content type.
+type TxnResult struct {
+	Succeeded bool        `json:"succeeded"`
+	Results   []TxnOutput `json:"results"`
+}
+
+type TxnOutput struct {
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	Found       bool   `json:"found,omitempty"`
+}
+
+func (c Command) Encode() []byte {
+	return Must1(json.Marshal(c))
+}
+
+func SetCommand(key string, value string) []byte {
+	return Command{Op: OpSet, Key: key, Value: value}.Encode()
+}
+
+func DelCommand(key string) []byte {
+	return Command{Op: OpDel, Key: key}.Encode()
+}
+
+func CasCommand(key string, expect string, value string) []byte {
+	return Command{Op: OpCas, Key: key, Expect: expect, Value: value}.Encode()
+}
+
+// CreateCommand sets key only if it does not exist.
+func CreateCommand(key string, value string) []byte {
+	return Command{Op: OpCas, Key: key, Missing: true, Value: value}.Encode()
+}
+
+func GetCommand(key string) []byte {
+	return Command{Op: OpGet, Key: key}.Encode()
+}
+
+// Get is answered with the store.KeyValue of the key or KeyNotFound.
+type Get struct {
+	Key string
+}
+
+// Range is answered with []store.KeyValue of keys in [From, To).
+type Range struct {
+	From  string
+	To    string
+	Limit int
+}
+
+// Changes is answered with ChangeList of changes after index From to keys
+// with Prefix, or ChangesCompacted if some of them are no longer kept.
+type Changes struct {
+	From   int
+	Prefix string
+	Limit  int
+}
+
+// Change is a set or delete applied at log Index, a successful cas is a set.
+type Change struct {
+	Index       int    `json:"index"`
+	Op          string `json:"op"`
+	Key         string `json:"key"`
+	Value       string `json:"value,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+// ChangeList.Index is where the next Changes request continues.
+type ChangeList struct {
+	Index   int      `json:"index"`
+	Changes []Change `json:"changes"`
+}
+
+// ChangesCompacted means changes up to Since are no longer kept.
+type ChangesCompacted struct {
+	Since int
+}
+
+type KeyNotFound struct {
+}
+
+// CasFailed is the result of a cas command when the key does not hold the
+// expected value, or exists although it was expected to be missing.
+type CasFailed struct {
+}
+
+// PatchFailed is the result of a patch command that can not be applied to
+// the value of the key, the value is left as it was.
+type PatchFailed struct {
+	Reason string
+}
+
+// InvalidCommand is the result of applying a command that can not be decoded.
+type InvalidCommand struct {
+	Reason string
+}
+
+// StateMachine applies commands to a storage engine selected by
+// -storage-engine.
+type StateMachine struct {
+	store store.StateMachineStore
+
+	sessions map[string]*session
+	// batch holds the writes of the entry being applied
+	batch []store.Op
+	// changes holds the changes applied after changesSince
+	changes      []Change
+	changesSince int
+
+	// applied is the last index passed to Apply, digests holds the digest
+	// of the state after each of the last writes
+	applied int
+	digest  Digest
+	digests []IndexDigest
+}
+
+// session remembers the results of commands of a client.
+type session struct {
+	// Index of the last command
+	Index   int
+	Ack     int
+	Results map[int]any
+}
+
+// storedSession is a session in the store, a result is stored with its type
+// to be decoded as the same type.
+type storedSession struct {
+	Index   int                  `json:"index"`
+	Ack     int                  `json:"ack"`
+	Results map[int]storedResult `json:"results,omitempty"`
+}
+
+type storedResult struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Open is a dbnode.StateMachineFactory. With -restore-from an empty store
+// starts from the backup.
+func Open() (*StateMachine, error) {
+	st, err := store.Open(opt.StorageEngine, filepath.Join(opt.DataDir, "storage"))
+	if err != nil {
+		return nil, err
+	}
+	if opt.RestoreFrom != "" && st.AppliedIndex() < 0 {
+		if err := restoreBackup(st, opt.RestoreFrom); err != nil {
+			st.Close()
+			return nil, err
+		}
+	}
+	keysMetric.Set(float64(st.Len()))
+	m := &StateMachine{store: st, changesSince: st.AppliedIndex()}
+	if err := m.loadSessions(); err != nil {
+		st.Close()
+		return nil, err
+	}
+	m.resetDigest()
+	return m, nil
+}
+
+// restoreBackup makes the snapshot of a backup the state before the first
+// entry of the log of a new cluster. The cluster id and the sessions of the
+// backup are left out, so that the new cluster gets its own.
+func restoreBackup(st store.StateMachineStore, path string) error {
+	_, snapshot, err := backup.Load(path)
+	if err != nil {
+		return err
+	}
+	_, entries, err := store.ReadSnapshot(bytes.NewReader(snapshot))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	entries = slices.DeleteFunc(entries, func(kv store.KeyValue) bool {
+		return kv.Key == ClusterIdKey || strings.HasPrefix(kv.Key, sessionPrefix)
+	})
+	var rebased bytes.Buffer
+	if err := store.WriteSnapshot(&rebased, 0, entries); err != nil {
+		return err
+	}
+	return st.Restore(&rebased)
+}
+
+func (m *StateMachine) Apply(index int, command []byte) any {
+	m.applied = max(m.applied, index)
+	defer m.commit(index)
+	var cmd Command
+	if err := json.Unmarshal(command, &cmd); err != nil {
+		return InvalidCommand{Reason: err.Error()}
+	}
+	// the sessions of a persistent engine are loaded as they were after the
+	// entries it applied before a restart
+	if cmd.ClientId == "" || index <= m.store.AppliedIndex() {
+		return m.apply(index, cmd)
+	}
+	s, ok := m.sessions[cmd.ClientId]
+	if !ok {
+		if len(m.sessions) >= maxSessions {
+			m.expireSession()
+		}
+		s = &session{Results: make(map[int]any)}
+		m.sessions[cmd.ClientId] = s
+	}
+	defer m.saveSession(cmd.ClientId, s)
+	s.acknowledge(cmd.Ack)
+	if cmd.Seq <= s.Ack {
+		return InvalidCommand{Reason: fmt.Sprintf("request %d of client %s was acknowledged", cmd.Seq, cmd.ClientId)}
+	}
+	if result, ok := s.Results[cmd.Seq]; ok {
+		return result
+	}
+	result := m.apply(index, cmd)
+	s.Index = index
+	s.Results[cmd.Seq] = result
+	if len(s.Results) > maxSessionResults {
+		// the client does not acknowledge, forget its oldest result
+		s.acknowledge(slices.Min(slices.Collect(maps.Keys(s.Results))))
+	}
+	return result
+}
+
+func (s *session) acknowledge(ack int) {
+	if ack <= s.Ack {
+		return
+	}
+	s.Ack = ack
+	for seq := range s.Results {
+		if seq <= ack {
+			delete(s.Results, seq)
+		}
+	}
+}
+
+// expireSession drops the least recently used session, every replica drops
+// the same one: sessions with the same index are ordered by client id.
+func (m *StateMachine) expireSession() {
+	oldest, oldestIndex := "", 0
+	for id, s := range m.sessions {
+		if oldest == "" || s.Index < oldestIndex || s.Index == oldestIndex && id < oldest {
+			oldest, oldestIndex = id, s.Index
+		}
+	}
+	delete(m.sessions, oldest)
+	m.write(store.Op{Key: sessionPrefix + oldest, Tombstone: true})
+}
+
+// saveSession writes the session of client with the entry being applied.
+func (m *StateMachine) saveSession(client string, s *session) {
+	stored := storedSession{Index: s.Index, Ack: s.Ack, Results: make(map[int]storedResult, len(s.Results))}
+	for seq, result := range s.Results {
+		stored.Results[seq] = storedResult{Type: resultType(result), Value: Must1(json.Marshal(result))}
+	}
+	m.write(store.Op{Key: sessionPrefix + client, Value: string(Must1(json.Marshal(stored)))})
+}
+
+// loadSessions reads the sessions from the store after it was opened or
+// restored.
+func (m *StateMachine) loadSessions() error {
+	entries, err := m.store.Range(sessionPrefix, sessionsEnd, 0)
+	if err != nil {
+		return err
+	}
+	m.sessions = make(map[string]*session, len(entries))
+	for _, kv := range entries {
+		var stored storedSession
+		if err := json.Unmarshal([]byte(kv.Value), &stored); err != nil {
+			return fmt.Errorf("session %s: %w", kv.Key, err)
+		}
+		s := &session{Index: stored.Index, Ack: stored.Ack, Results: make(map[int]any, len(stored.Results))}
+		for seq, result := range stored.Results {
+			if s.Results[seq], err = decodeResult(result); err != nil {
+				return fmt.Errorf("session %s: %w", kv.Key, err)
+			}
+		}
+		m.sessions[strings.TrimPrefix(kv.Key, sessionPrefix)] = s
+	}
+	return nil
+}
+
+// resultType names the type of a result of apply in a stored session.
+func resultType(result any) string {
+	switch result.(type) {
+	case bool:
+		return "ok"
+	case store.KeyValue:
+		return "value"
+	case KeyNotFound:
+		return "notFound"
+	case CasFailed:
+		return "casFailed"
+	case PatchFailed:
+		return "patchFailed"
+	case TxnResult:
+		return "txn"
+	case InvalidCommand:
+		return "invalid"
+	}
+	panic(fmt.Sprintf("result of type %T can not be stored", result))
+}
+
+func decodeResult(result storedResult) (any, error) {
+	switch result.Type {
+	case "ok":
+		return decodeAs[bool](result.Value)
+	case "value":
+		return decodeAs[store.KeyValue](result.Value)
+	case "notFound":
+		return decodeAs[KeyNotFound](result.Value)
+	case "casFailed":
+		return decodeAs[CasFailed](result.Value)
+	case "patchFailed":
+		return decodeAs[PatchFailed](result.Value)
+	case "txn":
+		return decodeAs[TxnResult](result.Value)
+	case "invalid":
+		return decodeAs[InvalidCommand](result.Value)
+	}
+	return nil, fmt.Errorf("unknown result type %q", result.Type)
+}
+
+func decodeAs[T any](data []byte) (any, error) {
+	var value T
+	err := json.Unmarshal(data, &value)
+	return value, err
+}
+
+func (m *StateMachine) apply(index int, cmd Command) any {
+	result := m.applyOp(index, cmd)
+	m.audit(index, cmd, result)
+	return result
+}
+
+func (m *StateMachine) applyOp(index int, cmd Command) any {
+	switch cmd.Op {
+	case OpSet:
+		m.write(store.Op{Key: cmd.Key, Value: cmd.Value, ContentType: cmd.ContentType})
+		m.recordChange(Change{Index: index, Op: OpSet, Key: cmd.Key, Value: cmd.Value, ContentType: cmd.ContentType})
+	case OpDel:
+		m.write(store.Op{Key: cmd.Key, Tombstone: true})
+		m.recordChange(Change{Index: index, Op: OpDel, Key: cmd.Key})
+	case OpCas:
+		current, ok := Must2(m.store.Get(cmd.Key))
+		if ok == cmd.Missing || (ok && (current.Value != cmd.Expect || current.ContentType != cmd.ContentType)) {
+			return CasFailed{}
+		}
+		m.write(store.Op{Key: cmd.Key, Value: cmd.Value, ContentType: cmd.ContentType})
+		m.recordChange(Change{Index: index, Op: OpSet, Key: cmd.Key, Value: cmd.Value, ContentType: cmd.ContentType})
+	case OpGet:
+		return Must1(m.Query(Get{Key: cmd.Key}))
+	case OpTxn:
+		return m.applyTxn(index, cmd.Txn)
+	case OpPatch:
+		return m.applyPatch(index, cmd)
+	default:
+		return InvalidCommand{Reason: fmt.Sprintf("unknown op %q", cmd.Op)}
+	}
+	return true
+}
+
+// audit records the writes of cmd in the audit log, a txn has an entry per
+// write of the branch it applied. Gets change nothing and are left out.
+func (m *StateMachine) audit(index int, cmd Command, result any) {
+	entry := audit.Entry{Principal: cmd.Principal, Client: cmd.RemoteAddr, Op: cmd.Op, Key: cmd.Key, Index: index, Outcome: audit.OutcomeOk}
+	switch res := result.(type) {
+	case CasFailed:
+		entry.Outcome = audit.OutcomeCasFailed
+	case PatchFailed:
+		entry.Outcome = audit.OutcomePatchFailed
+	case InvalidCommand:
+		entry.Outcome = audit.OutcomeInvalid
+	case TxnResult:
+		if !res.Succeeded {
+			entry.Outcome = audit.OutcomeElse
+		}
+		for _, output := range res.Results {
+			if output.Op != OpGet {
+				entry.Op, entry.Key = output.Op, output.Key
+				appendAudit(entry)
+			}
+		}
+		return
+	}
+	if cmd.Op != OpGet {
+		appendAudit(entry)
+	}
+}
+
+// appendAudit writes entry to the audit log. The write is applied on every
+// replica whatever the audit log says, so a failure is only logged and
+// counted.
+func appendAudit(entry audit.Entry) {
+	if err := opt.Audit.Append(entry); err != nil {
+		auditErrorsMetric.Inc()
+		log.Printf("[error] unable to write %s of %q at %d to the audit log: %s", entry.Op, entry.Key, entry.Index, err)
+	}
+}
+
+// applyTxn writes all ops of the branch under a single index, gets see the
+// writes before them.
+func (m *StateMachine) applyTxn(index int, txn *Txn) any {
+	if txn == nil {
+		return InvalidCommand{Reason: "txn without body"}
+	}
+	for _, cmd := range append(slices.Clone(txn.Then), txn.Else...) {
+		if cmd.Op != OpSet && cmd.Op != OpDel && cmd.Op != OpGet {
+			return InvalidCommand{Reason: fmt.Sprintf("op %q is not allowed in txn", cmd.Op)}
+		}
+	}
+	result := TxnResult{Succeeded: true, Results: []TxnOutput{}}
+	for _, compare := range txn.If {
+		current, ok := Must2(m.store.Get(compare.Key))
+		if ok == compare.Missing || (ok && current.Value != compare.Value) {
+			result.Succeeded = false
+			break
+		}
+	}
+	branch := txn.Then
+	if !result.Succeeded {
+		branch = txn.Else
+	}
+	var ops []store.Op
+	written := make(map[string]store.Op)
+	for _, cmd := range branch {
+		output := TxnOutput{Op: cmd.Op, Key: cmd.Key}
+		switch cmd.Op {
+		case OpSet, OpDel:
+			op := store.Op{Key: cmd.Key, Value: cmd.Value, ContentType: cmd.ContentType, Tombstone: cmd.Op == OpDel}
+			ops = append(ops, op)
+			written[cmd.Key] = op
+		case OpGet:
+			if op, ok := written[cmd.Key]; ok {
+				output.Value, output.ContentType, output.Found = op.Value, op.ContentType, !op.Tombstone
+			} else {
+				current, ok := Must2(m.store.Get(cmd.Key))
+				output.Value, output.ContentType, output.Found = current.Value, current.ContentType, ok
+			}
+		}
+		result.Results = append(result.Results, output)
+	}
+	if len(ops) == 0 {
+		return result
+	}
+	m.write(ops...)
+	for _, op := range ops {
+		change := Change{Index: index, Op: OpSet, Key: op.Key, Value: op.Value, ContentType: op.ContentType}
+		if op.Tombstone {
+			change.Op = OpDel
+		}
+		m.recordChange(change)
+	}
+	return result
+}
+
+// applyPatch sets the key to its document patched by cmd and answers with
+// the store.KeyValue it holds then. A missing key is patched as null.
+func (m *StateMachine) applyPatch(index int, cmd Command) any {
+	var doc []byte
+	if current := m.lookup(cmd.Key); current != nil {
+		switch current.ContentType {
+		case content.TypeJSON:
+			doc = []byte(current.Value)
+		case "":
+			doc = Must1(json.Marshal(current.Value))
+		default:
+			return PatchFailed{Reason: "the value is not a JSON document"}
+		}
+	}
+	patched, err := jsonpatch.Apply(doc, []byte(cmd.Value), cmd.ContentType)
+	if errors.Is(err, jsonpatch.ErrInvalid) {
+		return InvalidCommand{Reason: err.Error()}
+	} else if err != nil {
+		return PatchFailed{Reason: err.Error()}
+	}
+	// a JSON string is stored as text, like one in a request body
+	kv := store.KeyValue{Key: cmd.Key, Value: string(patched), ContentType: content.TypeJSON}
+	if err := json.Unmarshal(patched, &kv.Value); err == nil {
+		kv.ContentType = ""
+	}
+	m.write(store.Op{Key: kv.Key, Value: kv.Value, ContentType: kv.ContentType})
+	m.recordChange(Change{Index: index, Op: OpSet, Key: kv.Key, Value: kv.Value, ContentType: kv.ContentType})
+	return kv
+}
+
+func (m *StateMachine) recordChange(change Change) {
+	// entries replayed into a persistent engine are not changes
+	if change.Index <= m.changesSince {
+		return
+	}
+	if len(m.changes) == maxChanges {
+		m.changesSince = m.changes[0].Index
+		m.changes = m.changes[1:]
+	}
+	m.changes = append(m.changes, change)
+}
+
+func (m *StateMachine) Query(request any) (any, error) {
+	switch req := request.(type) {
+	case Get:
+		kv, ok, err := m.store.Get(req.Key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return KeyNotFound{}, nil
+		}
+		return kv, nil
+	case Range:
+		return m.store.Range(req.From, req.To, req.Limit)
+	case Changes:
+		return m.queryChanges(req), nil
+	case StateDigest:
+		return m.queryDigest(req), nil
+	case RangeDigest:
+		return m.queryRangeDigest(req)
+	}
+	return nil, fmt.Errorf("Invalid request type: %T", request)
+}
+
+func (m *StateMachine) queryChanges(req Changes) any {
+	if req.From < m.changesSince {
+		return ChangesCompacted{Since: m.changesSince}
+	}
+	list := ChangeList{Index: req.From, Changes: []Change{}}
+	for _, change := range m.changes {
+		if change.Index <= req.From {
+			continue
+		}
+		// changes of a txn share the index and are not split
+		if req.Limit > 0 && len(list.Changes) >= req.Limit && change.Index != list.Index {
+			break
+		}
+		list.Index = change.Index
+		if strings.HasPrefix(change.Key, req.Prefix) {
+			list.Changes = append(list.Changes, change)
+		}
+	}
+	return list
+}
+
+func (m *StateMachine) AppliedIndex() int {
+	return m.store.AppliedIndex()
+}
+
+func (m *StateMachine) Snapshot(w io.Writer) error {
+	return m.store.Snapshot(w)
+}
+
+func (m *StateMachine) Restore(r io.Reader) error {
+	if err := m.store.Restore(r); err != nil {
+		return err
+	}
+	if err := m.loadSessions(); err != nil {
+		return err
+	}
+	m.changes = nil
+	m.changesSince = m.store.AppliedIndex()
+	m.resetDigest()
+	keysMetric.Set(float64(m.store.Len()))
+	return nil
+}
+
+func (m *StateMachine) Close() error {
+	return m.store.Close()
+}
+
+func (m *StateMachine) Inspect() map[string]string {
+	return map[string]string{
+		"engine":   opt.StorageEngine,
+		"keys":     strconv.Itoa(m.store.Len()),
+		"sessions": strconv.Itoa(len(m.sessions)),
+		"changes":  strconv.Itoa(len(m.changes)),
+	}
+}
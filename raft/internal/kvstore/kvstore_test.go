@@ -0,0 +1,353 @@
+package kvstore
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"chadcommon/audit"
+	"chadcommon/content"
+	"chadcommon/jsonpatch"
+	"chaddb/internal/metrics"
+	opt "chaddb/internal/options"
+	"chaddb/internal/store"
+)
+
+func openDisk(t *testing.T, dir string) *StateMachine {
+	t.Helper()
+	opt.StorageEngine, opt.DataDir = store.EngineDisk, dir
+	m, err := Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func clientCommand(seq int, cmd Command) []byte {
+	cmd.ClientId, cmd.Seq = "client", seq
+	return cmd.Encode()
+}
+
+func TestSessionsArePersisted(t *testing.T) {
+	dir := t.TempDir()
+	m := openDisk(t, dir)
+	set := clientCommand(1, Command{Op: OpSet, Key: "a", Value: "1"})
+	cas := clientCommand(2, Command{Op: OpCas, Key: "a", Expect: "0", Value: "2"})
+	txn := clientCommand(3, Command{Op: OpTxn, Txn: &Txn{Then: []Command{{Op: OpGet, Key: "a"}}}})
+	want := []any{m.Apply(1, set), m.Apply(2, cas), m.Apply(3, txn)}
+	m.Apply(4, SetCommand("a", "other"))
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	retry := func(m *StateMachine, index int) {
+		t.Helper()
+		for i, command := range [][]byte{set, cas, txn} {
+			if result := m.Apply(index+i, command); !reflect.DeepEqual(result, want[i]) {
+				t.Fatalf("retry of seq %d got %#v, want %#v", i+1, result, want[i])
+			}
+		}
+		if kv, _ := m.Query(Get{Key: "a"}); kv.(store.KeyValue).Value != "other" {
+			t.Fatalf("retries applied again: a is %+v", kv)
+		}
+	}
+
+	m = openDisk(t, dir)
+	defer m.Close()
+	if len(m.sessions) != 1 {
+		t.Fatalf("%d sessions after reopen, want 1", len(m.sessions))
+	}
+	retry(m, 5)
+
+	// sessions are part of snapshots
+	var snapshot bytes.Buffer
+	if err := m.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	restored := openDisk(t, t.TempDir())
+	defer restored.Close()
+	if err := restored.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	retry(restored, 10)
+}
+
+func TestExpireSessionBreaksTies(t *testing.T) {
+	for range 10 {
+		m := &StateMachine{sessions: map[string]*session{
+			"c": {Index: 3},
+			"b": {Index: 2},
+			"d": {Index: 2},
+			"a": {Index: 5},
+		}}
+		m.expireSession()
+		if _, ok := m.sessions["b"]; ok || len(m.sessions) != 3 {
+			t.Fatalf("sessions %v left, want b expired", m.sessions)
+		}
+		if len(m.batch) != 1 || m.batch[0] != (store.Op{Key: sessionPrefix + "b", Tombstone: true}) {
+			t.Fatalf("expiry wrote %+v", m.batch)
+		}
+	}
+}
+
+func TestAuditFailureDoesNotStopApply(t *testing.T) {
+	log, err := audit.Open(filepath.Join(t.TempDir(), "audit.log"), 1<<20, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// writes to a closed file fail
+	log.Close()
+	opt.Audit = log
+	defer func() { opt.Audit = nil }()
+
+	m := openDisk(t, t.TempDir())
+	defer m.Close()
+	if result := m.Apply(1, SetCommand("a", "1")); result != true {
+		t.Fatalf("set resulted in %v", result)
+	}
+	if kv, _ := m.Query(Get{Key: "a"}); kv.(store.KeyValue).Value != "1" {
+		t.Fatalf("a is %+v", kv)
+	}
+	var exposition strings.Builder
+	metrics.Default.WriteTo(&exposition)
+	if !strings.Contains(exposition.String(), "chaddb_audit_errors_total 1\n") {
+		t.Fatalf("audit error not counted:\n%s", exposition.String())
+	}
+}
+
+// testMachine applies commands to a state machine in memory at increasing
+// indexes.
+type testMachine struct {
+	*StateMachine
+	t     *testing.T
+	index int
+}
+
+func newTestMachine(t *testing.T) *testMachine {
+	t.Helper()
+	opt.StorageEngine, opt.DataDir = store.EngineMemory, t.TempDir()
+	m, err := Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close() })
+	return &testMachine{StateMachine: m, t: t}
+}
+
+func (m *testMachine) apply(cmd Command) any {
+	m.index++
+	return m.Apply(m.index, cmd.Encode())
+}
+
+// get returns the store.KeyValue of key or KeyNotFound.
+func (m *testMachine) get(key string) any {
+	m.t.Helper()
+	kv, err := m.Query(Get{Key: key})
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return kv
+}
+
+func TestCas(t *testing.T) {
+	doc := `{"a":1}`
+	tests := []struct {
+		name string
+		cmd  Command
+		want any
+		// the value of the key afterwards, nil if unchanged
+		after any
+	}{
+		{"matches", Command{Key: "text", Expect: "a", Value: "b"}, true, store.KeyValue{Key: "text", Value: "b"}},
+		{"other value", Command{Key: "text", Expect: "b", Value: "c"}, CasFailed{}, nil},
+		{"missing key", Command{Key: "none", Expect: "", Value: "c"}, CasFailed{}, KeyNotFound{}},
+		{"empty value", Command{Key: "empty", Expect: "", Value: "c"}, true, store.KeyValue{Key: "empty", Value: "c"}},
+		{"same content type", Command{Key: "doc", Expect: doc, Value: `{"a":2}`, ContentType: content.TypeJSON}, true,
+			store.KeyValue{Key: "doc", Value: `{"a":2}`, ContentType: content.TypeJSON}},
+		{"other content type", Command{Key: "doc", Expect: doc, Value: "c"}, CasFailed{}, nil},
+		{"text expected as a document", Command{Key: "text", Expect: "a", Value: `{"a":2}`, ContentType: content.TypeJSON}, CasFailed{}, nil},
+		{"absent key created", Command{Key: "none", Missing: true, Value: "c"}, true, store.KeyValue{Key: "none", Value: "c"}},
+		{"absent but exists", Command{Key: "text", Missing: true, Value: "c"}, CasFailed{}, nil},
+		{"absent but empty", Command{Key: "empty", Missing: true, Value: "c"}, CasFailed{}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestMachine(t)
+			m.apply(Command{Op: OpSet, Key: "text", Value: "a"})
+			m.apply(Command{Op: OpSet, Key: "empty", Value: ""})
+			m.apply(Command{Op: OpSet, Key: "doc", Value: doc, ContentType: content.TypeJSON})
+			before := m.get(test.cmd.Key)
+
+			test.cmd.Op = OpCas
+			if result := m.apply(test.cmd); result != test.want {
+				t.Fatalf("cas resulted in %#v, want %#v", result, test.want)
+			}
+			want := test.after
+			if want == nil {
+				want = before
+			}
+			if got := m.get(test.cmd.Key); got != want {
+				t.Fatalf("%s holds %#v, want %#v", test.cmd.Key, got, want)
+			}
+		})
+	}
+}
+
+func TestTxn(t *testing.T) {
+	m := newTestMachine(t)
+	m.apply(Command{Op: OpSet, Key: "a", Value: "1"})
+
+	// the comparisons hold, gets see the writes before them
+	txn := &Txn{
+		If: []Compare{{Key: "a", Value: "1"}, {Key: "b", Missing: true}},
+		Then: []Command{
+			{Op: OpGet, Key: "a"},
+			{Op: OpSet, Key: "a", Value: "2"},
+			{Op: OpSet, Key: "b", Value: `{"x":1}`, ContentType: content.TypeJSON},
+			{Op: OpGet, Key: "a"},
+			{Op: OpDel, Key: "b"},
+			{Op: OpGet, Key: "b"},
+		},
+		Else: []Command{{Op: OpSet, Key: "a", Value: "else"}},
+	}
+	want := TxnResult{Succeeded: true, Results: []TxnOutput{
+		{Op: OpGet, Key: "a", Value: "1", Found: true},
+		{Op: OpSet, Key: "a"},
+		{Op: OpSet, Key: "b"},
+		{Op: OpGet, Key: "a", Value: "2", Found: true},
+		{Op: OpDel, Key: "b"},
+		{Op: OpGet, Key: "b"},
+	}}
+	if result := m.apply(Command{Op: OpTxn, Txn: txn}); !reflect.DeepEqual(result, want) {
+		t.Fatalf("txn resulted in %#v, want %#v", result, want)
+	}
+	if got := m.get("a"); got != (store.KeyValue{Key: "a", Value: "2"}) {
+		t.Fatalf("a holds %#v", got)
+	}
+	if got := m.get("b"); got != (KeyNotFound{}) {
+		t.Fatalf("b holds %#v", got)
+	}
+
+	// the same txn again applies the else branch
+	want = TxnResult{Succeeded: false, Results: []TxnOutput{{Op: OpSet, Key: "a"}}}
+	if result := m.apply(Command{Op: OpTxn, Txn: txn}); !reflect.DeepEqual(result, want) {
+		t.Fatalf("second txn resulted in %#v, want %#v", result, want)
+	}
+	if got := m.get("a"); got != (store.KeyValue{Key: "a", Value: "else"}) {
+		t.Fatalf("a holds %#v", got)
+	}
+
+	for _, invalid := range []*Txn{nil, {Then: []Command{{Op: OpCas, Key: "a"}}}, {Else: []Command{{Op: OpPatch, Key: "a"}}}} {
+		if result, ok := m.apply(Command{Op: OpTxn, Txn: invalid}).(InvalidCommand); !ok {
+			t.Fatalf("invalid txn %+v resulted in %#v", invalid, result)
+		}
+	}
+	if got := m.get("a"); got != (store.KeyValue{Key: "a", Value: "else"}) {
+		t.Fatalf("invalid txns changed a to %#v", got)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       *store.KeyValue
+		contentType string
+		patch       string
+		want        any
+	}{
+		{"merge patch", &store.KeyValue{Value: `{"b":1,"a":{"x":1}}`, ContentType: content.TypeJSON}, jsonpatch.TypeMergePatch, `{"a":{"x":null,"y":2}}`,
+			store.KeyValue{Value: `{"a":{"y":2},"b":1}`, ContentType: content.TypeJSON}},
+		{"json patch", &store.KeyValue{Value: `{"a":[1]}`, ContentType: content.TypeJSON}, jsonpatch.TypeJSONPatch, `[{"op":"add","path":"/a/-","value":2}]`,
+			store.KeyValue{Value: `{"a":[1,2]}`, ContentType: content.TypeJSON}},
+		{"missing key is null", nil, jsonpatch.TypeMergePatch, `{"a":1}`,
+			store.KeyValue{Value: `{"a":1}`, ContentType: content.TypeJSON}},
+		{"text is a JSON string", &store.KeyValue{Value: "old"}, jsonpatch.TypeJSONPatch, `[{"op":"replace","path":"","value":"new"}]`,
+			store.KeyValue{Value: "new"}},
+		{"failed test", &store.KeyValue{Value: `{"a":1}`, ContentType: content.TypeJSON}, jsonpatch.TypeJSONPatch, `[{"op":"test","path":"/a","value":2}]`,
+			PatchFailed{}},
+		{"binary value", &store.KeyValue{Value: "AAE=", ContentType: content.TypeBinary}, jsonpatch.TypeMergePatch, `{"a":1}`,
+			PatchFailed{}},
+		{"invalid patch", &store.KeyValue{Value: `{"a":1}`, ContentType: content.TypeJSON}, jsonpatch.TypeJSONPatch, `[{"op":"jump","path":"/a"}]`,
+			InvalidCommand{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestMachine(t)
+			if test.value != nil {
+				m.apply(Command{Op: OpSet, Key: "doc", Value: test.value.Value, ContentType: test.value.ContentType})
+			}
+			before := m.get("doc")
+			result := m.apply(Command{Op: OpPatch, Key: "doc", Value: test.patch, ContentType: test.contentType})
+			switch want := test.want.(type) {
+			case store.KeyValue:
+				want.Key = "doc"
+				if result != want {
+					t.Fatalf("patch resulted in %#v, want %#v", result, want)
+				}
+				if got := m.get("doc"); got != want {
+					t.Fatalf("doc holds %#v, want %#v", got, want)
+				}
+			default:
+				if reflect.TypeOf(result) != reflect.TypeOf(want) {
+					t.Fatalf("patch resulted in %#v, want %T", result, want)
+				}
+				if got := m.get("doc"); got != before {
+					t.Fatalf("failed patch changed doc to %#v", got)
+				}
+			}
+		})
+	}
+}
+
+func TestChanges(t *testing.T) {
+	m := newTestMachine(t)
+	m.apply(Command{Op: OpSet, Key: "a/1", Value: "1"})
+	m.apply(Command{Op: OpSet, Key: "b/1", Value: "1"})
+	m.apply(Command{Op: OpCas, Key: "a/1", Expect: "1", Value: "2"})
+	m.apply(Command{Op: OpCas, Key: "a/1", Expect: "1", Value: "3"})
+	m.apply(Command{Op: OpGet, Key: "a/1"})
+	m.apply(Command{Op: OpTxn, Txn: &Txn{Then: []Command{{Op: OpDel, Key: "a/1"}, {Op: OpSet, Key: "a/2", Value: "1"}}}})
+	m.apply(Command{Op: OpPatch, Key: "a/3", Value: `{"x":1}`, ContentType: jsonpatch.TypeMergePatch})
+
+	all := []Change{
+		{Index: 1, Op: OpSet, Key: "a/1", Value: "1"},
+		{Index: 2, Op: OpSet, Key: "b/1", Value: "1"},
+		{Index: 3, Op: OpSet, Key: "a/1", Value: "2"},
+		{Index: 6, Op: OpDel, Key: "a/1"},
+		{Index: 6, Op: OpSet, Key: "a/2", Value: "1"},
+		{Index: 7, Op: OpSet, Key: "a/3", Value: `{"x":1}`, ContentType: content.TypeJSON},
+	}
+	tests := []struct {
+		name    string
+		request Changes
+		want    ChangeList
+	}{
+		{"all", Changes{From: 0}, ChangeList{Index: 7, Changes: all}},
+		{"after an index", Changes{From: 3}, ChangeList{Index: 7, Changes: all[3:]}},
+		{"prefix", Changes{From: 0, Prefix: "b/"}, ChangeList{Index: 7, Changes: all[1:2]}},
+		{"limit", Changes{From: 0, Limit: 2}, ChangeList{Index: 2, Changes: all[:2]}},
+		{"limit does not split a txn", Changes{From: 3, Limit: 1}, ChangeList{Index: 6, Changes: all[3:5]}},
+		{"none", Changes{From: 7}, ChangeList{Index: 7, Changes: []Change{}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got, _ := m.Query(test.request); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("changes %+v, want %+v", got, test.want)
+			}
+		})
+	}
+
+	t.Run("compacted", func(t *testing.T) {
+		for range maxChanges {
+			m.apply(Command{Op: OpSet, Key: "c", Value: "1"})
+		}
+		if got, _ := m.Query(Changes{From: 0}); got != (ChangesCompacted{Since: 7}) {
+			t.Fatalf("changes %+v, want compacted since 7", got)
+		}
+		if got, _ := m.Query(Changes{From: 7, Limit: 1}); !reflect.DeepEqual(got, ChangeList{Index: 8, Changes: []Change{{Index: 8, Op: OpSet, Key: "c", Value: "1"}}}) {
+			t.Fatalf("changes after compaction %+v", got)
+		}
+	})
+}
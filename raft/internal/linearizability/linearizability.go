@@ -0,0 +1,244 @@
+// Package linearizability checks whether a concurrent history of operations
+// is linearizable with respect to a sequential model. The search is the one
+// of Porcupine (Wing & Gong with the memoization of Lowe): operations are
+// linearized in the order of their calls as long as no return is passed
+// over, with backtracking and a cache of visited (linearized set, state).
+package linearizability
+
+import (
+	"math"
+	"slices"
+	"sort"
+)
+
+// Operation is a completed or timed out call. Times are in any monotonic
+// unit; Return is Unknown when the outcome was never received, such an
+// operation may take effect at any point after Call or not at all.
+type Operation struct {
+	ClientId int
+	Input    any
+	Output   any
+	Call     int64
+	Return   int64
+}
+
+const Unknown int64 = math.MaxInt64
+
+type Model struct {
+	// Partition splits a history into independent ones (e.g. by key), nil
+	// checks the history as a whole.
+	Partition func(history []Operation) [][]Operation
+	Init      func() any
+	// Step applies input to state and reports whether output is a possible
+	// result. States are compared with ==.
+	Step func(state any, input any, output any) (bool, any)
+	// ReadOnly operations are dropped when the counterexample is minimized,
+	// nil keeps all operations.
+	ReadOnly func(op Operation) bool
+}
+
+type Result struct {
+	Ok bool
+	// History of the first partition that is not linearizable.
+	History []Operation
+	// Counterexample is a subset of History that is still not linearizable.
+	Counterexample []Operation
+	// Linearized is the longest sequence of Counterexample operations that
+	// could be linearized before the search got stuck.
+	Linearized []Operation
+}
+
+// maxMinimize is the size of a history above which the counterexample is
+// not minimized.
+const maxMinimize = 2000
+
+func Check(model Model, history []Operation) Result {
+	partitions := [][]Operation{history}
+	if model.Partition != nil {
+		partitions = model.Partition(history)
+	}
+	for _, partition := range partitions {
+		if ok, _ := check(model, partition); ok {
+			continue
+		}
+		counterexample := partition
+		if len(partition) <= maxMinimize {
+			counterexample = minimize(model, partition)
+		}
+		_, linearized := check(model, counterexample)
+		return Result{History: partition, Counterexample: counterexample, Linearized: linearized}
+	}
+	return Result{Ok: true}
+}
+
+// minimize drops read-only operations while the history stays not
+// linearizable. Dropping a read never makes a linearizable history
+// non-linearizable, so the result is a genuine counterexample.
+func minimize(model Model, history []Operation) []Operation {
+	if model.ReadOnly == nil {
+		return history
+	}
+	result := slices.Clone(history)
+	for i := len(result) - 1; i >= 0; i-- {
+		if !model.ReadOnly(result[i]) {
+			continue
+		}
+		candidate := slices.Delete(slices.Clone(result), i, i+1)
+		if ok, _ := check(model, candidate); !ok {
+			result = candidate
+		}
+	}
+	return result
+}
+
+type entry struct {
+	id    int
+	call  bool
+	time  int64
+	match *entry // return entry of a call
+	prev  *entry
+	next  *entry
+}
+
+func makeEntries(history []Operation) *entry {
+	entries := make([]*entry, 0, 2*len(history))
+	for id, op := range history {
+		ret := &entry{id: id, time: op.Return}
+		entries = append(entries, &entry{id: id, call: true, time: op.Call, match: ret}, ret)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].time != entries[j].time {
+			return entries[i].time < entries[j].time
+		}
+		// calls first, so operations touching at a point are concurrent
+		return entries[i].call && !entries[j].call
+	})
+	head := &entry{id: -1}
+	last := head
+	for _, e := range entries {
+		last.next = e
+		e.prev = last
+		last = e
+	}
+	return head
+}
+
+func (e *entry) lift() {
+	e.prev.next = e.next
+	if e.next != nil {
+		e.next.prev = e.prev
+	}
+	ret := e.match
+	ret.prev.next = ret.next
+	if ret.next != nil {
+		ret.next.prev = ret.prev
+	}
+}
+
+func (e *entry) unlift() {
+	ret := e.match
+	ret.prev.next = ret
+	if ret.next != nil {
+		ret.next.prev = ret
+	}
+	e.prev.next = e
+	if e.next != nil {
+		e.next.prev = e
+	}
+}
+
+type bitset []uint64
+
+func newBitset(n int) bitset {
+	return make(bitset, (n+63)/64)
+}
+
+func (b bitset) set(i int)   { b[i/64] |= 1 << (i % 64) }
+func (b bitset) clear(i int) { b[i/64] &^= 1 << (i % 64) }
+
+func (b bitset) hash() uint64 {
+	h := uint64(14695981039346656037)
+	for _, word := range b {
+		h ^= word
+		h *= 1099511628211
+	}
+	return h
+}
+
+type cacheEntry struct {
+	linearized bitset
+	state      any
+}
+
+type frame struct {
+	entry *entry
+	state any
+}
+
+// check returns whether history is linearizable and the longest partial
+// linearization found.
+func check(model Model, history []Operation) (bool, []Operation) {
+	head := makeEntries(history)
+	state := model.Init()
+	linearized := newBitset(len(history))
+	cache := make(map[uint64][]cacheEntry)
+	var stack []frame
+	var longest []Operation
+
+	e := head.next
+	for head.next != nil {
+		if e.call {
+			op := history[e.id]
+			ok, next := model.Step(state, op.Input, op.Output)
+			if ok {
+				candidate := slices.Clone(linearized)
+				candidate.set(e.id)
+				if cacheAdd(cache, candidate, next) {
+					stack = append(stack, frame{entry: e, state: state})
+					state = next
+					linearized = candidate
+					e.lift()
+					if len(stack) > len(longest) {
+						longest = longest[:0]
+						for _, f := range stack {
+							longest = append(longest, history[f.entry.id])
+						}
+					}
+					e = head.next
+					continue
+				}
+			}
+			e = e.next
+		} else if history[e.id].Return == Unknown {
+			// only operations with unknown outcome are left, they may
+			// never have taken effect
+			return true, nil
+		} else {
+			// the operation returning here can not be linearized yet,
+			// undo the last linearized one
+			if len(stack) == 0 {
+				return false, longest
+			}
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			state = top.state
+			linearized = slices.Clone(linearized)
+			linearized.clear(top.entry.id)
+			top.entry.unlift()
+			e = top.entry.next
+		}
+	}
+	return true, nil
+}
+
+// cacheAdd reports whether the pair was not visited before and remembers it.
+func cacheAdd(cache map[uint64][]cacheEntry, linearized bitset, state any) bool {
+	h := linearized.hash()
+	for _, c := range cache[h] {
+		if c.state == state && slices.Equal(c.linearized, linearized) {
+			return false
+		}
+	}
+	cache[h] = append(cache[h], cacheEntry{linearized: linearized, state: state})
+	return true
+}
@@ -0,0 +1,195 @@
+package linearizability
+
+import (
+	"fmt"
+	"testing"
+)
+
+type registerInput struct {
+	op     string // "read", "write" or "cas"
+	value  int
+	expect int
+}
+
+// registerOutput is nil for operations with an unknown outcome.
+type registerOutput struct {
+	value int
+	ok    bool
+}
+
+// registerModel is a register starting at 0, with compare-and-swap.
+var registerModel = Model{
+	Init: func() any { return 0 },
+	Step: func(state any, input any, output any) (bool, any) {
+		s, in := state.(int), input.(registerInput)
+		out, known := output.(registerOutput)
+		switch in.op {
+		case "read":
+			return !known || out.value == s, s
+		case "write":
+			return true, in.value
+		case "cas":
+			if !known {
+				if s == in.expect {
+					return true, in.value
+				}
+				return true, s
+			}
+			if out.ok != (s == in.expect) {
+				return false, s
+			}
+			if out.ok {
+				return true, in.value
+			}
+			return true, s
+		}
+		return false, s
+	},
+	ReadOnly: func(op Operation) bool {
+		return op.Input.(registerInput).op == "read"
+	},
+}
+
+func read(client int, value int, call, ret int64) Operation {
+	return Operation{ClientId: client, Input: registerInput{op: "read"}, Output: registerOutput{value: value}, Call: call, Return: ret}
+}
+
+func write(client int, value int, call, ret int64) Operation {
+	return Operation{ClientId: client, Input: registerInput{op: "write", value: value}, Call: call, Return: ret}
+}
+
+func cas(client int, expect, value int, ok bool, call, ret int64) Operation {
+	return Operation{ClientId: client, Input: registerInput{op: "cas", expect: expect, value: value}, Output: registerOutput{ok: ok}, Call: call, Return: ret}
+}
+
+// lost is op with an unknown outcome.
+func lost(op Operation) Operation {
+	op.Output, op.Return = nil, Unknown
+	return op
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name         string
+		history      []Operation
+		linearizable bool
+	}{
+		{"empty", nil, true},
+		{"sequential", []Operation{write(1, 1, 0, 1), read(2, 1, 2, 3), write(1, 2, 4, 5), read(2, 2, 6, 7)}, true},
+		{"initial value", []Operation{read(1, 0, 0, 1)}, true},
+		{"value never written", []Operation{write(1, 1, 0, 1), read(2, 2, 2, 3)}, false},
+		{"read concurrent with write sees the old value", []Operation{write(1, 1, 0, 10), read(2, 0, 1, 2)}, true},
+		{"read concurrent with write sees the new value", []Operation{write(1, 1, 0, 10), read(2, 1, 1, 2)}, true},
+		{"stale read", []Operation{write(1, 1, 0, 1), read(2, 0, 2, 3)}, false},
+		{"reads go back in time", []Operation{write(1, 1, 0, 10), read(2, 1, 1, 2), read(3, 0, 3, 4)}, false},
+		{"operations touching at a point are concurrent", []Operation{write(1, 1, 0, 5), read(2, 0, 5, 6)}, true},
+		{"concurrent writes in either order", []Operation{
+			write(1, 1, 0, 10), write(2, 2, 0, 10), read(3, 2, 11, 12), read(3, 2, 13, 14),
+		}, true},
+		{"concurrent writes seen in both orders", []Operation{
+			write(1, 1, 0, 10), write(2, 2, 0, 10), read(3, 1, 11, 12), read(4, 2, 13, 14), read(5, 1, 15, 16),
+		}, false},
+
+		{"cas swaps", []Operation{write(1, 1, 0, 1), cas(2, 1, 2, true, 2, 3), read(1, 2, 4, 5)}, true},
+		{"cas fails", []Operation{write(1, 1, 0, 1), cas(2, 0, 2, false, 2, 3), read(1, 1, 4, 5)}, true},
+		{"cas fails although it matches", []Operation{write(1, 1, 0, 1), cas(2, 1, 2, false, 2, 3)}, false},
+		{"cas swaps although it does not match", []Operation{cas(1, 1, 2, true, 0, 1)}, false},
+		{"one of two concurrent cas swaps", []Operation{cas(1, 0, 1, true, 0, 10), cas(2, 0, 2, false, 1, 11), read(3, 1, 12, 13)}, true},
+		{"two concurrent cas swap the same value", []Operation{cas(1, 0, 1, true, 0, 10), cas(2, 0, 2, true, 1, 11)}, false},
+		{"concurrent cas chain", []Operation{cas(1, 0, 1, true, 0, 10), cas(2, 1, 2, true, 1, 11), read(3, 2, 12, 13)}, true},
+
+		{"lost write never takes effect", []Operation{lost(write(1, 1, 0, 1)), read(2, 0, 2, 3), read(2, 0, 100, 101)}, true},
+		{"lost write takes effect", []Operation{lost(write(1, 1, 0, 1)), read(2, 1, 2, 3)}, true},
+		{"lost write takes effect late", []Operation{lost(write(1, 1, 0, 1)), read(2, 0, 2, 3), read(2, 1, 100, 101)}, true},
+		{"lost write takes effect before its call", []Operation{read(2, 1, 0, 1), lost(write(1, 1, 2, 3))}, false},
+		{"lost write is undone", []Operation{lost(write(1, 1, 0, 1)), read(2, 1, 2, 3), read(2, 0, 4, 5)}, false},
+		{"lost cas takes effect", []Operation{lost(cas(1, 0, 1, true, 0, 1)), read(2, 1, 2, 3)}, true},
+		{"lost cas that can not swap", []Operation{write(1, 5, 0, 1), lost(cas(1, 0, 1, true, 2, 3)), read(2, 1, 4, 5)}, false},
+		{"lost cas makes another cas fail", []Operation{lost(cas(1, 0, 1, true, 0, 1)), cas(2, 0, 2, false, 2, 3)}, true},
+		{"lost read", []Operation{write(1, 1, 0, 1), lost(read(2, 0, 2, 3)), read(2, 1, 4, 5)}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result := Check(registerModel, test.history)
+			if result.Ok != test.linearizable {
+				t.Fatalf("linearizable %v, want %v", result.Ok, test.linearizable)
+			}
+			if result.Ok {
+				return
+			}
+			if len(result.History) != len(test.history) {
+				t.Fatalf("history of %d operations, want %d", len(result.History), len(test.history))
+			}
+			if ok, _ := check(registerModel, result.Counterexample); ok {
+				t.Fatalf("counterexample %v is linearizable", result.Counterexample)
+			}
+		})
+	}
+}
+
+func TestCounterexampleDropsReads(t *testing.T) {
+	history := []Operation{
+		read(3, 0, 0, 1),
+		write(1, 1, 2, 3),
+		read(3, 1, 4, 5),
+		read(3, 1, 6, 7),
+		write(1, 2, 8, 9),
+		read(2, 1, 10, 11), // stale
+		read(3, 2, 12, 13),
+	}
+	result := Check(registerModel, history)
+	if result.Ok {
+		t.Fatal("stale read is linearizable")
+	}
+	want := []Operation{write(1, 1, 2, 3), write(1, 2, 8, 9), read(2, 1, 10, 11)}
+	if fmt.Sprint(result.Counterexample) != fmt.Sprint(want) {
+		t.Fatalf("counterexample %v, want %v", result.Counterexample, want)
+	}
+	if fmt.Sprint(result.Linearized) != fmt.Sprint(want[:2]) {
+		t.Fatalf("linearized %v, want %v", result.Linearized, want[:2])
+	}
+}
+
+func TestPartition(t *testing.T) {
+	// every client works on a register of its own
+	model := registerModel
+	model.Partition = func(history []Operation) [][]Operation {
+		byClient := make(map[int][]Operation)
+		for _, op := range history {
+			byClient[op.ClientId] = append(byClient[op.ClientId], op)
+		}
+		return [][]Operation{byClient[1], byClient[2]}
+	}
+	history := []Operation{write(1, 1, 0, 1), write(2, 2, 2, 3), read(1, 1, 4, 5), read(2, 2, 6, 7)}
+	if !Check(model, history).Ok {
+		t.Fatal("independent registers are not linearizable")
+	}
+	if Check(registerModel, history).Ok {
+		t.Fatal("one register is linearizable")
+	}
+	history = append(history, read(2, 1, 8, 9))
+	result := Check(model, history)
+	if result.Ok || len(result.History) != 3 {
+		t.Fatalf("result %+v, want the history of client 2", result)
+	}
+}
+
+// TestConcurrentWrites lets the search backtrack over orders of concurrent
+// writes, the cache of visited states keeps it short.
+func TestConcurrentWrites(t *testing.T) {
+	var history []Operation
+	const n = 10
+	for i := range n {
+		history = append(history, write(i, i+1, 0, 100))
+	}
+	for i := range n {
+		history = append(history, read(i, 3, int64(101+2*i), int64(102+2*i)))
+	}
+	if !Check(registerModel, history).Ok {
+		t.Fatal("concurrent writes are not linearizable")
+	}
+	history = append(history, read(0, 4, 500, 501))
+	if Check(registerModel, history).Ok {
+		t.Fatal("a read of another write is linearizable")
+	}
+}
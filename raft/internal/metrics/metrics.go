@@ -0,0 +1,307 @@
+// Package metrics implements counters, gauges and histograms exported in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefBuckets are histogram buckets in seconds suited for request latencies.
+var DefBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Default is the registry all metrics created by this package belong to.
+var Default = &Registry{}
+
+type Registry struct {
+	mu      sync.Mutex
+	metrics []*family
+}
+
+// Handler serves metrics of the Default registry.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.WriteTo(writer)
+	})
+}
+
+func (r *Registry) register(f *family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, f)
+}
+
+// WriteTo writes all metrics in the text exposition format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := slices.Clone(r.metrics)
+	r.mu.Unlock()
+
+	counter := &countingWriter{w: w}
+	buffered := bufio.NewWriter(counter)
+	for _, f := range metrics {
+		f.write(buffered)
+	}
+	err := buffered.Flush()
+	return counter.n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// family is a metric name with all its label combinations.
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	create func() sample
+
+	mu       sync.Mutex
+	children map[string]*child
+}
+
+type child struct {
+	values []string
+	sample sample
+}
+
+type sample interface {
+	write(w *bufio.Writer, name string, labels string)
+}
+
+func newFamily(name string, help string, kind string, labels []string, create func() sample) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, create: create, children: make(map[string]*child)}
+	Default.register(f)
+	return f
+}
+
+func (f *family) with(values []string) sample {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.children[key]
+	if !ok {
+		c = &child{values: slices.Clone(values), sample: f.create()}
+		f.children[key] = c
+	}
+	return c.sample
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	children := make([]*child, 0, len(f.children))
+	for _, c := range f.children {
+		children = append(children, c)
+	}
+	f.mu.Unlock()
+	slices.SortFunc(children, func(a, b *child) int { return slices.Compare(a.values, b.values) })
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	for _, c := range children {
+		c.sample.write(w, f.name, formatLabels(f.labels, c.values))
+	}
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + escapeLabel(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writeSample(w *bufio.Writer, name string, labels string, value float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) Load() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+func (v *value) Store(f float64) {
+	v.bits.Store(math.Float64bits(f))
+}
+
+func (v *value) Add(f float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+f)) {
+			return
+		}
+	}
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v value
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(f float64) {
+	if f < 0 {
+		panic("counter can not decrease")
+	}
+	c.v.Add(f)
+}
+
+func (c *Counter) write(w *bufio.Writer, name string, labels string) {
+	writeSample(w, name, labels, c.v.Load())
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v value
+}
+
+func (g *Gauge) Set(f float64) {
+	g.v.Store(f)
+}
+
+func (g *Gauge) Add(f float64) {
+	g.v.Add(f)
+}
+
+func (g *Gauge) write(w *bufio.Writer, name string, labels string) {
+	writeSample(w, name, labels, g.v.Load())
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(f float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i, _ := slices.BinarySearch(h.buckets, f); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += f
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string, labels string) {
+	h.mu.Lock()
+	counts := slices.Clone(h.counts)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+	cumulative := uint64(0)
+	for i, bound := range h.buckets {
+		cumulative += counts[i]
+		writeSample(w, name+"_bucket", prefix+`le="`+formatFloat(bound)+`"`, float64(cumulative))
+	}
+	writeSample(w, name+"_bucket", prefix+`le="+Inf"`, float64(count))
+	writeSample(w, name+"_sum", labels, sum)
+	writeSample(w, name+"_count", labels, float64(count))
+}
+
+func NewCounter(name string, help string) *Counter {
+	return newFamily(name, help, "counter", nil, func() sample { return &Counter{} }).with(nil).(*Counter)
+}
+
+func NewGauge(name string, help string) *Gauge {
+	return newFamily(name, help, "gauge", nil, func() sample { return &Gauge{} }).with(nil).(*Gauge)
+}
+
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	return newFamily(name, help, "histogram", nil, func() sample { return newHistogram(buckets) }).with(nil).(*Histogram)
+}
+
+type CounterVec struct {
+	f *family
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	return &CounterVec{newFamily(name, help, "counter", labels, func() sample { return &Counter{} })}
+}
+
+func (v *CounterVec) WithLabelValues(values ...string) *Counter {
+	return v.f.with(values).(*Counter)
+}
+
+type GaugeVec struct {
+	f *family
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{newFamily(name, help, "gauge", labels, func() sample { return &Gauge{} })}
+}
+
+func (v *GaugeVec) WithLabelValues(values ...string) *Gauge {
+	return v.f.with(values).(*Gauge)
+}
+
+type HistogramVec struct {
+	f *family
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{newFamily(name, help, "histogram", labels, func() sample { return newHistogram(buckets) })}
+}
+
+func (v *HistogramVec) WithLabelValues(values ...string) *Histogram {
+	return v.f.with(values).(*Histogram)
+}
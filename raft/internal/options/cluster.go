@@ -0,0 +1,137 @@
+package options
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"chadcommon/cluster"
+	"chadcommon/discovery"
+)
+
+var (
+	// Resolver finds the nodes of the cluster, it is set by Validate.
+	Resolver discovery.Resolver
+
+	clusterMutex sync.RWMutex
+	current      cluster.Cluster
+	self         cluster.Node
+)
+
+func init() {
+	cluster.NamePrefix = "chaddb-node"
+}
+
+// newResolver returns the resolver chosen by -discovery-srv, -cluster or the
+// static cluster of -node-count local nodes.
+func newResolver() (discovery.Resolver, error) {
+	switch {
+	case DiscoverySrv != "":
+		var lookup discovery.Lookup
+		if SrvRecords != "" {
+			records, err := discovery.LoadRecords(SrvRecords)
+			if err != nil {
+				return nil, err
+			}
+			lookup = records
+		}
+		return discovery.NewSRV(DiscoverySrv, lookup), nil
+	case ClusterFile != "":
+		c, err := cluster.Load(ClusterFile)
+		return discovery.Static{Cluster: c}, err
+	}
+	return discovery.Static{Cluster: cluster.Default(NodeCount)}, nil
+}
+
+func loadCluster() error {
+	var err error
+	if Resolver, err = newResolver(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := Resolver.Resolve(ctx)
+	if err != nil {
+		return err
+	}
+	local := ClusterFile == "" && DiscoverySrv == ""
+	if !local {
+		NodeCount = len(c.Nodes)
+	}
+	var ok bool
+	if self, ok = c.Node(NodeId); !ok {
+		if !local {
+			return fmt.Errorf("node %d is not in the cluster", NodeId)
+		}
+		// a local node joining the cluster
+		self = cluster.DefaultNode(NodeId)
+	}
+	if ApiPort != 0 {
+		self.Api = overridePort(self.Api, ApiPort)
+	}
+	if ObserverPort != 0 {
+		self.Observer = overridePort(self.Observer, ObserverPort)
+	}
+	SetCluster(c)
+	return nil
+}
+
+func overridePort(address string, port int) string {
+	host, _, _ := net.SplitHostPort(address)
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// Cluster returns the nodes last resolved.
+func Cluster() cluster.Cluster {
+	clusterMutex.RLock()
+	defer clusterMutex.RUnlock()
+	return current
+}
+
+// SetCluster replaces the nodes after they are resolved again.
+func SetCluster(c cluster.Cluster) {
+	clusterMutex.Lock()
+	defer clusterMutex.Unlock()
+	current = c
+}
+
+// Self is this node with the ports given by flags.
+func Self() cluster.Node {
+	return self
+}
+
+// node returns the cluster node id, nodes that are not in the cluster are
+// assumed to run locally.
+func node(id int) cluster.Node {
+	if id == NodeId {
+		return self
+	}
+	if node, ok := Cluster().Node(id); ok {
+		return node
+	}
+	return cluster.DefaultNode(id)
+}
+
+func MakeNodeName(id int) string {
+	return node(id).Name
+}
+
+// ParseNodeName returns the id of the node with the ergo node name.
+func ParseNodeName(name string) (int, bool) {
+	if name == self.Name {
+		return self.Id, true
+	}
+	if node, ok := Cluster().NodeByName(name); ok {
+		return node.Id, true
+	}
+	var id int
+	_, err := fmt.Sscanf(name, cluster.NamePrefix+"-%d@", &id)
+	return id, err == nil
+}
+
+func MakeApiAddress(id int) string {
+	return node(id).Api
+}
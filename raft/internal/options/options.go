@@ -3,7 +3,16 @@ package options
 import (
 	"flag"
 	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
+	"chadcommon/audit"
+	"chadcommon/auth"
+	"chadcommon/certs"
+
+	"ergo.services/ergo/gen"
 	"ergo.services/ergo/lib"
 )
 
@@ -13,16 +22,180 @@ var (
 	ObserverPort int
 	ApiPort      int
 	NodeCount    int
+	Join         bool
+	DataDir      string
+
+	ClusterFile       string
+	DiscoverySrv      string
+	SrvRecords        string
+	DiscoveryInterval time.Duration
+	InitialVoters     string
+	// Voters are the ids of -initial-voters parsed by Validate, nil if it is
+	// not given.
+	Voters []int
+
+	StorageEngine   string
+	ShutdownTimeout time.Duration
+	RestoreFrom     string
+	SnapshotEntries int
+
+	TLSCert           string
+	TLSKey            string
+	TLSCA             string
+	TLSClientAuth     bool
+	TLSReloadInterval time.Duration
+
+	// Certs are loaded by Validate if -tls-cert is given, nil otherwise.
+	Certs *certs.Certs
+	// CertManager serves the current certificate of Certs to ergo.
+	CertManager gen.CertManager
+
+	AuthFile       string
+	AuthReplicated bool
+	// Auth is loaded by Validate from -auth-file, nil if it is not given.
+	Auth *auth.Authorizer
+
+	AuditLog      string
+	AuditMaxSize  int
+	AuditMaxFiles int
+	// Audit is opened by Validate from -audit-log, nil if it is not given.
+	Audit *audit.Log
+
+	MaxValueSize int
+)
+
+// Keys with reserved prefixes hold the users table, the cluster id and the
+// client sessions, only admins may access them.
+const (
+	AuthPrefix    = "_auth/"
+	ClusterPrefix = "_cluster/"
 )
 
+var ReservedPrefixes = []string{AuthPrefix, ClusterPrefix}
+
 func init() {
 	flag.IntVar(&NodeId, "node-id", 1, "node id")
 	flag.StringVar(&NodeCookie, "cookie", lib.RandomString(16), "a secret cookie for the network messaging")
-	flag.IntVar(&ObserverPort, "observer-port", 4000, "port for observer")
-	flag.IntVar(&ApiPort, "api-port", 5000, "port for api")
-	flag.IntVar(&NodeCount, "node-count", 3, "amount of replicas")
+	flag.IntVar(&ObserverPort, "observer-port", 0, "port for observer, overrides the one of the cluster")
+	flag.IntVar(&ApiPort, "api-port", 0, "port for api, overrides the one of the cluster")
+	flag.IntVar(&NodeCount, "node-count", 3, "amount of replicas, ignored with -cluster")
+	flag.StringVar(&ClusterFile, "cluster", "", "cluster file with the names and addresses of the nodes")
+	flag.StringVar(&DiscoverySrv, "discovery-srv", "", "find the nodes in the DNS SRV records of this domain instead of -cluster")
+	flag.StringVar(&SrvRecords, "srv-records", "", "file with the SRV records for -discovery-srv, instead of DNS")
+	flag.DurationVar(&DiscoveryInterval, "discovery-interval", 30*time.Second, "interval of resolving the nodes again")
+	flag.BoolVar(&Join, "join", false, "start without membership and wait to be added to the cluster")
+	flag.StringVar(&InitialVoters, "initial-voters", "", "comma separated ids of the voters of a new cluster, all nodes of the cluster by default, required with -discovery-srv")
+	flag.StringVar(&DataDir, "data-dir", "", "directory for the raft log, keep it in memory if empty")
+	flag.StringVar(&StorageEngine, "storage-engine", "memory", "storage engine: memory or disk (requires -data-dir)")
+	flag.StringVar(&RestoreFrom, "restore-from", "", "backup taken with /admin/snapshot that a new cluster starts from")
+	flag.IntVar(&SnapshotEntries, "snapshot-entries", 10000, "applied entries after which the raft log is compacted into a snapshot, 0 disables compaction")
+	flag.DurationVar(&ShutdownTimeout, "shutdown-timeout", 30*time.Second, "deadline for graceful shutdown on SIGINT or SIGTERM")
+	flag.StringVar(&TLSCert, "tls-cert", "", "certificate of the node, enables HTTPS on the api and TLS between nodes")
+	flag.StringVar(&TLSKey, "tls-key", "", "private key of -tls-cert")
+	flag.StringVar(&TLSCA, "tls-ca", "", "CA certificates that node and client certificates are verified with")
+	flag.BoolVar(&TLSClientAuth, "tls-client-auth", false, "require api clients to present a certificate signed by -tls-ca")
+	flag.DurationVar(&TLSReloadInterval, "tls-reload-interval", time.Minute, "interval of checking the certificate files for changes")
+	flag.StringVar(&AuthFile, "auth-file", "", "users, tokens and roles, enables authentication of api requests")
+	flag.BoolVar(&AuthReplicated, "auth-replicated", false, "take users from the replicated table managed with /admin/auth, -auth-file is used until it is set")
+	flag.StringVar(&AuditLog, "audit-log", "", "file of the audit log of client mutations, auditing is off if empty")
+	flag.IntVar(&AuditMaxSize, "audit-max-size", 100, "size in megabytes at which the audit log is rotated")
+	flag.IntVar(&AuditMaxFiles, "audit-max-files", 10, "amount of rotated audit log files to keep")
+
+	flag.IntVar(&MaxValueSize, "max-value-size", 1024, "size in kilobytes of the largest value the api accepts")
+}
+
+// Validate checks combinations of flags and loads the cluster, call it after
+// flag.Parse.
+func Validate() error {
+	if StorageEngine == "disk" && DataDir == "" {
+		return fmt.Errorf("-storage-engine disk requires -data-dir")
+	}
+	if DiscoverySrv != "" && ClusterFile != "" {
+		return fmt.Errorf("-discovery-srv and -cluster are exclusive")
+	}
+	if err := parseVoters(); err != nil {
+		return err
+	}
+	if SnapshotEntries < 0 {
+		return fmt.Errorf("-snapshot-entries must not be negative")
+	}
+	if MaxValueSize <= 0 {
+		return fmt.Errorf("-max-value-size must be positive")
+	}
+	if err := loadCerts(); err != nil {
+		return err
+	}
+	if AuthFile != "" {
+		var err error
+		if Auth, err = auth.Load(AuthFile, ReservedPrefixes...); err != nil {
+			return err
+		}
+	}
+	if AuditLog != "" {
+		var err error
+		if Audit, err = audit.Open(AuditLog, int64(AuditMaxSize)<<20, AuditMaxFiles); err != nil {
+			return err
+		}
+	}
+	return loadCluster()
+}
+
+// parseVoters reads -initial-voters. Nodes found in DNS may see different
+// records while they start, so that they would bootstrap with different
+// configurations: -discovery-srv requires the voters, or -join for nodes
+// added later.
+func parseVoters() error {
+	if InitialVoters == "" {
+		if DiscoverySrv != "" && !Join {
+			return fmt.Errorf("-discovery-srv requires -initial-voters, or -join for nodes added to a running cluster")
+		}
+		return nil
+	}
+	Voters = nil
+	for _, field := range strings.Split(InitialVoters, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || id <= 0 {
+			return fmt.Errorf("invalid node id %q in -initial-voters", field)
+		}
+		if slices.Contains(Voters, id) {
+			return fmt.Errorf("node %d is twice in -initial-voters", id)
+		}
+		Voters = append(Voters, id)
+	}
+	slices.Sort(Voters)
+	return nil
+}
+
+func loadCerts() error {
+	if (TLSCert == "") != (TLSKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key must be given together")
+	}
+	if TLSCert == "" {
+		if TLSCA != "" || TLSClientAuth {
+			return fmt.Errorf("-tls-ca and -tls-client-auth require -tls-cert")
+		}
+		return nil
+	}
+	if TLSClientAuth && TLSCA == "" {
+		return fmt.Errorf("-tls-client-auth requires -tls-ca")
+	}
+	var err error
+	if Certs, err = certs.Load(TLSCert, TLSKey, TLSCA); err != nil {
+		return err
+	}
+	CertManager = gen.CreateCertManager(Certs.Certificate())
+	return nil
+}
+
+// ApiScheme is https if the api is served with TLS.
+func ApiScheme() string {
+	if Certs != nil {
+		return "https"
+	}
+	return "http"
 }
 
-func MakeNodeName(id int) string {
-    return fmt.Sprintf("chaddb-node-%d@localhost", id)
+// MaxValueBytes is -max-value-size in bytes.
+func MaxValueBytes() int64 {
+	return int64(MaxValueSize) << 10
 }
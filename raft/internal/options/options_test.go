@@ -0,0 +1,39 @@
+package options
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParseVoters(t *testing.T) {
+	tests := []struct {
+		name      string
+		voters    string
+		discovery string
+		join      bool
+		want      []int
+		fails     bool
+	}{
+		{"default", "", "", false, nil, false},
+		{"list", "3, 1,2", "", false, []int{1, 2, 3}, false},
+		{"discovery", "1", "chaddb.local", false, []int{1}, false},
+		{"discovery without voters", "", "chaddb.local", false, nil, true},
+		{"discovery joining", "", "chaddb.local", true, nil, false},
+		{"invalid id", "1,x", "", false, nil, true},
+		{"zero", "0", "", false, nil, true},
+		{"duplicate", "1,2,1", "", false, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			InitialVoters, DiscoverySrv, Join, Voters = test.voters, test.discovery, test.join, nil
+			t.Cleanup(func() { InitialVoters, DiscoverySrv, Join, Voters = "", "", false, nil })
+			err := parseVoters()
+			if (err != nil) != test.fails {
+				t.Fatalf("error %v, want failure %t", err, test.fails)
+			}
+			if err == nil && !slices.Equal(Voters, test.want) {
+				t.Fatalf("voters %v, want %v", Voters, test.want)
+			}
+		})
+	}
+}
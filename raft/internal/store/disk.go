@@ -0,0 +1,380 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// memtableLimit is the approximate size in bytes of the memtable after
+	// which it is written to a new sstable.
+	memtableLimit = 4 << 20
+	// compactAfter is the number of sstables that triggers merging all of
+	// them into one.
+	compactAfter = 4
+)
+
+// DiskStore is a log-structured merge tree. Writes go to an in-memory table
+// that is flushed to an immutable sstable once it grows large; sstables are
+// merged into one when there are too many of them.
+//
+// There is no write-ahead log of its own: the manifest records the index of
+// the last entry that reached an sstable and entries after it are applied
+// again from the raft log after a restart.
+type DiskStore struct {
+	dir      string
+	manifest manifest
+	tables   []*sstable // oldest first
+	memtable map[string]record
+	memSize  int
+	applied  int
+	keys     int
+}
+
+type manifest struct {
+	Tables       []string `json:"tables"`
+	AppliedIndex int      `json:"appliedIndex"`
+	NextTable    int      `json:"nextTable"`
+}
+
+func OpenDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &DiskStore{dir: dir, memtable: make(map[string]record), manifest: manifest{AppliedIndex: -1}}
+
+	data, err := os.ReadFile(filepath.Join(dir, "MANIFEST"))
+	if err == nil {
+		err = json.Unmarshal(data, &s.manifest)
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read manifest: %w", err)
+	}
+	for _, name := range s.manifest.Tables {
+		table, err := openSSTable(filepath.Join(dir, name))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.tables = append(s.tables, table)
+	}
+	s.applied = s.manifest.AppliedIndex
+
+	for it := s.newIterator("", ""); it.next(); {
+		if !it.current.tombstone {
+			s.keys++
+		}
+	}
+	return s, nil
+}
+
+func (s *DiskStore) Apply(index int, ops ...Op) error {
+	if index <= s.applied {
+		return nil
+	}
+	for _, op := range ops {
+		existed := s.has(op.Key)
+		if op.Tombstone && existed {
+			s.keys--
+		} else if !op.Tombstone && !existed {
+			s.keys++
+		}
+
+		s.memtable[op.Key] = record{key: op.Key, value: op.Value, contentType: op.ContentType, tombstone: op.Tombstone}
+		s.memSize += len(op.Key) + len(op.Value) + len(op.ContentType)
+	}
+	s.applied = index
+	if s.memSize >= memtableLimit {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *DiskStore) Get(key string) (KeyValue, bool, error) {
+	if r, ok := s.memtable[key]; ok {
+		return r.keyValue(), !r.tombstone, nil
+	}
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		r, found, err := s.tables[i].lookup(key)
+		if err != nil || found {
+			return r.keyValue(), found && !r.tombstone, err
+		}
+	}
+	return KeyValue{}, false, nil
+}
+
+// has reports whether key is live without reading its value.
+func (s *DiskStore) has(key string) bool {
+	if r, ok := s.memtable[key]; ok {
+		return !r.tombstone
+	}
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		if j, ok := s.tables[i].find(key); ok {
+			return !s.tables[i].index[j].tombstone
+		}
+	}
+	return false
+}
+
+func (s *DiskStore) Range(from string, to string, limit int) ([]KeyValue, error) {
+	result := make([]KeyValue, 0)
+	for it := s.newIterator(from, to); (limit <= 0 || len(result) < limit) && it.next(); {
+		if it.current.tombstone {
+			continue
+		}
+		r, err := it.record()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r.keyValue())
+	}
+	return result, nil
+}
+
+// iterator merges the memtable and the sstables in key order and yields the
+// newest record of every key, tombstones included. Values are read from
+// sstables only by record.
+type iterator struct {
+	memtable []record
+	// keys of tables in range, newest table first
+	tables [][]sstableKey
+	owners []*sstable
+	memPos int
+	pos    []int
+
+	current record
+	table   *sstable
+	entry   sstableKey
+}
+
+func (s *DiskStore) newIterator(from string, to string) *iterator {
+	it := &iterator{memtable: s.sortedMemtable(from, to), pos: make([]int, len(s.tables))}
+	for i := len(s.tables) - 1; i >= 0; i-- {
+		it.tables = append(it.tables, s.tables[i].keysInRange(from, to))
+		it.owners = append(it.owners, s.tables[i])
+	}
+	return it
+}
+
+// next moves to the next key, current holds its record without the value.
+func (it *iterator) next() bool {
+	key, found := "", false
+	if it.memPos < len(it.memtable) {
+		key, found = it.memtable[it.memPos].key, true
+	}
+	for i, keys := range it.tables {
+		if it.pos[i] < len(keys) && (!found || keys[it.pos[i]].key < key) {
+			key, found = keys[it.pos[i]].key, true
+		}
+	}
+	if !found {
+		return false
+	}
+
+	// the newest source with the key wins, the others skip it
+	found = false
+	it.table = nil
+	if it.memPos < len(it.memtable) && it.memtable[it.memPos].key == key {
+		it.current = it.memtable[it.memPos]
+		it.memPos++
+		found = true
+	}
+	for i, keys := range it.tables {
+		if it.pos[i] >= len(keys) || keys[it.pos[i]].key != key {
+			continue
+		}
+		if !found {
+			entry := keys[it.pos[i]]
+			it.current = record{key: key, contentType: entry.contentType, tombstone: entry.tombstone}
+			it.table, it.entry = it.owners[i], entry
+			found = true
+		}
+		it.pos[i]++
+	}
+	return true
+}
+
+// record returns the current record with its value.
+func (it *iterator) record() (record, error) {
+	if it.table == nil || it.current.tombstone {
+		return it.current, nil
+	}
+	value, err := it.table.read(it.entry)
+	r := it.current
+	r.value = value
+	return r, err
+}
+
+// sortedMemtable returns records of the memtable in [from, to) sorted by key.
+func (s *DiskStore) sortedMemtable(from string, to string) []record {
+	records := make([]record, 0)
+	for key, r := range s.memtable {
+		if inRange(key, from, to) {
+			records = append(records, r)
+		}
+	}
+	slices.SortFunc(records, func(a, b record) int { return strings.Compare(a.key, b.key) })
+	return records
+}
+
+// AppliedIndex includes entries still in the memtable, after a restart it
+// is the index of the last flushed entry.
+func (s *DiskStore) AppliedIndex() int {
+	return s.applied
+}
+
+func (s *DiskStore) Len() int {
+	return s.keys
+}
+
+func (s *DiskStore) Snapshot(w io.Writer) error {
+	entries, err := s.Range("", "", 0)
+	if err != nil {
+		return err
+	}
+	return WriteSnapshot(w, s.applied, entries)
+}
+
+func (s *DiskStore) Restore(r io.Reader) error {
+	applied, entries, err := ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	records := make([]record, len(entries))
+	for i, entry := range entries {
+		records[i] = record{key: entry.Key, value: entry.Value, contentType: entry.ContentType}
+	}
+	if err := s.replaceTables(records, applied); err != nil {
+		return err
+	}
+	s.memtable = make(map[string]record)
+	s.memSize = 0
+	s.applied = applied
+	s.keys = len(entries)
+	return nil
+}
+
+// flush writes the memtable to a new sstable.
+func (s *DiskStore) flush() error {
+	if len(s.memtable) == 0 {
+		return nil
+	}
+	table, err := writeSSTable(s.nextTablePath(), s.sortedMemtable("", ""))
+	if err != nil {
+		return err
+	}
+	next := s.manifest
+	next.Tables = append(slices.Clone(next.Tables), filepath.Base(table.path))
+	next.AppliedIndex = s.applied
+	if err := s.saveManifest(next); err != nil {
+		table.close()
+		return err
+	}
+	s.tables = append(s.tables, table)
+	s.memtable = make(map[string]record)
+	s.memSize = 0
+
+	if len(s.tables) >= compactAfter {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact merges all sstables into one dropping overwritten values and
+// tombstones.
+func (s *DiskStore) compact() error {
+	live, err := s.Range("", "", 0)
+	if err != nil {
+		return err
+	}
+	records := make([]record, len(live))
+	for i, entry := range live {
+		records[i] = record{key: entry.Key, value: entry.Value, contentType: entry.ContentType}
+	}
+	// the memtable is empty after flush, so live is exactly what tables hold
+	return s.replaceTables(records, s.manifest.AppliedIndex)
+}
+
+// replaceTables swaps all sstables for a single one made of records.
+func (s *DiskStore) replaceTables(records []record, applied int) error {
+	table, err := writeSSTable(s.nextTablePath(), records)
+	if err != nil {
+		return err
+	}
+	next := s.manifest
+	next.Tables = []string{filepath.Base(table.path)}
+	next.AppliedIndex = applied
+	if err := s.saveManifest(next); err != nil {
+		table.close()
+		return err
+	}
+	for _, old := range s.tables {
+		old.close()
+		os.Remove(old.path)
+	}
+	s.tables = []*sstable{table}
+	return nil
+}
+
+func (s *DiskStore) nextTablePath() string {
+	s.manifest.NextTable++
+	return filepath.Join(s.dir, fmt.Sprintf("%06d.sst", s.manifest.NextTable))
+}
+
+// saveManifest durably replaces the manifest, the tables it lists must
+// already be on disk.
+func (s *DiskStore) saveManifest(next manifest) error {
+	data, err := json.Marshal(next)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(s.dir, "MANIFEST.tmp")
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, "MANIFEST")); err != nil {
+		return err
+	}
+	if err := syncDir(s.dir); err != nil {
+		return err
+	}
+	s.manifest = next
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close flushes the memtable so that the next start does not need to apply
+// those entries again.
+func (s *DiskStore) Close() error {
+	err := s.flush()
+	for _, table := range s.tables {
+		table.close()
+	}
+	s.tables = nil
+	return err
+}
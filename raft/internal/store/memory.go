@@ -0,0 +1,89 @@
+package store
+
+import (
+	"io"
+	"slices"
+)
+
+// MemoryStore keeps everything in a map, the state is rebuilt from the raft
+// log after a restart.
+type MemoryStore struct {
+	data    map[string]KeyValue
+	applied int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string]KeyValue), applied: -1}
+}
+
+func (s *MemoryStore) Apply(index int, ops ...Op) error {
+	if index <= s.applied {
+		return nil
+	}
+	for _, op := range ops {
+		if op.Tombstone {
+			delete(s.data, op.Key)
+		} else {
+			s.data[op.Key] = KeyValue{Key: op.Key, Value: op.Value, ContentType: op.ContentType}
+		}
+	}
+	s.applied = index
+	return nil
+}
+
+func (s *MemoryStore) Get(key string) (KeyValue, bool, error) {
+	kv, ok := s.data[key]
+	return kv, ok, nil
+}
+
+func (s *MemoryStore) Range(from string, to string, limit int) ([]KeyValue, error) {
+	keys := make([]string, 0)
+	for key := range s.data {
+		if inRange(key, from, to) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	if limit > 0 && len(keys) > limit {
+		keys = keys[:limit]
+	}
+	result := make([]KeyValue, len(keys))
+	for i, key := range keys {
+		result[i] = s.data[key]
+	}
+	return result, nil
+}
+
+// AppliedIndex is always -1 on start since nothing survives a restart.
+func (s *MemoryStore) AppliedIndex() int {
+	return s.applied
+}
+
+func (s *MemoryStore) Len() int {
+	return len(s.data)
+}
+
+func (s *MemoryStore) Snapshot(w io.Writer) error {
+	entries, err := s.Range("", "", 0)
+	if err != nil {
+		return err
+	}
+	return WriteSnapshot(w, s.applied, entries)
+}
+
+func (s *MemoryStore) Restore(r io.Reader) error {
+	applied, entries, err := ReadSnapshot(r)
+	if err != nil {
+		return err
+	}
+	s.data = make(map[string]KeyValue, len(entries))
+	for _, entry := range entries {
+		s.data[entry.Key] = entry
+	}
+	s.applied = applied
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
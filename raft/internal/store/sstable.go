@@ -0,0 +1,215 @@
+package store
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+)
+
+// An sstable is an immutable file of records sorted by key:
+//
+//	magic | record... | record count (8 bytes) | crc32 of everything before (4 bytes)
+//	record = uvarint key length | key | tombstone byte |
+//	         uvarint content type length | content type | uvarint value length | value
+//
+// Keys with value positions are indexed in memory when the table is opened,
+// values are read from the file on demand.
+const sstableMagic = "CHSST1\n"
+
+type sstable struct {
+	path  string
+	file  *os.File
+	index []sstableKey
+}
+
+type sstableKey struct {
+	key         string
+	contentType string
+	tombstone   bool
+	offset      int64
+	length      int
+}
+
+type record struct {
+	key         string
+	value       string
+	contentType string
+	tombstone   bool
+}
+
+func (r record) keyValue() KeyValue {
+	return KeyValue{Key: r.key, Value: r.value, ContentType: r.contentType}
+}
+
+// writeSSTable atomically creates an sstable at path from records sorted by
+// key and opens it.
+func writeSSTable(path string, records []record) (*sstable, error) {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp)
+
+	hash := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(file, hash))
+	writer.WriteString(sstableMagic)
+	var buf [binary.MaxVarintLen64]byte
+	for _, r := range records {
+		writer.Write(buf[:binary.PutUvarint(buf[:], uint64(len(r.key)))])
+		writer.WriteString(r.key)
+		if r.tombstone {
+			writer.WriteByte(1)
+		} else {
+			writer.WriteByte(0)
+		}
+		writer.Write(buf[:binary.PutUvarint(buf[:], uint64(len(r.contentType)))])
+		writer.WriteString(r.contentType)
+		writer.Write(buf[:binary.PutUvarint(buf[:], uint64(len(r.value)))])
+		writer.WriteString(r.value)
+	}
+	binary.BigEndian.PutUint64(buf[:8], uint64(len(records)))
+	writer.Write(buf[:8])
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(buf[:4], hash.Sum32())
+	if _, err := file.Write(buf[:4]); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return nil, err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	return openSSTable(path)
+}
+
+func openSSTable(path string) (*sstable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(sstableMagic)+12 {
+		return nil, fmt.Errorf("%s is not an sstable", path)
+	}
+	if string(data[:len(sstableMagic)]) != sstableMagic {
+		return nil, fmt.Errorf("%s is not an sstable", path)
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, fmt.Errorf("%s is corrupted: checksum mismatch", path)
+	}
+	count := binary.BigEndian.Uint64(body[len(body)-8:])
+	records := body[:len(body)-8]
+
+	index := make([]sstableKey, 0, count)
+	pos := len(sstableMagic)
+	for pos < len(records) {
+		keyLen, n := binary.Uvarint(records[pos:])
+		if n <= 0 || pos+n+int(keyLen)+1 > len(records) {
+			return nil, fmt.Errorf("%s is corrupted at offset %d", path, pos)
+		}
+		pos += n
+		entry := sstableKey{key: string(records[pos : pos+int(keyLen)])}
+		pos += int(keyLen)
+		entry.tombstone = records[pos] == 1
+		pos++
+		typeLen, n := binary.Uvarint(records[pos:])
+		if n <= 0 || pos+n+int(typeLen) > len(records) {
+			return nil, fmt.Errorf("%s is corrupted at offset %d", path, pos)
+		}
+		pos += n
+		entry.contentType = string(records[pos : pos+int(typeLen)])
+		pos += int(typeLen)
+		valueLen, n := binary.Uvarint(records[pos:])
+		if n <= 0 || pos+n+int(valueLen) > len(records) {
+			return nil, fmt.Errorf("%s is corrupted at offset %d", path, pos)
+		}
+		pos += n
+		entry.offset = int64(pos)
+		entry.length = int(valueLen)
+		pos += int(valueLen)
+		index = append(index, entry)
+	}
+	if uint64(len(index)) != count {
+		return nil, fmt.Errorf("%s is corrupted: expected %d records, found %d", path, count, len(index))
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sstable{path: path, file: file, index: index}, nil
+}
+
+// find returns the position of key in the index and whether it is present.
+func (t *sstable) find(key string) (int, bool) {
+	return slices.BinarySearchFunc(t.index, key, func(e sstableKey, key string) int {
+		switch {
+		case e.key < key:
+			return -1
+		case e.key > key:
+			return 1
+		}
+		return 0
+	})
+}
+
+// lookup reports whether the table has a record for key. A record may be a
+// tombstone, then found is true and tombstone is set.
+func (t *sstable) lookup(key string) (r record, found bool, err error) {
+	i, ok := t.find(key)
+	if !ok {
+		return record{}, false, nil
+	}
+	entry := t.index[i]
+	r = record{key: key, contentType: entry.contentType, tombstone: entry.tombstone}
+	if entry.tombstone {
+		return r, true, nil
+	}
+	r.value, err = t.read(entry)
+	return r, true, err
+}
+
+func (t *sstable) read(entry sstableKey) (string, error) {
+	buf := make([]byte, entry.length)
+	if _, err := t.file.ReadAt(buf, entry.offset); err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// keysInRange returns keys of [from, to) including tombstones.
+func (t *sstable) keysInRange(from string, to string) []sstableKey {
+	start := sort.Search(len(t.index), func(i int) bool { return t.index[i].key >= from })
+	end := len(t.index)
+	if to != "" {
+		end = sort.Search(len(t.index), func(i int) bool { return t.index[i].key >= to })
+	}
+	if start >= end {
+		return nil
+	}
+	return t.index[start:end]
+}
+
+func (t *sstable) close() error {
+	return t.file.Close()
+}
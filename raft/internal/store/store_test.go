@@ -0,0 +1,213 @@
+package store
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func set(key string, value string) Op {
+	return Op{Key: key, Value: value}
+}
+
+func del(key string) Op {
+	return Op{Key: key, Tombstone: true}
+}
+
+func keys(entries []KeyValue) []string {
+	result := make([]string, len(entries))
+	for i, entry := range entries {
+		result[i] = entry.Key
+	}
+	return result
+}
+
+func TestEngines(t *testing.T) {
+	engines := map[string]func(t *testing.T) StateMachineStore{
+		EngineMemory: func(t *testing.T) StateMachineStore { return NewMemoryStore() },
+		EngineDisk: func(t *testing.T) StateMachineStore {
+			s, err := OpenDiskStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+	for name, open := range engines {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+			steps := [][]Op{
+				{set("a", "1"), set("b", "2"), {Key: "doc", Value: `{"x":1}`, ContentType: "application/json"}},
+				{set("a", "3"), del("b"), set("c", "4")},
+				{del("missing")},
+			}
+			for i, ops := range steps {
+				if err := s.Apply(i, ops...); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// entries applied before are ignored
+			if err := s.Apply(1, set("a", "stale")); err != nil {
+				t.Fatal(err)
+			}
+
+			if s.AppliedIndex() != 2 || s.Len() != 3 {
+				t.Fatalf("applied %d with %d keys, want 2 and 3", s.AppliedIndex(), s.Len())
+			}
+			kv, ok, err := s.Get("a")
+			if err != nil || !ok || kv.Value != "3" {
+				t.Fatalf("a is %+v %v %v", kv, ok, err)
+			}
+			if _, ok, _ := s.Get("b"); ok {
+				t.Fatal("deleted key b is live")
+			}
+			if kv, _, _ := s.Get("doc"); kv.ContentType != "application/json" {
+				t.Fatalf("doc lost its content type: %+v", kv)
+			}
+
+			tests := []struct {
+				from, to string
+				limit    int
+				want     []string
+			}{
+				{"", "", 0, []string{"a", "c", "doc"}},
+				{"b", "", 0, []string{"c", "doc"}},
+				{"", "c", 0, []string{"a"}},
+				{"", "", 2, []string{"a", "c"}},
+				{"x", "", 0, []string{}},
+			}
+			for _, test := range tests {
+				entries, err := s.Range(test.from, test.to, test.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := keys(entries); !slices.Equal(got, test.want) {
+					t.Errorf("Range(%q, %q, %d) = %v, want %v", test.from, test.to, test.limit, got, test.want)
+				}
+			}
+
+			var snapshot bytes.Buffer
+			if err := s.Snapshot(&snapshot); err != nil {
+				t.Fatal(err)
+			}
+			restored := open(t)
+			defer restored.Close()
+			if err := restored.Restore(bytes.NewReader(snapshot.Bytes())); err != nil {
+				t.Fatal(err)
+			}
+			var again bytes.Buffer
+			if err := restored.Snapshot(&again); err != nil {
+				t.Fatal(err)
+			}
+			if again.String() != snapshot.String() || restored.Len() != 3 || restored.AppliedIndex() != 2 {
+				t.Fatalf("restored snapshot differs:\n%s\nwant\n%s", again.String(), snapshot.String())
+			}
+		})
+	}
+}
+
+func TestDiskStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Apply(0, set("a", "1"), set("b", "2"))
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	// newer tables and the memtable shadow older values
+	s.Apply(1, set("a", "3"), del("b"), set("c", "4"))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.AppliedIndex() != 1 || s.Len() != 2 {
+		t.Fatalf("reopened with applied %d and %d keys, want 1 and 2", s.AppliedIndex(), s.Len())
+	}
+	entries, err := s.Range("", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0] != (KeyValue{Key: "a", Value: "3"}) || entries[1] != (KeyValue{Key: "c", Value: "4"}) {
+		t.Fatalf("reopened with %+v", entries)
+	}
+}
+
+func TestDiskStoreCompaction(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := range compactAfter {
+		ops := []Op{set("k", strings.Repeat("v", i+1)), set("gone", "x")}
+		if i == compactAfter-1 {
+			ops = []Op{set("k", "last"), del("gone")}
+		}
+		if err := s.Apply(i, ops...); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(s.tables) != 1 {
+		t.Fatalf("%d tables after compaction, want 1", len(s.tables))
+	}
+	if table := s.tables[0]; len(table.index) != 1 || table.index[0].key != "k" {
+		t.Fatalf("compacted table has %+v, want only the live key", table.index)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.sst*"))
+	if len(files) != 1 || files[0] != s.tables[0].path {
+		t.Fatalf("files %v left after compaction", files)
+	}
+	if kv, ok, _ := s.Get("k"); !ok || kv.Value != "last" || s.Len() != 1 {
+		t.Fatalf("k is %+v after compaction with %d keys", kv, s.Len())
+	}
+}
+
+func TestSSTableCorruption(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(data []byte) []byte
+		want    string
+	}{
+		{"flipped value byte", func(data []byte) []byte { data[len(sstableMagic)+3] ^= 0xff; return data }, "checksum mismatch"},
+		{"flipped checksum", func(data []byte) []byte { data[len(data)-1] ^= 0xff; return data }, "checksum mismatch"},
+		{"truncated", func(data []byte) []byte { return data[:len(data)-6] }, "checksum mismatch"},
+		{"too short", func(data []byte) []byte { return data[:4] }, "not an sstable"},
+		{"wrong magic", func(data []byte) []byte { data[0] = 'X'; return data }, "not an sstable"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "000001.sst")
+			table, err := writeSSTable(path, []record{{key: "a", value: "value"}, {key: "b", tombstone: true}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			table.close()
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, test.corrupt(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := openSSTable(path); err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("opening the corrupted table returned %v, want %q", err, test.want)
+			}
+		})
+	}
+}